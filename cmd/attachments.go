@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	attachmentsQuery      string
+	attachmentsDir        string
+	attachmentsTemplate   string
+	attachmentsTypes      []string
+	attachmentsExtensions []string
+	attachmentsDryRun     bool
+)
+
+func init() {
+	rootCmd.AddCommand(attachmentsCmd)
+	attachmentsCmd.AddCommand(attachmentsDownloadCmd)
+
+	attachmentsDownloadCmd.Flags().StringVar(&attachmentsQuery, "query", "has:attachment", "Gmail search query selecting the messages")
+	attachmentsDownloadCmd.Flags().StringVar(&attachmentsDir, "dir", "attachments", "Directory to save attachments to")
+	attachmentsDownloadCmd.Flags().StringVar(&attachmentsTemplate, "template", internal.DefaultAttachmentTemplate, "File name template; placeholders: {date} {year} {month} {sender} {domain} {subject} {filename} {id}")
+	attachmentsDownloadCmd.Flags().StringSliceVar(&attachmentsTypes, "type", nil, "Only download these MIME types, e.g. application/pdf or image/*")
+	attachmentsDownloadCmd.Flags().StringSliceVar(&attachmentsExtensions, "ext", nil, "Only download files with these extensions, e.g. pdf,xlsx")
+	attachmentsDownloadCmd.Flags().BoolVar(&attachmentsDryRun, "dry-run", false, "List the files that would be downloaded, without checking for ones already saved")
+}
+
+// attachmentsCmd represents the attachments command
+var attachmentsCmd = &cobra.Command{
+	Use:   "attachments",
+	Short: "Work with message attachments",
+}
+
+// attachmentsDownloadCmd represents the attachments download command
+var attachmentsDownloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Download the attachments of messages matching a query",
+	Long: `The attachments download command saves the attachments of the messages matching --query to --dir.
+Files are named with --template, whose placeholders are replaced with the message date ({date},
+{year}, {month}), the sender address and its domain, the subject, the original file name and the
+message ID; a "/" in the template creates subdirectories, e.g. "{year}/{month}/{sender}_{filename}".
+
+Attachments whose content is already saved anywhere in --dir are skipped, so the command can run
+every month over an overlapping window without creating copies. Different files with the same
+name get a numbered suffix. Use --type and --ext to keep only some kinds of files.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'attachments download' command...")
+		ctx := cmd.Context()
+
+		// Step 1: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 2: Download Attachments
+		if attachmentsDryRun {
+			logrus.Info("Dry run: no files will be written.")
+		}
+		result, err := svc.DownloadAttachments(ctx, attachmentsQuery, &internal.AttachmentOptions{
+			Dir:        attachmentsDir,
+			Template:   attachmentsTemplate,
+			MimeTypes:  attachmentsTypes,
+			Extensions: attachmentsExtensions,
+			DryRun:     attachmentsDryRun,
+		})
+		if interrupted(err) {
+			exitInterrupted(err, "Saved %d attachments before stopping.", result.Saved)
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to download attachments: %v", err)
+		}
+
+		if attachmentsDryRun {
+			logrus.Infof("Attachments download command completed (dry run): %d would be downloaded, %d filtered out, from %d messages. "+
+				"Attachments already saved in %s are only skipped when downloading.",
+				result.WouldDownload, result.Filtered, result.Messages, attachmentsDir)
+			return
+		}
+		logrus.Infof("Attachments download command completed: %d saved, %d already saved, %d filtered out, from %d messages.",
+			result.Saved, result.Duplicates, result.Filtered, result.Messages)
+	},
+}
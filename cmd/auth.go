@@ -16,13 +16,21 @@ func init() {
 		gmail.GmailLabelsScope,
 		gmail.GmailReadonlyScope,
 		gmail.GmailSettingsBasicScope,
+		gmail.GmailModifyScope,
+		gmail.GmailInsertScope,
+		gmail.GmailComposeScope,
 	}, "OAuth 2.0 scopes to request")
 }
 
 var authCmd = &cobra.Command{
 	Use:   "auth",
 	Short: "Authenticate with the Gmail API",
-	Long:  `Authenticate with the Gmail API using the specified credentials and token files.`,
+	Long: `Authenticate with the Gmail API using the specified credentials and token files.
+
+The default scopes cover every command: settings backups and pushes need labels and
+settings.basic, 'restore messages' needs insert, 'unsubscribe' needs compose to create drafts, and
+'retention', 'rules', 'retro' and 'watch' need modify to label and trash messages. Pass a narrower
+--scopes list to grant only what the commands you use need.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'auth' command...")
 
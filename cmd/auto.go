@@ -51,17 +51,18 @@ var autoCmd = &cobra.Command{
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'auto' command...")
+		ctx := cmd.Context()
 
 		// Step 1: Initialize Gmail Service
 		logrus.Info("Initializing Gmail service...")
-		svc, err := internal.NewService(credentialsPath, tokenPath, scopes)
+		svc, err := newService()
 		if err != nil {
 			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
 		}
 
 		// Step 2: Fetch Gmail Messages
 		logrus.Infof("Fetching the latest %d emails...", numEmails)
-		messages, err := svc.Messages(numEmails, "")
+		messages, err := svc.Messages(ctx, numEmails, "")
 		if err != nil {
 			logrus.Fatalf("Failed to fetch emails: %v", err)
 		}
@@ -69,7 +70,7 @@ var autoCmd = &cobra.Command{
 
 		// Step 3: Call OpenAI API
 		logrus.Infof("Generating filters and labels using OpenAI model '%s'...", openAIModel)
-		response, err := internal.GetFiltersAndLabelsFromAI(openAIKey, openAIHost, openAIModel, messages)
+		response, err := internal.GetFiltersAndLabelsFromAI(ctx, openAIKey, openAIHost, openAIModel, messages)
 		if err != nil {
 			logrus.Fatalf("Failed to generate filters and labels: %v", err)
 		}
@@ -78,7 +79,7 @@ var autoCmd = &cobra.Command{
 		// Step 4: Save Output to File
 		outputFile := "filters_and_labels.json"
 		logrus.Infof("Saving filters and labels to file: %s", outputFile)
-		err = response.SaveToFile(outputFile)
+		err = response.SaveToFile(outputFile, nil)
 		if err != nil {
 			logrus.Fatalf("Failed to save filters and labels to file: %v", err)
 		}
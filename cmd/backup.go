@@ -8,30 +8,53 @@ import (
 )
 
 var outputPath string
+var backupDir string
+var backupKeepDaily int
+var backupKeepWeekly int
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
 
 	// Define and attach the `--output` flag
 	backupCmd.Flags().StringVar(&outputPath, "output", "backup.yaml", "Path to save the backup YAML file")
+	backupCmd.Flags().StringVar(&backupDir, "dir", "", "Save a timestamped snapshot in this backup directory instead of --output")
+	backupCmd.Flags().IntVar(&backupKeepDaily, "keep-daily", 0, "With --dir, keep the latest snapshot of this many days and remove older ones")
+	backupCmd.Flags().IntVar(&backupKeepWeekly, "keep-weekly", 0, "With --dir, keep the latest snapshot of this many weeks and remove older ones")
 }
 
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Backup Gmail settings (filters and labels) to a YAML file",
+	Long: `The backup command saves the filters and labels of the account to a YAML file that can be
+pushed again later. Use the messages subcommand to back up the messages themselves.
+
+With --dir, every run saves a new timestamped snapshot in a backup directory instead of overwriting
+one file, and records it in the directory's manifest.json with the account, label and filter counts
+and a SHA-256 checksum. --keep-daily and --keep-weekly remove snapshots no longer needed: the latest
+snapshot of each of the given number of most recent days and weeks is kept, as is the newest
+snapshot. Each account's snapshots are rotated separately, so one directory can hold several
+accounts. List snapshots with 'backup list' and roll back to one with 'restore --at'.
+Without --dir, the checksum and counts are recorded in <output>.manifest.json. Check that a
+backup is intact and restorable with 'backup verify'.
+
+Backups are encrypted at rest in the age format when --recipient or --passphrase is given:
+--recipient encrypts to age public keys, --passphrase to the passphrase in GMAIL_BACKUP_PASSPHRASE.
+Commands reading backups, such as push and restore, decrypt them transparently with the keys of
+--identity or with GMAIL_BACKUP_PASSPHRASE. Encrypted backups can also be read with the age tool.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'backup' command...")
+		ctx := cmd.Context()
 
 		// Step 1: Initialize Gmail Service
 		logrus.Info("Initializing Gmail service...")
-		svc, err := internal.NewService(credentialsPath, tokenPath, scopes)
+		svc, err := newService()
 		if err != nil {
 			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
 		}
 
 		// Step 2: Fetch Gmail Filters
 		logrus.Info("Fetching Gmail filters...")
-		filters, err := svc.Filters()
+		filters, err := svc.Filters(ctx)
 		if err != nil {
 			logrus.Fatalf("Failed to fetch Gmail filters: %v", err)
 		}
@@ -39,7 +62,7 @@ var backupCmd = &cobra.Command{
 
 		// Step 3: Fetch Gmail Labels
 		logrus.Info("Fetching Gmail labels...")
-		labels, err := svc.Labels()
+		labels, err := svc.Labels(ctx)
 		if err != nil {
 			logrus.Fatalf("Failed to fetch Gmail labels: %v", err)
 		}
@@ -49,15 +72,49 @@ var backupCmd = &cobra.Command{
 		logrus.Info("Creating backup configuration...")
 		backupConfig := internal.NewConfig(filters, labels)
 
-		// Step 5: Save Backup to File
-		logrus.Infof("Saving backup to file: %s", outputPath)
-		err = backupConfig.SaveToFile(outputPath)
+		profile, err := svc.Client.GetProfile(ctx)
 		if err != nil {
-			logrus.Errorf("Failed to save backup to file: %v", err)
+			logrus.Fatalf("Failed to fetch mailbox profile: %v", err)
+		}
+
+		if backupDir == "" {
+			// Step 5: Save Backup to File
+			logrus.Infof("Saving backup to file: %s", outputPath)
+			enc := backupEncryption()
+			err = backupConfig.SaveToFile(outputPath, enc)
+			if err != nil {
+				logrus.Errorf("Failed to save backup to file: %v", err)
+				return
+			}
+			if err := internal.WriteSettingsManifest(outputPath, backupConfig, profile.EmailAddress, enc); err != nil {
+				logrus.Fatalf("Failed to write backup manifest: %v", err)
+			}
+
+			logrus.Infof("Backup saved successfully to %s.", outputPath)
+			logrus.Info("Backup command completed.")
 			return
 		}
 
-		logrus.Infof("Backup saved successfully to %s.", outputPath)
+		// Step 5: Save Snapshot
+		manifest, err := internal.LoadSnapshotManifest(backupDir)
+		if err != nil {
+			logrus.Fatalf("Failed to load backup manifest: %v", err)
+		}
+		snapshot, err := manifest.SaveSnapshot(backupDir, backupConfig, profile.EmailAddress, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to save snapshot: %v", err)
+		}
+		logrus.Infof("Snapshot %s saved to %s.", snapshot.File, backupDir)
+
+		// Step 6: Rotate Snapshots
+		if backupKeepDaily > 0 || backupKeepWeekly > 0 {
+			removed, err := manifest.Rotate(backupDir, backupKeepDaily, backupKeepWeekly)
+			if err != nil {
+				logrus.Fatalf("Failed to rotate snapshots: %v", err)
+			}
+			logrus.Infof("Removed %d old snapshots; %d kept.", len(removed), len(manifest.Snapshots))
+		}
+
 		logrus.Info("Backup command completed.")
 	},
 }
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var backupListDir string
+
+func init() {
+	backupCmd.AddCommand(backupListCmd)
+
+	backupListCmd.Flags().StringVar(&backupListDir, "dir", "backups", "Backup directory to list")
+}
+
+// backupListCmd represents the backup list command
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the settings snapshots of a backup directory",
+	Long: `The backup list command lists the snapshots recorded in the manifest of a backup directory
+written by 'backup --dir', oldest first, with the account, label and filter counts of each.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest, err := internal.LoadSnapshotManifest(backupListDir)
+		if err != nil {
+			logrus.Fatalf("Failed to load backup manifest: %v", err)
+		}
+		if len(manifest.Snapshots) == 0 {
+			logrus.Infof("No snapshots in %s.", backupListDir)
+			return
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "CREATED\tACCOUNT\tLABELS\tFILTERS\tENCRYPTED\tFILE\n")
+		for _, s := range manifest.Snapshots {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%t\t%s\n",
+				s.CreatedAt.Local().Format("2006-01-02 15:04:05"), s.EmailAddress, s.Labels, s.Filters, s.Encrypted, s.File)
+		}
+		if err := tw.Flush(); err != nil {
+			logrus.Fatalf("Failed to write snapshot list: %v", err)
+		}
+	},
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupMessagesFormat string
+	backupMessagesQuery  string
+	backupMessagesOutput string
+	backupIncremental    bool
+	backupIndexPath      string
+)
+
+func init() {
+	backupCmd.AddCommand(backupMessagesCmd)
+
+	backupMessagesCmd.Flags().StringVar(&backupMessagesFormat, "format", "mbox", "Archive format: mbox or maildir")
+	backupMessagesCmd.Flags().StringVar(&backupMessagesQuery, "query", "", "Gmail search query selecting the messages to back up (default all)")
+	backupMessagesCmd.Flags().StringVar(&backupMessagesOutput, "output", "", "Path of the mbox file or Maildir directory (default messages.mbox or Maildir)")
+	backupMessagesCmd.Flags().BoolVar(&backupIncremental, "incremental", false, "Only fetch messages added or relabeled since the previous incremental backup")
+	backupMessagesCmd.Flags().StringVar(&backupIndexPath, "index", "", "Path of the backup index used by --incremental (default <output>.index.json)")
+}
+
+// backupMessagesCmd represents the backup messages command
+var backupMessagesCmd = &cobra.Command{
+	Use:   "messages",
+	Short: "Back up messages to an mbox file or a Maildir directory",
+	Long: `The backup messages command fetches the messages matching --query in raw format and writes them,
+one at a time, to an mbox file or a Maildir directory.
+
+In mbox archives the Gmail labels of each message are kept in an X-Gmail-Labels header. In Maildir
+archives every label becomes a folder, inbox messages go to the top level, and the unread and
+starred states become Maildir flags. Existing archives are appended to.
+
+Mbox archives are encrypted with --recipient or --passphrase like settings backups. Encrypted data
+cannot be appended to, so every later run that finds new messages writes them to a new encrypted
+segment next to the archive, <output>.1.age, <output>.2.age and so on. Restores and verification
+read the archive and its segments in order; keep them together.
+
+With --incremental, a local index records every archived message with its location and labels,
+and the mailbox history ID the archive is current up to. Later runs read the mailbox history to
+fetch only new messages and refile relabeled ones, so backing up an unchanged mailbox takes a
+couple of API calls. Messages deleted from the mailbox are kept in the archive and marked deleted
+in the index. When the history has expired, every matching message is listed and only new or
+relabeled ones are fetched.
+
+Each run records the checksums of the archive's files and its message count in
+<output>.manifest.json, so the archive can be checked with 'backup verify'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'backup messages' command...")
+		ctx := cmd.Context()
+
+		output := backupMessagesOutput
+		if output == "" {
+			output = "messages.mbox"
+			if backupMessagesFormat == "maildir" {
+				output = "Maildir"
+			}
+		}
+
+		// Step 1: Open Archive
+		enc := backupEncryption()
+		writer, err := internal.NewMessageWriter(backupMessagesFormat, output, enc)
+		if err != nil {
+			logrus.Fatalf("Failed to open archive: %v", err)
+		}
+		defer writer.Close()
+
+		// Step 2: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 3: Fetch Label Names
+		labelNames, err := svc.LabelNames(ctx)
+		if err != nil {
+			logrus.Fatalf("Failed to fetch Gmail labels: %v", err)
+		}
+
+		if !backupIncremental {
+			// Step 4: Export Messages
+			exported, err := svc.ExportMessages(ctx, backupMessagesQuery, labelNames, writer, nil)
+			if interrupted(err) {
+				writer.Close()
+				exitInterrupted(err, "Backed up %d messages to %s before stopping.", exported, output)
+			}
+			if err != nil {
+				logrus.Fatalf("Failed to back up messages after %d: %v", exported, err)
+			}
+
+			// Step 5: Write Manifest
+			writeArchiveManifest(ctx, svc, writer, output, "", exported, enc)
+			logrus.Infof("Backup messages command completed. %d messages saved to %s.", exported, output)
+			return
+		}
+
+		// Step 4: Load Backup Index
+		indexPath := backupIndexPath
+		if indexPath == "" {
+			indexPath = strings.TrimSuffix(output, string(filepath.Separator)) + ".index.json"
+		}
+		index, err := internal.LoadBackupIndex(indexPath, backupMessagesFormat, backupMessagesQuery)
+		if err != nil {
+			logrus.Fatalf("Failed to load backup index: %v", err)
+		}
+
+		// Step 5: Back Up Changes
+		result, err := svc.IncrementalBackup(ctx, index, labelNames, writer)
+		// Messages written so far are recorded even when the backup stops early
+		if saveErr := index.Save(indexPath); saveErr != nil {
+			logrus.Fatalf("Failed to save backup index: %v", saveErr)
+		}
+		if interrupted(err) {
+			writer.Close()
+			exitInterrupted(err, "Backup stopped; progress saved to %s.", indexPath)
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to back up messages: %v", err)
+		}
+
+		// Step 6: Write Manifest
+		writeArchiveManifest(ctx, svc, writer, output, indexPath, result.Added, enc)
+		logrus.Infof("Backup messages command completed: %d added, %d relabeled, %d deleted; archive at %s is current up to history ID %d.",
+			result.Added, result.Relabeled, result.Deleted, output, index.HistoryId)
+	},
+}
+
+// writeArchiveManifest closes a message archive and records its checksums and message count in its manifest.
+func writeArchiveManifest(ctx context.Context, svc *internal.Service, writer internal.MessageWriter, output, indexPath string, written int, enc *internal.Encryption) {
+	if err := writer.Close(); err != nil {
+		logrus.Fatalf("Failed to close archive: %v", err)
+	}
+	profile, err := svc.Client.GetProfile(ctx)
+	if err != nil {
+		logrus.Fatalf("Failed to fetch mailbox profile: %v", err)
+	}
+	err = internal.WriteArchiveManifest(output, backupMessagesFormat, backupMessagesQuery, indexPath, profile.EmailAddress, written, enc)
+	if err != nil {
+		logrus.Fatalf("Failed to write backup manifest: %v", err)
+	}
+}
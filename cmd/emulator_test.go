@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/api/gmail/v1"
+)
+
+// useEmulator serves a new empty mailbox on a gmailtest emulator and points --endpoint at it for
+// the rest of the test, so newService talks to it over HTTP through the retrying transport.
+func useEmulator(t *testing.T) (*gmailtest.Emulator, *internal.Service) {
+	t.Helper()
+	emulator := gmailtest.New(gmailtest.NewFakeClient())
+	server := emulator.Start()
+	t.Cleanup(server.Close)
+
+	restoreEndpoint, restoreDelay := endpoint, labelPropagationDelay
+	endpoint, labelPropagationDelay = server.URL, 0
+	t.Cleanup(func() {
+		endpoint, labelPropagationDelay = restoreEndpoint, restoreDelay
+	})
+
+	svc, err := newService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return emulator, svc
+}
+
+// fatalExit is raised instead of exiting when a command logs a fatal error during execute.
+type fatalExit int
+
+// execute runs the command line given by args like the gmail binary does, failing the test when
+// the command exits. The flags it sets are reset to their defaults afterwards.
+func execute(t *testing.T, args ...string) {
+	t.Helper()
+	if code := executeStatus(t, args...); code != 0 {
+		t.Fatalf("gmail %v exited with status %d", args, code)
+	}
+}
+
+// executeStatus runs the command line given by args like execute, and returns the status the command
+// exits with, 0 when it completes.
+func executeStatus(t *testing.T, args ...string) (code int) {
+	t.Helper()
+	logger := logrus.StandardLogger()
+	restoreExit := logger.ExitFunc
+	logger.ExitFunc = func(code int) { panic(fatalExit(code)) }
+	defer func() {
+		logger.ExitFunc = restoreExit
+		resetFlags(rootCmd)
+		if r := recover(); r != nil {
+			exit, ok := r.(fatalExit)
+			if !ok {
+				panic(r)
+			}
+			code = int(exit)
+		}
+	}()
+
+	rootCmd.SetArgs(args)
+	if err := rootCmd.ExecuteContext(context.Background()); err != nil {
+		t.Fatalf("gmail %v: %v", args, err)
+	}
+	return 0
+}
+
+// resetFlags restores the flags changed on a command and its subcommands to their defaults.
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if !f.Changed {
+			return
+		}
+		// Setting a slice appends to it, so slices are replaced by their default values instead
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			var values []string
+			if def := strings.Trim(f.DefValue, "[]"); def != "" {
+				values = strings.Split(def, ",")
+			}
+			_ = slice.Replace(values)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, child := range cmd.Commands() {
+		resetFlags(child)
+	}
+}
+
+// countMessages returns the number of messages of a fake mailbox matching a query.
+func countMessages(t *testing.T, fake *gmailtest.FakeClient, query string) int {
+	t.Helper()
+	resp, err := fake.ListMessages(context.Background(), query, "", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(resp.Messages)
+}
+
+func TestEmulatorPushAndRetro(t *testing.T) {
+	emulator, svc := useEmulator(t)
+	ctx := context.Background()
+
+	order := emulator.Fake.AddMessage(rawMessage("shop@example.com", "Order"), "INBOX", "UNREAD")
+	other := emulator.Fake.AddMessage(rawMessage("friend@example.com", "Hi"), "INBOX")
+
+	// Creating a label is not idempotent, but a rate limited request was never applied and is retried
+	emulator.FailNext(http.StatusTooManyRequests, "rateLimitExceeded", 1)
+	config := internal.NewConfig(
+		internal.Filters{filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"})},
+		internal.Labels{{Name: "Receipts"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+
+	ids := labelIds(t, svc)
+	if ids["Receipts"] == "" {
+		t.Fatal("label Receipts was not created")
+	}
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 || filters[0].Action.AddLabelIds[0] != ids["Receipts"] {
+		t.Fatalf("filters = %+v, want one filter adding %s", filters, ids["Receipts"])
+	}
+
+	// Listing and modifying messages is retried on server errors
+	emulator.FailNext(http.StatusServiceUnavailable, "backendError", 1)
+	state := internal.NewRetroState()
+	if err := runRetro(ctx, svc, filters, state, filepath.Join(t.TempDir(), "retro.state.json")); err != nil {
+		t.Fatalf("runRetro() error = %v", err)
+	}
+
+	if got := emulator.Fake.MessageLabels(order); fmt.Sprint(got) != fmt.Sprint([]string{"UNREAD", ids["Receipts"]}) {
+		t.Errorf("order labels = %v, want [UNREAD %s]", got, ids["Receipts"])
+	}
+	if got := emulator.Fake.MessageLabels(other); fmt.Sprint(got) != "[INBOX]" {
+		t.Errorf("other labels = %v, want [INBOX]", got)
+	}
+	if state.Applied != 1 {
+		t.Errorf("applied = %d, want 1", state.Applied)
+	}
+}
+
+func TestEmulatorCreateNotRetried(t *testing.T) {
+	emulator, svc := useEmulator(t)
+	ctx := context.Background()
+
+	// A server error on a create may have been applied, so it is reported instead of retried
+	emulator.FailNext(http.StatusInternalServerError, "backendError", 1)
+	config := internal.NewConfig(nil, internal.Labels{{Name: "Receipts"}})
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+	if ids := labelIds(t, svc); ids["Receipts"] != "" {
+		t.Fatal("label creation was retried after a server error")
+	}
+
+	// Pushing again creates the missing label
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+	if ids := labelIds(t, svc); ids["Receipts"] == "" {
+		t.Error("label Receipts was not created by the second push")
+	}
+}
+
+func TestEmulatorBackupAndRestoreSettings(t *testing.T) {
+	_, svc := useEmulator(t)
+	backup := filepath.Join(t.TempDir(), "backup.yaml")
+
+	config := internal.NewConfig(
+		internal.Filters{
+			filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"}),
+			filterFor("boss@example.com", []string{"Work"}, nil),
+		},
+		internal.Labels{{Name: "Receipts"}, {Name: "Work"}},
+	)
+	if err := runPush(context.Background(), svc, config); err != nil {
+		t.Fatal(err)
+	}
+	execute(t, "backup", "--output", backup)
+
+	// Restore into another, empty account
+	_, restored := useEmulator(t)
+	execute(t, "restore", backup)
+
+	ids := labelIds(t, restored)
+	filters, err := restored.Filters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("restored %d filters, want 2", len(filters))
+	}
+	want := map[string]string{"shop@example.com": ids["Receipts"], "boss@example.com": ids["Work"]}
+	for _, f := range filters {
+		if id := want[f.Criteria.From]; id == "" || f.Action.AddLabelIds[0] != id {
+			t.Errorf("restored filter from %s adds %v, want [%s]", f.Criteria.From, f.Action.AddLabelIds, id)
+		}
+	}
+
+	// Restoring again finds everything in place
+	execute(t, "restore", backup)
+	if filters, _ := restored.Filters(context.Background()); len(filters) != 2 {
+		t.Errorf("got %d filters after restoring twice, want 2", len(filters))
+	}
+}
+
+func TestEmulatorBackupAndRestoreMessages(t *testing.T) {
+	emulator, _ := useEmulator(t)
+	archive := filepath.Join(t.TempDir(), "messages.mbox")
+
+	receipts, err := emulator.Fake.CreateLabel(context.Background(), &gmail.Label{Name: "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator.Fake.AddMessage(rawMessage("shop@example.com", "Order"), receipts.Id, "UNREAD")
+	emulator.Fake.AddMessage(rawMessage("boss@example.com", "Report"), "INBOX", "STARRED")
+	emulator.Fake.AddMessage(rawMessage("friend@example.com", "Hi"), "INBOX")
+
+	// Throttle the mailbox so the backup runs into the per-user rate limit and waits it out
+	emulator.QuotaPerSecond = 15
+	execute(t, "backup", "messages", "--output", archive)
+	// Listing, three message gets, labels and profile take 6 requests when none is rate limited
+	if emulator.Requests() <= 6 {
+		t.Errorf("backup made %d requests, want rate limited retries", emulator.Requests())
+	}
+
+	manifest, err := internal.LoadBackupManifest(archive)
+	if err != nil || manifest == nil {
+		t.Fatalf("backup manifest not loaded: %v", err)
+	}
+	if manifest.Messages != 3 || manifest.EmailAddress != "me@example.com" {
+		t.Errorf("manifest has %d messages of %s, want 3 of me@example.com", manifest.Messages, manifest.EmailAddress)
+	}
+
+	// Restore into another, empty account
+	restored, _ := useEmulator(t)
+	execute(t, "restore", "messages", archive)
+
+	for query, want := range map[string]int{
+		"":                         3,
+		"label:Receipts":           1,
+		"label:Receipts is:unread": 1,
+		"in:inbox":                 2,
+		"is:starred from:boss":     1,
+	} {
+		if got := countMessages(t, restored.Fake, query); got != want {
+			t.Errorf("restored messages matching %q = %d, want %d", query, got, want)
+		}
+	}
+
+	// The restore state and the Message-ID check keep a second run from importing duplicates
+	execute(t, "restore", "messages", archive)
+	if got := countMessages(t, restored.Fake, ""); got != 3 {
+		t.Errorf("got %d messages after restoring twice, want 3", got)
+	}
+}
+
+func TestEmulatorRestoreSnapshotOfAccount(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two accounts back up to the same directory
+	_, work := useEmulator(t)
+	config := internal.NewConfig(internal.Filters{filterFor("boss@example.com", []string{"Work"}, nil)}, internal.Labels{{Name: "Work"}})
+	if err := runPush(context.Background(), work, config); err != nil {
+		t.Fatal(err)
+	}
+	execute(t, "backup", "--dir", dir)
+
+	personal, svc := useEmulator(t)
+	personal.Fake.EmailAddress = "personal@example.com"
+	config = internal.NewConfig(internal.Filters{filterFor("mom@example.com", []string{"Family"}, nil)}, internal.Labels{{Name: "Family"}})
+	if err := runPush(context.Background(), svc, config); err != nil {
+		t.Fatal(err)
+	}
+	execute(t, "backup", "--dir", dir, "--keep-daily", "1")
+
+	manifest, err := internal.LoadSnapshotManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Snapshots) != 2 {
+		t.Fatalf("directory has %d snapshots after rotation, want one per account", len(manifest.Snapshots))
+	}
+
+	// Wiping and restoring the personal account brings back its own settings
+	execute(t, "restore", "--at", "2100-01-01", "--dir", dir, "--wipe", "--yes")
+	if ids := labelIds(t, svc); ids["Family"] == "" || ids["Work"] != "" {
+		t.Errorf("restored labels %v, want Family only", ids)
+	}
+
+	// --account restores the snapshot of another account
+	execute(t, "restore", "--at", "2100-01-01", "--dir", dir, "--account", "me@example.com")
+	if ids := labelIds(t, svc); ids["Family"] == "" || ids["Work"] == "" {
+		t.Errorf("restored labels %v, want Family and Work", ids)
+	}
+}
+
+func TestEmulatorEncryptedIncrementalBackup(t *testing.T) {
+	emulator, _ := useEmulator(t)
+	dir := t.TempDir()
+	output := filepath.Join(dir, "messages.mbox")
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup := []string{"backup", "messages", "--incremental", "--output", output, "--recipient", identity.Recipient().String()}
+
+	// Nightly runs: the first writes the archive, later ones add a segment only when there are new messages
+	emulator.Fake.AddMessage(rawMessage("shop@example.com", "Order 1"), "INBOX")
+	execute(t, backup...)
+	execute(t, backup...)
+	emulator.Fake.AddMessage(rawMessage("shop@example.com", "Order 2"), "INBOX")
+	execute(t, backup...)
+
+	if segments := internal.MboxSegments(output); len(segments) != 2 {
+		t.Fatalf("archive files = %v, want the archive and one segment", segments)
+	}
+	enc, err := internal.NewEncryption(nil, identityPath, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := internal.VerifyBackup(output, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) > 0 || report.Messages != 2 || report.Files != 2 {
+		t.Errorf("verify report = %+v, want 2 messages in 2 intact files", report)
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	exportFormat string
+	exportOutput string
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.PersistentFlags().StringVar(&exportFormat, "format", "eml", "Output format: eml, markdown or html")
+	exportCmd.PersistentFlags().StringVarP(&exportOutput, "output", "o", "", "File to write to (default standard output)")
+}
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a message or a thread as EML, Markdown or HTML",
+	Long: `The export commands write a single message or a whole thread, ready to attach to or paste into
+tickets and documents.
+
+The eml format is the original message as Gmail stores it. The markdown and html formats are
+readable renderings with the sender, recipients and date of each message, its text and the list
+of its attachments; HTML bodies are reduced to their text.`,
+}
+
+// writeRendering renders messages fetched in full format to the --output file or standard output.
+func writeRendering(messages []*gmail.Message) {
+	var buf bytes.Buffer
+	if err := internal.RenderMessages(&buf, exportFormat, messages); err != nil {
+		logrus.Fatalf("Failed to render messages: %v", err)
+	}
+	writeExport(buf.Bytes())
+}
+
+// writeExport writes exported data to the --output file or standard output.
+func writeExport(data []byte) {
+	if exportOutput == "" || exportOutput == "-" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			logrus.Fatalf("Failed to write output: %v", err)
+		}
+		return
+	}
+	if err := os.WriteFile(exportOutput, data, 0600); err != nil {
+		logrus.Fatalf("Failed to write %s: %v", exportOutput, err)
+	}
+	logrus.Infof("Export saved to %s.", exportOutput)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/gmail/v1"
+)
+
+func init() {
+	exportCmd.AddCommand(exportMessageCmd)
+}
+
+// exportMessageCmd represents the export message command
+var exportMessageCmd = &cobra.Command{
+	Use:   "message <id>",
+	Short: "Export a message as EML, Markdown or HTML",
+	Long: `The export message command writes the message with the given ID as an .eml file, or as a
+Markdown or HTML rendering with --format.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		id := args[0]
+
+		// Step 1: Initialize Gmail Service
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 2: Fetch and Write Message
+		if exportFormat == "eml" {
+			msg, err := svc.ExportMessage(ctx, id, nil)
+			if err != nil {
+				logrus.Fatalf("Failed to export message %s: %v", id, err)
+			}
+			writeExport(msg.Raw)
+			return
+		}
+
+		msg, err := svc.Client.GetMessage(ctx, id, "full")
+		if err != nil {
+			logrus.Fatalf("Failed to fetch message %s: %v", id, err)
+		}
+		writeRendering([]*gmail.Message{msg})
+	},
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportThread(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	dir := t.TempDir()
+	first := fake.AddMessage([]byte("From: alice@example.com\r\nSubject: Plan\r\nMessage-Id: <p1@example.com>\r\n\r\nHow about Monday?\r\n"), "INBOX")
+	reply := fake.AddMessage([]byte("From: bob@example.com\r\nSubject: Re: Plan\r\nIn-Reply-To: <p1@example.com>\r\n\r\nMonday works.\r\n"), "INBOX")
+
+	// The eml format writes one file per message to --dir
+	emlDir := filepath.Join(dir, "thread")
+	execute(t, "export", "thread", first, "--dir", emlDir)
+	for _, id := range []string{first, reply} {
+		if _, err := os.Stat(filepath.Join(emlDir, id+".eml")); err != nil {
+			t.Errorf("message %s was not exported: %v", id, err)
+		}
+	}
+
+	// Markdown and HTML are written to the --output file
+	output := filepath.Join(dir, "thread.md")
+	execute(t, "export", "thread", first, "--format", "markdown", "-o", output)
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "How about Monday?") || !strings.Contains(string(data), "Monday works.") {
+		t.Errorf("markdown export does not contain both messages:\n%s", data)
+	}
+}
+
+func TestExportThreadRejectsMisplacedOutput(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	dir := t.TempDir()
+	id := fake.AddMessage(rawMessage("alice@example.com", "Plan"), "INBOX")
+
+	// -o names a file, so it is refused instead of creating a directory called t.eml
+	output := filepath.Join(dir, "t.eml")
+	if code := executeStatus(t, "export", "thread", id, "-o", output); code == 0 {
+		t.Error("export thread -o exited with status 0 for the eml format")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("%s was created: %v", output, err)
+	}
+
+	if code := executeStatus(t, "export", "thread", id, "--format", "html", "--dir", dir); code == 0 {
+		t.Error("export thread --dir exited with status 0 for the html format")
+	}
+}
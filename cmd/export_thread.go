@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var exportThreadDir string
+
+func init() {
+	exportCmd.AddCommand(exportThreadCmd)
+
+	exportThreadCmd.Flags().StringVar(&exportThreadDir, "dir", "", "Directory to write the .eml files to (default a directory named after the thread)")
+}
+
+// exportThreadCmd represents the export thread command
+var exportThreadCmd = &cobra.Command{
+	Use:   "thread <id>",
+	Short: "Export the messages of a thread as EML, Markdown or HTML",
+	Long: `The export thread command writes every message of the thread with the given ID, oldest first.
+
+With --format markdown or html the thread is rendered as one document, written to --output or
+standard output. With the default eml format each message is written to its own <message id>.eml
+file in the --dir directory, which defaults to a directory named after the thread.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		id := args[0]
+		if exportFormat == "eml" && exportOutput != "" {
+			logrus.Fatal("The eml format writes one file per message; use --dir instead of --output.")
+		}
+		if exportFormat != "eml" && exportThreadDir != "" {
+			logrus.Fatal("--dir only applies to the eml format; use --output for markdown and html.")
+		}
+
+		// Step 1: Initialize Gmail Service
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		if exportFormat != "eml" {
+			// Step 2: Fetch and Render Thread
+			thread, err := svc.Client.GetThread(ctx, id, "full")
+			if err != nil {
+				logrus.Fatalf("Failed to fetch thread %s: %v", id, err)
+			}
+			writeRendering(thread.Messages)
+			return
+		}
+
+		// Step 2: Fetch Thread Messages
+		thread, err := svc.Client.GetThread(ctx, id, "minimal")
+		if err != nil {
+			logrus.Fatalf("Failed to fetch thread %s: %v", id, err)
+		}
+
+		// Step 3: Write One File per Message
+		dir := exportThreadDir
+		if dir == "" {
+			dir = id
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logrus.Fatalf("Failed to create directory %s: %v", dir, err)
+		}
+		for _, m := range thread.Messages {
+			msg, err := svc.ExportMessage(ctx, m.Id, nil)
+			if err != nil {
+				logrus.Fatalf("Failed to export message %s: %v", m.Id, err)
+			}
+			path := filepath.Join(dir, msg.Id+".eml")
+			if err := os.WriteFile(path, msg.Raw, 0600); err != nil {
+				logrus.Fatalf("Failed to write %s: %v", path, err)
+			}
+		}
+		logrus.Infof("Export thread command completed. %d messages saved to %s.", len(thread.Messages), dir)
+	},
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+}
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint [config.yaml]",
+	Short: "Check the search queries of configured filters for errors",
+	Long: `The lint command parses the from, to, subject, query and negated query values of every filter
+in a configuration file and reports malformed queries, such as unbalanced parentheses or quotes,
+and operator values Gmail would not understand, without contacting Gmail.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'lint' command...")
+
+		configPath := cfgFile
+		if len(args) > 0 {
+			configPath = args[0]
+		}
+
+		// Step 1: Load Configuration
+		logrus.Infof("Loading configuration from file: %s", configPath)
+		config, err := internal.NewConfigFromYAML(configPath, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %v", err)
+		}
+
+		// Step 2: Check Filter Queries
+		var problems int
+		for i, filter := range config.Filters {
+			for _, problem := range internal.LintCriteria(filter.Criteria) {
+				logrus.Errorf("Filter #%d: %s", i+1, problem)
+				problems++
+			}
+		}
+
+		if problems > 0 {
+			logrus.Fatalf("Found %d problems in %d filters.", problems, len(config.Filters))
+		}
+		logrus.Infof("All %d filters are valid.", len(config.Filters))
+		logrus.Info("Lint command completed.")
+	},
+}
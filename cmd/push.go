@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"github.com/ryanparsa/gmail/internal"
 	"github.com/sirupsen/logrus"
 	"time"
@@ -8,6 +10,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// labelPropagationDelay is how long push waits after creating labels before mapping them to IDs.
+var labelPropagationDelay = 2 * time.Second
+
 func init() {
 	rootCmd.AddCommand(pushCmd)
 }
@@ -18,78 +23,94 @@ var pushCmd = &cobra.Command{
 	Short: "Push Gmail labels and filters configuration",
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'push' command...")
+		ctx := cmd.Context()
 
 		// Step 1: Initialize Gmail Service
 		logrus.Info("Initializing Gmail service...")
-		svc, err := internal.NewService(credentialsPath, tokenPath, scopes)
+		svc, err := newService()
 		if err != nil {
 			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
 		}
 
 		// Step 2: Load Configuration
 		logrus.Infof("Loading configuration from file: %s", cfgFile)
-		config, err := internal.NewConfigFromYAML(cfgFile)
+		config, err := internal.NewConfigFromYAML(cfgFile, backupEncryption())
 		if err != nil {
 			logrus.Errorf("Failed to load configuration: %v", err)
 			return
 		}
 		logrus.Info("Configuration loaded successfully.")
 
-		// Step 3: Create Labels
-		logrus.Info("Creating labels...")
-		err = svc.CreateLabels(config.Labels)
-		if err != nil {
-			logrus.Errorf("Failed to create labels: %v", err)
+		if err := runPush(ctx, svc, config); err != nil {
+			if interrupted(err) {
+				exitInterrupted(err, "Some labels or filters may not have been created; push is safe to run again.")
+			}
+			logrus.Errorf("%v", err)
 			return
 		}
-		logrus.Info("Labels created successfully. Waiting 2 seconds for propagation...")
-		time.Sleep(2 * time.Second)
+		logrus.Info("Push command completed.")
+	},
+}
 
-		// Step 4: Fetch Existing Labels Map
-		logrus.Info("Fetching existing labels map...")
-		lm, err := svc.LabelsMap()
-		if err != nil {
-			logrus.Fatalf("Failed to fetch labels map: %v", err)
-		}
-		logrus.Infof("Labels map retrieved: %d labels found.", len(lm))
+// runPush creates the labels of a configuration and then its filters, mapping the label
+// names used in the filter actions to the IDs of the labels in the account.
+func runPush(ctx context.Context, svc *internal.Service, config *internal.Config) error {
+	// Step 3: Create Labels
+	logrus.Info("Creating labels...")
+	err := svc.CreateLabels(ctx, config.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to create labels: %w", err)
+	}
+	logrus.Infof("Labels created successfully. Waiting %s for propagation...", labelPropagationDelay)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(labelPropagationDelay):
+	}
 
-		// Step 5: Update Filters with Label IDs
-		logrus.Info("Updating filters with existing label IDs...")
-		var updatedFilters internal.Filters
-		for _, filter := range config.Filters {
-			logrus.Infof("Processing filter: %v", filter)
+	// Step 4: Fetch Existing Labels Map
+	logrus.Info("Fetching existing labels map...")
+	lm, err := svc.LabelsMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch labels map: %v", err)
+	}
+	logrus.Infof("Labels map retrieved: %d labels found.", len(lm))
 
-			// Update AddLabelIds
-			for id, label := range filter.Action.AddLabelIds {
-				if labelID, exists := lm[label]; exists {
-					filter.Action.AddLabelIds[id] = labelID.Id
-				} else {
-					logrus.Warnf("Label '%s' does not exist. Skipping AddLabelId mapping.", label)
-				}
-			}
+	// Step 5: Update Filters with Label IDs
+	logrus.Info("Updating filters with existing label IDs...")
+	var updatedFilters internal.Filters
+	for _, filter := range config.Filters {
+		logrus.Infof("Processing filter: %v", filter)
 
-			// Update RemoveLabelIds
-			for id, label := range filter.Action.RemoveLabelIds {
-				if labelID, exists := lm[label]; exists {
-					filter.Action.RemoveLabelIds[id] = labelID.Id
-					logrus.Infof("Mapped RemoveLabelId '%s' to ID '%s'.", label, labelID.Id)
-				} else {
-					logrus.Warnf("Label '%s' does not exist. Skipping RemoveLabelId mapping.", label)
-				}
+		// Update AddLabelIds
+		for id, label := range filter.Action.AddLabelIds {
+			if labelID, exists := lm[label]; exists {
+				filter.Action.AddLabelIds[id] = labelID.Id
+			} else {
+				logrus.Warnf("Label '%s' does not exist. Skipping AddLabelId mapping.", label)
 			}
-
-			updatedFilters = append(updatedFilters, filter)
 		}
-		logrus.Info("Filters updated successfully.")
 
-		// Step 6: Create Filters
-		logrus.Info("Creating filters...")
-		err = svc.CreateFilters(updatedFilters)
-		if err != nil {
-			logrus.Errorf("Failed to create filters: %v", err)
-			return
+		// Update RemoveLabelIds
+		for id, label := range filter.Action.RemoveLabelIds {
+			if labelID, exists := lm[label]; exists {
+				filter.Action.RemoveLabelIds[id] = labelID.Id
+				logrus.Infof("Mapped RemoveLabelId '%s' to ID '%s'.", label, labelID.Id)
+			} else {
+				logrus.Warnf("Label '%s' does not exist. Skipping RemoveLabelId mapping.", label)
+			}
 		}
-		logrus.Info("Filters created successfully.")
-		logrus.Info("Push command completed.")
-	},
+
+		updatedFilters = append(updatedFilters, filter)
+	}
+	logrus.Info("Filters updated successfully.")
+
+	// Step 6: Create Filters
+	logrus.Info("Creating filters...")
+	err = svc.CreateFilters(ctx, updatedFilters)
+	if err != nil {
+		return fmt.Errorf("failed to create filters: %w", err)
+	}
+	logrus.Info("Filters created successfully.")
+	return nil
 }
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestRunPush(t *testing.T) {
+	_, svc := useFakeClient(t)
+	ctx := context.Background()
+
+	config := internal.NewConfig(
+		internal.Filters{
+			filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"}),
+			filterFor("boss@example.com", []string{"Work/Clients", "STARRED"}, nil),
+		},
+		internal.Labels{{Name: "Receipts"}, {Name: "Work/Clients"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+
+	ids := labelIds(t, svc)
+	for _, name := range []string{"Receipts", "Work/Clients"} {
+		if ids[name] == "" {
+			t.Errorf("label %s was not created", name)
+		}
+	}
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		from   string
+		add    []string
+		remove []string
+	}{
+		{"shop@example.com", []string{ids["Receipts"]}, []string{"INBOX"}},
+		{"boss@example.com", []string{ids["Work/Clients"], "STARRED"}, nil},
+	}
+	if len(filters) != len(want) {
+		t.Fatalf("got %d filters, want %d", len(filters), len(want))
+	}
+	for i, w := range want {
+		f := filters[i]
+		if f.Id == "" {
+			t.Errorf("filter %d has no ID", i)
+		}
+		if f.Criteria.From != w.from {
+			t.Errorf("filter %d from = %q, want %q", i, f.Criteria.From, w.from)
+		}
+		if !reflect.DeepEqual(f.Action.AddLabelIds, w.add) {
+			t.Errorf("filter %d adds %v, want %v", i, f.Action.AddLabelIds, w.add)
+		}
+		if !reflect.DeepEqual(f.Action.RemoveLabelIds, w.remove) {
+			t.Errorf("filter %d removes %v, want %v", i, f.Action.RemoveLabelIds, w.remove)
+		}
+	}
+}
+
+func TestRunPushExistingLabels(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	ctx := context.Background()
+
+	existing, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The label already exists, so push maps the filter to it rather than failing
+	config := internal.NewConfig(
+		internal.Filters{filterFor("shop@example.com", []string{"Receipts"}, nil)},
+		internal.Labels{{Name: "Receipts"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+
+	labels, err := svc.Labels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for _, l := range labels {
+		if l.Name == "Receipts" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("got %d Receipts labels, want 1", count)
+	}
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 || !reflect.DeepEqual(filters[0].Action.AddLabelIds, []string{existing.Id}) {
+		t.Errorf("filters = %+v, want one filter adding %s", filters, existing.Id)
+	}
+}
+
+func TestRunPushUnknownLabel(t *testing.T) {
+	_, svc := useFakeClient(t)
+	ctx := context.Background()
+
+	// A filter with a label that is neither in the configuration nor in the account is rejected
+	config := internal.NewConfig(
+		internal.Filters{
+			filterFor("shop@example.com", []string{"Missing"}, nil),
+			filterFor("news@example.com", []string{"News"}, nil),
+		},
+		internal.Labels{{Name: "News"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatalf("runPush() error = %v", err)
+	}
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 || filters[0].Criteria.From != "news@example.com" {
+		t.Errorf("filters = %+v, want only the news filter", filters)
+	}
+}
+
+func TestRunPushCancelled(t *testing.T) {
+	_, svc := useFakeClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	config := internal.NewConfig(nil, internal.Labels{{Name: "Receipts"}})
+	if err := runPush(ctx, svc, config); !interrupted(err) {
+		t.Errorf("runPush() error = %v, want an interruption", err)
+	}
+	if id := labelIds(t, svc)["Receipts"]; id != "" {
+		t.Errorf("label Receipts was created after cancellation")
+	}
+}
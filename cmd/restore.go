@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var restoreAt string
+var restoreDir string
+var restoreWipe bool
+var restoreYes bool
+var restoreAccount string
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringVar(&restoreAt, "at", "", "Restore the latest snapshot taken at or before this time, e.g. 2024-01-02 or '2024-01-02 15:04'")
+	restoreCmd.Flags().StringVar(&restoreDir, "dir", "backups", "Backup directory holding the snapshots")
+	restoreCmd.Flags().StringVar(&restoreAccount, "account", "", "With --at, restore a snapshot of this account (default the authenticated account)")
+	restoreCmd.Flags().BoolVar(&restoreWipe, "wipe", false, "Delete all filters and user labels of the account before restoring")
+	restoreCmd.Flags().BoolVarP(&restoreYes, "yes", "y", false, "Wipe without asking for confirmation")
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [backup.yaml]",
+	Short: "Restore backed up data into Gmail",
+	Long: `The restore command brings data saved by the backup command back into a Gmail account,
+either the account it was taken from or another one. Use the messages subcommand to upload
+messages from an mbox file or a Maildir directory.
+
+Given a settings backup file, restore recreates its user labels with their color and visibility,
+skipping system labels and labels that already exist, and then its filters. Filter actions in
+backups refer to labels by their IDs in the backed up account; they are mapped by label name to
+the IDs in this account. Filters that already exist are skipped, so restore is safe to run again.
+Labels and filters that could not be restored are reported at the end.
+
+With --at, the latest snapshot in the backup directory taken at or before the given time is
+restored instead, to roll settings back to how they were then. A date selects the last snapshot
+of that day. Only snapshots of the authenticated account are considered, unless --account selects
+the snapshots of another account to restore from. The snapshot's checksum is verified against the
+manifest first.
+
+With --wipe, all filters and user labels are deleted before restoring, after confirmation.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 && restoreAt == "" {
+			_ = cmd.Help()
+			return
+		}
+		if len(args) > 0 && restoreAt != "" {
+			logrus.Fatal("Give either a backup file or --at, not both.")
+		}
+		if restoreAccount != "" && restoreAt == "" {
+			logrus.Fatal("--account only applies to snapshots selected with --at.")
+		}
+		logrus.Info("Starting the 'restore' command...")
+		ctx := cmd.Context()
+
+		// Step 1: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 2: Select Backup
+		var backupPath string
+		if len(args) > 0 {
+			backupPath = args[0]
+		} else {
+			at, err := internal.ParseSnapshotTime(restoreAt)
+			if err != nil {
+				logrus.Fatalf("%v", err)
+			}
+			manifest, err := internal.LoadSnapshotManifest(restoreDir)
+			if err != nil {
+				logrus.Fatalf("Failed to load backup manifest: %v", err)
+			}
+			account := restoreAccount
+			if account == "" {
+				profile, err := svc.Client.GetProfile(ctx)
+				if err != nil {
+					logrus.Fatalf("Failed to fetch mailbox profile: %v", err)
+				}
+				account = profile.EmailAddress
+			}
+			snapshot := manifest.At(at, account)
+			if snapshot == nil {
+				logrus.Fatalf("No snapshot of %s in %s was taken at or before %s.", account, restoreDir, at.Local().Format("2006-01-02 15:04:05"))
+			}
+			logrus.Infof("Restoring snapshot %s taken %s for %s.", snapshot.File, snapshot.CreatedAt.Local().Format("2006-01-02 15:04:05"), snapshot.EmailAddress)
+
+			backupPath = filepath.Join(restoreDir, snapshot.File)
+			if err := snapshot.Verify(restoreDir); err != nil {
+				logrus.Fatalf("Snapshot %s is damaged: %v", backupPath, err)
+			}
+		}
+
+		// Step 3: Load Backup
+		config, err := internal.NewConfigFromYAML(backupPath, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to load backup: %v", err)
+		}
+
+		// Step 4: Wipe Account
+		if restoreWipe {
+			if !restoreYes && !confirm("Delete all filters and user labels of the account before restoring %s?", backupPath) {
+				logrus.Info("Restore cancelled.")
+				return
+			}
+			if err := runWipe(ctx, svc); err != nil {
+				if interrupted(err) {
+					exitInterrupted(err, "Wipe stopped before the backup was restored.")
+				}
+				logrus.Fatalf("%v", err)
+			}
+		}
+
+		// Step 5: Restore Labels and Filters
+		report, err := svc.RestoreSettings(ctx, config)
+		if interrupted(err) {
+			exitInterrupted(err, "Restored %d labels and %d filters before stopping; restore is safe to run again.", report.LabelsCreated, report.FiltersCreated)
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to restore settings: %v", err)
+		}
+
+		logrus.Infof("Restored %d labels (%d already existed) and %d filters (%d already existed).",
+			report.LabelsCreated, report.LabelsExisting, report.FiltersCreated, report.FiltersExisting)
+		if len(report.Failures) > 0 {
+			for _, failure := range report.Failures {
+				logrus.Errorf("Not restored: %s", failure)
+			}
+			logrus.Fatalf("%d labels or filters could not be restored.", len(report.Failures))
+		}
+		logrus.Info("Restore command completed.")
+	},
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreMessagesState  string
+	restoreMessagesDryRun bool
+)
+
+func init() {
+	restoreCmd.AddCommand(restoreMessagesCmd)
+
+	restoreMessagesCmd.Flags().StringVar(&restoreMessagesState, "state", "", "Path of the state file recording restored messages (default <archive>.restore.json)")
+	restoreMessagesCmd.Flags().BoolVar(&restoreMessagesDryRun, "dry-run", false, "List the messages and labels that would be restored without changing anything")
+}
+
+// restoreMessagesCmd represents the restore messages command
+var restoreMessagesCmd = &cobra.Command{
+	Use:   "messages <archive>",
+	Short: "Upload messages from an mbox file or a Maildir directory",
+	Long: `The restore messages command imports the messages of an mbox file or a Maildir directory into
+Gmail, as if they had been delivered on the date of their Date header. Labels are recreated by name:
+from the X-Gmail-Labels header of mbox archives, or from the folders and flags of Maildir archives.
+Archives written by 'backup messages' and Google Takeout mbox exports are both supported.
+
+Messages whose Message-ID is already in the mailbox are skipped, so restoring into an account
+recovers only what is missing. Messages in the trash do not count as present. Restored messages
+are recorded in a state file, so an interrupted restore resumes where it stopped.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'restore messages' command...")
+		ctx := cmd.Context()
+		archive := args[0]
+
+		// Step 1: Open Archive
+		reader, err := internal.NewMessageReader(archive, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to open archive: %v", err)
+		}
+		defer reader.Close()
+
+		// Step 2: Load Restore State
+		statePath := restoreMessagesState
+		if statePath == "" {
+			statePath = strings.TrimSuffix(archive, string(filepath.Separator)) + ".restore.json"
+		}
+		state, err := internal.LoadRestoreState(statePath, archive)
+		if err != nil {
+			logrus.Fatalf("Failed to load restore state: %v", err)
+		}
+
+		// Step 3: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 4: Restore Messages
+		if restoreMessagesDryRun {
+			logrus.Info("Dry run: no messages will be imported.")
+		}
+		result, err := svc.RestoreMessages(ctx, reader, state, statePath, restoreMessagesDryRun)
+		if interrupted(err) {
+			exitInterrupted(err, "Restored %d messages before stopping; run the command again to resume.", result.Imported)
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to restore messages: %v", err)
+		}
+
+		verb := "Restored"
+		if restoreMessagesDryRun {
+			verb = "Would restore"
+		}
+		logrus.Infof("%s %d messages; %d already in the mailbox, %d restored by a previous run, %d failed.",
+			verb, result.Imported, result.Duplicates, result.Resumed, result.Failed)
+		if result.Failed > 0 {
+			logrus.Fatalf("%d messages could not be restored; run the command again to retry them.", result.Failed)
+		}
+		logrus.Info("Restore messages command completed.")
+	},
+}
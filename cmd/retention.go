@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var retentionDryRun bool
+
+func init() {
+	rootCmd.AddCommand(retentionCmd)
+	retentionCmd.AddCommand(retentionApplyCmd)
+
+	retentionApplyCmd.Flags().BoolVar(&retentionDryRun, "dry-run", false, "Preview the number of affected messages without changing anything")
+}
+
+// retentionCmd represents the retention command
+var retentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Work with the age-based retention policies of the configuration",
+	Long: `Retention policies are defined in the retention section of the configuration. Each one archives,
+marks as read or trashes the messages under a label once they are older than a given age, optionally
+keeping starred or important messages. Gmail filters only act on arrival; retention policies clean up
+what has been lying around.`,
+}
+
+// retentionApplyCmd represents the retention apply command
+var retentionApplyCmd = &cobra.Command{
+	Use:   "apply [config.yaml]",
+	Short: "Apply the configured retention policies",
+	Long: `The retention apply command builds a search query for every retention policy, previews the number of
+messages each one affects, and applies the actions in batches. All actions are journaled and can be
+reverted with the undo command, which moves trashed messages out of the trash as long as Gmail still
+keeps them there. The command exits with an error when any policy failed. Use --dry-run to only
+preview the counts.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'retention apply' command...")
+		ctx := cmd.Context()
+
+		configPath := cfgFile
+		if len(args) > 0 {
+			configPath = args[0]
+		}
+
+		// Step 1: Load Configuration
+		logrus.Infof("Loading configuration from file: %s", configPath)
+		config, err := internal.NewConfigFromYAML(configPath, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %v", err)
+		}
+		if len(config.Retention) == 0 {
+			logrus.Fatalf("No retention policies defined in %s.", configPath)
+		}
+
+		// Step 2: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 3: Preview
+		matches := make([][]string, len(config.Retention))
+		var total int
+		for i, policy := range config.Retention {
+			query := policy.BuildQuery()
+			ids, err := svc.MessageIds(ctx, query)
+			if interrupted(err) {
+				exitInterrupted(err, "Nothing was changed.")
+			}
+			if err != nil {
+				logrus.Fatalf("Failed to preview policy '%s': %v", policy, err)
+			}
+			matches[i] = ids
+			total += len(ids)
+			logrus.Infof("Policy '%s' (query: %s): %d messages", policy, query, len(ids))
+		}
+		if retentionDryRun {
+			logrus.Infof("Retention apply completed (dry run). %d messages would be affected.", total)
+			return
+		}
+		if total == 0 {
+			logrus.Info("Retention apply completed. Nothing to do.")
+			return
+		}
+
+		// Step 4: Apply Policies
+		runId := internal.NewRunId()
+		svc.Journal, err = internal.OpenJournal(journalPath, runId)
+		if err != nil {
+			logrus.Fatalf("Failed to open journal: %v", err)
+		}
+		defer svc.Journal.Close()
+
+		var applied, affected, failed int
+		for i, policy := range config.Retention {
+			if len(matches[i]) == 0 {
+				continue
+			}
+			err := svc.ApplyRetention(ctx, policy, matches[i])
+			if interrupted(err) {
+				exitInterrupted(err, "Applied %d of %d policies before stopping. Run ID: %s", applied, len(config.Retention), runId)
+			}
+			if err != nil {
+				logrus.Errorf("Failed to apply policy '%s': %v", policy, err)
+				failed++
+				continue
+			}
+			applied++
+			affected += len(matches[i])
+		}
+
+		logrus.Infof("Retention apply completed. %d messages affected, %d policies failed. Run ID: %s", affected, failed, runId)
+		if failed > 0 {
+			logrus.Fatalf("%d of %d retention policies could not be applied.", failed, len(config.Retention))
+		}
+	},
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+// failingModifyClient is a fake mailbox whose batch label modifications fail.
+type failingModifyClient struct {
+	*gmailtest.FakeClient
+}
+
+func (c failingModifyClient) BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	return fmt.Errorf("batch modify is unavailable")
+}
+
+// writeRetentionConfig writes a configuration holding only the given retention section.
+func writeRetentionConfig(t *testing.T, retention string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("retention:\n"+retention), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// journalRunId returns the run ID of the last entry of a journal.
+func journalRunId(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var entry internal.JournalEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	return entry.RunId
+}
+
+func TestRetentionTrashIsUndone(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	ci, err := fake.CreateLabel(ctx, &gmail.Label{Name: "CI"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage(rawMessage("ci@example.com", "Build 1"), "INBOX", ci.Id)
+	fake.AddMessage(rawMessage("ci@example.com", "Build 2"), ci.Id)
+	fake.AddMessage(rawMessage("friend@example.com", "Hello"), "INBOX")
+
+	config := writeRetentionConfig(t, "  - label: CI\n    older_than: 14d\n    action: trash\n")
+	execute(t, "retention", "apply", config, "--journal", journal)
+	if n := countMessages(t, fake, "in:trash"); n != 2 {
+		t.Fatalf("%d messages in the trash after retention, want 2", n)
+	}
+
+	execute(t, "undo", journalRunId(t, journal), "--journal", journal)
+	if n := countMessages(t, fake, "in:trash"); n != 0 {
+		t.Errorf("%d messages in the trash after undo, want 0", n)
+	}
+	if n := countMessages(t, fake, "label:CI"); n != 2 {
+		t.Errorf("%d messages under CI after undo, want 2", n)
+	}
+}
+
+func TestRetentionFailedPolicyExits(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	newService = func() (*internal.Service, error) {
+		return internal.NewServiceWithClient(failingModifyClient{fake}), nil
+	}
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	ci, err := fake.CreateLabel(ctx, &gmail.Label{Name: "CI"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage(rawMessage("ci@example.com", "Build 1"), "INBOX", ci.Id)
+	fake.AddMessage(rawMessage("ci@example.com", "Build 2"), "INBOX", ci.Id)
+
+	// Archiving fails, trashing still runs, and the command exits with an error
+	config := writeRetentionConfig(t, "  - label: CI\n    older_than: 14d\n    action: archive\n"+
+		"  - label: CI\n    older_than: 14d\n    action: trash\n")
+	if code := executeStatus(t, "retention", "apply", config, "--journal", journal); code == 0 {
+		t.Error("retention apply exited with status 0 after a policy failed")
+	}
+	if n := countMessages(t, fake, "in:trash"); n != 2 {
+		t.Errorf("%d messages in the trash, want 2 from the policy that did not fail", n)
+	}
+}
@@ -1,25 +1,40 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/ryanparsa/gmail/internal"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var (
+	retroResume    bool
+	retroStatePath string
+)
+
 func init() {
 	rootCmd.AddCommand(retroCmd)
 
+	retroCmd.Flags().BoolVar(&retroResume, "resume", false, "Resume an interrupted run from the state file")
+	retroCmd.Flags().StringVar(&retroStatePath, "state", "retro.state.json", "Path to the retro state file")
 }
 
 var retroCmd = &cobra.Command{
 	Use:   "retro",
 	Short: "Retroactively apply Gmail filters to existing messages",
+	Long: `The retro command applies the actions of every Gmail filter to the existing messages matching it.
+Each page of matching messages is modified with batch requests, and progress is checkpointed to a
+state file after every page, so an interrupted run can be continued with --resume instead of
+starting over from the first filter.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'retro' command...")
+		ctx := cmd.Context()
 
 		// Step 1: Initialize Gmail Service
 		logrus.Info("Initializing Gmail service...")
-		svc, err := internal.NewService(credentialsPath, tokenPath, scopes)
+		svc, err := newService()
 		if err != nil {
 			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
 		}
@@ -27,42 +42,112 @@ var retroCmd = &cobra.Command{
 
 		// Step 2: Fetch Filters
 		logrus.Info("Fetching Gmail filters...")
-		filters, err := svc.Filters()
+		filters, err := svc.Filters(ctx)
 		if err != nil {
 			logrus.Fatalf("Failed to fetch Gmail filters: %v", err)
 		}
 		logrus.Infof("Fetched %d filters successfully.", len(filters))
 
-		// Step 3: Process Each Filter
-		for _, filter := range filters {
-			logrus.Infof("Processing filter: %v", filter)
+		// Step 3: Load or Initialize State
+		state := internal.NewRetroState()
+		if retroResume {
+			logrus.Infof("Resuming from state file: %s", retroStatePath)
+			state, err = internal.LoadRetroState(retroStatePath)
+			if err != nil {
+				logrus.Fatalf("Failed to load retro state: %v", err)
+			}
+			if state.FilterIndex < len(filters) && state.FilterId != "" && filters[state.FilterIndex].Id != state.FilterId {
+				logrus.Fatalf("Filters changed since the interrupted run (expected filter %s at position %d). "+
+					"Run without --resume to start over.", state.FilterId, state.FilterIndex)
+			}
+		}
+
+		// Step 4: Open Journal
+		svc.Journal, err = internal.OpenJournal(journalPath, state.RunId)
+		if err != nil {
+			logrus.Fatalf("Failed to open journal: %v", err)
+		}
+		defer svc.Journal.Close()
+		logrus.Infof("Run ID: %s (revert with 'gmail undo %s')", state.RunId, state.RunId)
 
-			// Build the query from filter criteria
-			query := svc.BuildQueryFromFilter(filter.Criteria)
-			if query == "" {
-				logrus.Warn("Empty query generated from filter criteria. Skipping this filter.")
-				continue
+		// Step 5: Process Each Filter
+		if err := runRetro(ctx, svc, filters, state, retroStatePath); err != nil {
+			if interrupted(err) {
+				exitInterrupted(err, "Applied filter actions to %d messages, stopped at filter %d/%d. "+
+					"Run again with --resume to continue.", state.Applied, state.FilterIndex+1, len(filters))
 			}
-			logrus.Infof("Built query: %s", query)
+			logrus.Fatalf("%v. Run again with --resume to continue.", err)
+		}
+
+		// Step 6: Clear State
+		if err := internal.ClearRetroState(retroStatePath); err != nil {
+			logrus.Warnf("Failed to remove state file %s: %v", retroStatePath, err)
+		}
+
+		logrus.Infof("Retro command completed: applied filter actions to %d messages. Run ID: %s", state.Applied, state.RunId)
+	},
+}
+
+// runRetro applies the actions of each filter to the messages matching it, starting at the
+// position recorded in the state and checkpointing the state after every page of messages.
+func runRetro(ctx context.Context, svc *internal.Service, filters internal.Filters, state *internal.RetroState, statePath string) error {
+	for ; state.FilterIndex < len(filters); state.NextFilter() {
+		filter := filters[state.FilterIndex]
+		state.FilterId = filter.Id
+		logrus.Infof("Processing filter %d/%d: %v", state.FilterIndex+1, len(filters), filter)
+
+		// Build the query from filter criteria
+		query, err := svc.BuildQueryFromFilter(filter.Criteria)
+		if err != nil {
+			logrus.Errorf("Cannot search for the messages of filter %d: %v. Skipping this filter.", state.FilterIndex+1, err)
+			continue
+		}
+		if query == "" {
+			logrus.Warn("Empty query generated from filter criteria. Skipping this filter.")
+			continue
+		}
+		logrus.Infof("Built query: %s", query)
 
-			// Fetch emails matching the query
-			logrus.Infof("Fetching emails matching query: %s", query)
-			messages, err := svc.Messages(100000, query)
+		// Walk the matching messages page by page, checkpointing after every page
+		for {
+			messages, next, err := svc.MessagesPage(ctx, query, state.PageToken)
 			if err != nil {
-				logrus.Errorf("Failed to fetch emails for query '%s': %v", query, err)
-				continue
+				saveRetroState(state, statePath)
+				return fmt.Errorf("failed to fetch emails for query '%s': %w", query, err)
 			}
-			logrus.Infof("Fetched %d messages matching the query.", len(messages))
 
-			// Apply filter actions to the messages
-			logrus.Info("Applying filter actions to the fetched messages...")
-			if err := svc.ApplyFilterActions(filter.Action, messages); err != nil {
-				logrus.Errorf("Failed to apply filter actions: %v", err)
-				continue
+			var pending []string
+			for _, msg := range messages {
+				if !state.IsProcessed(msg.Id) {
+					pending = append(pending, msg.Id)
+				}
 			}
-			logrus.Info("Filter actions applied successfully.")
+			logrus.Infof("Applying filter actions to %d messages (%d already processed)...",
+				len(pending), len(messages)-len(pending))
+
+			if err := svc.ApplyFilterActionsToPage(ctx, filter.Action, pending); err != nil {
+				saveRetroState(state, statePath)
+				return fmt.Errorf("failed to apply filter actions: %w", err)
+			}
+			for _, id := range pending {
+				state.MarkProcessed(id)
+			}
+
+			if next == "" {
+				saveRetroState(state, statePath)
+				break
+			}
+			state.NextPage(next)
+			saveRetroState(state, statePath)
 		}
+		logrus.Info("Filter actions applied successfully.")
+	}
+	return nil
+}
 
-		logrus.Info("Retro command completed.")
-	},
+// saveRetroState checkpoints the retro progress, logging rather than aborting on failure.
+func saveRetroState(state *internal.RetroState, statePath string) {
+	if err := state.Save(statePath); err != nil {
+		logrus.Warnf("Failed to save retro state: %v", err)
+	}
 }
@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestRunRetro(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "retro.state.json")
+
+	config := internal.NewConfig(
+		internal.Filters{
+			filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"}),
+			// Criteria that cannot be searched for are skipped
+			{Criteria: &gmail.FilterCriteria{Query: "from:(a"}, Action: &gmail.FilterAction{AddLabelIds: []string{"STARRED"}}},
+			filterFor("news@example.com", []string{"News"}, nil),
+		},
+		internal.Labels{{Name: "Receipts"}, {Name: "News"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatal(err)
+	}
+	ids := labelIds(t, svc)
+
+	order := fake.AddMessage(rawMessage("shop@example.com", "Order 1"), "INBOX")
+	invoice := fake.AddMessage(rawMessage("Shop <shop@example.com>", "Invoice"), "INBOX", "UNREAD")
+	news := fake.AddMessage(rawMessage("news@example.com", "Weekly"), "INBOX")
+	other := fake.AddMessage(rawMessage("friend@example.com", "Hi"), "INBOX")
+
+	// The fake rejects the unbalanced filter, so the filters are built directly
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters = slices.Insert(filters, 1, config.Filters[1])
+
+	state := internal.NewRetroState()
+	if err := runRetro(ctx, svc, filters, state, statePath); err != nil {
+		t.Fatalf("runRetro() error = %v", err)
+	}
+
+	want := map[string][]string{
+		order:   {ids["Receipts"]},
+		invoice: {"UNREAD", ids["Receipts"]},
+		news:    {"INBOX", ids["News"]},
+		other:   {"INBOX"},
+	}
+	for id, labels := range want {
+		got := fake.MessageLabels(id)
+		slices.Sort(got)
+		slices.Sort(labels)
+		if !slices.Equal(got, labels) {
+			t.Errorf("message %s labels = %v, want %v", id, got, labels)
+		}
+	}
+	if state.Applied != 3 {
+		t.Errorf("applied = %d, want 3", state.Applied)
+	}
+	if state.FilterIndex != len(filters) {
+		t.Errorf("filter index = %d, want %d", state.FilterIndex, len(filters))
+	}
+}
+
+// perMessageClient counts the requests that fetch or modify a single message.
+type perMessageClient struct {
+	internal.Client
+	gets, modifies int
+}
+
+func (c *perMessageClient) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	c.gets++
+	return c.Client.GetMessage(ctx, id, format)
+}
+
+func (c *perMessageClient) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	c.modifies++
+	return c.Client.ModifyMessage(ctx, id, req)
+}
+
+func TestRunRetroJournal(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	config := internal.NewConfig(
+		internal.Filters{filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"})},
+		internal.Labels{{Name: "Receipts"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatal(err)
+	}
+	receipts := labelIds(t, svc)["Receipts"]
+	inbox := fake.AddMessage(rawMessage("shop@example.com", "Order 1"), "INBOX")
+	archived := fake.AddMessage(rawMessage("shop@example.com", "Order 2"))
+	labeled := fake.AddMessage(rawMessage("shop@example.com", "Order 3"), "INBOX", receipts)
+	done := fake.AddMessage(rawMessage("shop@example.com", "Order 4"), receipts)
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &perMessageClient{Client: fake}
+	svc.Client = client
+	state := internal.NewRetroState()
+	journal := filepath.Join(dir, "journal.jsonl")
+	svc.Journal, err = internal.OpenJournal(journal, state.RunId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Journal.Close()
+
+	if err := runRetro(ctx, svc, filters, state, filepath.Join(dir, "retro.state.json")); err != nil {
+		t.Fatalf("runRetro() error = %v", err)
+	}
+	if client.gets != 0 || client.modifies != 0 {
+		t.Errorf("retro fetched %d and modified %d messages one by one, want batch requests only", client.gets, client.modifies)
+	}
+
+	// Only the labels that actually changed are journaled, so undo restores every message exactly
+	entries, err := internal.ReadJournal(journal, state.RunId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]internal.JournalEntry)
+	for _, e := range entries {
+		got[e.MessageId] = e
+	}
+	want := map[string]internal.JournalEntry{
+		inbox:    {Added: []string{receipts}, Removed: []string{"INBOX"}},
+		archived: {Added: []string{receipts}},
+		labeled:  {Removed: []string{"INBOX"}},
+	}
+	if len(got) != len(want) {
+		t.Errorf("journaled messages = %v, want %d", got, len(want))
+	}
+	for id, w := range want {
+		if !slices.Equal(got[id].Added, w.Added) || !slices.Equal(got[id].Removed, w.Removed) {
+			t.Errorf("journal of %s = +%v -%v, want +%v -%v", id, got[id].Added, got[id].Removed, w.Added, w.Removed)
+		}
+	}
+	if _, ok := got[done]; ok {
+		t.Errorf("unchanged message %s was journaled", done)
+	}
+}
+
+func TestRunRetroResume(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "retro.state.json")
+
+	config := internal.NewConfig(
+		internal.Filters{
+			filterFor("shop@example.com", []string{"Receipts"}, nil),
+			filterFor("news@example.com", []string{"News"}, nil),
+		},
+		internal.Labels{{Name: "Receipts"}, {Name: "News"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatal(err)
+	}
+	ids := labelIds(t, svc)
+	done := fake.AddMessage(rawMessage("news@example.com", "Weekly 1"), "INBOX")
+	pending := fake.AddMessage(rawMessage("news@example.com", "Weekly 2"), "INBOX")
+	skipped := fake.AddMessage(rawMessage("shop@example.com", "Order"), "INBOX")
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted run stopped on the second filter after processing one message
+	interruptedState := internal.NewRetroState()
+	interruptedState.NextFilter()
+	interruptedState.FilterId = filters[1].Id
+	interruptedState.MarkProcessed(done)
+	if err := interruptedState.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := internal.LoadRetroState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runRetro(ctx, svc, filters, state, statePath); err != nil {
+		t.Fatalf("runRetro() error = %v", err)
+	}
+
+	if got := fake.MessageLabels(pending); !slices.Contains(got, ids["News"]) {
+		t.Errorf("pending message labels = %v, want %s", got, ids["News"])
+	}
+	if got := fake.MessageLabels(done); slices.Contains(got, ids["News"]) {
+		t.Errorf("processed message was modified again: %v", got)
+	}
+	if got := fake.MessageLabels(skipped); slices.Contains(got, ids["Receipts"]) {
+		t.Errorf("message of a finished filter was modified: %v", got)
+	}
+	if state.Applied != 2 {
+		t.Errorf("applied = %d, want 2", state.Applied)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("state file was not saved: %v", err)
+	}
+}
+
+func TestRunRetroCancelled(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	statePath := filepath.Join(t.TempDir(), "retro.state.json")
+
+	if err := runPush(context.Background(), svc, internal.NewConfig(
+		internal.Filters{filterFor("shop@example.com", []string{"STARRED"}, nil)}, nil,
+	)); err != nil {
+		t.Fatal(err)
+	}
+	id := fake.AddMessage(rawMessage("shop@example.com", "Order"), "INBOX")
+	filters, err := svc.Filters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	state := internal.NewRetroState()
+	if err := runRetro(ctx, svc, filters, state, statePath); !interrupted(err) {
+		t.Fatalf("runRetro() error = %v, want an interruption", err)
+	}
+	if got := fake.MessageLabels(id); slices.Contains(got, "STARRED") {
+		t.Errorf("message was modified after cancellation: %v", got)
+	}
+
+	// The checkpoint lets the next run resume at the same filter
+	saved, err := internal.LoadRetroState(statePath)
+	if err != nil {
+		t.Fatalf("state was not saved: %v", err)
+	}
+	if saved.FilterIndex != 0 || saved.FilterId != filters[0].Id {
+		t.Errorf("saved state at filter %d (%s), want 0 (%s)", saved.FilterIndex, saved.FilterId, filters[0].Id)
+	}
+}
@@ -1,6 +1,17 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -8,6 +19,16 @@ import (
 var credentialsPath string
 var tokenPath string
 var cfgFile string
+var journalPath string
+var endpoint string
+var timeout time.Duration
+var logFormat string
+var recipients []string
+var identityPath string
+var encryptWithPassphrase bool
+
+// passphraseEnv is the environment variable holding the backup passphrase, kept off the command line.
+const passphraseEnv = "GMAIL_BACKUP_PASSPHRASE"
 
 func init() {
 	logrus.SetFormatter(&logrus.TextFormatter{
@@ -20,18 +41,102 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "", "config.yaml", "config file")
 	rootCmd.PersistentFlags().StringVarP(&credentialsPath, "credentials", "c", "credentials.json", "Path to the credentials JSON file")
 	rootCmd.PersistentFlags().StringVarP(&tokenPath, "token", "t", "token.json", "Path to the token JSON file")
+	rootCmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "Custom Gmail API endpoint, such as a local emulator")
+	_ = rootCmd.PersistentFlags().MarkHidden("endpoint")
+	rootCmd.PersistentFlags().StringVar(&journalPath, "journal", "journal.jsonl", "Path to the journal of label changes")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Maximum duration of the command, e.g. 30m (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringSliceVar(&recipients, "recipient", nil, "Encrypt backups to an age public key or a file of public keys (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&identityPath, "identity", "", "Decrypt backups with the keys of an age identity file")
+	rootCmd.PersistentFlags().BoolVar(&encryptWithPassphrase, "passphrase", false, "Encrypt backups with the passphrase in "+passphraseEnv)
+}
+
+// newService creates the Gmail service used by commands.
+// Tests replace it to run command logic against an in-memory gmailtest.FakeClient.
+var newService = func() (*internal.Service, error) {
+	if endpoint != "" {
+		return internal.NewService(credentialsPath, tokenPath, scopes, internal.WithEndpoint(endpoint))
+	}
+	return internal.NewService(credentialsPath, tokenPath, scopes)
+}
 
+// backupEncryption builds the keys backups are encrypted and decrypted with from the --recipient,
+// --identity and --passphrase flags and the passphrase environment variable.
+func backupEncryption() *internal.Encryption {
+	enc, err := internal.NewEncryption(recipients, identityPath, os.Getenv(passphraseEnv), encryptWithPassphrase)
+	if err != nil {
+		logrus.Fatalf("Invalid backup encryption settings: %v", err)
+	}
+	return enc
 }
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "gmail",
 	Short: "A brief description of your application",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		switch logFormat {
+		case "text":
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		default:
+			logrus.Fatalf("Unknown log format '%s'. Use text or json.", logFormat)
+		}
+
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			cancelTimeout = cancel
+			cmd.SetContext(ctx)
+		}
+	},
 }
 
+// cancelTimeout releases the context created for --timeout.
+var cancelTimeout context.CancelFunc = func() {}
+
+// Execute runs the root command with a context that is cancelled on the first SIGINT or SIGTERM.
+// Commands stop after their in-flight batch when the context is cancelled; a second signal exits immediately.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Warnf("Received %s, stopping after the in-flight batch. Press Ctrl-C again to exit immediately.", sig)
+		cancel()
+		<-signals
+		logrus.Warn("Exiting immediately.")
+		os.Exit(130)
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
 	if err != nil {
 		logrus.Fatalln(err)
 	}
 }
+
+// interrupted reports whether an error was caused by a signal or by the --timeout limit.
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// exitInterrupted logs a summary of an interrupted command and exits with status 130.
+func exitInterrupted(err error, format string, args ...interface{}) {
+	logrus.Warnf("Interrupted (%v). "+format, append([]interface{}{err}, args...)...)
+	os.Exit(130)
+}
+
+// stdin is shared by prompts, so answers piped in on several lines are read one by one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks a yes/no question on the terminal and reports whether the answer was yes.
+// Without an answer, for example when standard input is not a terminal, the answer is no.
+func confirm(format string, args ...interface{}) bool {
+	fmt.Fprintf(os.Stderr, format+" [y/N] ", args...)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
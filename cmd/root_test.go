@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+// useFakeClient makes newService return a service backed by a new in-memory FakeClient for the
+// rest of the test, and removes the delay push waits for labels to propagate.
+func useFakeClient(t *testing.T) (*gmailtest.FakeClient, *internal.Service) {
+	t.Helper()
+	fake := gmailtest.NewFakeClient()
+	restoreService, restoreDelay := newService, labelPropagationDelay
+	newService = func() (*internal.Service, error) {
+		return internal.NewServiceWithClient(fake), nil
+	}
+	labelPropagationDelay = 0
+	t.Cleanup(func() {
+		newService, labelPropagationDelay = restoreService, restoreDelay
+	})
+
+	svc, err := newService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, svc
+}
+
+// rawMessage builds a minimal RFC 822 message from a sender with a subject.
+func rawMessage(from, subject string) []byte {
+	return []byte("From: " + from + "\r\nTo: me@example.com\r\nSubject: " + subject +
+		"\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\nContent-Type: text/plain\r\n\r\nHello\r\n")
+}
+
+// labelIds returns the IDs of the labels of a fake mailbox by name.
+func labelIds(t *testing.T, svc *internal.Service) map[string]string {
+	t.Helper()
+	labels, err := svc.Labels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string)
+	for _, l := range labels {
+		ids[l.Name] = l.Id
+	}
+	return ids
+}
+
+// filterFor builds a filter on a sender that adds and removes labels by name or ID.
+func filterFor(from string, add, remove []string) *gmail.Filter {
+	return &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{From: from},
+		Action:   &gmail.FilterAction{AddLabelIds: add, RemoveLabelIds: remove},
+	}
+}
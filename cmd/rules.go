@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rulesQuery  string
+	rulesDryRun bool
+)
+
+func init() {
+	rootCmd.AddCommand(rulesCmd)
+	rulesCmd.AddCommand(rulesRunCmd)
+
+	rulesRunCmd.Flags().StringVar(&rulesQuery, "query", "in:inbox", "Gmail search query selecting the messages to process")
+	rulesRunCmd.Flags().BoolVar(&rulesDryRun, "dry-run", false, "Log the actions without applying them")
+}
+
+// rulesCmd represents the rules command
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Work with the advanced rules of the configuration",
+	Long: `Rules are defined in the rules section of the configuration and evaluated locally by the tool,
+so they can match what Gmail filters cannot: regular expressions over arbitrary headers, the body
+and attachment names, and the age of a message. Matching messages can be labeled, archived,
+marked as read, starred, trashed or forwarded as a draft.`,
+}
+
+// rulesRunCmd represents the rules run command
+var rulesRunCmd = &cobra.Command{
+	Use:   "run [config.yaml]",
+	Short: "Apply the configured rules to existing messages",
+	Long: `The rules run command applies the rules of a configuration file to the messages matching --query.
+Label changes are journaled and can be reverted with the undo command. Use --dry-run to see which
+rules match without changing anything. To apply rules to new mail as it arrives, use watch --rules.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'rules run' command...")
+		ctx := cmd.Context()
+
+		configPath := cfgFile
+		if len(args) > 0 {
+			configPath = args[0]
+		}
+
+		// Step 1: Load Configuration
+		logrus.Infof("Loading configuration from file: %s", configPath)
+		config, err := internal.NewConfigFromYAML(configPath, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %v", err)
+		}
+		if len(config.Rules) == 0 {
+			logrus.Fatalf("No rules defined in %s.", configPath)
+		}
+		logrus.Infof("Loaded %d rules.", len(config.Rules))
+
+		// Step 2: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		runId := internal.NewRunId()
+		if !rulesDryRun {
+			svc.Journal, err = internal.OpenJournal(journalPath, runId)
+			if err != nil {
+				logrus.Fatalf("Failed to open journal: %v", err)
+			}
+			defer svc.Journal.Close()
+		}
+
+		// Step 3: Apply Rules
+		labelNames, err := svc.LabelNames(ctx)
+		if err != nil {
+			logrus.Fatalf("Failed to fetch Gmail labels: %v", err)
+		}
+		runner := internal.NewRuleRunner(svc, config.Rules, rulesDryRun)
+		var processed, failed int
+		var pageToken string
+		for {
+			page, next, err := svc.MessagesPage(ctx, rulesQuery, pageToken)
+			if interrupted(err) {
+				exitInterrupted(err, "Processed %d messages before stopping. Run ID: %s", processed, runId)
+			}
+			if err != nil {
+				logrus.Fatalf("Failed to fetch messages: %v", err)
+			}
+
+			for _, ref := range page {
+				msg, err := svc.Client.GetMessage(ctx, ref.Id, "full")
+				if err == nil {
+					var local *internal.LocalMessage
+					local, err = internal.ParseGmailMessage(msg, labelNames)
+					if err == nil {
+						err = runner.Process(ctx, svc, msg, local)
+					}
+				}
+				if interrupted(err) {
+					exitInterrupted(err, "Processed %d messages before stopping. Run ID: %s", processed, runId)
+				}
+				if err != nil {
+					logrus.Errorf("Failed to process message %s: %v", ref.Id, err)
+					failed++
+					continue
+				}
+				processed++
+			}
+
+			if next == "" {
+				break
+			}
+			pageToken = next
+		}
+
+		if rulesDryRun {
+			logrus.Infof("Rules run completed (dry run). Evaluated %d messages.", processed)
+			return
+		}
+		logrus.Infof("Rules run completed. Processed %d messages, %d failed. Run ID: %s", processed, failed, runId)
+	},
+}
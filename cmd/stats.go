@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsQuery  string
+	statsMax    int64
+	statsTop    int
+	statsFormat string
+
+	// statsOutput is where the report is written.
+	statsOutput io.Writer = os.Stdout
+)
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringVar(&statsQuery, "query", "newer_than:30d", "Gmail search query selecting the messages to analyze")
+	statsCmd.Flags().Int64Var(&statsMax, "max", 1000, "Maximum number of messages to analyze")
+	statsCmd.Flags().IntVar(&statsTop, "top", 10, "Number of senders, domains and threads to list")
+	statsCmd.Flags().StringVar(&statsFormat, "format", "table", "Output format: table, csv or json")
+}
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Report mailbox analytics over a query window",
+	Long: `The stats command analyzes the messages matching --query and reports the top senders and sender
+domains, message volume per week, message and unread counts per label, and the largest threads.
+Only message metadata is fetched. The report is written to standard output as a table, CSV or JSON.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'stats' command...")
+		ctx := cmd.Context()
+
+		var write func(s *internal.MailboxStats) error
+		switch statsFormat {
+		case "table":
+			write = func(s *internal.MailboxStats) error { return s.WriteTable(statsOutput) }
+		case "csv":
+			write = func(s *internal.MailboxStats) error { return s.WriteCSV(statsOutput) }
+		case "json":
+			write = func(s *internal.MailboxStats) error { return s.WriteJSON(statsOutput) }
+		default:
+			logrus.Fatalf("Unknown format '%s'. Use table, csv or json.", statsFormat)
+		}
+
+		// Step 1: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 2: Fetch Labels
+		labelNames, err := svc.LabelNames(ctx)
+		if err != nil {
+			logrus.Fatalf("Failed to fetch Gmail labels: %v", err)
+		}
+
+		// Step 3: Fetch Message Metadata
+		messages, err := svc.MessagesWithFormat(ctx, statsMax, statsQuery, "metadata")
+		if interrupted(err) {
+			exitInterrupted(err, "No report was written.")
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to fetch messages: %v", err)
+		}
+
+		// Step 4: Compute and Write Report
+		stats := internal.ComputeStats(messages, labelNames, statsTop)
+		if err := write(stats); err != nil {
+			logrus.Fatalf("Failed to write report: %v", err)
+		}
+
+		logrus.Info("Stats command completed.")
+	},
+}
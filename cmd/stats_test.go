@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+)
+
+// captureStats collects the stats report for the rest of the test.
+func captureStats(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	restore := statsOutput
+	statsOutput = &buf
+	t.Cleanup(func() { statsOutput = restore })
+	return &buf
+}
+
+func TestStatsFormats(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	fake.AddMessage(rawMessage("alice@example.com", "Invoice"), "INBOX", "UNREAD")
+	fake.AddMessage(rawMessage("alice@example.com", "Receipt"), "INBOX")
+	fake.AddMessage(rawMessage("bob@example.org", "Hello"), "INBOX")
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"table", []string{"Messages:  3 (1 unread)", "alice@example.com  2", "INBOX   3         1"}},
+		{"csv", []string{"total,,3,1,", "sender,alice@example.com,2,,", "domain,example.org,1,,", "label,INBOX,3,1,"}},
+		{"json", []string{`"messages": 3`, `"key": "alice@example.com"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			output := captureStats(t)
+			execute(t, "stats", "--query", "", "--format", tt.format)
+			for _, want := range tt.want {
+				if !strings.Contains(output.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, output.String())
+				}
+			}
+		})
+	}
+}
+
+func TestStatsQueryAndTop(t *testing.T) {
+	fake, _ := useFakeClient(t)
+	fake.AddMessage(rawMessage("alice@example.com", "Invoice"), "INBOX")
+	fake.AddMessage(rawMessage("alice@example.com", "Receipt"), "INBOX")
+	fake.AddMessage(rawMessage("bob@example.org", "Hello"), "INBOX")
+	fake.AddMessage(rawMessage("carol@example.net", "Hi"), "INBOX")
+	fake.AddMessage(rawMessage("spam@example.com", "Win"), "SPAM")
+
+	output := captureStats(t)
+	execute(t, "stats", "--query", "-from:carol@example.net", "--top", "1", "--format", "json")
+
+	var stats internal.MailboxStats
+	if err := json.Unmarshal(output.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 3 {
+		t.Errorf("messages = %d, want 3 matching the query outside spam", stats.Messages)
+	}
+	if len(stats.TopSenders) != 1 || stats.TopSenders[0] != (internal.StatCount{Key: "alice@example.com", Count: 2}) {
+		t.Errorf("top senders = %+v, want only alice@example.com with 2", stats.TopSenders)
+	}
+}
+
+func TestStatsUnknownFormat(t *testing.T) {
+	useFakeClient(t)
+	output := captureStats(t)
+	if code := executeStatus(t, "stats", "--format", "xml"); code == 0 {
+		t.Error("stats --format xml exited with status 0")
+	}
+	if output.Len() != 0 {
+		t.Errorf("report written for an unknown format:\n%s", output.String())
+	}
+}
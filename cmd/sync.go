@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	syncStatePath string
+	syncFull      bool
+	syncQuery     string
+)
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringVar(&syncStatePath, "state", "sync.state.json", "Path to the sync state file")
+	syncCmd.Flags().BoolVar(&syncFull, "full", false, "Ignore the stored history ID and scan the whole mailbox")
+	syncCmd.Flags().StringVar(&syncQuery, "query", "", "Gmail search query limiting the messages of a full scan")
+}
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Fetch the messages changed since the last sync",
+	Long: `The sync command stores the mailbox's last history ID in a state file and uses the Gmail History API
+to list only the messages added, relabeled or deleted since the previous run. When there is no state
+yet, or Gmail no longer keeps history that old, it falls back to a full scan of the mailbox.
+
+The state file records the account it belongs to. A state file of another account is refused;
+use a separate --state file per account, or --full to start over.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'sync' command...")
+		ctx := cmd.Context()
+
+		// Step 1: Load State
+		state := &internal.SyncState{}
+		if !syncFull {
+			var err error
+			state, err = internal.LoadSyncState(syncStatePath)
+			if err != nil {
+				logrus.Fatalf("Failed to load sync state: %v", err)
+			}
+		}
+
+		// Step 2: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+		if err := svc.CheckAccount(ctx, state); err != nil {
+			logrus.Fatalf("Cannot use sync state %s: %v. Use another --state file, or --full to start over.", syncStatePath, err)
+		}
+
+		// Step 3: Sync
+		result, err := svc.Sync(ctx, state, syncQuery)
+		if interrupted(err) {
+			exitInterrupted(err, "Sync interrupted; the state file was left unchanged.")
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to sync mailbox: %v", err)
+		}
+		for _, id := range result.Added {
+			logrus.Infof("  added: %s", id)
+		}
+		for _, id := range result.Relabeled {
+			logrus.Infof("  relabeled: %s", id)
+		}
+		for _, id := range result.Deleted {
+			logrus.Infof("  deleted: %s", id)
+		}
+
+		// Step 4: Save State
+		if err := state.Save(syncStatePath); err != nil {
+			logrus.Fatalf("Failed to save sync state: %v", err)
+		}
+
+		logrus.Infof("Sync command completed. History ID: %d", result.HistoryId)
+	},
+}
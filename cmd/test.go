@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var testMessages []string
+
+func init() {
+	rootCmd.AddCommand(testCmd)
+
+	testCmd.Flags().StringSliceVar(&testMessages, "messages", nil, "Paths or glob patterns of .eml files to evaluate")
+}
+
+// testCmd represents the test command
+var testCmd = &cobra.Command{
+	Use:   "test [config.yaml] [--messages ./fixtures/*.eml]",
+	Short: "Evaluate configured filters against local .eml files",
+	Long: `The test command evaluates the filters of a configuration file against local .eml files
+without contacting Gmail. For every message it prints the filters that match and the labels the
+message ends up with, followed by the rules it matches. Messages start out with the INBOX and
+UNREAD labels. Like in Gmail, search terms match whole words: "sale" does not match "wholesale",
+and from:ann matches ann@example.com or "Ann Lee", but not joann@example.com.
+
+Arguments after the configuration file are treated as additional message files, so shell
+expanded globs work as well as quoted patterns passed to --messages.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'test' command...")
+
+		configPath := cfgFile
+		if len(args) > 0 {
+			configPath = args[0]
+			testMessages = append(testMessages, args[1:]...)
+		}
+
+		// Step 1: Load Configuration
+		logrus.Infof("Loading configuration from file: %s", configPath)
+		config, err := internal.NewConfigFromYAML(configPath, backupEncryption())
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %v", err)
+		}
+
+		// Step 2: Resolve Message Files
+		var paths []string
+		for _, pattern := range testMessages {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				logrus.Fatalf("Invalid message pattern '%s': %v", pattern, err)
+			}
+			if len(matches) == 0 {
+				logrus.Warnf("No message files match '%s'.", pattern)
+			}
+			paths = append(paths, matches...)
+		}
+		if len(paths) == 0 {
+			logrus.Fatal("No message files to evaluate. Use --messages to specify .eml files.")
+		}
+		logrus.Infof("Evaluating %d filters against %d messages...", len(config.Filters), len(paths))
+
+		// Step 3: Evaluate Filters
+		for _, path := range paths {
+			msg, err := internal.LoadEML(path)
+			if err != nil {
+				logrus.Errorf("Failed to load message: %v", err)
+				continue
+			}
+
+			result := internal.EvaluateFilters(config.Filters, msg)
+			logrus.Infof("%s (from: %s, subject: %s)", path, msg.From, msg.Subject)
+			if len(result.Matched) == 0 {
+				logrus.Info("  no filters match")
+			}
+			for _, i := range result.Matched {
+				logrus.Infof("  matches filter #%d: %s", i+1, internal.DescribeFilter(config.Filters[i].Criteria))
+			}
+			logrus.Infof("  labels: %s", strings.Join(result.Labels, ", "))
+			for _, rule := range internal.EvaluateRules(config.Rules, msg) {
+				logrus.Infof("  matches rule %s", rule.Name)
+			}
+		}
+
+		logrus.Info("Test command completed.")
+	},
+}
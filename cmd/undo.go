@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(undoCmd)
+}
+
+// undoCmd represents the undo command
+var undoCmd = &cobra.Command{
+	Use:   "undo <run-id>",
+	Short: "Revert the label changes made by a previous run",
+	Long: `The undo command reads the journal entries recorded for a run and applies the inverse
+label changes in batches. The undo itself is journaled under a new run ID, so it can be undone too.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'undo' command...")
+		ctx := cmd.Context()
+		runId := args[0]
+
+		// Step 1: Read Journal
+		logrus.Infof("Reading journal entries for run %s from %s...", runId, journalPath)
+		entries, err := internal.ReadJournal(journalPath, runId)
+		if err != nil {
+			logrus.Fatalf("Failed to read journal: %v", err)
+		}
+		if len(entries) == 0 {
+			logrus.Warnf("No journal entries found for run %s. Nothing to undo.", runId)
+			return
+		}
+
+		// Step 2: Compute Inverse Changes
+		changes := internal.InverseChanges(entries)
+		logrus.Infof("Computed %d inverse label changes from %d journal entries.", len(changes), len(entries))
+
+		// Step 3: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		undoRunId := internal.NewRunId()
+		svc.Journal, err = internal.OpenJournal(journalPath, undoRunId)
+		if err != nil {
+			logrus.Fatalf("Failed to open journal: %v", err)
+		}
+		defer svc.Journal.Close()
+
+		// Step 4: Apply Inverse Changes
+		var reverted int
+		for _, change := range changes {
+			err := svc.BatchModifyMessages(ctx, change.MessageIds, change.AddLabelIds, change.RemoveLabelIds)
+			if interrupted(err) {
+				exitInterrupted(err, "Reverted %d messages before stopping. The partial undo is journaled as run %s.", reverted, undoRunId)
+			}
+			if err != nil {
+				logrus.Fatalf("Failed to revert changes on %d messages after reverting %d: %v", len(change.MessageIds), reverted, err)
+			}
+			reverted += len(change.MessageIds)
+		}
+
+		logrus.Infof("Undo command completed. Run ID: %s", undoRunId)
+	},
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	unsubscribeQuery       string
+	unsubscribeMax         int64
+	unsubscribeSenders     []string
+	unsubscribeYes         bool
+	unsubscribeDryRun      bool
+	unsubscribeTrashFilter bool
+	unsubscribeRecord      string
+)
+
+func init() {
+	rootCmd.AddCommand(unsubscribeCmd)
+
+	unsubscribeCmd.Flags().StringVar(&unsubscribeQuery, "query", "category:promotions", "Gmail search query selecting the messages to look at")
+	unsubscribeCmd.Flags().Int64Var(&unsubscribeMax, "max", 500, "Maximum number of messages to look at")
+	unsubscribeCmd.Flags().StringSliceVar(&unsubscribeSenders, "sender", nil, "Only unsubscribe from these sender addresses")
+	unsubscribeCmd.Flags().BoolVarP(&unsubscribeYes, "yes", "y", false, "Unsubscribe without asking for each sender")
+	unsubscribeCmd.Flags().BoolVar(&unsubscribeDryRun, "dry-run", false, "List the senders and their unsubscribe methods without unsubscribing")
+	unsubscribeCmd.Flags().BoolVar(&unsubscribeTrashFilter, "trash-filter", false, "Also create a filter sending future mail from the sender to the trash")
+	unsubscribeCmd.Flags().StringVar(&unsubscribeRecord, "record", "unsubscribe.jsonl", "Path to the record of unsubscribe actions")
+}
+
+// unsubscribeClient sends one-click unsubscribe requests. Tests replace it to trust a local TLS server.
+var unsubscribeClient = &http.Client{Timeout: 30 * time.Second}
+
+// unsubscribeCmd represents the unsubscribe command
+var unsubscribeCmd = &cobra.Command{
+	Use:   "unsubscribe",
+	Short: "Unsubscribe from mailing lists in bulk",
+	Long: `The unsubscribe command groups the messages matching --query by sender and reads the List-Unsubscribe
+and List-Unsubscribe-Post headers of each sender's latest message. For every sender it asks whether
+to unsubscribe, unless --yes is given, and then sends an RFC 8058 one-click request or, when the
+sender only accepts email, creates a draft of the unsubscribe request for you to send. Senders that
+only offer an unsubscribe page are listed with its URL.
+
+With --trash-filter, a filter sending the sender's future mail to the trash is created after
+unsubscribing. When unsubscribing fails, the filter is only created if you confirm it; with --yes
+it is skipped, so mail you may still want is never trashed unattended.
+
+Every action is appended to a record file (--record), including failures.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'unsubscribe' command...")
+		ctx := cmd.Context()
+
+		// Step 1: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+
+		// Step 2: Find Subscriptions
+		messages, err := svc.MessagesWithFormat(ctx, unsubscribeMax, unsubscribeQuery, "metadata")
+		if interrupted(err) {
+			exitInterrupted(err, "Nothing was changed.")
+		}
+		if err != nil {
+			logrus.Fatalf("Failed to fetch messages: %v", err)
+		}
+
+		var subscriptions []*internal.Subscription
+		for _, sub := range internal.GroupSubscriptions(messages) {
+			if len(unsubscribeSenders) > 0 && !containsFold(unsubscribeSenders, sub.Sender) {
+				continue
+			}
+			subscriptions = append(subscriptions, sub)
+		}
+		logrus.Infof("Found %d senders with unsubscribe links.", len(subscriptions))
+		for _, sub := range subscriptions {
+			method := "web page only: " + sub.WebURL
+			switch {
+			case sub.OneClickURL != "":
+				method = "one-click"
+			case sub.MailTo != "":
+				method = "email"
+			}
+			logrus.Infof("  %s: %d messages (%s), latest: %s", sub.Sender, sub.Messages, method, sub.LatestSubject)
+		}
+		if unsubscribeDryRun {
+			logrus.Info("Unsubscribe command completed (dry run).")
+			return
+		}
+
+		// Step 3: Unsubscribe
+		var unsubscribed, failed int
+		for _, sub := range subscriptions {
+			if err := ctx.Err(); err != nil {
+				exitInterrupted(err, "Unsubscribed from %d senders before stopping.", unsubscribed)
+			}
+			if !unsubscribeYes && !confirm("Unsubscribe from %s (%d messages)?", sub.Sender, sub.Messages) {
+				continue
+			}
+
+			record, err := svc.Unsubscribe(ctx, sub, unsubscribeClient)
+			trashFilter := unsubscribeTrashFilter
+			if err != nil {
+				logrus.Errorf("Failed to unsubscribe from %s: %v", sub.Sender, err)
+				record.Error = err.Error()
+				failed++
+				if trashFilter && (unsubscribeYes || !confirm("Unsubscribing from %s failed. Send its future mail to the trash anyway?", sub.Sender)) {
+					logrus.Warnf("Not creating a trash filter for %s since unsubscribing failed.", sub.Sender)
+					trashFilter = false
+				}
+			} else {
+				unsubscribed++
+			}
+
+			if trashFilter {
+				filter, err := svc.Client.CreateFilter(ctx, internal.TrashFilter(sub.Sender))
+				if err != nil {
+					logrus.Errorf("Failed to create trash filter for %s: %v", sub.Sender, err)
+				} else {
+					record.FilterId = filter.Id
+					logrus.Infof("Created filter %s sending mail from %s to the trash", filter.Id, sub.Sender)
+				}
+			}
+
+			if err := internal.AppendUnsubscribeRecord(unsubscribeRecord, record); err != nil {
+				logrus.Errorf("Failed to record unsubscribe action: %v", err)
+			}
+		}
+
+		logrus.Infof("Unsubscribe command completed. Unsubscribed from %d senders, %d failed. Actions recorded in %s.",
+			unsubscribed, failed, unsubscribeRecord)
+	},
+}
+
+// containsFold reports whether a list contains a value, ignoring case.
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
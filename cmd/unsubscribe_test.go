@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+)
+
+// listMail builds a list message from a sender with a List-Unsubscribe header.
+func listMail(from, unsubscribe, post string) []byte {
+	raw := "From: " + from + "\r\nTo: me@example.com\r\nSubject: News\r\nList-Unsubscribe: " + unsubscribe + "\r\n"
+	if post != "" {
+		raw += "List-Unsubscribe-Post: " + post + "\r\n"
+	}
+	return []byte(raw + "\r\nHello\r\n")
+}
+
+func TestUnsubscribeTrashFilter(t *testing.T) {
+	emulator, svc := useEmulator(t)
+	server := gmailtest.NewUnsubscribeServer()
+	defer server.Close()
+	restoreClient := unsubscribeClient
+	unsubscribeClient = server.Client()
+	t.Cleanup(func() { unsubscribeClient = restoreClient })
+
+	emulator.Fake.AddMessage(listMail("news@example.com", "<"+server.URL+"/u/news>", "List-Unsubscribe=One-Click"), "INBOX")
+	emulator.Fake.AddMessage(listMail("shop@example.com", "<https://shop.example.com/preferences>", ""), "INBOX")
+	record := filepath.Join(t.TempDir(), "unsubscribe.jsonl")
+
+	execute(t, "unsubscribe", "--query", "in:inbox", "--yes", "--trash-filter", "--record", record)
+
+	// The trash filter is only created for the sender that was unsubscribed from
+	filters, err := svc.Filters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 || filters[0].Criteria.From != "news@example.com" || filters[0].Action.AddLabelIds[0] != "TRASH" {
+		t.Fatalf("filters = %+v, want one trash filter for news@example.com", filters)
+	}
+	if got := server.Requests(); len(got) != 1 || got[0] != "/u/news" {
+		t.Errorf("unsubscribe server received %v, want [/u/news]", got)
+	}
+
+	file, err := os.Open(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records := make(map[string]*internal.UnsubscribeRecord)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r := &internal.UnsubscribeRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		records[r.Sender] = r
+	}
+	if r := records["news@example.com"]; r == nil || r.Error != "" || r.FilterId != filters[0].Id {
+		t.Errorf("news record = %+v, want a success with filter %s", r, filters[0].Id)
+	}
+	if r := records["shop@example.com"]; r == nil || r.Error == "" || r.FilterId != "" {
+		t.Errorf("shop record = %+v, want a failure without filter", r)
+	}
+}
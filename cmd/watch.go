@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	watchStatePath    string
+	watchInterval     time.Duration
+	watchMaxBackoff   time.Duration
+	watchQuery        string
+	watchHealthListen string
+	watchLabel        string
+	watchExec         string
+	watchTopic        string
+	watchPushListen   string
+	watchPushToken    string
+	watchPushAudience string
+	watchPushAccount  string
+	watchSubscription string
+	watchLabelIds     []string
+	watchRules        bool
+)
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().StringVar(&watchStatePath, "state", "watch.state.json", "Path to the watch state file")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", time.Minute, "Time between polls of the mailbox history")
+	watchCmd.Flags().DurationVar(&watchMaxBackoff, "max-backoff", 15*time.Minute, "Maximum time between polls after repeated errors")
+	watchCmd.Flags().StringVar(&watchQuery, "query", "in:inbox", "Gmail search query new messages must match to be processed")
+	watchCmd.Flags().StringVar(&watchHealthListen, "health-listen", "", "Address to serve the /healthz endpoint on, e.g. 127.0.0.1:8080")
+	watchCmd.Flags().StringVar(&watchLabel, "label", "", "Label to add to every new message, created if missing")
+	watchCmd.Flags().BoolVar(&watchRules, "rules", false, "Apply the rules of the configuration file (--config) to every new message")
+	watchCmd.Flags().StringVar(&watchExec, "exec", "", "Command to run for every new message, with GMAIL_MESSAGE_ID, GMAIL_FROM, GMAIL_SUBJECT and GMAIL_LABELS set")
+	watchCmd.Flags().StringVar(&watchTopic, "topic", "", "Pub/Sub topic to publish mailbox changes to, e.g. projects/my-project/topics/gmail")
+	watchCmd.Flags().StringVar(&watchPushListen, "push-listen", "", "Address to receive Pub/Sub push deliveries on at /push, e.g. 0.0.0.0:8081")
+	watchCmd.Flags().StringVar(&watchPushToken, "push-token", "", "Secret the push endpoint URL must carry as ?token=")
+	watchCmd.Flags().StringVar(&watchPushAudience, "push-audience", "", "Audience of the OIDC token of an authenticated push subscription")
+	watchCmd.Flags().StringVar(&watchPushAccount, "push-service-account", "", "Service account email an authenticated push subscription signs its OIDC token as")
+	watchCmd.Flags().StringVar(&watchSubscription, "subscription", "", "Full name of the push subscription deliveries must come from")
+	watchCmd.Flags().StringSliceVar(&watchLabelIds, "watch-labels", nil, "Label IDs whose changes are published to the topic (default all)")
+}
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Continuously process new messages as they arrive",
+	Long: `The watch command runs until it is stopped, polling the Gmail History API for new messages and
+processing each one that matches --query: every message is logged, and can be labeled with --label,
+run through the configured rules with --rules, or passed to a notification command with --exec.
+
+The position in the mailbox history is kept in a state file, so a restarted watcher continues where
+it stopped. A state file of another account is refused. Failed polls are retried with exponential
+backoff. With --health-listen, the watcher serves its status on /healthz, answering 503 after
+repeated failures. Combine with --log-format json to run it as a systemd service.
+
+For near-real-time processing, pass a Pub/Sub --topic and --push-listen. The watcher registers a
+Gmail watch on the topic, renews it before its 7-day expiry, and polls as soon as a push delivery
+arrives on /push. Polling at --interval continues as a fallback for lost deliveries.
+
+Deliveries are authenticated by the OIDC token of an authenticated push subscription: pass the
+subscription's --push-audience and --push-service-account, and the token's signature, audience and
+account are verified. Alternatively, configure the push endpoint as
+https://<host>/push?token=<push-token> and pass --push-token. Authenticated deliveries that are
+malformed or for another subscription or mailbox are acknowledged and dropped, so Pub/Sub does not
+redeliver them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.Info("Starting the 'watch' command...")
+		ctx := cmd.Context()
+
+		// Step 1: Parse Query and Rules
+		var query internal.QueryNode
+		if watchQuery != "" {
+			var err error
+			query, err = internal.ParseQuery(watchQuery)
+			if err != nil {
+				logrus.Fatalf("Invalid watch query: %v", err)
+			}
+		}
+
+		var rules internal.Rules
+		if watchRules {
+			config, err := internal.NewConfigFromYAML(cfgFile, backupEncryption())
+			if err != nil {
+				logrus.Fatalf("Failed to load configuration: %v", err)
+			}
+			if len(config.Rules) == 0 {
+				logrus.Fatalf("No rules defined in %s.", cfgFile)
+			}
+			rules = config.Rules
+		}
+
+		// Step 2: Load State
+		state, err := internal.LoadSyncState(watchStatePath)
+		if err != nil {
+			logrus.Fatalf("Failed to load watch state: %v", err)
+		}
+
+		// Step 3: Initialize Gmail Service
+		logrus.Info("Initializing Gmail service...")
+		svc, err := newService()
+		if err != nil {
+			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
+		}
+		if err := svc.CheckAccount(ctx, state); err != nil {
+			logrus.Fatalf("Cannot use watch state %s: %v. Use another --state file for this account.", watchStatePath, err)
+		}
+
+		runId := internal.NewRunId()
+		svc.Journal, err = internal.OpenJournal(journalPath, runId)
+		if err != nil {
+			logrus.Fatalf("Failed to open journal: %v", err)
+		}
+		defer svc.Journal.Close()
+		logrus.Infof("Label changes are journaled as run %s.", runId)
+
+		// Step 4: Set Up Processors
+		watcher := internal.NewWatcher(svc, state, watchStatePath, watchInterval, watchMaxBackoff)
+		watcher.Query = query
+		watcher.Processors = append(watcher.Processors, logMessage)
+		if watchLabel != "" {
+			labelId, err := svc.EnsureLabel(ctx, watchLabel)
+			if err != nil {
+				logrus.Fatalf("Failed to prepare label %s: %v", watchLabel, err)
+			}
+			watcher.Processors = append(watcher.Processors, addLabel(labelId))
+		}
+		if rules != nil {
+			watcher.Processors = append(watcher.Processors, internal.NewRuleRunner(svc, rules, false).Process)
+		}
+		if watchExec != "" {
+			watcher.Processors = append(watcher.Processors, execCommand(watchExec))
+		}
+
+		// Step 5: Register Push Notifications
+		if (watchTopic == "") != (watchPushListen == "") {
+			logrus.Fatal("Push notifications need both --topic and --push-listen.")
+		}
+		if watchPushAccount != "" && watchPushAudience == "" {
+			logrus.Fatal("--push-service-account needs the --push-audience of the push subscription.")
+		}
+		if watchPushListen != "" && watchPushToken == "" && watchPushAccount == "" {
+			logrus.Warn("Neither --push-service-account nor --push-token set; the push endpoint accepts deliveries from anyone who can reach it.")
+		}
+		if watchTopic != "" {
+			res, err := svc.StartWatch(ctx, watchTopic, watchLabelIds)
+			if err != nil {
+				logrus.Fatalf("Failed to register the Gmail watch: %v", err)
+			}
+			go func() { _ = svc.KeepWatching(ctx, watchTopic, watchLabelIds, res) }()
+			defer func() { _ = svc.StopWatch(context.WithoutCancel(ctx)) }()
+		}
+
+		// Step 6: Serve Endpoints
+		muxes := make(map[string]*http.ServeMux)
+		handle := func(addr, pattern string, handler http.Handler) {
+			if muxes[addr] == nil {
+				muxes[addr] = http.NewServeMux()
+			}
+			muxes[addr].Handle(pattern, handler)
+			logrus.Infof("Serving %s on http://%s%s", pattern, addr, pattern)
+		}
+		if watchHealthListen != "" {
+			handle(watchHealthListen, "/healthz", watcher)
+		}
+		if watchPushListen != "" {
+			handle(watchPushListen, "/push", &internal.PushReceiver{
+				Token:          watchPushToken,
+				Audience:       watchPushAudience,
+				ServiceAccount: watchPushAccount,
+				Subscription:   watchSubscription,
+				EmailAddress:   state.EmailAddress,
+				OnNotify: func(n internal.PushNotification) {
+					if n.HistoryId > watcher.Status().HistoryId {
+						watcher.Trigger()
+					}
+				},
+			})
+		}
+		for addr, mux := range muxes {
+			server := &http.Server{Addr: addr, Handler: mux}
+			go func() {
+				<-ctx.Done()
+				_ = server.Close()
+			}()
+			go func() {
+				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					logrus.Fatalf("Server on %s stopped: %v", addr, err)
+				}
+			}()
+		}
+
+		// Step 7: Watch
+		err = watcher.Run(ctx)
+		status := watcher.Status()
+		if interrupted(err) {
+			logrus.Infof("Watch command stopped after processing %d messages. History ID: %d", status.Processed, status.HistoryId)
+			return
+		}
+		if err != nil {
+			logrus.Fatalf("Watch stopped: %v", err)
+		}
+	},
+}
+
+// logMessage logs every new message.
+func logMessage(ctx context.Context, svc *internal.Service, msg *gmail.Message, local *internal.LocalMessage) error {
+	logrus.WithFields(logrus.Fields{
+		"message_id": msg.Id,
+		"from":       local.From,
+		"subject":    local.Subject,
+	}).Info("New message")
+	return nil
+}
+
+// addLabel returns a processor that adds a label to every new message.
+func addLabel(labelId string) internal.MessageProcessor {
+	return func(ctx context.Context, svc *internal.Service, msg *gmail.Message, local *internal.LocalMessage) error {
+		action := &gmail.FilterAction{AddLabelIds: []string{labelId}}
+		return svc.ApplyFilterActions(ctx, action, internal.Messages{msg})
+	}
+}
+
+// execCommand returns a processor that runs a shell command for every new message.
+func execCommand(command string) internal.MessageProcessor {
+	return func(ctx context.Context, svc *internal.Service, msg *gmail.Message, local *internal.LocalMessage) error {
+		c := exec.CommandContext(ctx, "sh", "-c", command)
+		c.Env = append(os.Environ(),
+			"GMAIL_MESSAGE_ID="+msg.Id,
+			"GMAIL_FROM="+local.From,
+			"GMAIL_SUBJECT="+local.Subject,
+			"GMAIL_LABELS="+strings.Join(msg.LabelIds, ","),
+		)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		return c.Run()
+	}
+}
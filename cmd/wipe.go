@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"github.com/ryanparsa/gmail/internal"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -18,57 +20,73 @@ var wipeCmd = &cobra.Command{
 It ensures a clean slate by removing user-defined filters and labels.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Info("Starting the 'wipe' command...")
+		ctx := cmd.Context()
 
 		// Step 1: Initialize Gmail Service
 		logrus.Info("Initializing Gmail service...")
-		svc, err := internal.NewService(credentialsPath, tokenPath, scopes)
+		svc, err := newService()
 		if err != nil {
 			logrus.Fatalf("Failed to initialize Gmail service: %v", err)
 		}
 		logrus.Info("Gmail service initialized successfully.")
 
-		// Step 2: Fetch Gmail Filters
-		logrus.Info("Fetching Gmail filters...")
-		filters, err := svc.Filters()
-		if err != nil {
-			logrus.Fatalf("Failed to fetch Gmail filters: %v", err)
+		if err := runWipe(ctx, svc); err != nil {
+			if interrupted(err) {
+				exitInterrupted(err, "Some filters or labels were not deleted; run wipe again to finish.")
+			}
+			logrus.Fatalf("%v", err)
 		}
-		logrus.Infof("Fetched %d filters successfully.", len(filters))
+		logrus.Info("Wipe command completed successfully.")
+	},
+}
 
-		// Step 3: Fetch Gmail Labels
-		logrus.Info("Fetching Gmail labels...")
-		labels, err := svc.Labels()
-		if err != nil {
-			logrus.Fatalf("Failed to fetch Gmail labels: %v", err)
-		}
-		logrus.Infof("Fetched %d labels successfully.", len(labels))
+// runWipe deletes all filters and user labels of the account.
+func runWipe(ctx context.Context, svc *internal.Service) error {
+	// Step 2: Fetch Gmail Filters
+	logrus.Info("Fetching Gmail filters...")
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Gmail filters: %v", err)
+	}
+	logrus.Infof("Fetched %d filters successfully.", len(filters))
 
-		// Step 4: Delete Filters
-		if len(filters) > 0 {
-			logrus.Info("Deleting Gmail filters...")
-			err = svc.DeleteFilters(filters)
-			if err != nil {
-				logrus.Errorf("Failed to delete filters: %v", err)
-			} else {
-				logrus.Info("Filters deleted successfully.")
-			}
+	// Step 3: Fetch Gmail Labels
+	logrus.Info("Fetching Gmail labels...")
+	labels, err := svc.Labels(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Gmail labels: %v", err)
+	}
+	logrus.Infof("Fetched %d labels successfully.", len(labels))
+
+	// Step 4: Delete Filters
+	if len(filters) > 0 {
+		logrus.Info("Deleting Gmail filters...")
+		err = svc.DeleteFilters(ctx, filters)
+		if interrupted(err) {
+			return err
+		} else if err != nil {
+			logrus.Errorf("Failed to delete filters: %v", err)
 		} else {
-			logrus.Info("No filters to delete.")
+			logrus.Info("Filters deleted successfully.")
 		}
+	} else {
+		logrus.Info("No filters to delete.")
+	}
 
-		// Step 5: Delete Labels
-		if len(labels) > 0 {
-			logrus.Info("Deleting Gmail labels...")
-			err = svc.DeleteLabels(labels)
-			if err != nil {
-				logrus.Errorf("Failed to delete labels: %v", err)
-			} else {
-				logrus.Info("Labels deleted successfully.")
-			}
+	// Step 5: Delete Labels
+	if len(labels) > 0 {
+		logrus.Info("Deleting Gmail labels...")
+		err = svc.DeleteLabels(ctx, labels)
+		if interrupted(err) {
+			return err
+		} else if err != nil {
+			logrus.Errorf("Failed to delete labels: %v", err)
 		} else {
-			logrus.Info("No labels to delete.")
+			logrus.Info("Labels deleted successfully.")
 		}
+	} else {
+		logrus.Info("No labels to delete.")
+	}
 
-		logrus.Info("Wipe command completed successfully.")
-	},
+	return nil
 }
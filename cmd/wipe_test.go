@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+)
+
+func TestRunWipe(t *testing.T) {
+	fake, svc := useFakeClient(t)
+	ctx := context.Background()
+
+	config := internal.NewConfig(
+		internal.Filters{filterFor("shop@example.com", []string{"Receipts"}, []string{"INBOX"})},
+		internal.Labels{{Name: "Receipts"}, {Name: "Work"}},
+	)
+	if err := runPush(ctx, svc, config); err != nil {
+		t.Fatal(err)
+	}
+	ids := labelIds(t, svc)
+	id := fake.AddMessage(rawMessage("shop@example.com", "Order"), "INBOX", ids["Receipts"], ids["Work"])
+
+	if err := runWipe(ctx, svc); err != nil {
+		t.Fatalf("runWipe() error = %v", err)
+	}
+
+	filters, err := svc.Filters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 0 {
+		t.Errorf("got %d filters after wipe, want 0", len(filters))
+	}
+
+	labels, err := svc.Labels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range labels {
+		if l.Type != "system" {
+			t.Errorf("user label %s was not deleted", l.Name)
+		}
+	}
+	if len(labels) == 0 {
+		t.Error("system labels were deleted")
+	}
+
+	if got := fake.MessageLabels(id); len(got) != 1 || got[0] != "INBOX" {
+		t.Errorf("message labels = %v, want [INBOX]", got)
+	}
+}
+
+func TestRunWipeEmpty(t *testing.T) {
+	_, svc := useFakeClient(t)
+	if err := runWipe(context.Background(), svc); err != nil {
+		t.Errorf("runWipe() error = %v", err)
+	}
+}
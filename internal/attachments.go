@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// DefaultAttachmentTemplate names downloaded attachments after the message date and sender.
+const DefaultAttachmentTemplate = "{date}_{sender}_{filename}"
+
+// AttachmentOptions configures an attachment download.
+type AttachmentOptions struct {
+	// Dir is the directory attachments are saved to.
+	Dir string
+	// Template builds the path of a file relative to Dir from the placeholders {date}, {year},
+	// {month}, {sender}, {domain}, {subject}, {filename} and {id}. A "/" in the template creates subdirectories.
+	Template string
+	// MimeTypes restricts downloads to these MIME types; "image/*" matches all images.
+	MimeTypes []string
+	// Extensions restricts downloads to these file extensions, with or without the dot.
+	Extensions []string
+	// DryRun lists the attachments that would be downloaded without downloading them. Their content
+	// is not fetched, so attachments that are already saved are not detected.
+	DryRun bool
+}
+
+// AttachmentResult summarizes an attachment download.
+type AttachmentResult struct {
+	Messages int
+	Saved    int
+	// Duplicates counts attachments whose content was already saved in the directory.
+	Duplicates int
+	// Filtered counts attachments left out by the MIME type and extension filters.
+	Filtered int
+	// WouldDownload counts the attachments a dry run would download, including any already saved.
+	WouldDownload int
+}
+
+// DownloadAttachments saves the attachments of the messages matching a query. Files whose content is
+// already in the directory, from an earlier download or another message, are not saved again.
+func (s *Service) DownloadAttachments(ctx context.Context, query string, opts *AttachmentOptions) (*AttachmentResult, error) {
+	result := &AttachmentResult{}
+	template := opts.Template
+	if template == "" {
+		template = DefaultAttachmentTemplate
+	}
+
+	hashes, err := hashDirectory(opts.Dir)
+	if err != nil {
+		return result, err
+	}
+
+	ids, err := s.MessageIds(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	logrus.Infof("Downloading the attachments of %d messages...", len(ids))
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		msg, err := s.Client.GetMessage(ctx, id, "full")
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Failed to fetch message %s: %v", id, err)
+			return result, err
+		}
+		result.Messages++
+
+		headers := messageHeaders(msg)
+		fields := map[string]string{
+			"id":      msg.Id,
+			"sender":  senderAddress(headers["From"]),
+			"subject": decodeHeader(headers["Subject"]),
+		}
+		if date := messageDate(msg, headers["Date"]); !date.IsZero() {
+			fields["date"] = date.Format("2006-01-02")
+			fields["year"] = date.Format("2006")
+			fields["month"] = date.Format("01")
+		}
+		if _, domain, ok := strings.Cut(fields["sender"], "@"); ok {
+			fields["domain"] = domain
+		}
+
+		for _, part := range attachmentParts(msg.Payload) {
+			if !opts.matches(part) {
+				result.Filtered++
+				continue
+			}
+			fields["filename"] = part.Filename
+			relPath := expandAttachmentTemplate(template, fields)
+			if opts.DryRun {
+				logrus.Infof("Would download %s from message %s", relPath, msg.Id)
+				result.WouldDownload++
+				continue
+			}
+
+			data, err := s.attachmentData(ctx, msg.Id, part)
+			if err != nil {
+				return result, err
+			}
+			sum := sha256.Sum256(data)
+			hash := hex.EncodeToString(sum[:])
+			if existing, ok := hashes[hash]; ok {
+				logrus.Debugf("Attachment %s of message %s is already saved as %s", part.Filename, msg.Id, existing)
+				result.Duplicates++
+				continue
+			}
+
+			savedPath, err := writeNewFile(filepath.Join(opts.Dir, filepath.FromSlash(relPath)), data)
+			if err != nil {
+				return result, err
+			}
+			logrus.Infof("Saved %s", savedPath)
+			hashes[hash] = savedPath
+			result.Saved++
+		}
+	}
+	return result, nil
+}
+
+// attachmentParts returns the parts of a payload that are attachments, in order.
+func attachmentParts(part *gmail.MessagePart) []*gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+	var parts []*gmail.MessagePart
+	if part.Filename != "" && part.Body != nil {
+		parts = append(parts, part)
+	}
+	for _, child := range part.Parts {
+		parts = append(parts, attachmentParts(child)...)
+	}
+	return parts
+}
+
+// matches reports whether an attachment passes the MIME type and extension filters.
+func (o *AttachmentOptions) matches(part *gmail.MessagePart) bool {
+	if len(o.MimeTypes) > 0 {
+		mimeType := strings.ToLower(part.MimeType)
+		if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+			mimeType = mediaType
+		}
+		matched := false
+		for _, t := range o.MimeTypes {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+				matched = matched || strings.HasPrefix(mimeType, prefix+"/")
+			} else {
+				matched = matched || mimeType == t
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(o.Extensions) > 0 {
+		ext := strings.TrimPrefix(strings.ToLower(path.Ext(part.Filename)), ".")
+		matched := false
+		for _, e := range o.Extensions {
+			matched = matched || ext == strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), ".")
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// attachmentData returns the content of an attachment, fetching it by attachment ID unless it is inline in the part.
+func (s *Service) attachmentData(ctx context.Context, messageId string, part *gmail.MessagePart) ([]byte, error) {
+	encoded := part.Body.Data
+	if part.Body.AttachmentId != "" {
+		body, err := s.Client.GetAttachment(ctx, messageId, part.Body.AttachmentId)
+		if err != nil {
+			logrus.Errorf("Failed to fetch attachment %s of message %s: %v", part.Filename, messageId, err)
+			return nil, err
+		}
+		encoded = body.Data
+	}
+	data, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode attachment %s of message %s: %v", part.Filename, messageId, err)
+	}
+	return data, nil
+}
+
+// expandAttachmentTemplate fills in the placeholders of a file name template. Values are made safe
+// to use as file names; missing values become "unknown".
+func expandAttachmentTemplate(template string, fields map[string]string) string {
+	var pairs []string
+	for _, name := range []string{"date", "year", "month", "sender", "domain", "subject", "filename", "id"} {
+		value := sanitizeFilename(fields[name])
+		if value == "" {
+			value = "unknown"
+		}
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// sanitizeFilename replaces path separators and characters most file systems reject, and limits the length.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 32, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	name = strings.Trim(name, ". ")
+	if runes := []rune(name); len(runes) > 100 {
+		name = string(runes[:100])
+	}
+	return name
+}
+
+// writeNewFile writes data to a new file, adding " (2)", " (3)"... before the extension if the
+// path is taken, and returns the path written.
+func writeNewFile(filePath string, data []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create directory: %v", err)
+	}
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filePath, ext)
+	for i := 1; ; i++ {
+		candidate := filePath
+		if i > 1 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		file, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create %s: %v", candidate, err)
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return "", fmt.Errorf("failed to write %s: %v", candidate, err)
+		}
+		return candidate, file.Close()
+	}
+}
+
+// hashDirectory returns the SHA-256 checksums of the files under a directory, mapped to their paths.
+// A missing directory has no files.
+func hashDirectory(dir string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum, err := fileChecksum(p)
+		if err != nil {
+			return err
+		}
+		hashes[sum] = p
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", dir, err)
+	}
+	return hashes, nil
+}
@@ -0,0 +1,114 @@
+package internal_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+)
+
+// messageWithAttachment builds a message from a sender with one attachment.
+func messageWithAttachment(from, date, filename, mimeType, content string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"Subject: Documents\r\n" +
+		"Date: " + date + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: " + mimeType + "; name=\"" + filename + "\"\r\n" +
+		"Content-Disposition: attachment; filename=\"" + filename + "\"\r\n" +
+		"\r\n" +
+		content + "\r\n" +
+		"--b--\r\n")
+}
+
+// savedFiles returns the paths of the files under a directory, relative to it.
+func savedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestDownloadAttachments(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	fake.AddMessage(messageWithAttachment("shop@example.com", "Mon, 15 Jan 2024 10:00:00 +0000", "invoice.pdf", "application/pdf", "%PDF-1"), "INBOX")
+	// The same invoice forwarded again is a duplicate
+	fake.AddMessage(messageWithAttachment("shop@example.com", "Tue, 16 Jan 2024 10:00:00 +0000", "invoice.pdf", "application/pdf", "%PDF-1"), "INBOX")
+	// A different file with the same name gets a numbered suffix
+	fake.AddMessage(messageWithAttachment("shop@example.com", "Wed, 17 Jan 2024 10:00:00 +0000", "invoice.pdf", "application/pdf", "%PDF-2"), "INBOX")
+	fake.AddMessage(messageWithAttachment("friend@example.com", "Mon, 15 Jan 2024 12:00:00 +0000", "photo.jpg", "image/jpeg", "JPEG"), "INBOX")
+
+	opts := &internal.AttachmentOptions{Dir: dir, Template: "{year}/{filename}", Extensions: []string{"pdf"}}
+	result, err := svc.DownloadAttachments(ctx, "has:attachment", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := internal.AttachmentResult{Messages: 4, Saved: 2, Duplicates: 1, Filtered: 1}
+	if *result != want {
+		t.Errorf("result = %+v, want %+v", *result, want)
+	}
+	files := savedFiles(t, dir)
+	if len(files) != 2 || files[0] != "2024/invoice (2).pdf" || files[1] != "2024/invoice.pdf" {
+		t.Errorf("saved files = %q, want the two different invoices", files)
+	}
+
+	// Running again over the same messages saves nothing new, even under another template
+	opts.Template = "{filename}"
+	result, err = svc.DownloadAttachments(ctx, "has:attachment", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Saved != 0 || result.Duplicates != 3 {
+		t.Errorf("second run result = %+v, want 3 duplicates and nothing saved", *result)
+	}
+	if got := savedFiles(t, dir); len(got) != 2 {
+		t.Errorf("saved files after the second run = %q, want the same two", got)
+	}
+}
+
+func TestDownloadAttachmentsDryRun(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	dir := filepath.Join(t.TempDir(), "attachments")
+
+	fake.AddMessage(messageWithAttachment("shop@example.com", "Mon, 15 Jan 2024 10:00:00 +0000", "invoice.pdf", "application/pdf", "%PDF-1"), "INBOX")
+	fake.AddMessage(messageWithAttachment("shop@example.com", "Tue, 16 Jan 2024 10:00:00 +0000", "invoice.pdf", "application/pdf", "%PDF-1"), "INBOX")
+
+	// Duplicates cannot be detected without downloading, so they are not reported as saved
+	result, err := svc.DownloadAttachments(context.Background(), "has:attachment", &internal.AttachmentOptions{Dir: dir, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := internal.AttachmentResult{Messages: 2, WouldDownload: 2}
+	if *result != want {
+		t.Errorf("result = %+v, want %+v", *result, want)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("dry run created %s", dir)
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestAttachmentOptionsMatches(t *testing.T) {
+	pdf := &gmail.MessagePart{Filename: "Invoice.PDF", MimeType: "application/pdf"}
+	png := &gmail.MessagePart{Filename: "logo.png", MimeType: "image/png; name=logo.png"}
+
+	tests := []struct {
+		name string
+		opts AttachmentOptions
+		part *gmail.MessagePart
+		want bool
+	}{
+		{"no filters", AttachmentOptions{}, pdf, true},
+		{"mime type", AttachmentOptions{MimeTypes: []string{"application/pdf"}}, pdf, true},
+		{"other mime type", AttachmentOptions{MimeTypes: []string{"application/zip"}}, pdf, false},
+		{"mime type wildcard", AttachmentOptions{MimeTypes: []string{"image/*"}}, png, true},
+		{"mime type wildcard of other type", AttachmentOptions{MimeTypes: []string{"image/*"}}, pdf, false},
+		{"mime type with parameters and case", AttachmentOptions{MimeTypes: []string{" Image/PNG "}}, png, true},
+		{"extension with dot", AttachmentOptions{Extensions: []string{".pdf"}}, pdf, true},
+		{"extension without dot", AttachmentOptions{Extensions: []string{"xlsx", "pdf"}}, pdf, true},
+		{"other extension", AttachmentOptions{Extensions: []string{"xlsx"}}, pdf, false},
+		{"both filters must match", AttachmentOptions{MimeTypes: []string{"application/pdf"}, Extensions: []string{"png"}}, pdf, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.matches(tt.part); got != tt.want {
+				t.Errorf("matches(%s) = %v, want %v", tt.part.Filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAttachmentTemplate(t *testing.T) {
+	fields := map[string]string{
+		"date":     "2024-01-15",
+		"year":     "2024",
+		"month":    "01",
+		"sender":   "alice@example.com",
+		"domain":   "example.com",
+		"subject":  "Re: Q1/Q2 invoice?",
+		"filename": "invoice.pdf",
+		"id":       "18c2f",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		fields   map[string]string
+		want     string
+	}{
+		{"default", DefaultAttachmentTemplate, fields, "2024-01-15_alice@example.com_invoice.pdf"},
+		{"subdirectories", "{year}/{month}/{domain}/{id}_{filename}", fields, "2024/01/example.com/18c2f_invoice.pdf"},
+		{"values cannot add directories", "{subject}", fields, "Re_ Q1_Q2 invoice_"},
+		{"missing values", "{date}_{sender}_{filename}", map[string]string{"filename": "a.txt"}, "unknown_unknown_a.txt"},
+		{"unknown placeholders are kept", "{filename}.{ext}", fields, "invoice.pdf.{ext}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandAttachmentTemplate(tt.template, tt.fields); got != tt.want {
+				t.Errorf("expandAttachmentTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "_.._etc_passwd"},
+		{`C:\Users\me\a.txt`, "C__Users_me_a.txt"},
+		{"what? <now>|\"really\"*", "what_ _now___really__"},
+		{"tab\there\n", "tab_here"},
+		{"  .hidden. ", "hidden"},
+		{"..", ""},
+		{strings.Repeat("é", 120), strings.Repeat("é", 100)},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.name); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteNewFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "2024", "01", "invoice.pdf")
+
+	var written []string
+	for _, content := range []string{"first", "second", "third"} {
+		got, err := writeNewFile(path, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, got)
+	}
+
+	want := []string{
+		path,
+		filepath.Join(dir, "2024", "01", "invoice (2).pdf"),
+		filepath.Join(dir, "2024", "01", "invoice (3).pdf"),
+	}
+	for i, content := range []string{"first", "second", "third"} {
+		if written[i] != want[i] {
+			t.Errorf("file %d written to %s, want %s", i+1, written[i], want[i])
+		}
+		if data, err := os.ReadFile(want[i]); err != nil || string(data) != content {
+			t.Errorf("%s = %q (%v), want %q", want[i], data, err, content)
+		}
+	}
+
+	// Files without an extension get the suffix at the end
+	if got, err := writeNewFile(filepath.Join(dir, "README"), nil); err != nil || got != filepath.Join(dir, "README") {
+		t.Fatalf("writeNewFile() = %s, %v", got, err)
+	}
+	if got, err := writeNewFile(filepath.Join(dir, "README"), nil); err != nil || got != filepath.Join(dir, "README (2)") {
+		t.Errorf("writeNewFile() = %s, %v, want README (2)", got, err)
+	}
+}
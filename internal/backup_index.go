@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BackupIndex tracks the messages of a local archive and the mailbox history ID it is current up
+// to, so later backups only fetch what changed.
+type BackupIndex struct {
+	Format       string                 `json:"format"`
+	Query        string                 `json:"query"`
+	EmailAddress string                 `json:"email_address,omitempty"`
+	HistoryId    uint64                 `json:"history_id"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	Messages     map[string]*IndexEntry `json:"messages"`
+}
+
+// IndexEntry is an archived message.
+type IndexEntry struct {
+	// Location is where the message is in the archive, as returned by MessageWriter.WriteMessage.
+	Location string    `json:"location"`
+	Labels   []string  `json:"labels"`
+	Date     time.Time `json:"date,omitempty"`
+	// Deleted is set when the message was deleted from the mailbox; it is kept in the archive.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// IncrementalResult summarizes an incremental backup.
+type IncrementalResult struct {
+	Added     int
+	Relabeled int
+	Deleted   int
+	FullScan  bool
+}
+
+// LoadBackupIndex loads the index of an archive. A missing index yields an empty one.
+// An index written for another format or query cannot be reused.
+func LoadBackupIndex(indexPath, format, query string) (*BackupIndex, error) {
+	index := &BackupIndex{Format: format, Query: query, Messages: make(map[string]*IndexEntry)}
+	if !fileExists(indexPath) {
+		logrus.Infof("No backup index at %s; backing up all matching messages.", indexPath)
+		return index, nil
+	}
+	if err := loadStateFile(indexPath, index); err != nil {
+		return nil, err
+	}
+	if index.Format != format || index.Query != query {
+		return nil, fmt.Errorf("backup index %s was written for format '%s' and query '%s'", indexPath, index.Format, index.Query)
+	}
+	if index.Messages == nil {
+		index.Messages = make(map[string]*IndexEntry)
+	}
+
+	logrus.Infof("Loaded backup index with %d messages at history ID %d", len(index.Messages), index.HistoryId)
+	return index, nil
+}
+
+// Save writes the index atomically.
+func (b *BackupIndex) Save(indexPath string) error {
+	b.UpdatedAt = time.Now()
+	return saveStateFile(indexPath, b)
+}
+
+// Record adds a written message to the index.
+func (b *BackupIndex) Record(msg *ExportedMessage, location string) {
+	b.Messages[msg.Id] = &IndexEntry{Location: location, Labels: msg.Labels, Date: msg.Date}
+}
+
+// IncrementalBackup brings an archive up to date. The first run exports every message matching the
+// query; later runs read the mailbox history since the index's history ID, export new messages and
+// update the labels of changed ones. An unchanged mailbox costs a single history request. When the
+// history has expired, all matching messages are listed and only unknown or relabeled ones are fetched.
+func (s *Service) IncrementalBackup(ctx context.Context, index *BackupIndex, labelNames map[string]string, w MessageWriter) (*IncrementalResult, error) {
+	result := &IncrementalResult{}
+
+	if index.HistoryId == 0 {
+		// Read the history ID first, so changes made during the export are picked up next time
+		profile, err := s.Client.GetProfile(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to fetch mailbox profile: %v", err)
+			return nil, err
+		}
+		result.FullScan = true
+		result.Added, err = s.ExportMessages(ctx, index.Query, labelNames, w, index)
+		if err != nil {
+			return result, err
+		}
+		index.EmailAddress = profile.EmailAddress
+		index.HistoryId = profile.HistoryId
+		return result, nil
+	}
+
+	state := &SyncState{HistoryId: index.HistoryId}
+	changes, err := s.Sync(ctx, state, index.Query)
+	if err != nil {
+		return nil, err
+	}
+	result.FullScan = changes.FullScan
+
+	// New messages, and relabeled ones that are not archived yet but may match the query now
+	candidates := changes.Added
+	for _, id := range changes.Relabeled {
+		if index.Messages[id] == nil {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var query QueryNode
+	var serverMatches map[string]bool
+	if index.Query != "" && !changes.FullScan && len(candidates) > 0 {
+		if query, err = ParseQuery(index.Query); err != nil {
+			return nil, err
+		}
+		// Terms only Gmail can evaluate are left to a search of the mailbox
+		if !EvaluableOffline(query) {
+			logrus.Infof("Query '%s' cannot be evaluated locally; searching the mailbox for the new messages matching it...", index.Query)
+			ids, err := s.MessageIds(ctx, index.Query)
+			if err != nil {
+				return nil, err
+			}
+			serverMatches = make(map[string]bool, len(ids))
+			for _, id := range ids {
+				serverMatches[id] = true
+			}
+		}
+	}
+	for _, id := range candidates {
+		if entry := index.Messages[id]; entry != nil {
+			if changes.FullScan {
+				if err := s.updateIndexedLabels(ctx, index, id, labelNames, w, result); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+
+		msg, err := s.ExportMessage(ctx, id, labelNames)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if !changes.FullScan && !matchesBackupQuery(query, index.Query, msg, serverMatches) {
+			continue
+		}
+		location, err := w.WriteMessage(msg)
+		if err != nil {
+			return result, err
+		}
+		index.Record(msg, location)
+		result.Added++
+	}
+
+	for _, id := range changes.Relabeled {
+		if index.Messages[id] != nil {
+			if err := s.updateIndexedLabels(ctx, index, id, labelNames, w, result); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, id := range changes.Deleted {
+		if entry := index.Messages[id]; entry != nil && !entry.Deleted {
+			entry.Deleted = true
+			result.Deleted++
+		}
+	}
+
+	index.HistoryId = changes.HistoryId
+	return result, nil
+}
+
+// updateIndexedLabels fetches the current labels of an archived message and refiles it if they changed.
+func (s *Service) updateIndexedLabels(ctx context.Context, index *BackupIndex, id string, labelNames map[string]string, w MessageWriter, result *IncrementalResult) error {
+	entry := index.Messages[id]
+	msg, err := s.Client.GetMessage(ctx, id, "minimal")
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logrus.Errorf("Failed to fetch labels of message %s: %v", id, err)
+		return err
+	}
+
+	labels := exportedLabels(msg.LabelIds, labelNames)
+	if slices.Equal(labels, entry.Labels) {
+		return nil
+	}
+	location, err := w.UpdateLabels(entry.Location, &ExportedMessage{Id: id, ThreadId: msg.ThreadId, Labels: labels, Date: entry.Date})
+	if err != nil {
+		return err
+	}
+	entry.Location, entry.Labels = location, labels
+	result.Relabeled++
+	return nil
+}
+
+// matchesBackupQuery reports whether a message found in the history belongs in an archive of the
+// query. Like a message search, spam and trash are left out unless the query asks for them. When
+// the query cannot be evaluated locally, serverMatches holds the IDs of the messages Gmail found
+// for it.
+func matchesBackupQuery(query QueryNode, queryText string, msg *ExportedMessage, serverMatches map[string]bool) bool {
+	if hasAnyLabel(msg.Labels, "SPAM", "TRASH") && !strings.Contains(queryText, "in:spam") &&
+		!strings.Contains(queryText, "in:trash") && !strings.Contains(queryText, "in:anywhere") {
+		return false
+	}
+	if serverMatches != nil {
+		return serverMatches[msg.Id]
+	}
+	if query == nil {
+		return true
+	}
+	local, err := ParseRawMessage(msg.Raw)
+	if err != nil {
+		return false
+	}
+	local.Id, local.Labels = msg.Id, msg.Labels
+	return MatchQuery(query, local)
+}
@@ -0,0 +1,150 @@
+package internal_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// recordingClient records the queries messages are listed with.
+type recordingClient struct {
+	internal.Client
+	queries []string
+}
+
+func (r *recordingClient) ListMessages(ctx context.Context, query, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	r.queries = append(r.queries, query)
+	return r.Client.ListMessages(ctx, query, pageToken, maxResults)
+}
+
+func TestIncrementalBackupQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantSearch  bool
+		wantSubject []string
+	}{
+		{"evaluated locally", "from:shop@example.com", false, []string{"Order 2"}},
+		{"left to the server", "from:shop@example.com OR has:drive", true, []string{"Order 2"}},
+		{"no query", "", false, []string{"Order 2", "Hi 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := gmailtest.NewFakeClient()
+			client := &recordingClient{Client: fake}
+			svc := internal.NewServiceWithClient(client)
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "messages.mbox")
+
+			fake.AddMessage([]byte("From: shop@example.com\r\nSubject: Order 1\r\n\r\nHello\r\n"), "INBOX")
+			fake.AddMessage([]byte("From: friend@example.com\r\nSubject: Hi 1\r\n\r\nHello\r\n"), "INBOX")
+
+			index, err := internal.LoadBackupIndex(path+".index.json", "mbox", tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backup := func() {
+				writer, err := internal.NewMboxWriter(path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := svc.IncrementalBackup(ctx, index, nil, writer); err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			backup()
+
+			fake.AddMessage([]byte("From: shop@example.com\r\nSubject: Order 2\r\n\r\nHello\r\n"), "INBOX")
+			fake.AddMessage([]byte("From: friend@example.com\r\nSubject: Hi 2\r\n\r\nHello\r\n"), "INBOX")
+			client.queries = nil
+			before := len(index.Messages)
+			backup()
+
+			var subjects []string
+			reader, err := internal.NewMboxReader(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			for i := 0; ; i++ {
+				archived, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i >= before {
+					local, err := internal.ParseRawMessage(archived.Raw)
+					if err != nil {
+						t.Fatal(err)
+					}
+					subjects = append(subjects, local.Subject)
+				}
+			}
+			if fmt.Sprint(subjects) != fmt.Sprint(tt.wantSubject) {
+				t.Errorf("incremental run archived %v, want %v", subjects, tt.wantSubject)
+			}
+
+			searched := false
+			for _, q := range client.queries {
+				searched = searched || q == tt.query
+			}
+			if searched != tt.wantSearch {
+				t.Errorf("searched the mailbox for the query = %v, want %v (queries %q)", searched, tt.wantSearch, client.queries)
+			}
+		})
+	}
+}
+
+// deletingClient fails to fetch one message, as if it was deleted after it was listed.
+type deletingClient struct {
+	internal.Client
+	deleted string
+}
+
+func (d *deletingClient) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	if id == d.deleted {
+		return nil, &googleapi.Error{Code: http.StatusNotFound, Message: "Requested entity was not found."}
+	}
+	return d.Client.GetMessage(ctx, id, format)
+}
+
+func TestIncrementalBackupSkipsDeletedMessages(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	kept := fake.AddMessage([]byte("Subject: Kept\r\n\r\nHello\r\n"), "INBOX")
+	deleted := fake.AddMessage([]byte("Subject: Deleted\r\n\r\nHello\r\n"), "INBOX")
+	svc := internal.NewServiceWithClient(&deletingClient{Client: fake, deleted: deleted})
+	path := filepath.Join(t.TempDir(), "messages.mbox")
+
+	index, err := internal.LoadBackupIndex(path+".index.json", "mbox", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := internal.NewMboxWriter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := svc.IncrementalBackup(context.Background(), index, nil, writer)
+	if err != nil {
+		t.Fatalf("first incremental run failed on a deleted message: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || index.Messages[kept] == nil || index.Messages[deleted] != nil {
+		t.Errorf("added %d messages, index %v; want only %s", result.Added, index.Messages, kept)
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Client is the narrow set of Gmail API operations the tool needs.
+// Service is built on top of it, so the real API can be swapped for the in-memory gmailtest.FakeClient.
+type Client interface {
+	// ListLabels returns all labels of the mailbox.
+	ListLabels(ctx context.Context) ([]*gmail.Label, error)
+	// CreateLabel creates a label and returns it with its new ID.
+	CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error)
+	// DeleteLabel deletes a label by ID.
+	DeleteLabel(ctx context.Context, id string) error
+
+	// ListFilters returns all filters of the mailbox.
+	ListFilters(ctx context.Context) ([]*gmail.Filter, error)
+	// CreateFilter creates a filter and returns it with its new ID.
+	CreateFilter(ctx context.Context, filter *gmail.Filter) (*gmail.Filter, error)
+	// DeleteFilter deletes a filter by ID.
+	DeleteFilter(ctx context.Context, id string) error
+
+	// ListMessages returns one page of messages matching a search query.
+	ListMessages(ctx context.Context, query, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error)
+	// GetMessage fetches a message in the given format ("minimal", "metadata", "full" or "raw").
+	GetMessage(ctx context.Context, id, format string) (*gmail.Message, error)
+	// GetThread fetches a thread with its messages, oldest first, in the given format ("minimal", "metadata" or "full").
+	GetThread(ctx context.Context, id, format string) (*gmail.Thread, error)
+	// GetAttachment fetches the data of a message attachment.
+	GetAttachment(ctx context.Context, messageId, id string) (*gmail.MessagePartBody, error)
+	// ModifyMessage adds and removes labels on a message.
+	ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error)
+	// BatchModifyMessages adds and removes labels on up to 1000 messages.
+	BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error
+	// TrashMessage moves a message to the trash.
+	TrashMessage(ctx context.Context, id string) (*gmail.Message, error)
+	// CreateDraft creates a draft from a raw RFC 822 message.
+	CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error)
+	// ImportMessage adds a raw RFC 822 message to the mailbox with the given labels, like a delivered
+	// message dated from its Date header.
+	ImportMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error)
+
+	// ListHistory returns one page of mailbox changes since a history ID.
+	ListHistory(ctx context.Context, startHistoryId uint64, pageToken string) (*gmail.ListHistoryResponse, error)
+	// GetProfile returns the mailbox profile, including its current history ID.
+	GetProfile(ctx context.Context) (*gmail.Profile, error)
+
+	// Watch starts publishing mailbox changes to a Cloud Pub/Sub topic, or renews the existing watch.
+	Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error)
+	// StopWatch stops publishing mailbox changes.
+	StopWatch(ctx context.Context) error
+}
+
+// gmailClient implements Client with the Gmail API.
+type gmailClient struct {
+	svc *gmail.Service
+}
+
+// NewGmailClient creates a Client backed by a Gmail API service.
+func NewGmailClient(svc *gmail.Service) Client {
+	return &gmailClient{svc: svc}
+}
+
+func (c *gmailClient) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	res, err := c.svc.Users.Labels.List(userId).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.Labels, nil
+}
+
+func (c *gmailClient) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	return c.svc.Users.Labels.Create(userId, label).Context(ctx).Do()
+}
+
+func (c *gmailClient) DeleteLabel(ctx context.Context, id string) error {
+	return c.svc.Users.Labels.Delete(userId, id).Context(ctx).Do()
+}
+
+func (c *gmailClient) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	res, err := c.svc.Users.Settings.Filters.List(userId).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.Filter, nil
+}
+
+func (c *gmailClient) CreateFilter(ctx context.Context, filter *gmail.Filter) (*gmail.Filter, error) {
+	return c.svc.Users.Settings.Filters.Create(userId, filter).Context(ctx).Do()
+}
+
+func (c *gmailClient) DeleteFilter(ctx context.Context, id string) error {
+	return c.svc.Users.Settings.Filters.Delete(userId, id).Context(ctx).Do()
+}
+
+func (c *gmailClient) ListMessages(ctx context.Context, query, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	req := c.svc.Users.Messages.List(userId).Q(query).Context(ctx)
+	if pageToken != "" {
+		req = req.PageToken(pageToken)
+	}
+	if maxResults > 0 {
+		req = req.MaxResults(maxResults)
+	}
+	return req.Do()
+}
+
+func (c *gmailClient) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	return c.svc.Users.Messages.Get(userId, id).Format(format).Context(ctx).Do()
+}
+
+func (c *gmailClient) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	return c.svc.Users.Threads.Get(userId, id).Format(format).Context(ctx).Do()
+}
+
+func (c *gmailClient) GetAttachment(ctx context.Context, messageId, id string) (*gmail.MessagePartBody, error) {
+	return c.svc.Users.Messages.Attachments.Get(userId, messageId, id).Context(ctx).Do()
+}
+
+func (c *gmailClient) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	return c.svc.Users.Messages.Modify(userId, id, req).Context(ctx).Do()
+}
+
+func (c *gmailClient) BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	return c.svc.Users.Messages.BatchModify(userId, req).Context(ctx).Do()
+}
+
+func (c *gmailClient) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return c.svc.Users.Messages.Trash(userId, id).Context(ctx).Do()
+}
+
+func (c *gmailClient) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	return c.svc.Users.Drafts.Create(userId, draft).Context(ctx).Do()
+}
+
+func (c *gmailClient) ImportMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	return c.svc.Users.Messages.Import(userId, msg).InternalDateSource("dateHeader").NeverMarkSpam(true).Context(ctx).Do()
+}
+
+func (c *gmailClient) ListHistory(ctx context.Context, startHistoryId uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	req := c.svc.Users.History.List(userId).StartHistoryId(startHistoryId).Context(ctx)
+	if pageToken != "" {
+		req = req.PageToken(pageToken)
+	}
+	return req.Do()
+}
+
+func (c *gmailClient) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	return c.svc.Users.GetProfile(userId).Context(ctx).Do()
+}
+
+func (c *gmailClient) Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	return c.svc.Users.Watch(userId, req).Context(ctx).Do()
+}
+
+func (c *gmailClient) StopWatch(ctx context.Context) error {
+	return c.svc.Users.Stop(userId).Context(ctx).Do()
+}
@@ -20,8 +20,10 @@ const userId = "me"
 
 // Config represents the configuration containing filters and labels
 type Config struct {
-	Labels  Labels  `yaml:"labels" json:"labels" jsonschema_description:"Labels to be created"`
-	Filters Filters `yaml:"filters" json:"filters" jsonschema_description:"Filters to be applied to emails"`
+	Labels    Labels    `yaml:"labels" json:"labels" jsonschema_description:"Labels to be created"`
+	Filters   Filters   `yaml:"filters" json:"filters" jsonschema_description:"Filters to be applied to emails"`
+	Rules     Rules     `yaml:"rules,omitempty" json:"-"`
+	Retention Retention `yaml:"retention,omitempty" json:"-"`
 }
 
 // NewConfig creates a new Config instance from filters and labels
@@ -32,8 +34,8 @@ func NewConfig(f Filters, l Labels) *Config {
 	}
 }
 
-// NewConfigFromYAML loads a Config from a YAML file
-func NewConfigFromYAML(configFile string) (*Config, error) {
+// NewConfigFromYAML loads a Config from a YAML file, decrypting it with enc if it is an encrypted backup
+func NewConfigFromYAML(configFile string, enc *Encryption) (*Config, error) {
 	// Check if the file exists
 	if !fileExists(configFile) {
 		logrus.Errorf("Configuration file does not exist: %s", configFile)
@@ -41,7 +43,7 @@ func NewConfigFromYAML(configFile string) (*Config, error) {
 	}
 
 	// Read the contents of the file
-	data, err := os.ReadFile(configFile)
+	data, err := enc.ReadFile(configFile)
 	if err != nil {
 		logrus.Errorf("Failed to read configuration file: %v", err)
 		return nil, fmt.Errorf("failed to read configuration file: %v", err)
@@ -53,13 +55,21 @@ func NewConfigFromYAML(configFile string) (*Config, error) {
 		logrus.Errorf("Failed to unmarshal YAML data: %v", err)
 		return nil, fmt.Errorf("failed to unmarshal YAML data: %v", err)
 	}
+	if err := config.Rules.Compile(); err != nil {
+		logrus.Errorf("Failed to compile rules: %v", err)
+		return nil, err
+	}
+	if err := config.Retention.Compile(); err != nil {
+		logrus.Errorf("Failed to compile retention policies: %v", err)
+		return nil, err
+	}
 
 	logrus.Infof("Configuration loaded successfully from file: %s", configFile)
 	return &config, nil
 }
 
-// SaveToFile saves the Config to a specified file in YAML format
-func (c *Config) SaveToFile(outputPath string) error {
+// SaveToFile saves the Config to a specified file in YAML format, encrypted when enc has recipients
+func (c *Config) SaveToFile(outputPath string, enc *Encryption) error {
 	// Create or overwrite the file
 	file, err := os.Create(outputPath)
 	if err != nil {
@@ -68,15 +78,33 @@ func (c *Config) SaveToFile(outputPath string) error {
 	}
 	defer file.Close()
 
-	// Write the YAML-encoded data to the file
-	encoder := yaml.NewEncoder(file)
-	defer encoder.Close()
+	w, err := enc.Encrypt(file)
+	if err != nil {
+		logrus.Errorf("Failed to encrypt file: %v", err)
+		return err
+	}
 
+	// Write the YAML-encoded data to the file
+	encoder := yaml.NewEncoder(w)
 	if err := encoder.Encode(c); err != nil {
 		logrus.Errorf("Failed to encode data to YAML: %v", err)
 		return fmt.Errorf("failed to encode data to YAML: %v", err)
 	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to encode data to YAML: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		logrus.Errorf("Failed to encrypt file: %v", err)
+		return fmt.Errorf("failed to encrypt file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
 
+	if enc.Encrypts() {
+		logrus.Infof("Configuration saved encrypted to file: %s", outputPath)
+		return nil
+	}
 	logrus.Infof("Configuration saved successfully to file: %s", outputPath)
 	return nil
 }
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Encryption holds the keys backups are encrypted with and decrypted with. Backups use the age
+// format (https://age-encryption.org), so they can also be decrypted with the age command line tool.
+type Encryption struct {
+	// Recipients are the keys backups are encrypted to; without recipients backups are written in plaintext.
+	Recipients []age.Recipient
+	// Identities are the keys encrypted backups are decrypted with.
+	Identities []age.Identity
+}
+
+// NewEncryption builds the keys for backups. recipients are age public keys ("age1...") or paths to
+// files listing them; identityPath is an age identity file. A passphrase is used to decrypt backups,
+// and to encrypt them when encryptWithPassphrase is set; it cannot be combined with recipients.
+func NewEncryption(recipients []string, identityPath, passphrase string, encryptWithPassphrase bool) (*Encryption, error) {
+	e := &Encryption{}
+	for _, value := range recipients {
+		if strings.HasPrefix(value, "age1") {
+			recipient, err := age.ParseX25519Recipient(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient %s: %v", value, err)
+			}
+			e.Recipients = append(e.Recipients, recipient)
+			continue
+		}
+		parsed, err := parseKeyFile(value, age.ParseRecipients)
+		if err != nil {
+			return nil, err
+		}
+		e.Recipients = append(e.Recipients, parsed...)
+	}
+
+	if identityPath != "" {
+		parsed, err := parseKeyFile(identityPath, age.ParseIdentities)
+		if err != nil {
+			return nil, err
+		}
+		e.Identities = append(e.Identities, parsed...)
+	}
+
+	if encryptWithPassphrase && passphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required to encrypt with a passphrase")
+	}
+	if passphrase != "" {
+		if encryptWithPassphrase {
+			if len(e.Recipients) > 0 {
+				return nil, fmt.Errorf("backups are encrypted either to recipients or with a passphrase, not both")
+			}
+			recipient, err := age.NewScryptRecipient(passphrase)
+			if err != nil {
+				return nil, err
+			}
+			e.Recipients = append(e.Recipients, recipient)
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		e.Identities = append(e.Identities, identity)
+	}
+	return e, nil
+}
+
+// parseKeyFile parses a file of age recipients or identities.
+func parseKeyFile[T any](path string, parse func(io.Reader) ([]T, error)) ([]T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %v", err)
+	}
+	defer file.Close()
+
+	keys, err := parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %v", path, err)
+	}
+	return keys, nil
+}
+
+// Encrypts reports whether backups are encrypted. A nil Encryption writes plaintext.
+func (e *Encryption) Encrypts() bool {
+	return e != nil && len(e.Recipients) > 0
+}
+
+// Encrypt returns a writer encrypting to w, or a writer passing data through when backups are not
+// encrypted. It must be closed to write the end of the encrypted data.
+func (e *Encryption) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	if !e.Encrypts() {
+		return nopWriteCloser{w}, nil
+	}
+	encrypted, err := age.Encrypt(w, e.Recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %v", err)
+	}
+	return encrypted, nil
+}
+
+// Decrypt returns a reader of the plaintext of r. Data that is not encrypted, binary or armored,
+// is returned as is, so plaintext and encrypted backups can be read alike.
+func (e *Encryption) Decrypt(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, _ := buffered.Peek(len(armor.Header))
+	encrypted, armored := encryptedHeader(header)
+	if !encrypted {
+		return buffered, nil
+	}
+
+	if e == nil || len(e.Identities) == 0 {
+		return nil, fmt.Errorf("the data is encrypted; pass an identity file or a passphrase to decrypt it")
+	}
+	var src io.Reader = buffered
+	if armored {
+		src = armor.NewReader(buffered)
+	}
+	decrypted, err := age.Decrypt(src, e.Identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return decrypted, nil
+}
+
+// encryptedHeader reports whether data starting with header is age encrypted, and whether it is armored.
+func encryptedHeader(header []byte) (encrypted, armored bool) {
+	armored = bytes.Equal(header, []byte(armor.Header))
+	return armored || bytes.HasPrefix(header, []byte("age-encryption.org/")), armored
+}
+
+// isEncryptedFile reports whether a file holds age encrypted data.
+func isEncryptedFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, len(armor.Header))
+	n, _ := io.ReadFull(file, header)
+	encrypted, _ := encryptedHeader(header[:n])
+	return encrypted
+}
+
+// ReadFile reads a file, decrypting it if it is encrypted.
+func (e *Encryption) ReadFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := e.Decrypt(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return io.ReadAll(r)
+}
+
+// nopWriteCloser adds a Close method doing nothing to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
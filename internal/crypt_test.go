@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"google.golang.org/api/gmail/v1"
+)
+
+// newKeyFiles writes a new age identity to a file and returns the identity, its file and a file of its recipient.
+func newKeyFiles(t *testing.T) (*age.X25519Identity, string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityPath := filepath.Join(dir, "key.txt")
+	recipientPath := filepath.Join(dir, "recipients.txt")
+	if err := os.WriteFile(identityPath, []byte("# test key\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(recipientPath, []byte(identity.Recipient().String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identity, identityPath, recipientPath
+}
+
+func TestNewEncryption(t *testing.T) {
+	identity, identityPath, recipientPath := newKeyFiles(t)
+	recipient := identity.Recipient().String()
+
+	tests := []struct {
+		name           string
+		recipients     []string
+		identityPath   string
+		passphrase     string
+		withPassphrase bool
+		wantErr        bool
+		wantEncrypts   bool
+		wantIdentities int
+	}{
+		{name: "no keys"},
+		{name: "recipient key", recipients: []string{recipient}, wantEncrypts: true},
+		{name: "recipient file", recipients: []string{recipientPath}, wantEncrypts: true},
+		{name: "identity file", identityPath: identityPath, wantIdentities: 1},
+		{name: "passphrase decrypts only", passphrase: "secret", wantIdentities: 1},
+		{name: "passphrase encrypts", passphrase: "secret", withPassphrase: true, wantEncrypts: true, wantIdentities: 1},
+		{name: "passphrase required", withPassphrase: true, wantErr: true},
+		{name: "passphrase and recipients", recipients: []string{recipient}, passphrase: "secret", withPassphrase: true, wantErr: true},
+		{name: "invalid recipient", recipients: []string{"age1invalid"}, wantErr: true},
+		{name: "missing recipient file", recipients: []string{filepath.Join(t.TempDir(), "missing.txt")}, wantErr: true},
+		{name: "invalid identity file", identityPath: recipientPath, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := NewEncryption(tt.recipients, tt.identityPath, tt.passphrase, tt.withPassphrase)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEncryption() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if enc.Encrypts() != tt.wantEncrypts || len(enc.Identities) != tt.wantIdentities {
+				t.Errorf("NewEncryption() encrypts = %v with %d identities, want %v with %d",
+					enc.Encrypts(), len(enc.Identities), tt.wantEncrypts, tt.wantIdentities)
+			}
+		})
+	}
+}
+
+// encrypt encrypts data with enc, armored if asked.
+func encrypt(t *testing.T, enc *Encryption, data string, armored bool) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var out io.WriteCloser = nopWriteCloser{&b}
+	if armored {
+		out = armor.NewWriter(&b)
+	}
+	w, err := enc.Encrypt(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	_, identityPath, recipientPath := newKeyFiles(t)
+	_, otherIdentityPath, _ := newKeyFiles(t)
+	keys := func(recipients []string, identityPath, passphrase string, withPassphrase bool) *Encryption {
+		enc, err := NewEncryption(recipients, identityPath, passphrase, withPassphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	recipientKeys := keys([]string{recipientPath}, identityPath, "", false)
+	passphraseKeys := keys(nil, "", "secret", true)
+
+	tests := []struct {
+		name      string
+		encryptor *Encryption
+		armored   bool
+		decryptor *Encryption
+		wantErr   string
+	}{
+		{name: "recipient", encryptor: recipientKeys, decryptor: keys(nil, identityPath, "", false)},
+		{name: "passphrase", encryptor: passphraseKeys, decryptor: keys(nil, "", "secret", false)},
+		{name: "armored", encryptor: recipientKeys, armored: true, decryptor: recipientKeys},
+		{name: "plaintext", encryptor: nil, decryptor: nil},
+		{name: "plaintext with keys", encryptor: keys(nil, identityPath, "", false), decryptor: recipientKeys},
+		{name: "wrong identity", encryptor: recipientKeys, decryptor: keys(nil, otherIdentityPath, "", false), wantErr: "failed to decrypt"},
+		{name: "wrong passphrase", encryptor: passphraseKeys, decryptor: keys(nil, "", "guess", false), wantErr: "failed to decrypt"},
+		{name: "encrypted without keys", encryptor: recipientKeys, decryptor: nil, wantErr: "pass an identity file or a passphrase"},
+		{name: "encrypted with recipients only", encryptor: recipientKeys, decryptor: keys([]string{recipientPath}, "", "", false), wantErr: "pass an identity file or a passphrase"},
+	}
+
+	const plaintext = "labels:\n  - name: Receipts\n"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "backup.yaml")
+			if err := os.WriteFile(path, encrypt(t, tt.encryptor, plaintext, tt.armored), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if isEncryptedFile(path) != tt.encryptor.Encrypts() {
+				t.Fatalf("written data encrypted = %v, want %v", !tt.encryptor.Encrypts(), tt.encryptor.Encrypts())
+			}
+			got, err := tt.decryptor.ReadFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ReadFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if string(got) != plaintext {
+				t.Errorf("ReadFile() = %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestConfigEncryptedRoundTrip(t *testing.T) {
+	_, identityPath, recipientPath := newKeyFiles(t)
+	writer, err := NewEncryption([]string{recipientPath}, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewEncryption(nil, identityPath, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig(
+		Filters{{Criteria: &gmail.FilterCriteria{From: "shop@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}}},
+		Labels{{Id: "Label_1", Name: "Receipts"}},
+	)
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name      string
+		encryptor *Encryption
+		encrypted bool
+	}{
+		{"encrypted", writer, true},
+		{"plaintext", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".yaml")
+			if err := config.SaveToFile(path, tt.encryptor); err != nil {
+				t.Fatal(err)
+			}
+			if isEncryptedFile(path) != tt.encrypted {
+				t.Fatalf("saved file encrypted = %v, want %v", !tt.encrypted, tt.encrypted)
+			}
+
+			loaded, err := NewConfigFromYAML(path, reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.Labels) != 1 || loaded.Labels[0].Name != "Receipts" || len(loaded.Filters) != 1 ||
+				loaded.Filters[0].Criteria.From != "shop@example.com" {
+				t.Errorf("loaded config = %+v, want the saved labels and filters", loaded)
+			}
+
+			_, err = NewConfigFromYAML(path, nil)
+			if (err != nil) != tt.encrypted {
+				t.Errorf("NewConfigFromYAML() without keys error = %v, want an error only for the encrypted file", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,599 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// LocalMessage is a message parsed into the parts that filter criteria are evaluated against.
+type LocalMessage struct {
+	Id            string
+	Header        mail.Header
+	From          string
+	To            string
+	Cc            string
+	Subject       string
+	Body          string
+	Date          time.Time
+	Size          int64
+	HasAttachment bool
+	Attachments   []string
+	Labels        []string
+}
+
+// IsChat reports whether the message is a chat message.
+func (m *LocalMessage) IsChat() bool {
+	for _, l := range m.Labels {
+		if l == "CHAT" {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadEML parses a local .eml file into a LocalMessage.
+// Messages loaded from files are treated as freshly delivered, unread inbox mail.
+func LoadEML(emlPath string) (*LocalMessage, error) {
+	data, err := os.ReadFile(emlPath)
+	if err != nil {
+		logrus.Errorf("Failed to read message file: %v", err)
+		return nil, fmt.Errorf("failed to read message file: %v", err)
+	}
+
+	msg, err := ParseRawMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", emlPath, err)
+	}
+	msg.Id = emlPath
+	msg.Labels = []string{"INBOX", "UNREAD"}
+	return msg, nil
+}
+
+// ParseRawMessage parses RFC 822 message data into a LocalMessage.
+func ParseRawMessage(raw []byte) (*LocalMessage, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %v", err)
+	}
+
+	msg := newLocalMessage(parsed.Header)
+	msg.Size = int64(len(raw))
+
+	var body strings.Builder
+	if err := walkMIMEPart(parsed.Header, parsed.Body, &body, msg); err != nil {
+		return nil, err
+	}
+	msg.Body = body.String()
+	msg.HasAttachment = len(msg.Attachments) > 0
+	return msg, nil
+}
+
+// ParseGmailMessage parses a Gmail API message fetched in "raw" or "full" format into a LocalMessage.
+// The API returns label IDs; they are mapped to names with labelNames, so label: terms match user
+// labels by name the way Gmail search does.
+func ParseGmailMessage(m *gmail.Message, labelNames map[string]string) (*LocalMessage, error) {
+	var msg *LocalMessage
+	switch {
+	case m.Raw != "":
+		raw, err := decodeBase64URL(m.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode raw message %s: %v", m.Id, err)
+		}
+		msg, err = ParseRawMessage(raw)
+		if err != nil {
+			return nil, err
+		}
+	case m.Payload != nil:
+		header := make(mail.Header)
+		for _, h := range m.Payload.Headers {
+			key := textproto.CanonicalMIMEHeaderKey(h.Name)
+			header[key] = append(header[key], h.Value)
+		}
+		msg = newLocalMessage(header)
+
+		var body strings.Builder
+		walkGmailPart(m.Payload, &body, msg)
+		msg.Body = body.String()
+		msg.HasAttachment = len(msg.Attachments) > 0
+	default:
+		return nil, fmt.Errorf("message %s has neither raw data nor a payload", m.Id)
+	}
+
+	msg.Id = m.Id
+	msg.Labels = exportedLabels(m.LabelIds, labelNames)
+	if m.SizeEstimate > 0 {
+		msg.Size = m.SizeEstimate
+	}
+	return msg, nil
+}
+
+// newLocalMessage creates a LocalMessage with the decoded addressing headers of a message.
+func newLocalMessage(header mail.Header) *LocalMessage {
+	msg := &LocalMessage{
+		Header:  header,
+		From:    decodeHeader(header.Get("From")),
+		To:      decodeHeader(header.Get("To")),
+		Cc:      decodeHeader(header.Get("Cc")),
+		Subject: decodeHeader(header.Get("Subject")),
+	}
+	if date, err := header.Date(); err == nil {
+		msg.Date = date
+	}
+	return msg
+}
+
+// walkMIMEPart collects the text and attachment names of a MIME part and its children.
+func walkMIMEPart(header map[string][]string, r io.Reader, body *strings.Builder, msg *LocalMessage) error {
+	get := func(key string) string {
+		if v := header[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read MIME part: %v", err)
+			}
+			if err := walkMIMEPart(part.Header, part, body, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if disposition == "attachment" || filename != "" {
+		msg.Attachments = append(msg.Attachments, decodeHeader(filename))
+		return nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return nil
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header, r))
+	if err != nil {
+		return fmt.Errorf("failed to read MIME part body: %v", err)
+	}
+	if mediaType == "text/html" {
+		data = []byte(stripHTML(string(data)))
+	}
+	body.Write(data)
+	body.WriteString("\n")
+	return nil
+}
+
+// decodeTransfer wraps a MIME part body with a decoder for its Content-Transfer-Encoding.
+func decodeTransfer(header map[string][]string, r io.Reader) io.Reader {
+	var encoding string
+	if v := header["Content-Transfer-Encoding"]; len(v) > 0 {
+		encoding = strings.ToLower(strings.TrimSpace(v[0]))
+	}
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// walkGmailPart collects the text and attachment names of a Gmail message part and its children.
+func walkGmailPart(part *gmail.MessagePart, body *strings.Builder, msg *LocalMessage) {
+	if part.Filename != "" {
+		msg.Attachments = append(msg.Attachments, part.Filename)
+	} else if strings.HasPrefix(part.MimeType, "text/") && part.Body != nil && part.Body.Data != "" {
+		data, err := decodeBase64URL(part.Body.Data)
+		if err != nil {
+			logrus.Warnf("Failed to decode body of part %s: %v", part.PartId, err)
+		} else {
+			if part.MimeType == "text/html" {
+				data = []byte(stripHTML(string(data)))
+			}
+			body.Write(data)
+			body.WriteString("\n")
+		}
+	}
+
+	for _, child := range part.Parts {
+		walkGmailPart(child, body, msg)
+	}
+}
+
+// decodeHeader decodes RFC 2047 encoded words in a header value.
+func decodeHeader(value string) string {
+	decoder := &mime.WordDecoder{CharsetReader: charsetReader}
+	decoded, err := decoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeBase64URL decodes base64url data as returned by the Gmail API, with or without padding.
+func decodeBase64URL(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// stripHTML removes tags from HTML so that only the text is searched.
+func stripHTML(html string) string {
+	var text strings.Builder
+	inTag := false
+	for _, r := range html {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			text.WriteRune(' ')
+		case !inTag:
+			text.WriteRune(r)
+		}
+	}
+	return text.String()
+}
+
+// MatchCriteria reports whether a message matches a filter's criteria.
+// The criteria are translated with QueryFromCriteria and evaluated as a search query,
+// so local evaluation matches the messages that retro would select in Gmail.
+func MatchCriteria(criteria *gmail.FilterCriteria, m *LocalMessage) bool {
+	query, err := QueryFromCriteria(criteria)
+	if err != nil {
+		logrus.Warnf("Failed to translate filter criteria: %v", err)
+		return false
+	}
+	if query == "" {
+		return false
+	}
+
+	node, err := ParseQuery(query)
+	if err != nil {
+		logrus.Warnf("Failed to parse filter query '%s': %v", query, err)
+		return false
+	}
+	return MatchQuery(node, m)
+}
+
+// FilterResult is the outcome of evaluating a set of filters against a message.
+type FilterResult struct {
+	Matched []int
+	Labels  []string
+}
+
+// EvaluateFilters evaluates filters against a message in order and returns the indexes of the
+// matching filters and the label set the message ends up with after their actions.
+func EvaluateFilters(filters Filters, m *LocalMessage) FilterResult {
+	var result FilterResult
+	labels := append([]string(nil), m.Labels...)
+
+	for i, filter := range filters {
+		if !MatchCriteria(filter.Criteria, m) {
+			continue
+		}
+		result.Matched = append(result.Matched, i)
+		if filter.Action == nil {
+			continue
+		}
+
+		current := make(map[string]bool, len(labels))
+		for _, l := range labels {
+			current[l] = true
+		}
+		for _, l := range filter.Action.RemoveLabelIds {
+			delete(current, l)
+		}
+		var next []string
+		for _, l := range labels {
+			if current[l] {
+				next = append(next, l)
+			}
+		}
+		for _, l := range filter.Action.AddLabelIds {
+			if !current[l] {
+				current[l] = true
+				next = append(next, l)
+			}
+		}
+		labels = next
+	}
+
+	result.Labels = labels
+	return result
+}
+
+// MatchQuery reports whether a message matches a parsed search query.
+func MatchQuery(node QueryNode, m *LocalMessage) bool {
+	switch n := node.(type) {
+	case *AndNode:
+		for _, child := range n.Children {
+			if !MatchQuery(child, m) {
+				return false
+			}
+		}
+		return true
+	case *OrNode:
+		for _, child := range n.Children {
+			if MatchQuery(child, m) {
+				return true
+			}
+		}
+		return false
+	case *NotNode:
+		return !MatchQuery(n.Child, m)
+	case *TermNode:
+		return matchTerm(n, m)
+	default:
+		return false
+	}
+}
+
+// offlineHasValues lists the has: values MatchQuery can evaluate from the message itself.
+var offlineHasValues = map[string]bool{"attachment": true, "userlabels": true, "nouserlabels": true}
+
+// EvaluableOffline reports whether MatchQuery can evaluate every term of a query from the message
+// itself. Terms such as has:drive or has:yellow-star depend on data only Gmail has.
+func EvaluableOffline(node QueryNode) bool {
+	evaluable := true
+	walkQuery(node, func(t *TermNode) {
+		if t.Operator == "has" && !offlineHasValues[strings.ToLower(t.Value)] {
+			evaluable = false
+		}
+	})
+	return evaluable
+}
+
+// matchTerm evaluates a single search term against a message.
+// Operators that need data Gmail does not expose in the message itself are treated as not matching.
+func matchTerm(t *TermNode, m *LocalMessage) bool {
+	value := strings.ToLower(t.Value)
+
+	switch t.Operator {
+	case "":
+		return containsWords(strings.Join([]string{m.From, m.To, m.Cc, m.Subject, m.Body, strings.Join(m.Attachments, " ")}, "\n"), value)
+	case "from":
+		return matchAddresses(m.From, value)
+	case "to":
+		return matchAddresses(m.To, value) || matchAddresses(m.Cc, value) || matchAddresses(m.Header.Get("Bcc"), value)
+	case "cc":
+		return matchAddresses(m.Cc, value)
+	case "bcc":
+		return matchAddresses(m.Header.Get("Bcc"), value)
+	case "deliveredto":
+		for _, header := range m.Header["Delivered-To"] {
+			if matchAddresses(header, value) {
+				return true
+			}
+		}
+		return false
+	case "subject":
+		return containsWords(m.Subject, value)
+	case "list":
+		return containsWords(m.Header.Get("List-Id"), value)
+	case "rfc822msgid":
+		return strings.EqualFold(strings.Trim(strings.TrimSpace(m.Header.Get("Message-Id")), "<>"), strings.Trim(value, "<>"))
+	case "filename":
+		return containsWords(strings.Join(m.Attachments, "\n"), value)
+	case "has":
+		switch value {
+		case "attachment":
+			return m.HasAttachment
+		case "userlabels":
+			return hasUserLabel(m.Labels)
+		case "nouserlabels":
+			return !hasUserLabel(m.Labels)
+		}
+	case "is":
+		switch value {
+		case "read":
+			return !m.hasLabel("UNREAD")
+		case "chat":
+			return m.IsChat()
+		default:
+			return m.hasLabel(value)
+		}
+	case "in":
+		if value == "anywhere" {
+			return true
+		}
+		if value == "chats" {
+			return m.IsChat()
+		}
+		return m.hasLabel(value)
+	case "label":
+		return m.hasLabel(value) || m.hasLabel(strings.ReplaceAll(value, "-", "/"))
+	case "category":
+		return m.hasLabel("CATEGORY_" + value)
+	case "larger", "size":
+		size, ok := parseQuerySize(value)
+		return ok && m.Size > size
+	case "smaller":
+		size, ok := parseQuerySize(value)
+		return ok && m.Size < size
+	case "older_than", "newer_than":
+		age, ok := parseQueryAge(value)
+		if !ok || m.Date.IsZero() {
+			return false
+		}
+		older := m.Date.Before(time.Now().Add(-age))
+		return older == (t.Operator == "older_than")
+	case "after", "newer", "before", "older":
+		date, ok := parseQueryDate(value)
+		if !ok || m.Date.IsZero() {
+			return false
+		}
+		if t.Operator == "after" || t.Operator == "newer" {
+			return !m.Date.Before(date)
+		}
+		return m.Date.Before(date)
+	}
+
+	logrus.Warnf("Search term '%s' cannot be evaluated offline; treating it as not matching.", t)
+	return false
+}
+
+// hasLabel reports whether the message has a label, comparing names case-insensitively.
+func (m *LocalMessage) hasLabel(label string) bool {
+	for _, l := range m.Labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUserLabel reports whether any of the labels is a user label rather than a system label.
+func hasUserLabel(labels []string) bool {
+	for _, l := range labels {
+		if !isSystemLabelId(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSystemLabelId reports whether a label ID belongs to a Gmail system label.
+func isSystemLabelId(id string) bool {
+	switch id {
+	case "INBOX", "SPAM", "TRASH", "UNREAD", "STARRED", "IMPORTANT", "SENT", "DRAFT", "CHAT":
+		return true
+	}
+	return strings.HasPrefix(id, "CATEGORY_")
+}
+
+// containsWords reports whether the words of value appear consecutively in text, ignoring case and
+// punctuation, the way Gmail matches search terms: "sale" matches "Summer sale!" but not "wholesale".
+func containsWords(text, value string) bool {
+	want := searchWords(value)
+	if len(want) == 0 {
+		return false
+	}
+	words := searchWords(text)
+	for i := 0; i+len(want) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchWords splits text into lower-cased runs of letters and digits. Han, Hiragana and Katakana
+// characters, which are written without spaces, are words of their own.
+func searchWords(text string) []string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			flush()
+			words = append(words, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// matchAddresses reports whether an address header has an address or display name containing the
+// words of value: "ann" matches ann@example.com and "Ann Lee", but not joann@example.com.
+func matchAddresses(header, value string) bool {
+	addresses, err := mail.ParseAddressList(header)
+	if err != nil {
+		return containsWords(header, value)
+	}
+	for _, a := range addresses {
+		if containsWords(a.Address, value) || containsWords(a.Name, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseQuerySize parses a size such as 1000, 10K or 5M into bytes.
+func parseQuerySize(value string) (int64, bool) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier, value = 1024, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		multiplier, value = 1024*1024, strings.TrimSuffix(value, "m")
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size * multiplier, true
+}
+
+// parseQueryAge parses a relative age such as 14d, 2m or 1y.
+func parseQueryAge(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || count < 0 {
+		return 0, false
+	}
+	day := 24 * time.Hour
+	switch value[len(value)-1] {
+	case 'd':
+		return time.Duration(count) * day, true
+	case 'm':
+		return time.Duration(count) * 30 * day, true
+	case 'y':
+		return time.Duration(count) * 365 * day, true
+	}
+	return 0, false
+}
+
+// parseQueryDate parses a date such as 2024/01/31, 2024-01-31 or a Unix timestamp in seconds.
+func parseQueryDate(value string) (time.Time, bool) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+	for _, layout := range []string{"2006/1/2", "2006-1-2"} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const testMessage = "From: Alice Example <alice@example.com>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Cc: carol@example.com\r\n" +
+	"Bcc: dave@example.com\r\n" +
+	"Delivered-To: bob@example.com\r\n" +
+	"Subject: Quarterly invoice\r\n" +
+	"Date: Mon, 15 Jan 2024 10:00:00 +0000\r\n" +
+	"List-Id: <billing.example.com>\r\n" +
+	"Message-Id: <inv-42@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Please find the invoice attached.\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF\r\n" +
+	"--b--\r\n"
+
+func testLocalMessage(t *testing.T, labels ...string) *LocalMessage {
+	t.Helper()
+	msg, err := ParseRawMessage([]byte(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Labels = labels
+	return msg
+}
+
+func TestMatchQuery(t *testing.T) {
+	msg := testLocalMessage(t, "INBOX", "UNREAD", "CATEGORY_UPDATES", "Finance/Invoices")
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		// Plain words and phrases search the headers, body and attachment names
+		{"invoice", true},
+		{"attached", true},
+		{`"find the invoice"`, true},
+		{`"invoice find"`, false},
+		{"receipt", false},
+		// Words match whole words only
+		{"invo", false},
+		{"quarter", false},
+		{"INVOICE.", true},
+
+		// Address and header operators
+		{"from:alice@example.com", true},
+		{"from:alice", true},
+		{"from:bob", false},
+		{"from:ali", false},
+		{"from:example.com", true},
+		{"from:@example.com", true},
+		{"from:le@example.com", false},
+		{"from:example", true},
+		{"from:(alice example)", true},
+		{"to:bob@example.com", true},
+		{"to:carol", true},
+		{"to:dave", true},
+		{"cc:carol", true},
+		{"cc:bob", false},
+		{"bcc:dave", true},
+		{"deliveredto:bob@example.com", true},
+		{"subject:quarterly", true},
+		{"subject:(quarterly invoice)", true},
+		{"subject:monthly", false},
+		{"subject:quarter", false},
+		{"list:billing.example.com", true},
+		{"rfc822msgid:inv-42@example.com", true},
+		{"filename:invoice.pdf", true},
+		{"filename:docx", false},
+		{"filename:pdf", true},
+		{"filename:voice", false},
+		{"rfc822msgid:42@example.com", false},
+
+		// Labels and states
+		{"has:attachment", true},
+		{"has:userlabels", true},
+		{"has:nouserlabels", false},
+		{"is:unread", true},
+		{"is:read", false},
+		{"is:starred", false},
+		{"is:chat", false},
+		{"in:inbox", true},
+		{"in:anywhere", true},
+		{"in:chats", false},
+		{"label:finance/invoices", true},
+		{"label:finance-invoices", true},
+		{"label:receipts", false},
+		{"category:updates", true},
+		{"category:social", false},
+
+		// Size and dates
+		{"larger:10", true},
+		{"larger:1m", false},
+		{"size:10", true},
+		{"smaller:1m", true},
+		{"smaller:10", false},
+		{"after:2024/01/01", true},
+		{"after:2024/02/01", false},
+		{"before:2024-02-01", true},
+		{"older:2024/01/01", false},
+		{"newer:2024/01/01", true},
+		{"older_than:1d", true},
+		{"newer_than:1d", false},
+
+		// Negation, AND, OR and groups
+		{"-from:bob", true},
+		{"-from:alice", false},
+		{"from:alice subject:invoice", true},
+		{"from:alice AND subject:receipt", false},
+		{"from:bob OR subject:invoice", true},
+		{"from:bob OR subject:receipt", false},
+		{"{from:bob from:alice}", true},
+		{"-{from:bob from:carol}", true},
+		{"from:alice -(is:unread has:attachment)", false},
+		{"from:(alice OR bob)", true},
+
+		// Unknown operators are plain text; operators needing server data never match
+		{"foo:bar", false},
+		{"http://example.com", false},
+		{"has:drive", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			node, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery() error = %v", err)
+			}
+			if got := MatchQuery(node, msg); got != tt.want {
+				t.Errorf("MatchQuery(%s) = %v, want %v", node, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchQueryWords(t *testing.T) {
+	raw := "From: Joann Lee <joann@wholesale.example.com>\r\n" +
+		"To: ann@example.com, \"Sales Team\" <team@example.org>\r\n" +
+		"Subject: Wholesale prices\r\n" +
+		"\r\n" +
+		"Our clearance-sale starts today. 東京オフィス\r\n"
+	msg, err := ParseRawMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"sale", true},
+		{"sales", true},
+		{"wholesale", true},
+		{"whole", false},
+		{"clearance-sale", true},
+		{`"sale starts"`, true},
+		{`"starts sale"`, false},
+		{"東京", true},
+		{"オフィス", true},
+		{"subject:sale", false},
+		{"subject:wholesale", true},
+		{"from:ann", false},
+		{"from:joann", true},
+		{"from:lee", true},
+		{"from:wholesale.example.com", true},
+		{"from:sale", false},
+		{"to:ann", true},
+		{"to:ann@example.com", true},
+		{"to:an", false},
+		{"to:team", true},
+		{`to:"sales team"`, true},
+		{"to:example.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			node, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery() error = %v", err)
+			}
+			if got := MatchQuery(node, msg); got != tt.want {
+				t.Errorf("MatchQuery(%s) = %v, want %v", node, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchQueryRelativeDates(t *testing.T) {
+	msg := testLocalMessage(t)
+	msg.Date = time.Now().Add(-48 * time.Hour)
+
+	for query, want := range map[string]bool{"newer_than:3d": true, "older_than:1d": true, "older_than:3d": false} {
+		node, err := ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := MatchQuery(node, msg); got != want {
+			t.Errorf("MatchQuery(%s) = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestEvaluateFilters(t *testing.T) {
+	msg := testLocalMessage(t, "INBOX", "UNREAD")
+	filters := Filters{
+		{Criteria: &gmail.FilterCriteria{From: "alice@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Finance"}, RemoveLabelIds: []string{"INBOX"}}},
+		{Criteria: &gmail.FilterCriteria{From: "bob@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Other"}}},
+		{Criteria: &gmail.FilterCriteria{HasAttachment: true}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"UNREAD"}}},
+	}
+
+	result := EvaluateFilters(filters, msg)
+	if len(result.Matched) != 2 || result.Matched[0] != 0 || result.Matched[1] != 2 {
+		t.Errorf("Matched = %v, want [0 2]", result.Matched)
+	}
+	if len(result.Labels) != 1 || result.Labels[0] != "Finance" {
+		t.Errorf("Labels = %v, want [Finance]", result.Labels)
+	}
+}
+
+func TestParseGmailMessageLabels(t *testing.T) {
+	msg := &gmail.Message{
+		Id:       "m1",
+		Raw:      base64.URLEncoding.EncodeToString([]byte(testMessage)),
+		LabelIds: []string{"INBOX", "UNREAD", "Label_1", "Label_2"},
+	}
+	local, err := ParseGmailMessage(msg, map[string]string{"INBOX": "INBOX", "UNREAD": "UNREAD", "Label_1": "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"label:Receipts", true},
+		{"label:receipts", true},
+		{"label:Label_1", false},
+		{"label:Label_2", true},
+		{"in:inbox is:unread", true},
+		{"has:userlabels", true},
+	}
+	for _, tt := range tests {
+		node, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := MatchQuery(node, local); got != tt.want {
+			t.Errorf("MatchQuery(%q) = %v, want %v (labels %v)", tt.query, got, tt.want, local.Labels)
+		}
+	}
+}
+
+func TestEvaluableOffline(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"from:shop", true},
+		{"has:attachment label:Receipts", true},
+		{"has:userlabels OR has:nouserlabels", true},
+		{"has:drive", false},
+		{"from:shop OR has:yellow-star", false},
+		{"-has:document", false},
+		{"{subject:a has:spreadsheet}", false},
+	}
+	for _, tt := range tests {
+		node, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := EvaluableOffline(node); got != tt.want {
+			t.Errorf("EvaluableOffline(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExportedMessage is a raw message with the metadata needed to file it in a local archive.
+type ExportedMessage struct {
+	Id       string
+	ThreadId string
+	// Labels holds label names; system labels keep their IDs, such as INBOX or UNREAD.
+	Labels []string
+	Date   time.Time
+	Raw    []byte
+}
+
+// MessageWriter writes messages to a local archive.
+type MessageWriter interface {
+	// WriteMessage writes a message and returns its location in the archive.
+	WriteMessage(m *ExportedMessage) (string, error)
+	// UpdateLabels files a message already written at location under new labels and returns its
+	// new location. The message is passed without its raw data.
+	UpdateLabels(location string, m *ExportedMessage) (string, error)
+	Close() error
+}
+
+// NewMessageWriter creates a writer for the "mbox" or "maildir" format.
+// Existing archives are appended to. Only mbox archives can be encrypted.
+func NewMessageWriter(format, path string, enc *Encryption) (MessageWriter, error) {
+	switch format {
+	case "mbox":
+		return NewMboxWriter(path, enc)
+	case "maildir":
+		if enc.Encrypts() {
+			return nil, fmt.Errorf("maildir archives cannot be encrypted; use the mbox format")
+		}
+		return NewMaildirWriter(path)
+	}
+	return nil, fmt.Errorf("unknown format '%s', use mbox or maildir", format)
+}
+
+// MboxWriter writes messages to an mbox file in the mboxrd variant, with the Gmail labels of each
+// message in an X-Gmail-Labels header as in Google Takeout exports.
+type MboxWriter struct {
+	file    *os.File
+	sink    io.WriteCloser
+	w       *bufio.Writer
+	written *countingWriter
+	// prefix is prepended to the offsets of the messages, naming the segment they are in.
+	prefix string
+	// segment is the encrypted segment to create before the first message, encrypted with enc.
+	segment string
+	enc     *Encryption
+	closed  bool
+}
+
+// countingWriter counts the bytes written through it, starting from an initial offset.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewMboxWriter opens an mbox file for appending, creating it if needed. When enc encrypts, the
+// data is encrypted as a whole and cannot be appended to, so once the file holds messages every
+// later writer starts a new encrypted segment next to it (see MboxSegmentPath).
+func NewMboxWriter(path string, enc *Encryption) (*MboxWriter, error) {
+	segments := MboxSegments(path)
+	if !enc.Encrypts() && (len(segments) > 1 || isEncryptedFile(path)) {
+		return nil, fmt.Errorf("cannot append to %s: the archive is encrypted, pass the recipients or passphrase it was written with", path)
+	}
+	if enc.Encrypts() {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			return newMboxSegmentWriter(path, len(segments), enc), nil
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Errorf("Failed to open mbox file: %v", err)
+		return nil, fmt.Errorf("failed to open mbox file: %v", err)
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open mbox file: %v", err)
+	}
+	return newMboxWriter(file, offset, "", enc)
+}
+
+// newMboxSegmentWriter returns a writer of the nth encrypted segment of an mbox archive. The
+// segment is created with the first message, so runs without new messages add no segment.
+// Locations in it are prefixed with the segment number, as in "2:1024".
+func newMboxSegmentWriter(path string, n int, enc *Encryption) *MboxWriter {
+	return &MboxWriter{segment: MboxSegmentPath(path, n), prefix: strconv.Itoa(n) + ":", enc: enc}
+}
+
+// createSegment creates the segment the writer was opened for.
+func (m *MboxWriter) createSegment() error {
+	file, err := os.OpenFile(m.segment, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create mbox segment: %v", err)
+	}
+	logrus.Infof("Writing new messages to encrypted segment %s", m.segment)
+	opened, err := newMboxWriter(file, 0, m.prefix, m.enc)
+	if err != nil {
+		return err
+	}
+	m.file, m.sink, m.w, m.written = opened.file, opened.sink, opened.w, opened.written
+	return nil
+}
+
+// newMboxWriter writes messages to an open file whose data ends at offset.
+func newMboxWriter(file *os.File, offset int64, prefix string, enc *Encryption) (*MboxWriter, error) {
+	sink, err := enc.Encrypt(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Offsets are counted as the buffered data reaches the file, since the buffer flushes on its own
+	// whenever it fills up in the middle of a message
+	written := &countingWriter{w: sink, n: offset}
+	return &MboxWriter{file: file, sink: sink, w: bufio.NewWriter(written), written: written, prefix: prefix}, nil
+}
+
+// MboxSegmentPath returns the path of the nth encrypted segment of an mbox archive, such as
+// messages.mbox.2.age. The archive file itself is segment 0.
+func MboxSegmentPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d.age", path, n)
+}
+
+// MboxSegments returns the files of an mbox archive in the order they were written: the archive
+// file followed by its encrypted segments.
+func MboxSegments(path string) []string {
+	segments := []string{path}
+	for n := 1; ; n++ {
+		if _, err := os.Stat(MboxSegmentPath(path, n)); err != nil {
+			break
+		}
+		segments = append(segments, MboxSegmentPath(path, n))
+	}
+	return segments
+}
+
+// WriteMessage appends a message and returns its byte offset in the file. Line endings are converted
+// to LF and body lines starting with "From " are quoted with ">", so the archive can be read by any
+// mbox reader.
+func (m *MboxWriter) WriteMessage(msg *ExportedMessage) (string, error) {
+	if m.w == nil {
+		if err := m.createSegment(); err != nil {
+			return "", err
+		}
+	}
+	location := m.prefix + strconv.FormatInt(m.written.n+int64(m.w.Buffered()), 10)
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	fmt.Fprintf(m.w, "From %s@gmail %s\n", msg.Id, date.UTC().Format(time.ANSIC))
+	fmt.Fprintf(m.w, "X-GM-THRID: %s\n", msg.ThreadId)
+	fmt.Fprintf(m.w, "X-Gmail-Labels: %s\n", strings.Join(msg.Labels, ","))
+
+	raw := bytes.ReplaceAll(msg.Raw, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			m.w.WriteByte('>')
+		}
+		m.w.Write(line)
+	}
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		m.w.WriteByte('\n')
+	}
+	m.w.WriteByte('\n')
+
+	// Flush after every message so an interrupted export leaves complete messages only. Encrypted
+	// files are written in chunks and are complete once closed.
+	if err := m.w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write message %s: %v", msg.Id, err)
+	}
+	return location, nil
+}
+
+// UpdateLabels keeps the message where it is: mbox messages cannot be changed in place, so their
+// current labels are only tracked in the backup index.
+func (m *MboxWriter) UpdateLabels(location string, msg *ExportedMessage) (string, error) {
+	return location, nil
+}
+
+// Close flushes and closes the mbox file.
+func (m *MboxWriter) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.w == nil {
+		return nil
+	}
+	if err := m.w.Flush(); err != nil {
+		m.file.Close()
+		return err
+	}
+	if err := m.sink.Close(); err != nil {
+		m.file.Close()
+		return fmt.Errorf("failed to encrypt mbox file: %v", err)
+	}
+	return m.file.Close()
+}
+
+// MaildirWriter writes messages to a Maildir++ directory. Inbox messages go to the top level,
+// every other label becomes a folder (".Work.Projects" for Work/Projects), and messages in no
+// folder go to ".Archive". A message with several labels is stored in each of their folders.
+type MaildirWriter struct {
+	root string
+}
+
+// NewMaildirWriter creates the Maildir root if needed.
+func NewMaildirWriter(root string) (*MaildirWriter, error) {
+	w := &MaildirWriter{root: root}
+	if err := w.ensureFolder(root); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// maildirSystemFolders maps system labels to Maildir folders; system labels not listed are flags or ignored.
+var maildirSystemFolders = map[string]string{
+	"INBOX": "",
+	"SENT":  "Sent",
+	"DRAFT": "Drafts",
+	"TRASH": "Trash",
+	"SPAM":  "Spam",
+}
+
+// WriteMessage stores a message in the folders of its labels. UNREAD and STARRED become the
+// Maildir "seen" and "flagged" flags. Files are named after the message ID, so writing a message
+// again replaces it. The returned location is the path of the first copy, relative to the Maildir root.
+func (w *MaildirWriter) WriteMessage(msg *ExportedMessage) (string, error) {
+	flags := "S"
+	var folders []string
+	for _, label := range msg.Labels {
+		switch {
+		case label == "UNREAD":
+			flags = strings.TrimSuffix(flags, "S")
+		case label == "STARRED":
+			flags = "F" + flags
+		case isSystemLabelId(label):
+			if folder, ok := maildirSystemFolders[label]; ok {
+				folders = append(folders, folder)
+			}
+		default:
+			folders = append(folders, label)
+		}
+	}
+	if len(folders) == 0 {
+		folders = []string{"Archive"}
+	}
+
+	// The file name must not change between exports, so undated messages get a fixed date
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	name := fmt.Sprintf("%d.%s.gmail", date.Unix(), msg.Id)
+
+	var location string
+	for _, folder := range folders {
+		dir := w.FolderPath(folder)
+		if err := w.ensureFolder(dir); err != nil {
+			return "", err
+		}
+		// Drop an earlier copy of the message, which may carry other flags
+		previous, _ := filepath.Glob(filepath.Join(dir, "cur", name+":2,*"))
+		for _, path := range previous {
+			_ = os.Remove(path)
+		}
+
+		tmp := filepath.Join(dir, "tmp", name)
+		if err := os.WriteFile(tmp, msg.Raw, 0600); err != nil {
+			return "", fmt.Errorf("failed to write message %s: %v", msg.Id, err)
+		}
+		path := filepath.Join(dir, "cur", name+":2,"+flags)
+		if err := os.Rename(tmp, path); err != nil {
+			return "", fmt.Errorf("failed to deliver message %s: %v", msg.Id, err)
+		}
+		if location == "" {
+			location, _ = filepath.Rel(w.root, path)
+		}
+	}
+	return location, nil
+}
+
+// UpdateLabels moves a message to the folders and flags of its new labels.
+func (w *MaildirWriter) UpdateLabels(location string, msg *ExportedMessage) (string, error) {
+	raw, err := os.ReadFile(filepath.Join(w.root, location))
+	if err != nil {
+		return "", fmt.Errorf("failed to read message %s from the archive: %v", msg.Id, err)
+	}
+
+	copies, _ := filepath.Glob(filepath.Join(w.root, "cur", "*."+msg.Id+".gmail:2,*"))
+	nested, _ := filepath.Glob(filepath.Join(w.root, ".*", "cur", "*."+msg.Id+".gmail:2,*"))
+	for _, path := range append(copies, nested...) {
+		if err := os.Remove(path); err != nil {
+			return "", fmt.Errorf("failed to remove message %s from the archive: %v", msg.Id, err)
+		}
+	}
+
+	updated := *msg
+	updated.Raw = raw
+	return w.WriteMessage(&updated)
+}
+
+// FolderPath returns the directory of a Maildir++ folder; the empty folder is the inbox.
+func (w *MaildirWriter) FolderPath(folder string) string {
+	if folder == "" {
+		return w.root
+	}
+	name := strings.NewReplacer(".", "_", "/", ".").Replace(folder)
+	return filepath.Join(w.root, "."+name)
+}
+
+// ensureFolder creates the cur, new and tmp directories of a folder.
+func (w *MaildirWriter) ensureFolder(dir string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return fmt.Errorf("failed to create Maildir folder: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close does nothing; every message is written as soon as it is exported.
+func (w *MaildirWriter) Close() error {
+	return nil
+}
+
+// ExportMessages fetches the messages matching a query in raw format and writes them one by one,
+// so memory use does not grow with the size of the mailbox. labelNames maps label IDs to names.
+// When an index is given, messages already in it are skipped and written ones are recorded.
+// It returns the number of messages written.
+func (s *Service) ExportMessages(ctx context.Context, query string, labelNames map[string]string, w MessageWriter, index *BackupIndex) (int, error) {
+	logrus.Infof("Exporting messages matching '%s'...", query)
+
+	var exported int
+	var pageToken string
+	for {
+		page, next, err := s.MessagesPage(ctx, query, pageToken)
+		if err != nil {
+			return exported, err
+		}
+
+		for _, ref := range page {
+			if index != nil && index.Messages[ref.Id] != nil {
+				continue
+			}
+			msg, err := s.ExportMessage(ctx, ref.Id, labelNames)
+			// Messages deleted since the page was listed are skipped
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return exported, err
+			}
+			location, err := w.WriteMessage(msg)
+			if err != nil {
+				return exported, err
+			}
+			if index != nil {
+				index.Record(msg, location)
+			}
+			exported++
+			if exported%100 == 0 {
+				logrus.Infof("Exported %d messages...", exported)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		pageToken = next
+	}
+
+	logrus.Infof("Exported %d messages.", exported)
+	return exported, nil
+}
+
+// ExportMessage fetches a message in raw format with its label names.
+func (s *Service) ExportMessage(ctx context.Context, id string, labelNames map[string]string) (*ExportedMessage, error) {
+	msg, err := s.Client.GetMessage(ctx, id, "raw")
+	if err != nil {
+		logrus.Errorf("Failed to fetch message %s: %v", id, err)
+		return nil, err
+	}
+	raw, err := decodeBase64URL(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode raw message %s: %v", id, err)
+	}
+
+	exported := &ExportedMessage{Id: msg.Id, ThreadId: msg.ThreadId, Raw: raw}
+	if msg.InternalDate > 0 {
+		exported.Date = time.UnixMilli(msg.InternalDate)
+	} else if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		exported.Date, _ = parsed.Header.Date()
+	}
+	exported.Labels = exportedLabels(msg.LabelIds, labelNames)
+	return exported, nil
+}
+
+// exportedLabels maps label IDs to the names written to archives; system labels keep their IDs.
+func exportedLabels(labelIds []string, labelNames map[string]string) []string {
+	var labels []string
+	for _, labelId := range labelIds {
+		name := labelNames[labelId]
+		if name == "" || isSystemLabelId(labelId) {
+			name = labelId
+		}
+		labels = append(labels, name)
+	}
+	return labels
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// exportedMessage builds a message with a body of the given size, including a line mbox quotes.
+func exportedMessage(id string, bodySize int, labels ...string) *ExportedMessage {
+	body := strings.Repeat("All work and no play.\r\n", bodySize/23+1)
+	raw := "From: sender@example.com\r\nSubject: Message " + id + "\r\n\r\n" + body + "From here on it is quoted.\r\n"
+	return &ExportedMessage{
+		Id:       id,
+		ThreadId: "t" + id,
+		Labels:   labels,
+		Date:     time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC),
+		Raw:      []byte(raw),
+	}
+}
+
+func TestMboxWriterRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.mbox")
+
+	// Messages larger than the write buffer make it flush in the middle of a message
+	messages := []*ExportedMessage{
+		exportedMessage("a", 100, "INBOX", "UNREAD"),
+		exportedMessage("b", 10000, "Receipts"),
+		exportedMessage("c", 50),
+		exportedMessage("d", 70000, "INBOX", "Work/Projects"),
+		exportedMessage("e", 10),
+	}
+	locations := make(map[string]string)
+
+	// Write in two runs, so the second one appends to the existing file
+	for _, batch := range [][]*ExportedMessage{messages[:3], messages[3:]} {
+		writer, err := NewMboxWriter(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range batch {
+			location, err := writer.WriteMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locations[msg.Id] = location
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		offset, err := strconv.Atoi(locations[msg.Id])
+		if err != nil || offset >= len(data) {
+			t.Fatalf("message %s location %q is not an offset in the file", msg.Id, locations[msg.Id])
+		}
+		if want := fmt.Sprintf("From %s@gmail ", msg.Id); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Errorf("message %s at offset %d starts with %q, want %q", msg.Id, offset, data[offset:offset+20], want)
+		}
+	}
+
+	reader, err := NewMboxReader(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for _, msg := range messages {
+		archived, err := reader.Next()
+		if err != nil {
+			t.Fatalf("reading message %s: %v", msg.Id, err)
+		}
+		if archived.Location != locations[msg.Id] {
+			t.Errorf("message %s read at %s, written at %s", msg.Id, archived.Location, locations[msg.Id])
+		}
+		if fmt.Sprint(archived.Labels) != fmt.Sprint(msg.Labels) {
+			t.Errorf("message %s labels = %v, want %v", msg.Id, archived.Labels, msg.Labels)
+		}
+		want := bytes.ReplaceAll(msg.Raw, []byte("\r\n"), []byte("\n"))
+		if !bytes.Equal(archived.Raw, want) {
+			t.Errorf("message %s was not read back as written:\n%q\nwant\n%q", msg.Id, archived.Raw[:min(len(archived.Raw), 200)], want[:200])
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() after the last message = %v, want io.EOF", err)
+	}
+}
+
+func TestEncryptedMboxSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.mbox")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &Encryption{Recipients: []age.Recipient{identity.Recipient()}, Identities: []age.Identity{identity}}
+
+	// Every run after the first writes its messages to a new segment; runs without messages add none
+	locations := make(map[string]string)
+	runs := [][]*ExportedMessage{
+		{exportedMessage("a", 100), exportedMessage("b", 10000)},
+		nil,
+		{exportedMessage("c", 50)},
+		{exportedMessage("d", 70000), exportedMessage("e", 10)},
+	}
+	var messages []*ExportedMessage
+	for _, run := range runs {
+		writer, err := NewMboxWriter(path, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range run {
+			location, err := writer.WriteMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locations[msg.Id] = location
+			messages = append(messages, msg)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{path, path + ".1.age", path + ".2.age"}
+	if segments := MboxSegments(path); fmt.Sprint(segments) != fmt.Sprint(want) {
+		t.Fatalf("MboxSegments() = %v, want %v", segments, want)
+	}
+	for _, segment := range want {
+		if !isEncryptedFile(segment) {
+			t.Errorf("%s is not encrypted", segment)
+		}
+	}
+	if _, err := NewMboxWriter(path, nil); err == nil {
+		t.Error("NewMboxWriter() appends plaintext to an encrypted archive")
+	}
+
+	reader, err := NewMessageReader(path, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for _, msg := range messages {
+		archived, err := reader.Next()
+		if err != nil {
+			t.Fatalf("reading message %s: %v", msg.Id, err)
+		}
+		if archived.Location != locations[msg.Id] {
+			t.Errorf("message %s read at %s, written at %s", msg.Id, archived.Location, locations[msg.Id])
+		}
+		if !bytes.Equal(archived.Raw, bytes.ReplaceAll(msg.Raw, []byte("\r\n"), []byte("\n"))) {
+			t.Errorf("message %s was not read back as written", msg.Id)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Next() after the last message = %v, want io.EOF", err)
+	}
+}
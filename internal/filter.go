@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -8,71 +11,325 @@ import (
 )
 
 // Filters fetches all Gmail filters for the user.
-func (s *Service) Filters() (Filters, error) {
+func (s *Service) Filters(ctx context.Context) (Filters, error) {
 	logrus.Info("Fetching Gmail filters...")
-	res, err := s.Service.Users.Settings.Filters.List(userId).Do()
+	filters, err := s.Client.ListFilters(ctx)
 	if err != nil {
 		logrus.Errorf("Failed to fetch Gmail filters: %v", err)
 		return nil, err
 	}
-	logrus.Infof("Fetched %d filters successfully.", len(res.Filter))
-	return res.Filter, nil
+	logrus.Infof("Fetched %d filters successfully.", len(filters))
+	return filters, nil
 }
 
 // ApplyFilterActions applies the actions defined in a Gmail filter to a set of messages.
-func (s *Service) ApplyFilterActions(action *gmail.FilterAction, messages []*gmail.Message) error {
+// When a journal is set, the labels actually added and removed on each message are recorded.
+func (s *Service) ApplyFilterActions(ctx context.Context, action *gmail.FilterAction, messages []*gmail.Message) error {
 	logrus.Infof("Applying filter actions to %d messages...", len(messages))
 
 	for _, msg := range messages {
+		if err := ctx.Err(); err != nil {
+			logrus.Warnf("Stopping before message %s: %v", msg.Id, err)
+			return err
+		}
+
 		modifyReq := &gmail.ModifyMessageRequest{
 			AddLabelIds:    action.AddLabelIds,
 			RemoveLabelIds: action.RemoveLabelIds,
 		}
 
-		_, err := s.Users.Messages.Modify(userId, msg.Id, modifyReq).Do()
+		// Fetch the current labels so that only real changes end up in the journal
+		if s.Journal != nil && msg.LabelIds == nil {
+			current, err := s.Client.GetMessage(ctx, msg.Id, "minimal")
+			if err != nil {
+				logrus.Errorf("Failed to fetch labels of message %s: %v", msg.Id, err)
+				return err
+			}
+			msg.LabelIds = current.LabelIds
+		}
+
+		// The modification is not cancelled midway, so it is always journaled once sent
+		_, err := s.Client.ModifyMessage(context.WithoutCancel(ctx), msg.Id, modifyReq)
 		if err != nil {
 			logrus.Errorf("Failed to apply filter actions to message %s: %v", msg.Id, err)
 			return err
 		}
 		logrus.Debugf("Filter actions applied successfully to message %s", msg.Id)
+
+		if s.Journal != nil {
+			added, removed := labelDelta(msg.LabelIds, action.AddLabelIds, action.RemoveLabelIds)
+			if err := s.Journal.Record(msg.Id, added, removed); err != nil {
+				return err
+			}
+		}
 	}
 
 	logrus.Info("Filter actions applied successfully to all messages.")
 	return nil
 }
 
+// ApplyFilterActionsToPage applies the actions of a Gmail filter to a page of messages with batch
+// requests. When a journal is set, the label changes the requests actually made are read back from
+// the mailbox history, so only real changes are journaled without fetching every message.
+func (s *Service) ApplyFilterActionsToPage(ctx context.Context, action *gmail.FilterAction, messageIds []string) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		logrus.Warnf("Stopping before %d messages: %v", len(messageIds), err)
+		return err
+	}
+
+	var startHistoryId uint64
+	if s.Journal != nil {
+		profile, err := s.Client.GetProfile(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to fetch the mailbox history ID: %v", err)
+			return err
+		}
+		startHistoryId = profile.HistoryId
+	}
+
+	// The modifications are not cancelled midway, so they are always journaled once sent
+	for start := 0; start < len(messageIds); start += batchModifyLimit {
+		batch := messageIds[start:min(start+batchModifyLimit, len(messageIds))]
+		err := s.Client.BatchModifyMessages(context.WithoutCancel(ctx), &gmail.BatchModifyMessagesRequest{
+			Ids:            batch,
+			AddLabelIds:    action.AddLabelIds,
+			RemoveLabelIds: action.RemoveLabelIds,
+		})
+		if err != nil {
+			logrus.Errorf("Failed to apply filter actions to a batch of %d messages: %v", len(batch), err)
+			return err
+		}
+	}
+	logrus.Debugf("Filter actions applied to %d messages", len(messageIds))
+
+	if s.Journal != nil {
+		return s.journalLabelChanges(context.WithoutCancel(ctx), startHistoryId, messageIds, action)
+	}
+	return nil
+}
+
+// journalLabelChanges records the labels of a filter action that the mailbox history shows were added
+// to or removed from the given messages after a history ID.
+func (s *Service) journalLabelChanges(ctx context.Context, startHistoryId uint64, messageIds []string, action *gmail.FilterAction) error {
+	type change struct{ added, removed []string }
+	changes := make(map[string]*change, len(messageIds))
+	for _, id := range messageIds {
+		changes[id] = &change{}
+	}
+
+	var pageToken string
+	for {
+		page, err := s.Client.ListHistory(ctx, startHistoryId, pageToken)
+		if err != nil {
+			logrus.Errorf("Failed to fetch the label changes to journal: %v", err)
+			return err
+		}
+		for _, h := range page.History {
+			for _, m := range h.LabelsAdded {
+				if c := changes[m.Message.Id]; c != nil {
+					c.added = append(c.added, intersectLabels(m.LabelIds, action.AddLabelIds)...)
+				}
+			}
+			for _, m := range h.LabelsRemoved {
+				if c := changes[m.Message.Id]; c != nil {
+					c.removed = append(c.removed, intersectLabels(m.LabelIds, action.RemoveLabelIds)...)
+				}
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	for _, id := range messageIds {
+		if err := s.Journal.Record(id, changes[id].added, changes[id].removed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intersectLabels returns the labels that are also in another list.
+func intersectLabels(labels, other []string) []string {
+	var common []string
+	for _, l := range labels {
+		if hasAnyLabel(other, l) {
+			common = append(common, l)
+		}
+	}
+	return common
+}
+
+// labelDelta returns the labels a modification actually adds to and removes from a message with the given labels.
+func labelDelta(current, add, remove []string) (added, removed []string) {
+	has := make(map[string]bool, len(current))
+	for _, l := range current {
+		has[l] = true
+	}
+	for _, l := range add {
+		if !has[l] {
+			added = append(added, l)
+		}
+	}
+	for _, l := range remove {
+		if has[l] {
+			removed = append(removed, l)
+		}
+	}
+	return added, removed
+}
+
 // BuildQueryFromFilter constructs a Gmail search query from a filter's criteria.
-func (s *Service) BuildQueryFromFilter(criteria *gmail.FilterCriteria) string {
+func (s *Service) BuildQueryFromFilter(criteria *gmail.FilterCriteria) (string, error) {
+	return QueryFromCriteria(criteria)
+}
+
+// QueryFromCriteria translates every field of a filter's criteria into Gmail search syntax,
+// the same way Gmail itself shows a filter as a search. The parts are combined with AND.
+//
+// Multi-word From, To and Subject values are grouped in parentheses, NegatedQuery becomes
+// a negated {} group (none of the words), and Size maps to larger: or smaller: in bytes.
+// Values with unbalanced quotes, parentheses or braces and unknown size comparisons cannot be
+// translated without changing what they match, so they are an error.
+func QueryFromCriteria(criteria *gmail.FilterCriteria) (string, error) {
+	if criteria == nil {
+		logrus.Warn("No criteria provided for filter. Returning an empty query.")
+		return "", nil
+	}
+
 	var queryParts []string
-	if criteria.From != "" {
-		queryParts = append(queryParts, "from:"+criteria.From)
+	for _, field := range []struct{ name, prefix, value string }{
+		{"from", "from:", criteria.From},
+		{"to", "to:", criteria.To},
+		{"subject", "subject:", criteria.Subject},
+		{"query", "", criteria.Query},
+	} {
+		v, err := queryValue(field.value)
+		if err != nil {
+			return "", fmt.Errorf("%s '%s': %v", field.name, field.value, err)
+		}
+		if v != "" {
+			queryParts = append(queryParts, field.prefix+v)
+		}
 	}
-	if criteria.To != "" {
-		queryParts = append(queryParts, "to:"+criteria.To)
+	if v := strings.TrimSpace(criteria.NegatedQuery); v != "" {
+		switch {
+		case isSimpleQueryValue(v):
+			queryParts = append(queryParts, "-"+v)
+		case isBalancedQueryValue(v):
+			queryParts = append(queryParts, "-{"+v+"}")
+		default:
+			return "", fmt.Errorf("negatedQuery '%s': unbalanced quotes, parentheses or braces", criteria.NegatedQuery)
+		}
 	}
-	if criteria.Subject != "" {
-		queryParts = append(queryParts, "subject:"+criteria.Subject)
+	if criteria.HasAttachment {
+		queryParts = append(queryParts, "has:attachment")
 	}
-	if criteria.Query != "" {
-		queryParts = append(queryParts, criteria.Query)
+	if criteria.ExcludeChats {
+		queryParts = append(queryParts, "-in:chats")
+	}
+	if criteria.Size > 0 {
+		switch criteria.SizeComparison {
+		case "larger":
+			queryParts = append(queryParts, fmt.Sprintf("larger:%d", criteria.Size))
+		case "smaller":
+			queryParts = append(queryParts, fmt.Sprintf("smaller:%d", criteria.Size))
+		default:
+			return "", fmt.Errorf("size %d has unsupported size comparison '%s'", criteria.Size, criteria.SizeComparison)
+		}
 	}
 
 	// If no criteria is provided, return an empty query
 	if len(queryParts) == 0 {
 		logrus.Warn("No criteria provided for filter. Returning an empty query.")
-		return ""
+		return "", nil
 	}
 
 	query := "(" + strings.Join(queryParts, " ") + ")"
 	logrus.Debugf("Constructed query from filter criteria: %s", query)
-	return query
+	return query, nil
+}
+
+// DescribeFilter returns the search query of a filter's criteria for messages, or the criteria
+// fields themselves when they cannot be translated.
+func DescribeFilter(criteria *gmail.FilterCriteria) string {
+	query, err := QueryFromCriteria(criteria)
+	if err == nil || criteria == nil {
+		return query
+	}
+	data, _ := json.Marshal(criteria)
+	return string(data)
+}
+
+// queryValue formats a criteria value as a single Gmail search term.
+//
+// A single word is used as is. Several words are grouped in parentheses, which keeps Gmail's
+// filter semantics (all words must match, OR and quoted phrases keep working). Values whose
+// quotes or parentheses are unbalanced cannot be grouped safely, and Gmail has no escape
+// character, so they are an error.
+func queryValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return "", nil
+	case isSimpleQueryValue(value):
+		return value, nil
+	case isBalancedQueryValue(value):
+		if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") && isBalancedQueryValue(value[1:len(value)-1]) {
+			return value, nil
+		}
+		return "(" + value + ")", nil
+	default:
+		return "", fmt.Errorf("unbalanced quotes, parentheses or braces")
+	}
+}
+
+// isSimpleQueryValue reports whether a value is a single search word without grouping characters.
+func isSimpleQueryValue(value string) bool {
+	return !strings.ContainsAny(value, " \t\n(){}\"")
+}
+
+// isBalancedQueryValue reports whether the quotes, parentheses and braces of a value are balanced.
+func isBalancedQueryValue(value string) bool {
+	var stack []rune
+	inQuote := false
+	for _, r := range value {
+		if r == '"' {
+			inQuote = !inQuote
+			continue
+		}
+		if inQuote {
+			continue
+		}
+		switch r {
+		case '(', '{':
+			stack = append(stack, r)
+		case ')', '}':
+			open := '('
+			if r == '}' {
+				open = '{'
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return !inQuote && len(stack) == 0
 }
 
 // DeleteFilters deletes Gmail filters for the user.
-func (s *Service) DeleteFilters(filters Filters) error {
+func (s *Service) DeleteFilters(ctx context.Context, filters Filters) error {
 	logrus.Infof("Deleting %d Gmail filters...", len(filters))
 	for _, filter := range filters {
-		err := s.Users.Settings.Filters.Delete(userId, filter.Id).Do()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.Client.DeleteFilter(ctx, filter.Id)
 		if err != nil {
 			logrus.Errorf("Failed to delete filter %s: %v", filter.Id, err)
 		} else {
@@ -84,11 +341,14 @@ func (s *Service) DeleteFilters(filters Filters) error {
 }
 
 // CreateFilters creates new Gmail filters for the user.
-func (s *Service) CreateFilters(f Filters) error {
+func (s *Service) CreateFilters(ctx context.Context, f Filters) error {
 	logrus.Infof("Creating %d Gmail filters...", len(f))
 
 	for _, filter := range f {
-		newFilter, err := s.Service.Users.Settings.Filters.Create(userId, filter).Do()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		newFilter, err := s.Client.CreateFilter(ctx, filter)
 		if err != nil {
 			logrus.Errorf("Failed to create filter: %v", err)
 		} else {
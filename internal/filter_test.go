@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestQueryFromCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria *gmail.FilterCriteria
+		want     string
+	}{
+		{"nil criteria", nil, ""},
+		{"empty criteria", &gmail.FilterCriteria{}, ""},
+		{"from", &gmail.FilterCriteria{From: "alice@example.com"}, "(from:alice@example.com)"},
+		{"from with several words", &gmail.FilterCriteria{From: "alice OR bob"}, "(from:(alice OR bob))"},
+		{"from already grouped", &gmail.FilterCriteria{From: "(alice OR bob)"}, "(from:(alice OR bob))"},
+		{"to", &gmail.FilterCriteria{To: "team@example.com"}, "(to:team@example.com)"},
+		{"subject phrase", &gmail.FilterCriteria{Subject: `"weekly report"`}, `(subject:("weekly report"))`},
+		{"subject words", &gmail.FilterCriteria{Subject: "weekly report"}, "(subject:(weekly report))"},
+		{"query", &gmail.FilterCriteria{Query: "list:dev.example.com"}, "(list:dev.example.com)"},
+		{"query with operators", &gmail.FilterCriteria{Query: "from:a OR from:b"}, "((from:a OR from:b))"},
+		{"negated word", &gmail.FilterCriteria{NegatedQuery: "unsubscribe"}, "(-unsubscribe)"},
+		{"negated words", &gmail.FilterCriteria{NegatedQuery: "sale offer"}, "(-{sale offer})"},
+		{"has attachment", &gmail.FilterCriteria{HasAttachment: true}, "(has:attachment)"},
+		{"exclude chats", &gmail.FilterCriteria{ExcludeChats: true}, "(-in:chats)"},
+		{"larger", &gmail.FilterCriteria{Size: 1048576, SizeComparison: "larger"}, "(larger:1048576)"},
+		{"smaller", &gmail.FilterCriteria{Size: 1024, SizeComparison: "smaller"}, "(smaller:1024)"},
+		{
+			"every field",
+			&gmail.FilterCriteria{
+				From: "alice@example.com", To: "me@example.com", Subject: "invoice", Query: "has:pdf",
+				NegatedQuery: "draft", HasAttachment: true, ExcludeChats: true, Size: 10, SizeComparison: "larger",
+			},
+			"(from:alice@example.com to:me@example.com subject:invoice has:pdf -draft has:attachment -in:chats larger:10)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := QueryFromCriteria(tt.criteria)
+			if err != nil {
+				t.Fatalf("QueryFromCriteria() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("QueryFromCriteria() = %q, want %q", got, tt.want)
+			}
+			if got == "" {
+				return
+			}
+			if _, err := ParseQuery(got); err != nil {
+				t.Errorf("ParseQuery(%q) error = %v", got, err)
+			}
+		})
+	}
+}
+
+func TestQueryFromCriteriaErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria *gmail.FilterCriteria
+	}{
+		{"unbalanced parenthesis in query", &gmail.FilterCriteria{Query: "from:(a"}},
+		{"unbalanced quote in from", &gmail.FilterCriteria{From: `"alice`}},
+		{"unbalanced brace in to", &gmail.FilterCriteria{To: "{a b"}},
+		{"unbalanced closing parenthesis in subject", &gmail.FilterCriteria{Subject: "a) b"}},
+		{"unbalanced negated query", &gmail.FilterCriteria{NegatedQuery: "(a b"}},
+		{"size without comparison", &gmail.FilterCriteria{Size: 10}},
+		{"unknown size comparison", &gmail.FilterCriteria{Size: 10, SizeComparison: "equal"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := QueryFromCriteria(tt.criteria); err == nil {
+				t.Errorf("QueryFromCriteria() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestDescribeFilter(t *testing.T) {
+	if got := DescribeFilter(&gmail.FilterCriteria{From: "a@example.com"}); got != "(from:a@example.com)" {
+		t.Errorf("DescribeFilter() = %q", got)
+	}
+	if got := DescribeFilter(&gmail.FilterCriteria{Query: "from:(a"}); got != `{"query":"from:(a"}` {
+		t.Errorf("DescribeFilter() = %q", got)
+	}
+}
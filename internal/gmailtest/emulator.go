@@ -0,0 +1,313 @@
+// Package gmailtest provides test doubles of the Gmail API: FakeClient, an in-memory mailbox
+// implementing internal.Client, and an HTTP emulator of the Gmail REST API for integration tests.
+//
+// The emulator serves the endpoints the tool uses (labels, settings/filters, messages
+// list/get/import/attachments/modify/batchModify/trash, threads get, drafts, history, watch/stop
+// and profile) on top of a FakeClient, so it assigns realistic IDs, paginates, validates requests and
+// can simulate quota errors. Point a Service at it with internal.WithEndpoint to run real commands end-to-end.
+package gmailtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Emulator is an http.Handler that emulates the Gmail REST API.
+type Emulator struct {
+	// Fake holds the state of the emulated mailbox.
+	Fake *FakeClient
+
+	// QuotaPerSecond is the number of quota units allowed per second; zero means unlimited.
+	// Requests over the limit fail with 429 and a Retry-After header, like Gmail's per-user limit.
+	QuotaPerSecond float64
+
+	// PushURL, when set, receives a Pub/Sub push delivery for every mailbox change while a watch
+	// is active, like a push subscription on the watch's topic.
+	PushURL string
+	// PushSubscription is the subscription name sent in push deliveries.
+	PushSubscription string
+	// PushIDToken, when set, is sent as the bearer token of push deliveries.
+	PushIDToken string
+
+	mu          sync.Mutex
+	failures    []failure
+	windowStart time.Time
+	windowUsed  float64
+	requests    int
+}
+
+// failure is an error injected with FailNext.
+type failure struct {
+	code   int
+	reason string
+}
+
+// New creates an emulator serving the given fake mailbox.
+func New(fake *FakeClient) *Emulator {
+	e := &Emulator{Fake: fake, PushSubscription: "projects/emulator/subscriptions/gmail"}
+	fake.Notify = e.notify
+	return e
+}
+
+// Start serves the emulator on a local httptest server. Its URL is the endpoint to pass to internal.WithEndpoint.
+func (e *Emulator) Start() *httptest.Server {
+	return httptest.NewServer(e)
+}
+
+// FailNext makes the next n requests fail with the given status code and error reason,
+// for example FailNext(http.StatusServiceUnavailable, "backendError", 2).
+func (e *Emulator) FailNext(code int, reason string, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		e.failures = append(e.failures, failure{code: code, reason: reason})
+	}
+}
+
+// Requests returns the number of requests served so far.
+func (e *Emulator) Requests() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.requests
+}
+
+// ServeHTTP routes a Gmail API request to the fake mailbox.
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("Emulator: %s %s", r.Method, r.URL.RequestURI())
+	if e.intercept(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/")
+	if path == r.URL.Path {
+		writeError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+	user, rest, _ := strings.Cut(path, "/")
+	profile, _ := e.Fake.GetProfile(r.Context())
+	if user != "me" && user != profile.EmailAddress {
+		writeError(w, http.StatusForbidden, "forbidden", "Delegation denied for "+user)
+		return
+	}
+
+	ctx := r.Context()
+	query := r.URL.Query()
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "profile" && r.Method == http.MethodGet:
+		writeJSON(w, profile, nil)
+
+	case rest == "labels" && r.Method == http.MethodGet:
+		labels, err := e.Fake.ListLabels(ctx)
+		writeJSON(w, &gmail.ListLabelsResponse{Labels: labels}, err)
+	case rest == "labels" && r.Method == http.MethodPost:
+		var label gmail.Label
+		if decode(w, r, &label) {
+			created, err := e.Fake.CreateLabel(ctx, &label)
+			writeJSON(w, created, err)
+		}
+	case len(parts) == 2 && parts[0] == "labels" && r.Method == http.MethodGet:
+		labels, _ := e.Fake.ListLabels(ctx)
+		for _, l := range labels {
+			if l.Id == parts[1] {
+				writeJSON(w, l, nil)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.")
+	case len(parts) == 2 && parts[0] == "labels" && r.Method == http.MethodDelete:
+		writeEmpty(w, e.Fake.DeleteLabel(ctx, parts[1]))
+
+	case rest == "settings/filters" && r.Method == http.MethodGet:
+		filters, err := e.Fake.ListFilters(ctx)
+		writeJSON(w, &gmail.ListFiltersResponse{Filter: filters}, err)
+	case rest == "settings/filters" && r.Method == http.MethodPost:
+		var filter gmail.Filter
+		if decode(w, r, &filter) {
+			created, err := e.Fake.CreateFilter(ctx, &filter)
+			writeJSON(w, created, err)
+		}
+	case len(parts) == 3 && parts[0] == "settings" && parts[1] == "filters" && r.Method == http.MethodGet:
+		filters, _ := e.Fake.ListFilters(ctx)
+		for _, f := range filters {
+			if f.Id == parts[2] {
+				writeJSON(w, f, nil)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "notFound", "Filter not found")
+	case len(parts) == 3 && parts[0] == "settings" && parts[1] == "filters" && r.Method == http.MethodDelete:
+		writeEmpty(w, e.Fake.DeleteFilter(ctx, parts[2]))
+
+	case rest == "messages" && r.Method == http.MethodGet:
+		maxResults, _ := strconv.ParseInt(query.Get("maxResults"), 10, 64)
+		res, err := e.Fake.ListMessages(ctx, query.Get("q"), query.Get("pageToken"), maxResults)
+		writeJSON(w, res, err)
+	case rest == "messages/import" && r.Method == http.MethodPost:
+		var msg gmail.Message
+		if decode(w, r, &msg) {
+			imported, err := e.Fake.ImportMessage(ctx, &msg)
+			writeJSON(w, imported, err)
+		}
+	case rest == "messages/batchModify" && r.Method == http.MethodPost:
+		var req gmail.BatchModifyMessagesRequest
+		if decode(w, r, &req) {
+			writeEmpty(w, e.Fake.BatchModifyMessages(ctx, &req))
+		}
+	case len(parts) == 2 && parts[0] == "messages" && r.Method == http.MethodGet:
+		format := query.Get("format")
+		if format == "" {
+			format = "full"
+		}
+		msg, err := e.Fake.GetMessage(ctx, parts[1], format)
+		writeJSON(w, msg, err)
+	case len(parts) == 2 && parts[0] == "threads" && r.Method == http.MethodGet:
+		format := query.Get("format")
+		if format == "" {
+			format = "full"
+		}
+		thread, err := e.Fake.GetThread(ctx, parts[1], format)
+		writeJSON(w, thread, err)
+	case len(parts) == 4 && parts[0] == "messages" && parts[2] == "attachments" && r.Method == http.MethodGet:
+		body, err := e.Fake.GetAttachment(ctx, parts[1], parts[3])
+		writeJSON(w, body, err)
+	case len(parts) == 3 && parts[0] == "messages" && parts[2] == "modify" && r.Method == http.MethodPost:
+		var req gmail.ModifyMessageRequest
+		if decode(w, r, &req) {
+			msg, err := e.Fake.ModifyMessage(ctx, parts[1], &req)
+			writeJSON(w, msg, err)
+		}
+	case len(parts) == 3 && parts[0] == "messages" && parts[2] == "trash" && r.Method == http.MethodPost:
+		msg, err := e.Fake.TrashMessage(ctx, parts[1])
+		writeJSON(w, msg, err)
+
+	case rest == "drafts" && r.Method == http.MethodPost:
+		var draft gmail.Draft
+		if decode(w, r, &draft) {
+			created, err := e.Fake.CreateDraft(ctx, &draft)
+			writeJSON(w, created, err)
+		}
+
+	case rest == "watch" && r.Method == http.MethodPost:
+		var req gmail.WatchRequest
+		if decode(w, r, &req) {
+			res, err := e.Fake.Watch(ctx, &req)
+			writeJSON(w, res, err)
+		}
+	case rest == "stop" && r.Method == http.MethodPost:
+		writeEmpty(w, e.Fake.StopWatch(ctx))
+
+	case rest == "history" && r.Method == http.MethodGet:
+		start, err := strconv.ParseUint(query.Get("startHistoryId"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid startHistoryId")
+			return
+		}
+		res, err := e.Fake.ListHistory(ctx, start, query.Get("pageToken"))
+		writeJSON(w, res, err)
+
+	default:
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("Method not found: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// intercept counts the request and answers it with an injected failure or a quota error if one applies.
+func (e *Emulator) intercept(w http.ResponseWriter, r *http.Request) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.requests++
+	if len(e.failures) > 0 {
+		f := e.failures[0]
+		e.failures = e.failures[1:]
+		writeError(w, f.code, f.reason, http.StatusText(f.code))
+		return true
+	}
+
+	if e.QuotaPerSecond > 0 {
+		now := time.Now()
+		if now.Sub(e.windowStart) >= time.Second {
+			e.windowStart, e.windowUsed = now, 0
+		}
+		units := internal.QuotaUnits(r.Method, r.URL.Path)
+		if e.windowUsed > 0 && e.windowUsed+units > e.QuotaPerSecond {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "rateLimitExceeded",
+				"User-rate limit exceeded. Retry after "+e.windowStart.Add(time.Second).UTC().Format(time.RFC3339))
+			return true
+		}
+		e.windowUsed += units
+	}
+	return false
+}
+
+// decode reads a JSON request body, answering with 400 if it is malformed.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid JSON payload received. "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeJSON writes a JSON response, or the error if the operation failed.
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeEmpty writes an empty 204 response, or the error if the operation failed.
+func writeEmpty(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAPIError writes a googleapi.Error returned by the fake mailbox.
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		reason := "backendError"
+		if len(apiErr.Errors) > 0 {
+			reason = apiErr.Errors[0].Reason
+		}
+		writeError(w, apiErr.Code, reason, apiErr.Message)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "backendError", err.Error())
+}
+
+// writeError writes an error in the JSON format of Google APIs.
+func writeError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"message": message, "domain": "global", "reason": reason}},
+			"status":  strings.ToUpper(strings.ReplaceAll(http.StatusText(code), " ", "_")),
+		},
+	})
+}
@@ -0,0 +1,795 @@
+package gmailtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// systemLabelIds lists the system labels every Gmail mailbox has.
+var systemLabelIds = []string{
+	"CHAT", "SENT", "INBOX", "IMPORTANT", "TRASH", "DRAFT", "SPAM", "STARRED", "UNREAD",
+	"CATEGORY_FORUMS", "CATEGORY_UPDATES", "CATEGORY_PERSONAL", "CATEGORY_PROMOTIONS", "CATEGORY_SOCIAL",
+}
+
+// FakeClient is an in-memory implementation of internal.Client for tests.
+// It keeps labels, filters, messages and a change history, assigns IDs the way Gmail does,
+// and returns googleapi errors with Gmail's status codes for invalid requests.
+type FakeClient struct {
+	mu        sync.Mutex
+	labels    []*gmail.Label
+	filters   []*gmail.Filter
+	messages  []*fakeMessage
+	drafts    map[string]string
+	history   []*gmail.History
+	historyId uint64
+	nextId    int
+
+	// EmailAddress is returned in the profile.
+	EmailAddress string
+	// MinHistoryId is the oldest history ID ListHistory accepts; older IDs fail with 404 like an expired history.
+	MinHistoryId uint64
+	// Notify, when set, is called with every new history ID while a watch is active, the way
+	// Gmail publishes to the watch's Pub/Sub topic. It is called with the mailbox locked.
+	Notify func(emailAddress string, historyId uint64)
+
+	watch           *gmail.WatchRequest
+	watchExpiration time.Time
+}
+
+// fakeMessage is a message stored by the FakeClient.
+type fakeMessage struct {
+	id        string
+	threadId  string
+	raw       []byte
+	labelIds  []string
+	historyId uint64
+}
+
+// NewFakeClient creates an empty mailbox with the Gmail system labels.
+func NewFakeClient() *FakeClient {
+	f := &FakeClient{EmailAddress: "me@example.com", historyId: 1000}
+	for _, id := range systemLabelIds {
+		f.labels = append(f.labels, &gmail.Label{Id: id, Name: id, Type: "system"})
+	}
+	return f
+}
+
+// AddMessage stores an RFC 822 message with the given labels and returns its ID.
+// The message is recorded in the history like a newly delivered message.
+func (f *FakeClient) AddMessage(raw []byte, labelIds ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.addMessage(raw, labelIds)
+}
+
+// addMessage stores a message and records it in the history.
+func (f *FakeClient) addMessage(raw []byte, labelIds []string) string {
+	id := f.newId("")
+	f.historyId++
+	msg := &fakeMessage{id: id, threadId: f.threadFor(raw, id), raw: raw, labelIds: append([]string(nil), labelIds...), historyId: f.historyId}
+	f.messages = append([]*fakeMessage{msg}, f.messages...)
+	f.recordHistory(&gmail.History{
+		Id:            f.historyId,
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: msg.minimal()}},
+	})
+	return id
+}
+
+// threadFor returns the thread of a new message: the thread of the message it replies to, going by
+// its In-Reply-To and References headers, or a new thread with the message's ID.
+func (f *FakeClient) threadFor(raw []byte, id string) string {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return id
+	}
+	refs := strings.Fields(parsed.Header.Get("In-Reply-To") + " " + parsed.Header.Get("References"))
+	if len(refs) == 0 {
+		return id
+	}
+	for _, msg := range f.messages {
+		existing, err := mail.ReadMessage(bytes.NewReader(msg.raw))
+		if err != nil {
+			continue
+		}
+		messageId := strings.TrimSpace(existing.Header.Get("Message-Id"))
+		for _, ref := range refs {
+			if messageId != "" && ref == messageId {
+				return msg.threadId
+			}
+		}
+	}
+	return id
+}
+
+// MessageLabels returns the label IDs of a stored message.
+func (f *FakeClient) MessageLabels(id string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if msg := f.findMessage(id); msg != nil {
+		return append([]string(nil), msg.labelIds...)
+	}
+	return nil
+}
+
+func (f *FakeClient) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	labels := make([]*gmail.Label, len(f.labels))
+	for i, l := range f.labels {
+		copied := *l
+		labels[i] = &copied
+	}
+	return labels, nil
+}
+
+func (f *FakeClient) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if strings.TrimSpace(label.Name) == "" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid label name")
+	}
+	for _, l := range f.labels {
+		if strings.EqualFold(l.Name, label.Name) {
+			return nil, fakeError(http.StatusConflict, "failedPrecondition", "Label name exists or conflicts")
+		}
+	}
+
+	created := *label
+	created.Id = f.newId("Label_")
+	created.Type = "user"
+	created.MessagesTotal, created.MessagesUnread, created.ThreadsTotal, created.ThreadsUnread = 0, 0, 0, 0
+	f.labels = append(f.labels, &created)
+
+	result := created
+	return &result, nil
+}
+
+func (f *FakeClient) DeleteLabel(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, l := range f.labels {
+		if l.Id != id {
+			continue
+		}
+		if l.Type == "system" {
+			return fakeError(http.StatusBadRequest, "invalidArgument", "Invalid delete request")
+		}
+		f.labels = append(f.labels[:i], f.labels[i+1:]...)
+		for _, msg := range f.messages {
+			msg.labelIds = removeLabels(msg.labelIds, []string{id})
+		}
+		return nil
+	}
+	return fakeError(http.StatusNotFound, "notFound", "Not Found")
+}
+
+func (f *FakeClient) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filters := make([]*gmail.Filter, len(f.filters))
+	copy(filters, f.filters)
+	return filters, nil
+}
+
+func (f *FakeClient) CreateFilter(ctx context.Context, filter *gmail.Filter) (*gmail.Filter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if query, err := internal.QueryFromCriteria(filter.Criteria); err == nil && query == "" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Filter doesn't have any criteria")
+	}
+	if filter.Action == nil || (len(filter.Action.AddLabelIds) == 0 && len(filter.Action.RemoveLabelIds) == 0 && filter.Action.Forward == "") {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Filter doesn't have any actions")
+	}
+	for _, id := range append(append([]string(nil), filter.Action.AddLabelIds...), filter.Action.RemoveLabelIds...) {
+		if f.findLabel(id) == nil {
+			return nil, fakeError(http.StatusBadRequest, "invalidArgument", fmt.Sprintf("Invalid label %s in AddLabelIds", id))
+		}
+	}
+
+	created := *filter
+	created.Id = f.newId("ANe1Bm")
+	f.filters = append(f.filters, &created)
+
+	result := created
+	return &result, nil
+}
+
+func (f *FakeClient) DeleteFilter(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, filter := range f.filters {
+		if filter.Id == id {
+			f.filters = append(f.filters[:i], f.filters[i+1:]...)
+			return nil
+		}
+	}
+	return fakeError(http.StatusNotFound, "notFound", "Filter not found")
+}
+
+func (f *FakeClient) ListMessages(ctx context.Context, query, pageToken string, maxResults int64) (*gmail.ListMessagesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	node, err := internal.ParseQuery(query)
+	if err != nil {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid query")
+	}
+	labelNames := make(map[string]string, len(f.labels))
+	for _, l := range f.labels {
+		if l.Type == "user" {
+			labelNames[l.Id] = l.Name
+		}
+	}
+	includeAll := strings.Contains(query, "in:trash") || strings.Contains(query, "in:spam") || strings.Contains(query, "in:anywhere")
+
+	var matched []*gmail.Message
+	for _, msg := range f.messages {
+		if !includeAll && (hasAnyLabel(msg.labelIds, "TRASH", "SPAM")) {
+			continue
+		}
+		local, err := f.localMessage(msg)
+		if err != nil {
+			continue
+		}
+		// Gmail search resolves label: terms by name on the server
+		local.Labels = queryLabels(local.Labels, labelNames)
+		if !internal.MatchQuery(node, local) {
+			continue
+		}
+		matched = append(matched, &gmail.Message{Id: msg.id, ThreadId: msg.threadId})
+	}
+
+	return paginate(matched, pageToken, maxResults, func(page []*gmail.Message, next string) *gmail.ListMessagesResponse {
+		return &gmail.ListMessagesResponse{Messages: page, NextPageToken: next, ResultSizeEstimate: int64(len(matched))}
+	})
+}
+
+func (f *FakeClient) GetMessage(ctx context.Context, id, format string) (*gmail.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg := f.findMessage(id)
+	if msg == nil {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+
+	return msg.formatted(format)
+}
+
+func (f *FakeClient) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if format == "raw" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid format: raw")
+	}
+	thread := &gmail.Thread{Id: id}
+	// Messages are stored newest first; threads list them oldest first.
+	for i := len(f.messages) - 1; i >= 0; i-- {
+		msg := f.messages[i]
+		if msg.threadId != id {
+			continue
+		}
+		result, err := msg.formatted(format)
+		if err != nil {
+			return nil, err
+		}
+		thread.Messages = append(thread.Messages, result)
+		thread.HistoryId = max(thread.HistoryId, msg.historyId)
+	}
+	if len(thread.Messages) == 0 {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+	return thread, nil
+}
+
+func (f *FakeClient) GetAttachment(ctx context.Context, messageId, id string) (*gmail.MessagePartBody, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg := f.findMessage(messageId)
+	if msg == nil {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+	payload, err := payloadFromRaw(msg.raw, true)
+	if err != nil {
+		return nil, fakeError(http.StatusInternalServerError, "backendError", err.Error())
+	}
+
+	parts := []*gmail.MessagePart{payload}
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = append(parts[1:], part.Parts...)
+		if part.Body.AttachmentId == id {
+			return &gmail.MessagePartBody{AttachmentId: id, Size: part.Body.Size, Data: part.Body.Data}, nil
+		}
+	}
+	return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+}
+
+func (f *FakeClient) ModifyMessage(ctx context.Context, id string, req *gmail.ModifyMessageRequest) (*gmail.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg := f.findMessage(id)
+	if msg == nil {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+	if err := f.modify(msg, req.AddLabelIds, req.RemoveLabelIds); err != nil {
+		return nil, err
+	}
+	return msg.minimal(), nil
+}
+
+func (f *FakeClient) BatchModifyMessages(ctx context.Context, req *gmail.BatchModifyMessagesRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(req.Ids) > 1000 {
+		return fakeError(http.StatusBadRequest, "invalidArgument", "Too many ids in request")
+	}
+	for _, id := range req.Ids {
+		if msg := f.findMessage(id); msg != nil {
+			if err := f.modify(msg, req.AddLabelIds, req.RemoveLabelIds); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FakeClient) TrashMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg := f.findMessage(id)
+	if msg == nil {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+	if err := f.modify(msg, []string{"TRASH"}, []string{"SPAM"}); err != nil {
+		return nil, err
+	}
+	return msg.minimal(), nil
+}
+
+func (f *FakeClient) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if draft.Message == nil || draft.Message.Raw == "" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Missing draft message")
+	}
+	raw, err := decodeRaw(draft.Message.Raw)
+	if err != nil {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid raw message")
+	}
+
+	id := f.addMessage(raw, []string{"DRAFT"})
+	draftId := f.newId("r")
+	if f.drafts == nil {
+		f.drafts = make(map[string]string)
+	}
+	f.drafts[draftId] = id
+	return &gmail.Draft{Id: draftId, Message: f.findMessage(id).minimal()}, nil
+}
+
+func (f *FakeClient) ImportMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if msg.Raw == "" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Missing raw message")
+	}
+	raw, err := decodeRaw(msg.Raw)
+	if err != nil {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid raw message")
+	}
+	for _, id := range msg.LabelIds {
+		if f.findLabel(id) == nil || id == "DRAFT" {
+			return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid label: "+id)
+		}
+	}
+
+	id := f.addMessage(raw, msg.LabelIds)
+	return f.findMessage(id).minimal(), nil
+}
+
+// Drafts returns the raw messages of all drafts, keyed by draft ID.
+func (f *FakeClient) Drafts() map[string][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	drafts := make(map[string][]byte)
+	for draftId, id := range f.drafts {
+		drafts[draftId] = f.findMessage(id).raw
+	}
+	return drafts
+}
+
+func (f *FakeClient) ListHistory(ctx context.Context, startHistoryId uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if startHistoryId < f.MinHistoryId {
+		return nil, fakeError(http.StatusNotFound, "notFound", "Requested entity was not found.")
+	}
+
+	var records []*gmail.History
+	for _, h := range f.history {
+		if h.Id > startHistoryId {
+			records = append(records, h)
+		}
+	}
+	return paginate(records, pageToken, 100, func(page []*gmail.History, next string) *gmail.ListHistoryResponse {
+		return &gmail.ListHistoryResponse{History: page, NextPageToken: next, HistoryId: f.historyId}
+	})
+}
+
+func (f *FakeClient) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &gmail.Profile{
+		EmailAddress:  f.EmailAddress,
+		HistoryId:     f.historyId,
+		MessagesTotal: int64(len(f.messages)),
+		ThreadsTotal:  int64(len(f.messages)),
+	}, nil
+}
+
+func (f *FakeClient) Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(req.TopicName, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" || parts[1] == "" || parts[3] == "" {
+		return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid topicName: "+req.TopicName)
+	}
+	for _, id := range req.LabelIds {
+		if f.findLabel(id) == nil {
+			return nil, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid label: "+id)
+		}
+	}
+
+	f.watch = req
+	f.watchExpiration = time.Now().Add(7 * 24 * time.Hour)
+	return &gmail.WatchResponse{HistoryId: f.historyId, Expiration: f.watchExpiration.UnixMilli()}, nil
+}
+
+func (f *FakeClient) StopWatch(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.watch = nil
+	return nil
+}
+
+// WatchRequest returns the active watch request, or nil when no watch is active.
+func (f *FakeClient) WatchRequest() *gmail.WatchRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.watch
+}
+
+// modify applies a label change to a message and records it in the history.
+func (f *FakeClient) modify(msg *fakeMessage, add, remove []string) error {
+	for _, id := range append(append([]string(nil), add...), remove...) {
+		if f.findLabel(id) == nil {
+			return fakeError(http.StatusBadRequest, "invalidArgument", "Invalid label: "+id)
+		}
+	}
+
+	added, removed := labelDelta(msg.labelIds, add, remove)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	msg.labelIds = append(removeLabels(msg.labelIds, removed), added...)
+
+	f.historyId++
+	msg.historyId = f.historyId
+	record := &gmail.History{Id: f.historyId}
+	if len(added) > 0 {
+		record.LabelsAdded = []*gmail.HistoryLabelAdded{{Message: msg.minimal(), LabelIds: added}}
+	}
+	if len(removed) > 0 {
+		record.LabelsRemoved = []*gmail.HistoryLabelRemoved{{Message: msg.minimal(), LabelIds: removed}}
+	}
+	f.recordHistory(record)
+	return nil
+}
+
+// recordHistory appends a change to the history and notifies the active watch, if any.
+func (f *FakeClient) recordHistory(record *gmail.History) {
+	f.history = append(f.history, record)
+	if f.Notify != nil && f.watch != nil && time.Now().Before(f.watchExpiration) {
+		f.Notify(f.EmailAddress, record.Id)
+	}
+}
+
+// localMessage parses a stored message for query evaluation. Its labels are label IDs, as the API returns them.
+func (f *FakeClient) localMessage(msg *fakeMessage) (*internal.LocalMessage, error) {
+	local, err := internal.ParseRawMessage(msg.raw)
+	if err != nil {
+		return nil, err
+	}
+	local.Id = msg.id
+	local.Labels = append([]string(nil), msg.labelIds...)
+	return local, nil
+}
+
+func (f *FakeClient) findMessage(id string) *fakeMessage {
+	for _, msg := range f.messages {
+		if msg.id == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (f *FakeClient) findLabel(id string) *gmail.Label {
+	for _, l := range f.labels {
+		if l.Id == id {
+			return l
+		}
+	}
+	return nil
+}
+
+// newId returns a new unique ID with the given prefix, formatted like Gmail's hexadecimal IDs when the prefix is empty.
+func (f *FakeClient) newId(prefix string) string {
+	f.nextId++
+	if prefix == "" {
+		return fmt.Sprintf("18c%013x", f.nextId)
+	}
+	return prefix + strconv.Itoa(f.nextId)
+}
+
+// formatted returns a message as the API returns it in the given format.
+func (m *fakeMessage) formatted(format string) (*gmail.Message, error) {
+	result := m.minimal()
+	switch format {
+	case "raw":
+		result.Raw = base64.URLEncoding.EncodeToString(m.raw)
+	case "metadata", "full", "":
+		payload, err := payloadFromRaw(m.raw, format != "metadata")
+		if err != nil {
+			return nil, fakeError(http.StatusInternalServerError, "backendError", err.Error())
+		}
+		stripAttachmentData(payload)
+		result.Payload = payload
+	}
+	return result, nil
+}
+
+// minimal returns the message in "minimal" format.
+func (m *fakeMessage) minimal() *gmail.Message {
+	return &gmail.Message{
+		Id:           m.id,
+		ThreadId:     m.threadId,
+		LabelIds:     append([]string(nil), m.labelIds...),
+		HistoryId:    m.historyId,
+		SizeEstimate: int64(len(m.raw)),
+	}
+}
+
+// paginate returns the page of items selected by an offset page token.
+func paginate[T any, R any](items []T, pageToken string, pageSize int64, build func([]T, string) R) (R, error) {
+	var zero R
+	offset := 0
+	if pageToken != "" {
+		n, err := strconv.Atoi(pageToken)
+		if err != nil || n < 0 || n > len(items) {
+			return zero, fakeError(http.StatusBadRequest, "invalidArgument", "Invalid pageToken")
+		}
+		offset = n
+	}
+	if pageSize <= 0 || pageSize > 500 {
+		pageSize = 100
+	}
+
+	end := min(offset+int(pageSize), len(items))
+	next := ""
+	if end < len(items) {
+		next = strconv.Itoa(end)
+	}
+	return build(items[offset:end], next), nil
+}
+
+// payloadFromRaw builds the message payload of the "full" or "metadata" format from RFC 822 data.
+func payloadFromRaw(raw []byte, withBody bool) (*gmail.MessagePart, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return buildPart("", msg.Header, msg.Body, withBody)
+}
+
+// buildPart converts a MIME part and its children into a Gmail message part.
+func buildPart(partId string, header map[string][]string, body io.Reader, withBody bool) (*gmail.MessagePart, error) {
+	part := &gmail.MessagePart{PartId: partId, Body: &gmail.MessagePartBody{}}
+	for name, values := range header {
+		for _, v := range values {
+			part.Headers = append(part.Headers, &gmail.MessagePartHeader{Name: name, Value: v})
+		}
+	}
+
+	contentType := "text/plain"
+	if v := header["Content-Type"]; len(v) > 0 {
+		contentType = v[0]
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	part.MimeType = mediaType
+	if v := header["Content-Disposition"]; len(v) > 0 {
+		if _, dp, err := mime.ParseMediaType(v[0]); err == nil {
+			part.Filename = dp["filename"]
+		}
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	part.Filename = decodeHeader(part.Filename)
+	if !withBody {
+		return part, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for i := 0; ; i++ {
+			p, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			childId := strconv.Itoa(i)
+			if partId != "" {
+				childId = partId + "." + childId
+			}
+			child, err := buildPart(childId, p.Header, p, withBody)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header, body))
+	if err != nil {
+		return nil, err
+	}
+	part.Body.Size = int64(len(data))
+	if part.Filename != "" {
+		part.Body.AttachmentId = "att-" + partId
+	}
+	part.Body.Data = base64.URLEncoding.EncodeToString(data)
+	return part, nil
+}
+
+// stripAttachmentData removes the data of attachments from a payload; like Gmail, their data is
+// fetched separately by attachment ID.
+func stripAttachmentData(part *gmail.MessagePart) {
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		part.Body.Data = ""
+	}
+	for _, child := range part.Parts {
+		stripAttachmentData(child)
+	}
+}
+
+// removeLabels returns labels without the given ones.
+func removeLabels(labels, remove []string) []string {
+	var kept []string
+	for _, l := range labels {
+		if !hasAnyLabel(remove, l) {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// hasAnyLabel reports whether labels contain any of the given label IDs.
+func hasAnyLabel(labels []string, ids ...string) bool {
+	for _, l := range labels {
+		for _, id := range ids {
+			if l == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fakeError builds a googleapi.Error like the ones returned by the Gmail API.
+func fakeError(code int, reason, message string) error {
+	return &googleapi.Error{
+		Code:    code,
+		Message: message,
+		Errors:  []googleapi.ErrorItem{{Reason: reason, Message: message}},
+	}
+}
+
+// queryLabels maps label IDs to the names search terms use; system labels keep their IDs.
+func queryLabels(labelIds []string, labelNames map[string]string) []string {
+	var labels []string
+	for _, id := range labelIds {
+		if name := labelNames[id]; name != "" {
+			id = name
+		}
+		labels = append(labels, id)
+	}
+	return labels
+}
+
+// labelDelta returns the labels a modification actually adds to and removes from a message with the given labels.
+func labelDelta(current, add, remove []string) (added, removed []string) {
+	for _, l := range add {
+		if !hasAnyLabel(current, l) && !hasAnyLabel(added, l) {
+			added = append(added, l)
+		}
+	}
+	for _, l := range remove {
+		if hasAnyLabel(current, l) && !hasAnyLabel(removed, l) {
+			removed = append(removed, l)
+		}
+	}
+	return added, removed
+}
+
+// decodeRaw decodes base64url data as sent to the Gmail API, with or without padding.
+func decodeRaw(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// decodeHeader decodes RFC 2047 encoded words in a header value.
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeTransfer wraps a MIME part body with a decoder for its Content-Transfer-Encoding.
+func decodeTransfer(header map[string][]string, r io.Reader) io.Reader {
+	var encoding string
+	if v := header["Content-Transfer-Encoding"]; len(v) > 0 {
+		encoding = strings.ToLower(strings.TrimSpace(v[0]))
+	}
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
@@ -0,0 +1,149 @@
+package gmailtest
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// pushMessageId numbers the Pub/Sub messages posted by PostPush.
+var pushMessageId atomic.Int64
+
+// PostPush delivers a Gmail notification to a push endpoint the way a Pub/Sub push subscription does,
+// and returns the status code the endpoint answered with. A non-empty idToken is sent as the bearer
+// token of an authenticated push subscription.
+func PostPush(ctx context.Context, url string, n internal.PushNotification, subscription, idToken string) (int, error) {
+	env := internal.NewPushEnvelope(n, subscription, strconv.FormatInt(pushMessageId.Add(1), 10))
+	body, err := json.Marshal(env)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idToken != "" {
+		req.Header.Set("Authorization", "Bearer "+idToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post push delivery: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// notify posts a push delivery for a mailbox change when PushURL is set.
+// It is called by the fake mailbox with its lock held, so the delivery is posted in the background.
+func (e *Emulator) notify(emailAddress string, historyId uint64) {
+	if e.PushURL == "" {
+		return
+	}
+	go func() {
+		n := internal.PushNotification{EmailAddress: emailAddress, HistoryId: historyId}
+		code, err := PostPush(context.Background(), e.PushURL, n, e.PushSubscription, e.PushIDToken)
+		if err != nil {
+			logrus.Warnf("Emulator: %v", err)
+			return
+		}
+		logrus.Debugf("Emulator: pushed history ID %d to %s (status %d)", historyId, e.PushURL, code)
+	}()
+}
+
+// oidcKeyId is the key ID of the key an OIDCIssuer signs with.
+const oidcKeyId = "gmailtest"
+
+// OIDCIssuer signs OIDC tokens the way Google does for authenticated push subscriptions.
+// Its Validator verifies them against the issuer's key instead of Google's.
+type OIDCIssuer struct {
+	key *rsa.PrivateKey
+}
+
+// NewOIDCIssuer creates an issuer with a new signing key.
+func NewOIDCIssuer() (*OIDCIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return &OIDCIssuer{key: key}, nil
+}
+
+// Token returns a token issued by accounts.google.com for the audience and service account email,
+// expiring at the given time.
+func (o *OIDCIssuer) Token(audience, email string, expires time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": oidcKeyId, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":            "https://accounts.google.com",
+		"aud":            audience,
+		"sub":            "1234567890",
+		"email":          email,
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, o.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Validator returns a token validator that fetches the issuer's public key in place of Google's.
+func (o *OIDCIssuer) Validator(ctx context.Context) (*idtoken.Validator, error) {
+	client := &http.Client{Transport: certsTransport{key: &o.key.PublicKey}}
+	return idtoken.NewValidator(ctx, option.WithHTTPClient(client))
+}
+
+// certsTransport answers every request with a JWK set holding a single RSA public key.
+type certsTransport struct {
+	key *rsa.PublicKey
+}
+
+func (t certsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"alg": "RS256",
+		"use": "sig",
+		"kid": oidcKeyId,
+		"n":   base64.RawURLEncoding.EncodeToString(t.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(t.key.E)).Bytes()),
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+		Request:    r,
+	}, nil
+}
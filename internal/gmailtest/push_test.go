@@ -0,0 +1,242 @@
+package gmailtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+)
+
+const testSubscription = "projects/p/subscriptions/gmail"
+
+// newReceiver serves a PushReceiver expecting the given token and mailbox, and returns its URL
+// and a function returning the notifications it accepted.
+func newReceiver(t *testing.T, token, emailAddress string) (string, func() []internal.PushNotification) {
+	t.Helper()
+	var mu sync.Mutex
+	var accepted []internal.PushNotification
+	server := httptest.NewServer(&internal.PushReceiver{
+		Token:        token,
+		Subscription: testSubscription,
+		EmailAddress: emailAddress,
+		OnNotify: func(n internal.PushNotification) {
+			mu.Lock()
+			defer mu.Unlock()
+			accepted = append(accepted, n)
+		},
+	})
+	t.Cleanup(server.Close)
+
+	return server.URL, func() []internal.PushNotification {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]internal.PushNotification(nil), accepted...)
+	}
+}
+
+func TestPushReceiver(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		emailAddress string
+		subscription string
+		query        string
+		wantStatus   int
+		wantAccepted bool
+	}{
+		{"good token", "secret", "me@example.com", testSubscription, "?token=secret", http.StatusNoContent, true},
+		{"bad token", "secret", "me@example.com", testSubscription, "?token=wrong", http.StatusForbidden, false},
+		{"missing token", "secret", "me@example.com", testSubscription, "", http.StatusForbidden, false},
+		{"token prefix", "secret", "me@example.com", testSubscription, "?token=secre", http.StatusForbidden, false},
+		// Deliveries that will never be valid are acknowledged, so Pub/Sub does not redeliver them
+		{"wrong email address", "secret", "other@example.com", testSubscription, "?token=secret", http.StatusNoContent, false},
+		{"wrong subscription", "secret", "me@example.com", "projects/p/subscriptions/other", "?token=secret", http.StatusNoContent, false},
+		{"no token configured", "", "me@example.com", testSubscription, "", http.StatusNoContent, true},
+		{"no email address configured", "secret", "", testSubscription, "?token=secret", http.StatusNoContent, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, accepted := newReceiver(t, tt.token, tt.emailAddress)
+			n := internal.PushNotification{EmailAddress: "me@example.com", HistoryId: 1234}
+			code, err := PostPush(context.Background(), url+tt.query, n, tt.subscription, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", code, tt.wantStatus)
+			}
+
+			got := accepted()
+			if tt.wantAccepted {
+				if len(got) != 1 || got[0] != n {
+					t.Errorf("accepted %v, want [%v]", got, n)
+				}
+			} else if len(got) != 0 {
+				t.Errorf("rejected delivery was passed on: %v", got)
+			}
+		})
+	}
+}
+
+func TestPushReceiverOIDC(t *testing.T) {
+	const (
+		audience       = "https://host.example.com/push"
+		serviceAccount = "push@p.iam.gserviceaccount.com"
+	)
+	ctx := context.Background()
+	issuer, err := NewOIDCIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator, err := issuer.Validator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewOIDCIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var accepted int
+	server := httptest.NewServer(&internal.PushReceiver{
+		Audience:       audience,
+		ServiceAccount: serviceAccount,
+		Validator:      validator,
+		Subscription:   testSubscription,
+		OnNotify: func(internal.PushNotification) {
+			mu.Lock()
+			defer mu.Unlock()
+			accepted++
+		},
+	})
+	t.Cleanup(server.Close)
+
+	token := func(issuer *OIDCIssuer, audience, email string, expires time.Time) string {
+		t.Helper()
+		s, err := issuer.Token(audience, email, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name         string
+		idToken      string
+		wantStatus   int
+		wantAccepted bool
+	}{
+		{"valid", token(issuer, audience, serviceAccount, later), http.StatusNoContent, true},
+		{"missing", "", http.StatusUnauthorized, false},
+		{"garbage", "not.a.token", http.StatusUnauthorized, false},
+		{"wrong audience", token(issuer, "https://other.example.com/push", serviceAccount, later), http.StatusUnauthorized, false},
+		{"expired", token(issuer, audience, serviceAccount, time.Now().Add(-time.Hour)), http.StatusUnauthorized, false},
+		{"wrong key", token(other, audience, serviceAccount, later), http.StatusUnauthorized, false},
+		{"wrong service account", token(issuer, audience, "other@p.iam.gserviceaccount.com", later), http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			accepted = 0
+			mu.Unlock()
+
+			n := internal.PushNotification{EmailAddress: "me@example.com", HistoryId: 1234}
+			code, err := PostPush(ctx, server.URL, n, testSubscription, tt.idToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", code, tt.wantStatus)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := accepted == 1; got != tt.wantAccepted {
+				t.Errorf("accepted = %v, want %v", got, tt.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestPushReceiverMalformed(t *testing.T) {
+	url, accepted := newReceiver(t, "secret", "")
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+	}{
+		{"get", http.MethodGet, "", http.StatusMethodNotAllowed},
+		// Malformed deliveries are acknowledged and dropped
+		{"not json", http.MethodPost, "hello", http.StatusNoContent},
+		{"not base64", http.MethodPost, `{"message":{"data":"%%%","messageId":"1"},"subscription":"` + testSubscription + `"}`, http.StatusNoContent},
+		// {"foo":"bar"} is not a Gmail notification
+		{"not a notification", http.MethodPost, `{"message":{"data":"eyJmb28iOiJiYXIifQ==","messageId":"1"},"subscription":"` + testSubscription + `"}`, http.StatusNoContent},
+		// {"emailAddress":"me@example.com","historyId":"99"} carries the history ID as a string
+		{"string history id", http.MethodPost, `{"message":{"data":"eyJlbWFpbEFkZHJlc3MiOiJtZUBleGFtcGxlLmNvbSIsImhpc3RvcnlJZCI6Ijk5In0=","messageId":"1"},"subscription":"` + testSubscription + `"}`, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, url+"?token=secret", strings.NewReader(tt.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	if got := accepted(); len(got) != 1 || got[0].HistoryId != 99 {
+		t.Errorf("accepted %v, want only history ID 99", got)
+	}
+}
+
+func TestEmulatorPush(t *testing.T) {
+	url, accepted := newReceiver(t, "secret", "me@example.com")
+	fake := NewFakeClient()
+	emulator := New(fake)
+	emulator.PushURL = url + "?token=secret"
+	emulator.PushSubscription = testSubscription
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+
+	// Nothing is published without a watch
+	fake.AddMessage([]byte("Subject: Before\r\n\r\nHello\r\n"), "INBOX")
+
+	res, err := svc.StartWatch(ctx, "projects/p/topics/gmail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage([]byte("Subject: During\r\n\r\nHello\r\n"), "INBOX")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(accepted()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := accepted()
+	if len(got) != 1 || got[0].EmailAddress != "me@example.com" || got[0].HistoryId <= res.HistoryId {
+		t.Fatalf("accepted %v, want one notification after history ID %d", got, res.HistoryId)
+	}
+
+	if err := svc.StopWatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage([]byte("Subject: After\r\n\r\nHello\r\n"), "INBOX")
+	time.Sleep(50 * time.Millisecond)
+	if got := accepted(); len(got) != 1 {
+		t.Errorf("accepted %d notifications after the watch stopped, want 1", len(got))
+	}
+}
@@ -0,0 +1,47 @@
+package gmailtest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// UnsubscribeServer is a stand-in for the unsubscribe endpoints of mailing lists. It accepts
+// RFC 8058 one-click POST requests on any path and records the paths it was called on.
+type UnsubscribeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewUnsubscribeServer starts an UnsubscribeServer on a local TLS listener, since one-click
+// unsubscribe URLs must use HTTPS. Use its Client to send requests to it.
+func NewUnsubscribeServer() *UnsubscribeServer {
+	u := &UnsubscribeServer{}
+	u.Server = httptest.NewTLSServer(http.HandlerFunc(u.serve))
+	return u
+}
+
+// Requests returns the paths of the accepted one-click requests, in order.
+func (u *UnsubscribeServer) Requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]string(nil), u.requests...)
+}
+
+func (u *UnsubscribeServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if r.Method != http.MethodPost || string(body) != "List-Unsubscribe=One-Click" ||
+		r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		http.Error(w, "not a one-click unsubscribe request", http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	u.requests = append(u.requests, r.URL.Path)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,61 @@
+package gmailtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+)
+
+func TestOneClickUnsubscribe(t *testing.T) {
+	server := NewUnsubscribeServer()
+	defer server.Close()
+	svc := internal.NewServiceWithClient(NewFakeClient())
+
+	sub := &internal.Subscription{
+		Sender:      "news@example.com",
+		OneClickURL: server.URL + "/u/42",
+		MailTo:      "mailto:unsub@example.com",
+	}
+	record, err := svc.Unsubscribe(context.Background(), sub, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Method != "one-click" || record.Target != sub.OneClickURL {
+		t.Errorf("record = %+v, want a one-click request to %s", record, sub.OneClickURL)
+	}
+	if got := server.Requests(); !slices.Equal(got, []string{"/u/42"}) {
+		t.Errorf("server received %v, want [/u/42]", got)
+	}
+}
+
+func TestOneClickUnsubscribeFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer server.Close()
+	svc := internal.NewServiceWithClient(NewFakeClient())
+
+	sub := &internal.Subscription{Sender: "news@example.com", OneClickURL: server.URL + "/u/42"}
+	record, err := svc.Unsubscribe(context.Background(), sub, server.Client())
+	if err == nil {
+		t.Fatal("Unsubscribe() succeeded on a 410 response")
+	}
+	if record.Method != "one-click" {
+		t.Errorf("record method = %s, want one-click", record.Method)
+	}
+
+	// A server with an untrusted certificate is not contacted
+	untrusted := NewUnsubscribeServer()
+	defer untrusted.Close()
+	sub.OneClickURL = untrusted.URL + "/u/42"
+	if _, err := svc.Unsubscribe(context.Background(), sub, http.DefaultClient); err == nil {
+		t.Error("Unsubscribe() succeeded against an untrusted certificate")
+	}
+	if got := untrusted.Requests(); len(got) != 0 {
+		t.Errorf("untrusted server received %v", got)
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JournalEntry records a single label modification applied to a message.
+type JournalEntry struct {
+	RunId     string    `json:"run_id"`
+	MessageId string    `json:"message_id"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Journal is an append-only log of label modifications, one JSON entry per line.
+// Every entry carries the ID of the run that produced it, so a whole run can be undone.
+type Journal struct {
+	mu    sync.Mutex
+	runId string
+	file  *os.File
+}
+
+// NewRunId generates a sortable, unique identifier for a run.
+func NewRunId() string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		logrus.Fatalf("Failed to generate run ID: %v", err)
+	}
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// OpenJournal opens the journal file for appending entries under the given run ID.
+func OpenJournal(journalPath, runId string) (*Journal, error) {
+	file, err := os.OpenFile(journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Errorf("Failed to open journal file: %v", err)
+		return nil, fmt.Errorf("failed to open journal file: %v", err)
+	}
+
+	logrus.Infof("Recording label changes to journal %s under run ID %s", journalPath, runId)
+	return &Journal{runId: runId, file: file}, nil
+}
+
+// RunId returns the run ID the journal records entries under.
+func (j *Journal) RunId() string {
+	return j.runId
+}
+
+// Record appends an entry for a message to the journal and flushes it to disk.
+// Entries with no added or removed labels are skipped.
+func (j *Journal) Record(messageId string, added, removed []string) error {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(JournalEntry{
+		RunId:     j.runId,
+		MessageId: messageId,
+		Added:     added,
+		Removed:   removed,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %v", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		logrus.Errorf("Failed to write journal entry: %v", err)
+		return fmt.Errorf("failed to write journal entry: %v", err)
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// ReadJournal reads all entries recorded under a run ID, in the order they were written.
+func ReadJournal(journalPath, runId string) ([]JournalEntry, error) {
+	file, err := os.Open(journalPath)
+	if err != nil {
+		logrus.Errorf("Failed to open journal file: %v", err)
+		return nil, fmt.Errorf("failed to open journal file: %v", err)
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode journal line %d: %v", line, err)
+		}
+		if entry.RunId == runId {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal file: %v", err)
+	}
+
+	logrus.Infof("Read %d journal entries for run %s", len(entries), runId)
+	return entries, nil
+}
+
+// LabelChange is a set of labels to add and remove, applied to a batch of messages.
+type LabelChange struct {
+	AddLabelIds    []string
+	RemoveLabelIds []string
+	MessageIds     []string
+}
+
+// InverseChanges computes the label changes that revert the given journal entries.
+// Entries are replayed backwards per message and messages needing the same change are grouped together.
+func InverseChanges(entries []JournalEntry) []LabelChange {
+	type delta struct{ add, remove map[string]bool }
+
+	deltas := make(map[string]*delta)
+	var order []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		d, ok := deltas[e.MessageId]
+		if !ok {
+			d = &delta{add: make(map[string]bool), remove: make(map[string]bool)}
+			deltas[e.MessageId] = d
+			order = append(order, e.MessageId)
+		}
+		for _, l := range e.Added {
+			delete(d.add, l)
+			d.remove[l] = true
+		}
+		for _, l := range e.Removed {
+			delete(d.remove, l)
+			d.add[l] = true
+		}
+	}
+
+	groups := make(map[string]*LabelChange)
+	var changes []LabelChange
+	var keys []string
+	for _, id := range order {
+		d := deltas[id]
+		add, remove := sortedKeys(d.add), sortedKeys(d.remove)
+		if len(add) == 0 && len(remove) == 0 {
+			continue
+		}
+		key := strings.Join(add, ",") + "|" + strings.Join(remove, ",")
+		g, ok := groups[key]
+		if !ok {
+			g = &LabelChange{AddLabelIds: add, RemoveLabelIds: remove}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.MessageIds = append(g.MessageIds, id)
+	}
+	for _, key := range keys {
+		changes = append(changes, *groups[key])
+	}
+	return changes
+}
+
+// sortedKeys returns the keys of a set in sorted order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
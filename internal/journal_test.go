@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInverseChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []JournalEntry
+		want    []LabelChange
+	}{
+		{
+			name:    "single entry",
+			entries: []JournalEntry{{MessageId: "m1", Added: []string{"Label_1"}, Removed: []string{"INBOX"}}},
+			want:    []LabelChange{{AddLabelIds: []string{"INBOX"}, RemoveLabelIds: []string{"Label_1"}, MessageIds: []string{"m1"}}},
+		},
+		{
+			name: "messages with the same change are grouped",
+			entries: []JournalEntry{
+				{MessageId: "m1", Removed: []string{"UNREAD"}},
+				{MessageId: "m2", Removed: []string{"UNREAD"}},
+				{MessageId: "m3", Added: []string{"STARRED"}},
+			},
+			want: []LabelChange{
+				{AddLabelIds: []string{}, RemoveLabelIds: []string{"STARRED"}, MessageIds: []string{"m3"}},
+				{AddLabelIds: []string{"UNREAD"}, RemoveLabelIds: []string{}, MessageIds: []string{"m2", "m1"}},
+			},
+		},
+		{
+			name: "entries of a message are replayed backwards",
+			entries: []JournalEntry{
+				{MessageId: "m1", Added: []string{"Label_1"}, Removed: []string{"INBOX"}},
+				{MessageId: "m1", Added: []string{"Label_2"}, Removed: []string{"Label_1"}},
+			},
+			want: []LabelChange{{AddLabelIds: []string{"INBOX"}, RemoveLabelIds: []string{"Label_1", "Label_2"}, MessageIds: []string{"m1"}}},
+		},
+		{
+			name: "a label removed and added back is restored",
+			entries: []JournalEntry{
+				{MessageId: "m1", Removed: []string{"INBOX"}},
+				{MessageId: "m1", Added: []string{"INBOX"}},
+			},
+			want: []LabelChange{{AddLabelIds: []string{"INBOX"}, RemoveLabelIds: []string{}, MessageIds: []string{"m1"}}},
+		},
+		{
+			name:    "no entries",
+			entries: nil,
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := InverseChanges(tt.entries)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("InverseChanges() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	for _, run := range []struct {
+		runId    string
+		messages []string
+	}{{"run-1", []string{"m1", "m2"}}, {"run-2", []string{"m3"}}} {
+		j, err := OpenJournal(path, run.runId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range run.messages {
+			if err := j.Record(id, []string{"Label_1"}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Changes without labels are not recorded
+		if err := j.Record("m9", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+	}
+
+	entries, err := ReadJournal(path, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.MessageId)
+	}
+	if want := []string{"m1", "m2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ReadJournal() messages = %v, want %v", ids, want)
+	}
+}
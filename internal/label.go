@@ -1,18 +1,23 @@
 package internal
 
 import (
+	"context"
+
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/gmail/v1"
 )
 
 // DeleteLabels deletes user-defined labels (ignoring system labels).
-func (s *Service) DeleteLabels(labels Labels) error {
+func (s *Service) DeleteLabels(ctx context.Context, labels Labels) error {
 	for _, label := range labels {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if label.Type == "system" {
 			logrus.Infof("Skipping system label: %s", label.Name)
 			continue
 		}
-		err := s.Users.Labels.Delete(userId, label.Id).Do()
+		err := s.Client.DeleteLabel(ctx, label.Id)
 		if err != nil {
 			logrus.Errorf("Failed to delete label %s: %v", label.Name, err)
 		} else {
@@ -23,9 +28,12 @@ func (s *Service) DeleteLabels(labels Labels) error {
 }
 
 // CreateLabels creates new labels in the user's Gmail account.
-func (s *Service) CreateLabels(l Labels) error {
+func (s *Service) CreateLabels(ctx context.Context, l Labels) error {
 	for _, label := range l {
-		newLabel, err := s.Service.Users.Labels.Create(userId, label).Do()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		newLabel, err := s.Client.CreateLabel(ctx, label)
 		if err != nil {
 			logrus.Errorf("Failed to create label %s: %v", label.Name, err)
 		} else {
@@ -36,21 +44,21 @@ func (s *Service) CreateLabels(l Labels) error {
 }
 
 // Labels retrieves all labels in the user's Gmail account.
-func (s *Service) Labels() (Labels, error) {
+func (s *Service) Labels(ctx context.Context) (Labels, error) {
 	logrus.Info("Fetching all labels from Gmail...")
-	res, err := s.Service.Users.Labels.List(userId).Do()
+	labels, err := s.Client.ListLabels(ctx)
 	if err != nil {
 		logrus.Errorf("Failed to fetch labels: %v", err)
 		return nil, err
 	}
-	logrus.Infof("Fetched %d labels successfully", len(res.Labels))
-	return res.Labels, nil
+	logrus.Infof("Fetched %d labels successfully", len(labels))
+	return labels, nil
 }
 
 // LabelsMap creates a map of label names to Gmail label objects.
-func (s *Service) LabelsMap() (map[string]*gmail.Label, error) {
+func (s *Service) LabelsMap(ctx context.Context) (map[string]*gmail.Label, error) {
 	logrus.Info("Creating labels map...")
-	labels, err := s.Labels()
+	labels, err := s.Labels(ctx)
 	if err != nil {
 		logrus.Errorf("Failed to fetch labels for mapping: %v", err)
 		return nil, err
@@ -63,3 +71,59 @@ func (s *Service) LabelsMap() (map[string]*gmail.Label, error) {
 	logrus.Infof("Labels map created successfully with %d entries", len(labelMap))
 	return labelMap, nil
 }
+
+// LabelNames maps the IDs of the labels in the user's Gmail account to their names.
+func (s *Service) LabelNames(ctx context.Context) (map[string]string, error) {
+	labels, err := s.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	labelNames := make(map[string]string, len(labels))
+	for _, label := range labels {
+		labelNames[label.Id] = label.Name
+	}
+	return labelNames, nil
+}
+
+// EnsureLabel returns the ID of the label with the given name, creating the label if it does not exist.
+// System labels such as INBOX or STARRED are returned as is.
+func (s *Service) EnsureLabel(ctx context.Context, name string) (string, error) {
+	if isSystemLabelId(name) {
+		return name, nil
+	}
+
+	labels, err := s.Client.ListLabels(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to fetch labels: %v", err)
+		return "", err
+	}
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Id, nil
+		}
+	}
+
+	label, err := s.Client.CreateLabel(ctx, &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	})
+	if err != nil {
+		logrus.Errorf("Failed to create label %s: %v", name, err)
+		return "", err
+	}
+	logrus.Infof("Label %s created successfully (ID: %s)", name, label.Id)
+	return label.Id, nil
+}
+
+// hasAnyLabel reports whether labels contain any of the given label IDs.
+func hasAnyLabel(labels []string, ids ...string) bool {
+	for _, l := range labels {
+		for _, id := range ids {
+			if l == id {
+				return true
+			}
+		}
+	}
+	return false
+}
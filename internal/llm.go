@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
 
 	"github.com/invopop/jsonschema"
 	"github.com/openai/openai-go"
@@ -23,10 +22,7 @@ func GenerateSchema[T any]() interface{} {
 }
 
 // GetFiltersAndLabelsFromAI interacts with the OpenAI API to generate Gmail filters and labels based on email samples.
-func GetFiltersAndLabelsFromAI(openAIKey, openAIHost, openAIModel string, messages Messages) (*Config, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
-
+func GetFiltersAndLabelsFromAI(ctx context.Context, openAIKey, openAIHost, openAIModel string, messages Messages) (*Config, error) {
 	// Initialize the OpenAI client
 	client := openai.NewClient(
 		option.WithAPIKey(openAIKey),
@@ -2,7 +2,6 @@ package internal
 
 import (
 	"context"
-	"time"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/gmail/v1"
@@ -11,35 +10,45 @@ import (
 // Messages fetches Gmail messages with optional query and limit.
 //
 // Parameters:
+// - ctx: The context that bounds the whole fetch.
 // - max: The maximum number of messages to fetch.
 // - query: A Gmail search query to filter messages.
 //
 // Returns:
 // - A slice of Gmail messages.
 // - An error if the API request fails.
-func (s *Service) Messages(max int64, query string) (Messages, error) {
+func (s *Service) Messages(ctx context.Context, max int64, query string) (Messages, error) {
+	return s.MessagesWithFormat(ctx, max, query, "full")
+}
+
+// MessagesWithFormat fetches Gmail messages like Messages, in the given format.
+// The "metadata" format returns headers and labels without bodies, which is much cheaper for large fetches.
+func (s *Service) MessagesWithFormat(ctx context.Context, max int64, query, format string) (Messages, error) {
 	logrus.Infof("Fetching Gmail messages with query: '%s' and max results: %d", query, max)
 	var fetched int64
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-
 	var messages Messages
-
-	// Initialize the request
-	req := s.Users.Messages.List(userId).Q(query)
+	var pageToken string
 
 	// Iterate through the pages of messages
-	err := req.Pages(ctx, func(page *gmail.ListMessagesResponse) error {
-
-		if fetched >= max {
-			logrus.Infof("Fetched %d messages, stopping...", fetched)
-			return nil
+	for fetched < max {
+		page, err := s.Client.ListMessages(ctx, query, pageToken, 0)
+		if err != nil {
+			logrus.Errorf("Failed to fetch messages: %v", err)
+			return nil, err
 		}
 
 		for _, m := range page.Messages {
-			// Fetch full message details
-			msg, err := s.Users.Messages.Get(userId, m.Id).Format("full").Do()
+			if fetched >= max {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				logrus.Errorf("Stopped fetching messages after %d: %v", fetched, err)
+				return nil, err
+			}
+
+			// Fetch message details
+			msg, err := s.Client.GetMessage(ctx, m.Id, format)
 			if err != nil {
 				logrus.Errorf("Error fetching message %s: %v", m.Id, err)
 				continue
@@ -47,16 +56,100 @@ func (s *Service) Messages(max int64, query string) (Messages, error) {
 			messages = append(messages, msg)
 			fetched++
 			logrus.Infof("Fetched message ID: %s | %d", m.Id, fetched)
-
 		}
-		return nil
-	})
 
-	if err != nil {
-		logrus.Errorf("Failed to fetch messages: %v", err)
-		return nil, err
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	if fetched >= max {
+		logrus.Infof("Fetched %d messages, stopping...", fetched)
 	}
 
 	logrus.Infof("Successfully fetched %d messages.", len(messages))
 	return messages, nil
 }
+
+// MessagesPage fetches a single page of message IDs matching a query.
+//
+// Parameters:
+// - ctx: The context of the request.
+// - query: A Gmail search query to filter messages.
+// - pageToken: The token of the page to fetch, or empty for the first page.
+//
+// Returns:
+// - The messages on the page (ID and thread ID only).
+// - The token of the next page, or empty if this is the last page.
+// - An error if the API request fails.
+func (s *Service) MessagesPage(ctx context.Context, query, pageToken string) (Messages, string, error) {
+	logrus.Debugf("Fetching Gmail message page with query: '%s' and page token: '%s'", query, pageToken)
+
+	res, err := s.Client.ListMessages(ctx, query, pageToken, 0)
+	if err != nil {
+		logrus.Errorf("Failed to fetch message page: %v", err)
+		return nil, "", err
+	}
+
+	logrus.Debugf("Fetched %d messages on page, next page token: '%s'", len(res.Messages), res.NextPageToken)
+	return res.Messages, res.NextPageToken, nil
+}
+
+// batchModifyLimit is the maximum number of message IDs accepted by a single batchModify request.
+const batchModifyLimit = 1000
+
+// BatchModifyMessages adds and removes labels on a set of messages, in batches of up to 1000 messages.
+// When a journal is set, the requested changes are recorded for every message.
+func (s *Service) BatchModifyMessages(ctx context.Context, messageIds, addLabelIds, removeLabelIds []string) error {
+	logrus.Infof("Modifying labels of %d messages (add: %v, remove: %v)...", len(messageIds), addLabelIds, removeLabelIds)
+
+	for start := 0; start < len(messageIds); start += batchModifyLimit {
+		if err := ctx.Err(); err != nil {
+			logrus.Warnf("Stopping after %d/%d messages: %v", start, len(messageIds), err)
+			return err
+		}
+		batch := messageIds[start:min(start+batchModifyLimit, len(messageIds))]
+
+		err := s.Client.BatchModifyMessages(context.WithoutCancel(ctx), &gmail.BatchModifyMessagesRequest{
+			Ids:            batch,
+			AddLabelIds:    addLabelIds,
+			RemoveLabelIds: removeLabelIds,
+		})
+		if err != nil {
+			logrus.Errorf("Failed to modify batch of %d messages: %v", len(batch), err)
+			return err
+		}
+
+		if s.Journal != nil {
+			for _, id := range batch {
+				if err := s.Journal.Record(id, addLabelIds, removeLabelIds); err != nil {
+					return err
+				}
+			}
+		}
+		logrus.Infof("Modified labels of %d/%d messages.", start+len(batch), len(messageIds))
+	}
+
+	return nil
+}
+
+// MessageIds lists the IDs of all messages matching a query, without fetching the messages.
+func (s *Service) MessageIds(ctx context.Context, query string) ([]string, error) {
+	var ids []string
+	var pageToken string
+	for {
+		page, err := s.Client.ListMessages(ctx, query, pageToken, 500)
+		if err != nil {
+			logrus.Errorf("Failed to list messages: %v", err)
+			return nil, err
+		}
+		for _, m := range page.Messages {
+			ids = append(ids, m.Id)
+		}
+
+		if page.NextPageToken == "" {
+			return ids, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
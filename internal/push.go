@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/idtoken"
+)
+
+// watchRenewMargin is how long before its expiry a watch is renewed. Watches expire after 7 days.
+const watchRenewMargin = 24 * time.Hour
+
+// PushEnvelope is the body of a Cloud Pub/Sub push delivery.
+type PushEnvelope struct {
+	Message struct {
+		Data        string            `json:"data"`
+		MessageId   string            `json:"messageId"`
+		PublishTime string            `json:"publishTime,omitempty"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PushNotification is the payload Gmail publishes when a watched mailbox changes.
+type PushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryId    uint64 `json:"historyId"`
+}
+
+// NewPushEnvelope wraps a notification in a Pub/Sub push envelope, the way Pub/Sub delivers it.
+func NewPushEnvelope(n PushNotification, subscription, messageId string) *PushEnvelope {
+	data, _ := json.Marshal(n)
+	env := &PushEnvelope{Subscription: subscription}
+	env.Message.Data = base64.StdEncoding.EncodeToString(data)
+	env.Message.MessageId = messageId
+	env.Message.PublishTime = time.Now().UTC().Format(time.RFC3339Nano)
+	return env
+}
+
+// ParsePushEnvelope decodes a Pub/Sub push delivery and the Gmail notification it carries.
+func ParsePushEnvelope(r io.Reader) (*PushEnvelope, *PushNotification, error) {
+	var env PushEnvelope
+	if err := json.NewDecoder(r).Decode(&env); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode push envelope: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Message.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode data of Pub/Sub message %s: %v", env.Message.MessageId, err)
+	}
+
+	// Gmail sends the history ID as a number, but accept a string as well
+	var payload struct {
+		EmailAddress string          `json:"emailAddress"`
+		HistoryId    json.RawMessage `json:"historyId"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode notification in Pub/Sub message %s: %v", env.Message.MessageId, err)
+	}
+	var historyId string
+	if err := json.Unmarshal(payload.HistoryId, &historyId); err != nil {
+		historyId = string(payload.HistoryId)
+	}
+	id, err := strconv.ParseUint(historyId, 10, 64)
+	if err != nil || payload.EmailAddress == "" {
+		return nil, nil, fmt.Errorf("Pub/Sub message %s is not a Gmail notification", env.Message.MessageId)
+	}
+
+	return &env, &PushNotification{EmailAddress: payload.EmailAddress, HistoryId: id}, nil
+}
+
+// TokenValidator verifies a Google-signed OIDC token and returns its payload.
+// *idtoken.Validator implements it.
+type TokenValidator interface {
+	Validate(ctx context.Context, idToken, audience string) (*idtoken.Payload, error)
+}
+
+// PushReceiver is an http.Handler accepting Pub/Sub push deliveries of Gmail notifications.
+// A delivery is accepted only if it carries the shared token as a "token" query parameter of the
+// push endpoint URL, or the OIDC token of an authenticated push subscription, whichever are set.
+type PushReceiver struct {
+	// Token is the secret configured in the push endpoint URL, e.g. https://host/push?token=secret.
+	Token string
+	// Audience is the audience configured on an authenticated push subscription. When Audience or
+	// ServiceAccount is set, a delivery must carry a valid "Authorization: Bearer" OIDC token.
+	Audience string
+	// ServiceAccount is the email address of the service account the subscription authenticates as.
+	ServiceAccount string
+	// Validator verifies OIDC tokens; nil verifies them against Google's public keys.
+	Validator TokenValidator
+	// Subscription is the full name of the expected subscription, e.g. projects/p/subscriptions/s.
+	Subscription string
+	// EmailAddress is the address of the watched mailbox.
+	EmailAddress string
+	// OnNotify is called with every accepted notification.
+	OnNotify func(n PushNotification)
+}
+
+// ServeHTTP verifies and decodes a push delivery. Deliveries failing authentication get 401 or 403.
+// Authenticated deliveries are acknowledged with 204 even when they are dropped for being malformed
+// or for another subscription or mailbox, since Pub/Sub would otherwise redeliver them until they
+// expire.
+func (p *PushReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.Token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(p.Token)) != 1 {
+		logrus.Warnf("Rejected push delivery from %s: invalid token", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	if p.Audience != "" || p.ServiceAccount != "" {
+		if code, err := p.verifyBearer(r); err != nil {
+			logrus.Warnf("Rejected push delivery from %s: %v", r.RemoteAddr, err)
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+
+	env, n, err := ParsePushEnvelope(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		logrus.Warnf("Dropped push delivery: %v", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if p.Subscription != "" && env.Subscription != p.Subscription {
+		logrus.Warnf("Dropped push delivery from unexpected subscription %s", env.Subscription)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if p.EmailAddress != "" && n.EmailAddress != p.EmailAddress {
+		logrus.Warnf("Dropped push notification for unexpected mailbox %s", n.EmailAddress)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"pubsub_message_id": env.Message.MessageId,
+		"history_id":        n.HistoryId,
+	}).Debug("Received push notification")
+	if p.OnNotify != nil {
+		p.OnNotify(*n)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyBearer checks the OIDC token Pub/Sub sends for an authenticated push subscription: its
+// signature, audience and issuer, and that it was issued to the expected service account.
+// It returns the status code to answer a failed check with.
+func (p *PushReceiver) verifyBearer(r *http.Request) (int, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return http.StatusUnauthorized, fmt.Errorf("missing bearer token")
+	}
+
+	validate := idtoken.Validate
+	if p.Validator != nil {
+		validate = p.Validator.Validate
+	}
+	payload, err := validate(r.Context(), token, p.Audience)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid bearer token: %v", err)
+	}
+	if payload.Issuer != "https://accounts.google.com" && payload.Issuer != "accounts.google.com" {
+		return http.StatusUnauthorized, fmt.Errorf("bearer token from unexpected issuer %s", payload.Issuer)
+	}
+	if p.ServiceAccount != "" {
+		email, _ := payload.Claims["email"].(string)
+		verified, _ := payload.Claims["email_verified"].(bool)
+		if email != p.ServiceAccount || !verified {
+			return http.StatusForbidden, fmt.Errorf("bearer token of unexpected account %q", email)
+		}
+	}
+	return 0, nil
+}
+
+// StartWatch asks Gmail to publish changes of the mailbox to a Pub/Sub topic.
+// Without label IDs, every change is published.
+func (s *Service) StartWatch(ctx context.Context, topic string, labelIds []string) (*gmail.WatchResponse, error) {
+	req := &gmail.WatchRequest{TopicName: topic, LabelIds: labelIds}
+	if len(labelIds) > 0 {
+		req.LabelFilterBehavior = "include"
+	}
+
+	res, err := s.Client.Watch(ctx, req)
+	if err != nil {
+		logrus.Errorf("Failed to watch mailbox on topic %s: %v", topic, err)
+		return nil, err
+	}
+	logrus.Infof("Watching mailbox on topic %s until %s (history ID %d)",
+		topic, time.UnixMilli(res.Expiration).Format(time.RFC3339), res.HistoryId)
+	return res, nil
+}
+
+// KeepWatching renews a watch started by StartWatch a day before each expiry until the context is done.
+// Failed renewals are retried every few minutes, so a watch outlives transient errors.
+func (s *Service) KeepWatching(ctx context.Context, topic string, labelIds []string, res *gmail.WatchResponse) error {
+	for {
+		delay := 5 * time.Minute
+		if res != nil {
+			delay = max(time.Until(time.UnixMilli(res.Expiration))-watchRenewMargin, time.Minute)
+			logrus.Infof("Renewing the watch in %s.", delay.Round(time.Minute))
+		} else {
+			logrus.Warnf("Retrying the watch in %s.", delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		res, _ = s.StartWatch(ctx, topic, labelIds)
+	}
+}
+
+// StopWatch stops publishing mailbox changes.
+func (s *Service) StopWatch(ctx context.Context) error {
+	if err := s.Client.StopWatch(ctx); err != nil {
+		logrus.Errorf("Failed to stop watching the mailbox: %v", err)
+		return err
+	}
+	logrus.Info("Stopped watching the mailbox.")
+	return nil
+}
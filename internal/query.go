@@ -0,0 +1,493 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// QueryNode is a node of a parsed Gmail search query.
+type QueryNode interface {
+	// String prints the node back as canonical Gmail search syntax.
+	String() string
+}
+
+// AndNode matches when all of its children match. Terms separated by spaces, parentheses
+// and the explicit AND keyword produce AndNodes.
+type AndNode struct {
+	Children []QueryNode
+}
+
+// OrNode matches when any of its children matches. The OR keyword and {} groups produce OrNodes.
+type OrNode struct {
+	Children []QueryNode
+}
+
+// NotNode matches when its child does not match. A leading "-" produces a NotNode.
+type NotNode struct {
+	Child QueryNode
+}
+
+// TermNode is a single search term, either a plain word or phrase or an operator with its value.
+// Operator is empty for plain words and always lower case otherwise.
+type TermNode struct {
+	Operator string
+	Value    string
+	Phrase   bool
+}
+
+// String prints the children separated by spaces.
+func (n *AndNode) String() string {
+	parts := make([]string, len(n.Children))
+	for i, child := range n.Children {
+		parts[i] = child.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// String prints the children as a {} group.
+func (n *OrNode) String() string {
+	parts := make([]string, len(n.Children))
+	for i, child := range n.Children {
+		if _, ok := child.(*AndNode); ok {
+			parts[i] = "(" + child.String() + ")"
+		} else {
+			parts[i] = child.String()
+		}
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// String prints the child prefixed with "-".
+func (n *NotNode) String() string {
+	if _, ok := n.Child.(*AndNode); ok {
+		return "-(" + n.Child.String() + ")"
+	}
+	return "-" + n.Child.String()
+}
+
+// String prints the term, quoting the value when it is a phrase or contains special characters.
+func (n *TermNode) String() string {
+	value := n.Value
+	if n.Phrase || value == "" || strings.ContainsAny(value, " \t(){}\"") || value == "OR" || value == "AND" {
+		value = `"` + strings.ReplaceAll(value, `"`, "") + `"`
+	} else if n.Operator == "" && strings.HasPrefix(value, "-") {
+		value = `"` + value + `"`
+	}
+	if n.Operator == "" {
+		return value
+	}
+	return n.Operator + ":" + value
+}
+
+// queryOperators lists the search operators Gmail understands. Words with an unknown
+// operator, such as "http://example.com", are searched as plain text.
+var queryOperators = map[string]bool{
+	"from": true, "to": true, "cc": true, "bcc": true, "subject": true, "label": true,
+	"list": true, "has": true, "is": true, "in": true, "filename": true, "category": true,
+	"after": true, "before": true, "older": true, "newer": true, "older_than": true,
+	"newer_than": true, "larger": true, "smaller": true, "size": true, "deliveredto": true,
+	"rfc822msgid": true,
+}
+
+// QueryError describes a syntax error in a search query.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseQuery parses a Gmail search query into an AST.
+//
+// Terms separated by spaces are combined with AND. OR binds tighter than AND, as in Gmail, so
+// "a b OR c" means a AND (b OR c). An operator applied to a group, such as from:(a b) or
+// subject:{x y}, is distributed over the group's terms.
+func ParseQuery(query string) (QueryNode, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseAnd(tokenEOF)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected '%s'", tok.text)}
+	}
+	if node == nil {
+		return &AndNode{}, nil
+	}
+	return node, nil
+}
+
+// CanonicalQuery parses a query and prints it back in canonical form.
+func CanonicalQuery(query string) (string, error) {
+	node, err := ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	return node.String(), nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenNot
+	tokenOr
+	tokenAnd
+	tokenLParen
+	tokenRParen
+	tokenLBrace
+	tokenRBrace
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenize splits a query into tokens. A "-" only negates when it starts a term.
+func tokenize(query string) ([]token, error) {
+	var tokens []token
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == '{':
+			tokens = append(tokens, token{tokenLBrace, "{", i})
+			i++
+		case r == '}':
+			tokens = append(tokens, token{tokenRBrace, "}", i})
+			i++
+		case r == '-' && (len(tokens) == 0 || !attached(tokens[len(tokens)-1], i)) && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, token{tokenNot, "-", i})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &QueryError{Pos: i, Msg: "unterminated quoted phrase"}
+			}
+			tokens = append(tokens, token{tokenPhrase, string(runes[i+1 : end]), i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`(){}"`, runes[end]) {
+				end++
+			}
+			word := string(runes[i:end])
+			kind := tokenWord
+			switch word {
+			case "OR":
+				kind = tokenOr
+			case "AND":
+				kind = tokenAnd
+			}
+			tokens = append(tokens, token{kind, word, i})
+			i = end
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "end of query", len(runes)}), nil
+}
+
+// attached reports whether a token ends right before position pos, such as an operator
+// directly followed by its value.
+func attached(tok token, pos int) bool {
+	return tok.kind == tokenWord && strings.HasSuffix(tok.text, ":") && tok.pos+len([]rune(tok.text)) == pos
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+
+	// operator is applied to plain terms inside an operator group such as from:(a b).
+	operator string
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseAnd parses terms up to the closing token and combines them with AND.
+func (p *queryParser) parseAnd(closing tokenKind) (QueryNode, error) {
+	var children []QueryNode
+	for {
+		tok := p.peek()
+		if tok.kind == closing || tok.kind == tokenEOF {
+			break
+		}
+		if tok.kind == tokenAnd {
+			p.next()
+			continue
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		children = appendFlattened[*AndNode](children, node)
+	}
+	return combine[*AndNode](children), nil
+}
+
+// parseOr parses a term followed by any number of "OR term".
+func (p *queryParser) parseOr() (QueryNode, error) {
+	node, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []QueryNode{node}
+	for p.peek().kind == tokenOr {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = appendFlattened[*OrNode](children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &OrNode{Children: children}, nil
+}
+
+// parseUnary parses an optionally negated term.
+func (p *queryParser) parseUnary() (QueryNode, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if not, ok := child.(*NotNode); ok {
+			return not.Child, nil
+		}
+		return &NotNode{Child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a group, phrase, word or operator term.
+func (p *queryParser) parsePrimary() (QueryNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		node, err := p.parseAnd(tokenRParen)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, &QueryError{Pos: tok.pos, Msg: "unbalanced '('"}
+		}
+		if node == nil {
+			return nil, &QueryError{Pos: tok.pos, Msg: "empty group '()'"}
+		}
+		return node, nil
+	case tokenLBrace:
+		var children []QueryNode
+		for p.peek().kind != tokenRBrace {
+			if p.peek().kind == tokenEOF {
+				return nil, &QueryError{Pos: tok.pos, Msg: "unbalanced '{'"}
+			}
+			if p.peek().kind == tokenAnd {
+				p.next()
+				continue
+			}
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			children = appendFlattened[*OrNode](children, node)
+		}
+		p.next()
+		if len(children) == 0 {
+			return nil, &QueryError{Pos: tok.pos, Msg: "empty group '{}'"}
+		}
+		return combine[*OrNode](children), nil
+	case tokenPhrase:
+		return &TermNode{Operator: p.operator, Value: tok.text, Phrase: true}, nil
+	case tokenWord:
+		op, value, found := strings.Cut(tok.text, ":")
+		if !found || !queryOperators[strings.ToLower(op)] {
+			return &TermNode{Operator: p.operator, Value: tok.text}, nil
+		}
+		op = strings.ToLower(op)
+		if value != "" {
+			return &TermNode{Operator: op, Value: value}, nil
+		}
+		return p.parseOperand(op, tok)
+	case tokenEOF:
+		return nil, &QueryError{Pos: tok.pos, Msg: "unexpected end of query"}
+	default:
+		return nil, &QueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected '%s'", tok.text)}
+	}
+}
+
+// parseOperand parses the value of an operator written with a space-less group or phrase,
+// such as from:(a b), from:{a b} or subject:"a b".
+func (p *queryParser) parseOperand(op string, opTok token) (QueryNode, error) {
+	tok := p.peek()
+	if !(tok.kind == tokenPhrase || tok.kind == tokenLParen || tok.kind == tokenLBrace) || tok.pos != opTok.pos+len([]rune(opTok.text)) {
+		return nil, &QueryError{Pos: opTok.pos, Msg: fmt.Sprintf("missing value for operator '%s:'", op)}
+	}
+
+	outer := p.operator
+	p.operator = op
+	defer func() { p.operator = outer }()
+	return p.parsePrimary()
+}
+
+// appendFlattened appends a node to a list of children, merging it if it is of the same kind as the parent.
+func appendFlattened[T *AndNode | *OrNode](children []QueryNode, node QueryNode) []QueryNode {
+	if same, ok := node.(T); ok {
+		switch n := any(same).(type) {
+		case *AndNode:
+			return append(children, n.Children...)
+		case *OrNode:
+			return append(children, n.Children...)
+		}
+	}
+	return append(children, node)
+}
+
+// combine builds an AND or OR node from a list of children, unwrapping a single child.
+func combine[T *AndNode | *OrNode](children []QueryNode) QueryNode {
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	var node T
+	switch any(node).(type) {
+	case *AndNode:
+		return &AndNode{Children: children}
+	default:
+		return &OrNode{Children: children}
+	}
+}
+
+// hasValues lists the values accepted by the has: operator, including the suffixes of star names like yellow-star.
+var hasValues = map[string]bool{
+	"attachment": true, "userlabels": true, "nouserlabels": true, "drive": true, "document": true,
+	"spreadsheet": true, "presentation": true, "youtube": true, "star": true, "circle": true,
+	"bang": true, "guillemet": true, "info": true, "check": true, "question": true,
+}
+
+// LintQuery checks a search query for syntax errors and operator values Gmail would not understand.
+// It returns one message per problem found.
+func LintQuery(query string) []string {
+	node, err := ParseQuery(query)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	walkQuery(node, func(t *TermNode) {
+		value := strings.ToLower(t.Value)
+		var ok bool
+		switch t.Operator {
+		case "has":
+			_, star, _ := strings.Cut(value, "-")
+			ok = hasValues[value] || hasValues[star]
+		case "larger", "smaller", "size":
+			_, ok = parseQuerySize(value)
+		case "older_than", "newer_than":
+			_, ok = parseQueryAge(value)
+		case "after", "before", "older", "newer":
+			_, ok = parseQueryDate(value)
+		default:
+			ok = true
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("invalid value '%s' for operator '%s:'", t.Value, t.Operator))
+		}
+	})
+	return problems
+}
+
+// LintCriteria checks the values of a filter's criteria. The from, to, subject, query and negated
+// query values are linted as written, since QueryFromCriteria groups them and rejects the ones it
+// cannot translate. It returns one message per problem found.
+func LintCriteria(criteria *gmail.FilterCriteria) []string {
+	if criteria == nil {
+		return []string{"no criteria"}
+	}
+
+	var problems []string
+	for _, field := range []struct{ name, value string }{
+		{"from", criteria.From},
+		{"to", criteria.To},
+		{"subject", criteria.Subject},
+		{"query", criteria.Query},
+		{"negatedQuery", criteria.NegatedQuery},
+	} {
+		if strings.TrimSpace(field.value) == "" {
+			continue
+		}
+		for _, problem := range LintQuery(field.value) {
+			problems = append(problems, fmt.Sprintf("%s '%s': %s", field.name, field.value, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	query, err := QueryFromCriteria(criteria)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if query == "" {
+		return []string{"no criteria"}
+	}
+	return nil
+}
+
+// walkQuery calls fn for every term of a query.
+func walkQuery(node QueryNode, fn func(*TermNode)) {
+	switch n := node.(type) {
+	case *AndNode:
+		for _, child := range n.Children {
+			walkQuery(child, fn)
+		}
+	case *OrNode:
+		for _, child := range n.Children {
+			walkQuery(child, fn)
+		}
+	case *NotNode:
+		walkQuery(n.Child, fn)
+	case *TermNode:
+		fn(n)
+	}
+}
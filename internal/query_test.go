@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"invoice", "invoice"},
+		{"from:alice@example.com", "from:alice@example.com"},
+		{"FROM:alice", "from:alice"},
+		{"a b", "a b"},
+		{"a AND b", "a b"},
+		{"a OR b", "{a b}"},
+		{"a b OR c", "a {b c}"},
+		{"{a b} c", "{a b} c"},
+		{"-a", "-a"},
+		{"--a", "a"},
+		{"-(a b)", "-(a b)"},
+		{`"weekly report"`, `"weekly report"`},
+		{`subject:"weekly report"`, `subject:"weekly report"`},
+		{"from:(alice bob)", "from:alice from:bob"},
+		{"from:{alice bob}", "{from:alice from:bob}"},
+		{"from:(alice OR bob)", "{from:alice from:bob}"},
+		{"(a (b c))", "a b c"},
+		{"http://example.com", "http://example.com"},
+		{"well-known", "well-known"},
+		{"larger:10M -has:attachment", "larger:10M -has:attachment"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := CanonicalQuery(tt.query)
+			if err != nil {
+				t.Fatalf("CanonicalQuery() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CanonicalQuery() = %q, want %q", got, tt.want)
+			}
+			// The canonical form parses back to itself
+			again, err := CanonicalQuery(got)
+			if err != nil || again != got {
+				t.Errorf("CanonicalQuery(%q) = %q, %v; want it unchanged", got, again, err)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		msg   string
+	}{
+		{"from:(a", "unbalanced '('"},
+		{"{a b", "unbalanced '{'"},
+		{`subject:"weekly`, "unterminated quoted phrase"},
+		{"a)", "unexpected ')'"},
+		{"a }", "unexpected '}'"},
+		{"()", "empty group '()'"},
+		{"{}", "empty group '{}'"},
+		{"from:", "missing value for operator 'from:'"},
+		{"from: alice", "missing value for operator 'from:'"},
+		{"a OR", "unexpected end of query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("ParseQuery() error = %v, want a QueryError", err)
+			}
+			if queryErr.Msg != tt.msg {
+				t.Errorf("ParseQuery() error = %q, want %q", queryErr.Msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestLintQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"from:alice has:attachment larger:5M older_than:1y after:2024/01/31", nil},
+		{"has:yellow-star", nil},
+		{"has:attachments", []string{"invalid value 'attachments' for operator 'has:'"}},
+		{"larger:5X", []string{"invalid value '5X' for operator 'larger:'"}},
+		{"older_than:2w", []string{"invalid value '2w' for operator 'older_than:'"}},
+		{"before:31/01/2024", []string{"invalid value '31/01/2024' for operator 'before:'"}},
+		{"from:(a", []string{"invalid query at position 5: unbalanced '('"}},
+		{`"a`, []string{"invalid query at position 0: unterminated quoted phrase"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := LintQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LintQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria *gmail.FilterCriteria
+		want     string
+	}{
+		{"valid", &gmail.FilterCriteria{From: "alice OR bob", Query: "has:attachment"}, ""},
+		{"nil criteria", nil, "no criteria"},
+		{"empty criteria", &gmail.FilterCriteria{}, "no criteria"},
+		{"unbalanced query", &gmail.FilterCriteria{Query: "from:(a"}, "query 'from:(a': invalid query at position 5: unbalanced '('"},
+		{"unbalanced from", &gmail.FilterCriteria{From: "{a b"}, "from '{a b': invalid query at position 0: unbalanced '{'"},
+		{"unbalanced to", &gmail.FilterCriteria{To: `"a`}, `to '"a': invalid query at position 0: unterminated quoted phrase`},
+		{"unbalanced subject", &gmail.FilterCriteria{Subject: "a)"}, "subject 'a)': invalid query at position 1: unexpected ')'"},
+		{"invalid negated query", &gmail.FilterCriteria{From: "a", NegatedQuery: "has:nothing"}, "negatedQuery 'has:nothing': invalid value 'nothing' for operator 'has:'"},
+		{"unknown size comparison", &gmail.FilterCriteria{Size: 10, SizeComparison: "equal"}, "unsupported size comparison"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(LintCriteria(tt.criteria), "; ")
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("LintCriteria() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// renderedMessage is a message reduced to what a readable rendering shows.
+type renderedMessage struct {
+	Subject     string
+	From        string
+	To          string
+	Cc          string
+	Date        string
+	Body        string
+	Attachments []string
+}
+
+// RenderMessages writes a readable rendering of messages fetched in "full" format, in "markdown"
+// or "html": the subject, then for each message its sender, recipients and date, its text and
+// the list of its attachments. Messages of a thread are rendered in order under one title.
+// The plain text alternative of a message is preferred; HTML bodies are reduced to their text,
+// so the HTML rendering never includes markup from the messages themselves.
+func RenderMessages(w io.Writer, format string, messages []*gmail.Message) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("no messages to render")
+	}
+	var rendered []*renderedMessage
+	for _, m := range messages {
+		rendered = append(rendered, newRenderedMessage(m))
+	}
+
+	switch format {
+	case "markdown", "md":
+		return renderMarkdown(w, rendered)
+	case "html":
+		return htmlTemplate.Execute(w, rendered)
+	}
+	return fmt.Errorf("unknown format %s, use eml, markdown or html", format)
+}
+
+// newRenderedMessage extracts the headers, text and attachment list of a message.
+func newRenderedMessage(m *gmail.Message) *renderedMessage {
+	headers := messageHeaders(m)
+	r := &renderedMessage{
+		Subject: decodeHeader(headers["Subject"]),
+		From:    decodeHeader(headers["From"]),
+		To:      decodeHeader(headers["To"]),
+		Cc:      decodeHeader(headers["Cc"]),
+	}
+	if date := messageDate(m, headers["Date"]); !date.IsZero() {
+		r.Date = date.Local().Format("Mon, 2 Jan 2006 15:04 MST")
+	}
+
+	plain, htmlBody := textParts(m.Id, m.Payload)
+	r.Body = strings.TrimSpace(strings.ReplaceAll(plain, "\r\n", "\n"))
+	if r.Body == "" {
+		r.Body = htmlToText(htmlBody)
+	}
+
+	for _, part := range attachmentParts(m.Payload) {
+		r.Attachments = append(r.Attachments, fmt.Sprintf("%s (%s, %s)", part.Filename, part.MimeType, formatSize(part.Body.Size)))
+	}
+	return r
+}
+
+// textParts returns the first plain text and the first HTML body of a payload, skipping attachments.
+func textParts(messageId string, part *gmail.MessagePart) (plain, htmlBody string) {
+	if part == nil || part.Filename != "" {
+		return "", ""
+	}
+	if (part.MimeType == "text/plain" || part.MimeType == "text/html") && part.Body != nil && part.Body.Data != "" {
+		data, err := decodeBase64URL(part.Body.Data)
+		if err == nil {
+			data, err = toUTF8(data, partCharset(part))
+		}
+		if err != nil {
+			logrus.Warnf("Failed to decode body of message %s: %v", messageId, err)
+		} else if part.MimeType == "text/plain" {
+			plain = string(data)
+		} else {
+			htmlBody = string(data)
+		}
+	}
+
+	for _, child := range part.Parts {
+		childPlain, childHTML := textParts(messageId, child)
+		if plain == "" {
+			plain = childPlain
+		}
+		if htmlBody == "" {
+			htmlBody = childHTML
+		}
+	}
+	return plain, htmlBody
+}
+
+// partCharset returns the charset parameter of the Content-Type header of a part, if any.
+func partCharset(part *gmail.MessagePart) string {
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			if _, params, err := mime.ParseMediaType(h.Value); err == nil {
+				return params["charset"]
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// toUTF8 converts text in the given charset to UTF-8. Text without a charset is returned as is.
+func toUTF8(data []byte, charset string) ([]byte, error) {
+	if charset == "" {
+		return data, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return enc.NewDecoder().Bytes(data)
+}
+
+// charsetReader converts RFC 2047 encoded words in any charset known to browsers to UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+var (
+	htmlInvisible = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)\s*>`)
+	htmlBreak     = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|li|h[1-6]|blockquote)\s*>`)
+	blankLines    = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// htmlToText reduces an HTML body to its text, keeping line and paragraph breaks.
+func htmlToText(body string) string {
+	body = htmlInvisible.ReplaceAllString(body, "")
+	body = htmlBreak.ReplaceAllString(body, "\n")
+	body = html.UnescapeString(stripHTML(body))
+
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// formatSize formats a size in bytes for display.
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// renderMarkdown writes messages as Markdown, separated by horizontal rules. Header values and
+// attachment names are escaped and bodies are put in code blocks, so sender-supplied text is shown
+// as written instead of rendering as links, images or HTML.
+func renderMarkdown(w io.Writer, messages []*renderedMessage) error {
+	var b strings.Builder
+	subject := messages[0].Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	fmt.Fprintf(&b, "# %s\n", markdownEscaper.Replace(subject))
+
+	for i, m := range messages {
+		if i > 0 {
+			b.WriteString("\n---\n")
+		}
+		b.WriteString("\n")
+		// Two trailing spaces keep each header on its own line
+		for _, h := range [][2]string{{"From", m.From}, {"To", m.To}, {"Cc", m.Cc}, {"Date", m.Date}} {
+			if h[1] != "" {
+				fmt.Fprintf(&b, "**%s:** %s  \n", h[0], markdownEscaper.Replace(h[1]))
+			}
+		}
+		if m.Body != "" {
+			fence := markdownFence(m.Body)
+			fmt.Fprintf(&b, "\n%s\n%s\n%s\n", fence, m.Body, fence)
+		}
+		if len(m.Attachments) > 0 {
+			b.WriteString("\n**Attachments:**\n\n")
+			for _, a := range m.Attachments {
+				fmt.Fprintf(&b, "- %s\n", markdownEscaper.Replace(a))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownEscaper backslash-escapes the characters that would make text render as Markdown or HTML.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "&", `\&`, "#", `\#`, "!", `\!`, "|", `\|`,
+)
+
+// markdownFence returns a code fence longer than any run of backticks in text, so the text cannot end the block.
+func markdownFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r != '`' {
+			run = 0
+			continue
+		}
+		run++
+		longest = max(longest, run)
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// htmlTemplate renders messages as a standalone HTML page. Values are escaped by html/template.
+var htmlTemplate = template.Must(template.New("messages").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{- $subject := (index . 0).Subject}}
+<title>{{if $subject}}{{$subject}}{{else}}(no subject){{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; }
+.headers { color: #555; }
+.body { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{if $subject}}{{$subject}}{{else}}(no subject){{end}}</h1>
+{{- range $i, $m := .}}
+{{if $i}}<hr>
+{{end}}<div class="message">
+<p class="headers">
+{{- if .From}}<b>From:</b> {{.From}}<br>{{end}}
+{{- if .To}}<b>To:</b> {{.To}}<br>{{end}}
+{{- if .Cc}}<b>Cc:</b> {{.Cc}}<br>{{end}}
+{{- if .Date}}<b>Date:</b> {{.Date}}{{end}}</p>
+{{- if .Body}}
+<div class="body">{{.Body}}</div>
+{{- end}}
+{{- if .Attachments}}
+<p><b>Attachments:</b></p>
+<ul>
+{{- range .Attachments}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</div>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,91 @@
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+// renderedRaw renders RFC 822 data as the API would return it in "full" format.
+func renderedRaw(t *testing.T, raw string) string {
+	t.Helper()
+	fake := gmailtest.NewFakeClient()
+	msg, err := fake.GetMessage(context.Background(), fake.AddMessage([]byte(raw), "INBOX"), "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := internal.RenderMessages(&b, "markdown", []*gmail.Message{msg}); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestRenderMessagesCharset(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "latin1 plain text",
+			raw:  "Subject: =?iso-8859-1?q?Caf=E9?=\r\nContent-Type: text/plain; charset=iso-8859-1\r\n\r\nCr\xe8me br\xfbl\xe9e\r\n",
+			want: "# Café\n\n\n```\nCrème brûlée\n```\n",
+		},
+		{
+			name: "windows-1252 quoted-printable",
+			raw:  "Subject: Quotes\r\nContent-Type: text/plain; charset=\"windows-1252\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n=93Hello=94 =80\r\n",
+			want: "\n“Hello” €\n",
+		},
+		{
+			name: "shift_jis html part",
+			raw: "Subject: =?shift_jis?b?g2WDWINn?=\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html; charset=Shift_JIS\r\n\r\n<p>\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd</p>\r\n--b--\r\n",
+			want: "# テスト\n\n\n```\nこんにちは\n```\n",
+		},
+		{
+			name: "no charset",
+			raw:  "Subject: Plain\r\n\r\nJust text\r\n",
+			want: "\nJust text\n",
+		},
+		{
+			name: "unknown charset keeps the html alternative",
+			raw: "Subject: Odd\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=x-unknown\r\n\r\nUnreadable\r\n" +
+				"--b\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<b>Readable</b>\r\n--b--\r\n",
+			want: "\nReadable\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderedRaw(t, tt.raw); !strings.Contains(got, tt.want) {
+				t.Errorf("rendering %q does not contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownEscapesSenderText(t *testing.T) {
+	raw := "From: \"[Support](https://evil.example.com)\" <support@example.com>\r\n" +
+		"Subject: <img src=x onerror=alert(1)> *urgent*\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Click [here](https://evil.example.com) <script>alert(1)</script>\r\n" +
+		"```\r\nnot the end\r\n"
+	got := renderedRaw(t, raw)
+
+	for _, want := range []string{
+		`# \<img src=x onerror=alert(1)\> \*urgent\*`,
+		`**From:** "\[Support\](https://evil.example.com)" \<support@example.com\>  `,
+		// The body is shown verbatim in a fence longer than its own backticks
+		"\n````\nClick [here](https://evil.example.com) <script>alert(1)</script>\n```\nnot the end\n````\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("rendering does not contain %q:\n%q", want, got)
+		}
+	}
+}
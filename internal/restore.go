@@ -0,0 +1,583 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// ArchivedMessage is a raw message read from a local archive with the labels it was filed under.
+type ArchivedMessage struct {
+	// Location identifies the message in the archive: a byte offset in an mbox file, prefixed with the
+	// segment number in encrypted mbox segments ("2:1024"), or a path in a Maildir.
+	Location string
+	// Labels holds label names; system labels are given by their IDs, such as INBOX or UNREAD.
+	Labels []string
+	Raw    []byte
+}
+
+// MessageReader reads the messages of a local archive one at a time.
+type MessageReader interface {
+	// Next returns the next message, or io.EOF after the last one.
+	Next() (*ArchivedMessage, error)
+	Close() error
+}
+
+// NewMessageReader opens an archive written by a MessageWriter or another mail client:
+// a directory is read as a Maildir, a file as an mbox. Encrypted mbox files are decrypted with enc.
+func NewMessageReader(path string, enc *Encryption) (MessageReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		logrus.Errorf("Failed to open archive: %v", err)
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	if info.IsDir() {
+		return NewMaildirReader(path)
+	}
+	if segments := MboxSegments(path); len(segments) > 1 {
+		return &mboxSegmentReader{paths: segments, enc: enc}, nil
+	}
+	return NewMboxReader(path, enc)
+}
+
+// mboxSegmentReader reads an mbox archive with encrypted segments, one segment after the other.
+// Locations are prefixed with the segment number like the locations MboxWriter returns.
+type mboxSegmentReader struct {
+	paths   []string
+	enc     *Encryption
+	n       int
+	current *MboxReader
+}
+
+// Next returns the next message of the current segment, moving on to the next segment at its end.
+func (r *mboxSegmentReader) Next() (*ArchivedMessage, error) {
+	for {
+		if r.current == nil {
+			if r.n >= len(r.paths) {
+				return nil, io.EOF
+			}
+			current, err := NewMboxReader(r.paths[r.n], r.enc)
+			if err != nil {
+				return nil, err
+			}
+			r.current = current
+		}
+
+		msg, err := r.current.Next()
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			r.n++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.n > 0 {
+			msg.Location = strconv.Itoa(r.n) + ":" + msg.Location
+		}
+		return msg, nil
+	}
+}
+
+// Close closes the segment being read.
+func (r *mboxSegmentReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
+
+// MboxReader reads messages from an mbox file. Labels are read from X-Gmail-Labels headers, as
+// written by MboxWriter and Google Takeout.
+type MboxReader struct {
+	file *os.File
+	r    *bufio.Reader
+	// offset is the position of the next line to read.
+	offset int64
+	// next is the "From " line starting the next message, and nextOffset its position.
+	next       []byte
+	nextOffset int64
+}
+
+// NewMboxReader opens an mbox file, decrypting it with enc if it is encrypted.
+func NewMboxReader(path string, enc *Encryption) (*MboxReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		logrus.Errorf("Failed to open mbox file: %v", err)
+		return nil, fmt.Errorf("failed to open mbox file: %v", err)
+	}
+	r, err := enc.Decrypt(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open mbox file %s: %v", path, err)
+	}
+	return &MboxReader{file: file, r: bufio.NewReader(r)}, nil
+}
+
+// readLine returns the next line with its line ending, or io.EOF at the end of the file.
+func (m *MboxReader) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	m.offset += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+// Next returns the next message. Lines quoted as ">From " are unquoted as in the mboxrd variant.
+func (m *MboxReader) Next() (*ArchivedMessage, error) {
+	// Skip anything before the first "From " line
+	for m.next == nil {
+		start := m.offset
+		line, err := m.readLine()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed to read mbox file: %v", err)
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			m.next, m.nextOffset = line, start
+		}
+	}
+
+	location := strconv.FormatInt(m.nextOffset, 10)
+	m.next = nil
+	var raw bytes.Buffer
+	for {
+		start := m.offset
+		line, err := m.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mbox file: %v", err)
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			m.next, m.nextOffset = line, start
+			break
+		}
+		if line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = line[1:]
+		}
+		raw.Write(line)
+	}
+
+	// The blank line before the next "From " line separates messages and is not part of the message
+	data := raw.Bytes()
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n\n")) {
+		data = data[:len(data)-1]
+	}
+
+	labels, data := extractGmailHeaders(data)
+	return &ArchivedMessage{Location: location, Labels: labels, Raw: data}, nil
+}
+
+// Close closes the mbox file.
+func (m *MboxReader) Close() error {
+	return m.file.Close()
+}
+
+// extractGmailHeaders removes the X-Gmail-Labels and X-GM-THRID headers added to mbox exports
+// and returns the labels they listed.
+func extractGmailHeaders(raw []byte) ([]string, []byte) {
+	end := bytes.Index(raw, []byte("\n\n"))
+	if crlf := bytes.Index(raw, []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+		end = crlf
+	}
+	if end < 0 {
+		return nil, raw
+	}
+
+	var labels []string
+	var kept bytes.Buffer
+	dropping := false
+	for _, line := range bytes.SplitAfter(raw[:end+1], []byte("\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// A folded continuation of the previous header
+			if dropping {
+				labels = append(labels, parseGmailLabels(string(line))...)
+				continue
+			}
+			kept.Write(line)
+			continue
+		}
+		name, value, _ := strings.Cut(string(line), ":")
+		switch {
+		case strings.EqualFold(name, "X-Gmail-Labels"):
+			dropping = true
+			labels = append(labels, parseGmailLabels(value)...)
+		case strings.EqualFold(name, "X-GM-THRID"):
+			dropping = true
+		default:
+			dropping = false
+			kept.Write(line)
+		}
+	}
+	kept.Write(raw[end+1:])
+	return labels, kept.Bytes()
+}
+
+// takeoutSystemLabels maps the system label names of Google Takeout exports to label IDs.
+// Takeout-only markers such as Opened and Archived map to nothing.
+var takeoutSystemLabels = map[string]string{
+	"inbox":     "INBOX",
+	"unread":    "UNREAD",
+	"starred":   "STARRED",
+	"important": "IMPORTANT",
+	"sent":      "SENT",
+	"drafts":    "DRAFT",
+	"draft":     "DRAFT",
+	"spam":      "SPAM",
+	"trash":     "TRASH",
+	"chat":      "CHAT",
+	"opened":    "",
+	"archived":  "",
+}
+
+// parseGmailLabels parses the comma-separated value of an X-Gmail-Labels header.
+func parseGmailLabels(value string) []string {
+	var labels []string
+	for _, label := range strings.Split(value, ",") {
+		label = strings.Trim(strings.TrimSpace(label), `"`)
+		if label == "" {
+			continue
+		}
+		if id, ok := takeoutSystemLabels[strings.ToLower(label)]; ok {
+			if id != "" {
+				labels = append(labels, id)
+			}
+			continue
+		}
+		if category, ok := strings.CutPrefix(label, "Category "); ok {
+			label = "CATEGORY_" + strings.ToUpper(category)
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// MaildirReader reads messages from a Maildir++ directory. The folders of a message become its labels
+// and its Maildir flags become UNREAD and STARRED, reversing MaildirWriter. Copies of a message in
+// several folders, recognized by their file name, are read as one message.
+type MaildirReader struct {
+	root     string
+	messages []*maildirEntry
+}
+
+// maildirEntry is a message found in a Maildir, with the labels of all its copies.
+type maildirEntry struct {
+	path   string
+	labels []string
+}
+
+// NewMaildirReader lists the messages of a Maildir directory.
+func NewMaildirReader(root string) (*MaildirReader, error) {
+	folders := []string{""}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		logrus.Errorf("Failed to read Maildir: %v", err)
+		return nil, fmt.Errorf("failed to read Maildir: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") && len(entry.Name()) > 1 {
+			folders = append(folders, entry.Name())
+		}
+	}
+
+	r := &MaildirReader{root: root}
+	byName := make(map[string]*maildirEntry)
+	for _, folder := range folders {
+		folderLabel, ok := maildirFolderLabel(folder)
+		for _, sub := range []string{"cur", "new"} {
+			files, err := os.ReadDir(filepath.Join(root, folder, sub))
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+					continue
+				}
+				name, info, _ := strings.Cut(file.Name(), ":2,")
+				entry := byName[name]
+				if entry == nil {
+					entry = &maildirEntry{path: filepath.Join(folder, sub, file.Name())}
+					byName[name] = entry
+					r.messages = append(r.messages, entry)
+				}
+				if ok {
+					entry.labels = appendLabel(entry.labels, folderLabel)
+				}
+				if sub == "new" || !strings.Contains(info, "S") {
+					entry.labels = appendLabel(entry.labels, "UNREAD")
+				}
+				if strings.Contains(info, "F") {
+					entry.labels = appendLabel(entry.labels, "STARRED")
+				}
+			}
+		}
+	}
+
+	// File names start with the delivery time, so sorting them restores the delivery order
+	sort.SliceStable(r.messages, func(i, j int) bool {
+		return filepath.Base(r.messages[i].path) < filepath.Base(r.messages[j].path)
+	})
+	logrus.Infof("Found %d messages in Maildir %s", len(r.messages), root)
+	return r, nil
+}
+
+// maildirFolderLabel returns the label of a Maildir++ folder; false means the folder has none, like ".Archive".
+// Label names are recovered by turning the "." separators back into "/".
+func maildirFolderLabel(folder string) (string, bool) {
+	if folder == "" {
+		return "INBOX", true
+	}
+	name := strings.TrimPrefix(folder, ".")
+	if name == "Archive" {
+		return "", false
+	}
+	for id, systemFolder := range maildirSystemFolders {
+		if systemFolder != "" && systemFolder == name {
+			return id, true
+		}
+	}
+	return strings.ReplaceAll(name, ".", "/"), true
+}
+
+// appendLabel appends a label unless it is already in the list.
+func appendLabel(labels []string, label string) []string {
+	for _, l := range labels {
+		if l == label {
+			return labels
+		}
+	}
+	return append(labels, label)
+}
+
+// Next returns the next message.
+func (r *MaildirReader) Next() (*ArchivedMessage, error) {
+	if len(r.messages) == 0 {
+		return nil, io.EOF
+	}
+	entry := r.messages[0]
+	r.messages = r.messages[1:]
+
+	raw, err := os.ReadFile(filepath.Join(r.root, entry.path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message %s: %v", entry.path, err)
+	}
+	return &ArchivedMessage{Location: entry.path, Labels: entry.labels, Raw: raw}, nil
+}
+
+// Close does nothing; message files are read whole.
+func (r *MaildirReader) Close() error {
+	return nil
+}
+
+// RestoreState records the messages of an archive already restored, so an interrupted restore can resume.
+type RestoreState struct {
+	Source string `json:"source"`
+	// Imported maps the Message-ID of each restored message, or the hash of messages without one,
+	// to its Gmail message ID. Messages found already in the mailbox are recorded as well.
+	Imported  map[string]string `json:"imported"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// LoadRestoreState loads the restore state of an archive. A missing state file yields an empty state;
+// a state file recorded for another archive is refused, as its messages would be skipped.
+func LoadRestoreState(statePath, source string) (*RestoreState, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	state := &RestoreState{Source: source, Imported: make(map[string]string)}
+	if !fileExists(statePath) {
+		return state, nil
+	}
+	if err := loadStateFile(statePath, state); err != nil {
+		return nil, err
+	}
+	if recorded, err := filepath.Abs(state.Source); err != nil || recorded != source {
+		return nil, fmt.Errorf("restore state %s was recorded for archive %s", statePath, state.Source)
+	}
+	if state.Imported == nil {
+		state.Imported = make(map[string]string)
+	}
+
+	logrus.Infof("Resuming restore: %d messages already restored according to %s", len(state.Imported), statePath)
+	return state, nil
+}
+
+// Save writes the RestoreState to a JSON state file.
+func (r *RestoreState) Save(statePath string) error {
+	r.UpdatedAt = time.Now()
+	return saveStateFile(statePath, r)
+}
+
+// RestoreResult summarizes a restore.
+type RestoreResult struct {
+	Imported   int
+	Duplicates int
+	Resumed    int
+	Failed     int
+}
+
+// RestoreMessages imports the messages of an archive with their labels, creating missing labels by
+// name. Messages whose Message-ID is already in the mailbox are skipped, as are those the state
+// records as restored. The state is saved to statePath every 50 messages and when the restore ends;
+// in a dry run nothing is imported, created or saved. A message Gmail rejects is reported and skipped.
+func (s *Service) RestoreMessages(ctx context.Context, r MessageReader, state *RestoreState, statePath string, dryRun bool) (result *RestoreResult, err error) {
+	result = &RestoreResult{}
+	labelMap, err := s.LabelsMap(ctx)
+	if err != nil {
+		return result, err
+	}
+	labelIds := make(map[string]string)
+	for name, label := range labelMap {
+		labelIds[name] = label.Id
+	}
+
+	if !dryRun {
+		defer func() {
+			if saveErr := state.Save(statePath); saveErr != nil && err == nil {
+				err = saveErr
+			}
+		}()
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		key, messageId := restoreKey(msg.Raw)
+		if _, done := state.Imported[key]; done {
+			result.Resumed++
+			continue
+		}
+
+		if term, err := queryValue(messageId); err == nil && term != "" {
+			existing, err := s.Client.ListMessages(ctx, "rfc822msgid:"+term, "", 1)
+			if err != nil {
+				logrus.Errorf("Failed to search for message %s: %v", messageId, err)
+				return result, err
+			}
+			if len(existing.Messages) > 0 {
+				logrus.Debugf("Message %s is already in the mailbox as %s", messageId, existing.Messages[0].Id)
+				state.Imported[key] = existing.Messages[0].Id
+				result.Duplicates++
+				continue
+			}
+		}
+
+		ids, err := s.restoreLabelIds(ctx, msg.Labels, labelIds, dryRun)
+		if err != nil {
+			return result, err
+		}
+		if dryRun {
+			logrus.Infof("Would import message at %s with labels %v", msg.Location, msg.Labels)
+			result.Imported++
+			continue
+		}
+
+		imported, err := s.Client.ImportMessage(ctx, &gmail.Message{
+			Raw:      base64.URLEncoding.EncodeToString(msg.Raw),
+			LabelIds: ids,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			logrus.Errorf("Failed to import message at %s: %v", msg.Location, err)
+			result.Failed++
+			continue
+		}
+		state.Imported[key] = imported.Id
+		result.Imported++
+
+		if result.Imported%50 == 0 {
+			logrus.Infof("Restored %d messages...", result.Imported)
+			if err := state.Save(statePath); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// restoreLabelIds returns the IDs of the labels to import a message with, creating missing labels.
+// Drafts and chats cannot be imported as such, so those labels are dropped. labelIds maps label
+// names to IDs and is updated with created labels.
+func (s *Service) restoreLabelIds(ctx context.Context, names []string, labelIds map[string]string, dryRun bool) ([]string, error) {
+	var ids []string
+	for _, name := range names {
+		switch {
+		case name == "DRAFT" || name == "CHAT":
+			continue
+		case isSystemLabelId(name):
+			ids = append(ids, name)
+			continue
+		case labelIds[name] != "":
+			ids = append(ids, labelIds[name])
+			continue
+		}
+
+		if dryRun {
+			logrus.Infof("Would create label %s", name)
+			labelIds[name] = name
+			continue
+		}
+		label, err := s.Client.CreateLabel(ctx, &gmail.Label{
+			Name:                  name,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		})
+		if err != nil {
+			logrus.Errorf("Failed to create label %s: %v", name, err)
+			return nil, err
+		}
+		logrus.Infof("Label %s created successfully (ID: %s)", name, label.Id)
+		labelIds[name] = label.Id
+		ids = append(ids, label.Id)
+	}
+	return ids, nil
+}
+
+// restoreKey identifies a message across archives and mailboxes by its Message-ID header, or by
+// the hash of its content when it has none. It also returns the Message-ID without angle brackets.
+func restoreKey(raw []byte) (key, messageId string) {
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		messageId = strings.Trim(strings.TrimSpace(parsed.Header.Get("Message-Id")), "<>")
+	}
+	if messageId != "" {
+		return "<" + messageId + ">", messageId
+	}
+	// Archives differ in line endings, so hash the message with LF line endings
+	sum := sha256.Sum256(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")))
+	return "sha256:" + hex.EncodeToString(sum[:]), ""
+}
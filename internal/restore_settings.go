@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// SettingsRestoreReport summarizes the restore of a settings backup.
+type SettingsRestoreReport struct {
+	LabelsCreated   int
+	LabelsExisting  int
+	FiltersCreated  int
+	FiltersExisting int
+	// Failures describes every label and filter that could not be restored.
+	Failures []string
+}
+
+// RestoreSettings recreates the labels and filters of a settings backup, in the account it was taken
+// from or another one. System labels are skipped and user labels are created with their color and
+// visibility unless a label with the same name exists. The label IDs in filter actions are those of
+// the backed up account, so they are mapped by label name to the IDs in this account. Filters that
+// already exist are skipped, so restoring again only creates what is missing.
+func (s *Service) RestoreSettings(ctx context.Context, config *Config) (*SettingsRestoreReport, error) {
+	report := &SettingsRestoreReport{}
+
+	current, err := s.LabelsMap(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	// Step 1: Recreate user labels
+	backupNames := make(map[string]string)
+	for _, label := range config.Labels {
+		if label.Id != "" {
+			backupNames[label.Id] = label.Name
+		}
+		if label.Type == "system" || isSystemLabelId(label.Id) || isSystemLabelId(label.Name) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if _, exists := current[label.Name]; exists {
+			report.LabelsExisting++
+			continue
+		}
+
+		created, err := s.Client.CreateLabel(ctx, &gmail.Label{
+			Name:                  label.Name,
+			Color:                 label.Color,
+			LabelListVisibility:   label.LabelListVisibility,
+			MessageListVisibility: label.MessageListVisibility,
+		})
+		if err != nil {
+			logrus.Errorf("Failed to create label %s: %v", label.Name, err)
+			report.Failures = append(report.Failures, fmt.Sprintf("label %s: %v", label.Name, err))
+			continue
+		}
+		logrus.Infof("Label %s created successfully (ID: %s)", label.Name, created.Id)
+		current[created.Name] = created
+		report.LabelsCreated++
+	}
+
+	// Step 2: Recreate filters with remapped label IDs
+	existing, err := s.Filters(ctx)
+	if err != nil {
+		return report, err
+	}
+	existingKeys := make(map[string]bool)
+	for _, f := range existing {
+		existingKeys[filterKey(f)] = true
+	}
+
+	for _, filter := range config.Filters {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		description := DescribeFilter(filter.Criteria)
+		restored, err := remapFilter(filter, backupNames, current)
+		if err != nil {
+			report.Failures = append(report.Failures, fmt.Sprintf("filter '%s': %v", description, err))
+			continue
+		}
+		if existingKeys[filterKey(restored)] {
+			report.FiltersExisting++
+			continue
+		}
+
+		created, err := s.Client.CreateFilter(ctx, restored)
+		if err != nil {
+			logrus.Errorf("Failed to create filter '%s': %v", description, err)
+			report.Failures = append(report.Failures, fmt.Sprintf("filter '%s': %v", description, err))
+			continue
+		}
+		logrus.Infof("Filter %s created successfully.", created.Id)
+		existingKeys[filterKey(restored)] = true
+		report.FiltersCreated++
+	}
+
+	return report, nil
+}
+
+// remapFilter copies a backed up filter with the label IDs of its actions replaced by the IDs of the
+// labels with the same names in the current account. Label names are accepted in place of IDs, as
+// in hand-written configurations.
+func remapFilter(filter *gmail.Filter, backupNames map[string]string, current map[string]*gmail.Label) (*gmail.Filter, error) {
+	if filter.Action == nil {
+		return &gmail.Filter{Criteria: filter.Criteria}, nil
+	}
+
+	remap := func(ids []string) ([]string, error) {
+		var mapped []string
+		for _, id := range ids {
+			if isSystemLabelId(id) {
+				mapped = append(mapped, id)
+				continue
+			}
+			name := backupNames[id]
+			if name == "" {
+				name = id
+			}
+			label, ok := current[name]
+			if !ok {
+				return nil, fmt.Errorf("label %s does not exist", name)
+			}
+			mapped = append(mapped, label.Id)
+		}
+		return mapped, nil
+	}
+
+	action := *filter.Action
+	var err error
+	if action.AddLabelIds, err = remap(filter.Action.AddLabelIds); err != nil {
+		return nil, err
+	}
+	if action.RemoveLabelIds, err = remap(filter.Action.RemoveLabelIds); err != nil {
+		return nil, err
+	}
+	return &gmail.Filter{Criteria: filter.Criteria, Action: &action}, nil
+}
+
+// filterKey identifies a filter by its criteria and actions, ignoring its ID.
+func filterKey(f *gmail.Filter) string {
+	criteria, _ := json.Marshal(f.Criteria)
+	action, _ := json.Marshal(f.Action)
+	return string(criteria) + string(action)
+}
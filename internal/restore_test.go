@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRestoreStateSource(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "restore.json")
+	archive := filepath.Join(dir, "messages.mbox")
+
+	state, err := LoadRestoreState(statePath, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Imported["<a@example.com>"] = "18c1"
+	if err := state.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same archive resumes, whichever way its path is written
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{archive, relative, archive + string(filepath.Separator)} {
+		resumed, err := LoadRestoreState(statePath, source)
+		if err != nil {
+			t.Fatalf("LoadRestoreState(%s) error = %v", source, err)
+		}
+		if len(resumed.Imported) != 1 {
+			t.Errorf("LoadRestoreState(%s) resumed %d messages, want 1", source, len(resumed.Imported))
+		}
+	}
+
+	if _, err := LoadRestoreState(statePath, filepath.Join(dir, "other.mbox")); err == nil {
+		t.Error("LoadRestoreState() accepted the state of another archive")
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Retention is a list of age-based policies applied on demand, for mail that should not stay around forever.
+type Retention []*RetentionPolicy
+
+// RetentionPolicy archives, marks as read or trashes messages under a label once they reach an age.
+type RetentionPolicy struct {
+	// Label is the name of the label the policy applies to, e.g. Newsletters or Notifications/CI.
+	Label string `yaml:"label"`
+	// OlderThan is the age after which the action is applied, in search query form (14d, 2m, 1y).
+	OlderThan string `yaml:"older_than"`
+	// Action is archive, mark_read or trash.
+	Action string `yaml:"action"`
+	// KeepStarred excludes starred messages.
+	KeepStarred bool `yaml:"keep_starred,omitempty"`
+	// KeepImportant excludes messages marked as important.
+	KeepImportant bool `yaml:"keep_important,omitempty"`
+	// Query is an optional additional Gmail search query messages must match.
+	Query string `yaml:"query,omitempty"`
+}
+
+// Compile validates the retention policies.
+func (r Retention) Compile() error {
+	for i, p := range r {
+		if p.Label == "" && p.Query == "" {
+			return fmt.Errorf("invalid retention policy #%d: label or query is required", i+1)
+		}
+		if _, ok := parseQueryAge(p.OlderThan); !ok {
+			return fmt.Errorf("invalid retention policy #%d: invalid older_than '%s', use e.g. 14d, 2m or 1y", i+1, p.OlderThan)
+		}
+		switch p.Action {
+		case "archive", "mark_read", "trash":
+		default:
+			return fmt.Errorf("invalid retention policy #%d: action must be archive, mark_read or trash, not '%s'", i+1, p.Action)
+		}
+		if p.Query != "" {
+			if _, err := ParseQuery(p.Query); err != nil {
+				return fmt.Errorf("invalid retention policy #%d: %v", i+1, err)
+			}
+			if _, err := queryValue(p.Query); err != nil {
+				return fmt.Errorf("invalid retention policy #%d: query '%s': %v", i+1, p.Query, err)
+			}
+		}
+	}
+	return nil
+}
+
+// String describes the policy, e.g. "archive Newsletters older than 14d".
+func (p *RetentionPolicy) String() string {
+	target := p.Label
+	if target == "" {
+		target = "(" + p.Query + ")"
+	}
+	return fmt.Sprintf("%s %s older than %s", p.Action, target, p.OlderThan)
+}
+
+// BuildQuery builds the Gmail search query selecting the messages the policy still has to act on.
+// Messages the action was already applied to are excluded, so applying a policy again is cheap.
+func (p *RetentionPolicy) BuildQuery() string {
+	var terms []string
+	if p.Label != "" {
+		label := p.Label
+		if strings.ContainsAny(label, " \"(){}") {
+			label = `"` + strings.ReplaceAll(label, `"`, "") + `"`
+		}
+		terms = append(terms, "label:"+label)
+	}
+	terms = append(terms, "older_than:"+p.OlderThan)
+	// Compile rejects queries that cannot be grouped
+	if query, err := queryValue(p.Query); err == nil && query != "" {
+		terms = append(terms, query)
+	}
+	switch p.Action {
+	case "archive":
+		terms = append(terms, "in:inbox")
+	case "mark_read":
+		terms = append(terms, "is:unread")
+	}
+	if p.KeepStarred {
+		terms = append(terms, "-is:starred")
+	}
+	if p.KeepImportant {
+		terms = append(terms, "-is:important")
+	}
+	return strings.Join(terms, " ")
+}
+
+// ApplyRetention applies a policy's action to messages and journals the changes. Archiving and marking
+// as read are done in batches; trashing is done message by message and journaled as adding the TRASH
+// label, so undo moves the messages out of the trash again.
+func (s *Service) ApplyRetention(ctx context.Context, p *RetentionPolicy, messageIds []string) error {
+	switch p.Action {
+	case "archive":
+		return s.BatchModifyMessages(ctx, messageIds, nil, []string{"INBOX"})
+	case "mark_read":
+		return s.BatchModifyMessages(ctx, messageIds, nil, []string{"UNREAD"})
+	case "trash":
+		logrus.Infof("Moving %d messages to the trash...", len(messageIds))
+		for _, id := range messageIds {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, err := s.Client.TrashMessage(ctx, id); err != nil {
+				logrus.Errorf("Failed to trash message %s: %v", id, err)
+				return err
+			}
+			if s.Journal != nil {
+				if err := s.Journal.Record(id, []string{"TRASH"}, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown retention action '%s'", p.Action)
+}
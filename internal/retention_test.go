@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRetentionCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		wantErr string
+	}{
+		{"label", RetentionPolicy{Label: "Newsletters", OlderThan: "14d", Action: "archive"}, ""},
+		{"query", RetentionPolicy{Query: "from:ci@example.com", OlderThan: "2m", Action: "trash"}, ""},
+		{"grouped query", RetentionPolicy{Label: "CI", OlderThan: "1y", Action: "mark_read", Query: "from:a OR from:b"}, ""},
+		{"no label or query", RetentionPolicy{OlderThan: "14d", Action: "archive"}, "label or query is required"},
+		{"missing age", RetentionPolicy{Label: "CI", Action: "archive"}, "invalid older_than ''"},
+		{"age without unit", RetentionPolicy{Label: "CI", OlderThan: "14", Action: "archive"}, "invalid older_than '14'"},
+		{"age in hours", RetentionPolicy{Label: "CI", OlderThan: "12h", Action: "archive"}, "invalid older_than '12h'"},
+		{"unknown action", RetentionPolicy{Label: "CI", OlderThan: "14d", Action: "delete"}, "action must be archive, mark_read or trash, not 'delete'"},
+		{"unbalanced query", RetentionPolicy{Label: "CI", OlderThan: "14d", Action: "trash", Query: `subject:"build`}, "invalid retention policy #1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Retention{&tt.policy}.Compile()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Compile() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Compile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetentionCompileNumbersPolicies(t *testing.T) {
+	r := Retention{
+		{Label: "Newsletters", OlderThan: "14d", Action: "archive"},
+		{Label: "CI", OlderThan: "14d", Action: "shred"},
+	}
+	if err := r.Compile(); err == nil || !strings.Contains(err.Error(), "policy #2") {
+		t.Errorf("Compile() error = %v, want an error about policy #2", err)
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   string
+	}{
+		{"archive", RetentionPolicy{Label: "Newsletters", OlderThan: "14d", Action: "archive"}, "label:Newsletters older_than:14d in:inbox"},
+		{"mark read", RetentionPolicy{Label: "Notifications/CI", OlderThan: "2m", Action: "mark_read"}, "label:Notifications/CI older_than:2m is:unread"},
+		{"trash", RetentionPolicy{Label: "Promotions", OlderThan: "1y", Action: "trash"}, "label:Promotions older_than:1y"},
+		{"label with spaces", RetentionPolicy{Label: `My "Old" Mail`, OlderThan: "1y", Action: "trash"}, `label:"My Old Mail" older_than:1y`},
+		{"keep starred and important", RetentionPolicy{Label: "CI", OlderThan: "14d", Action: "archive", KeepStarred: true, KeepImportant: true},
+			"label:CI older_than:14d in:inbox -is:starred -is:important"},
+		{"simple query", RetentionPolicy{Query: "from:ci@example.com", OlderThan: "14d", Action: "trash"}, "older_than:14d from:ci@example.com"},
+		{"query is grouped", RetentionPolicy{Label: "CI", Query: "from:a OR from:b", OlderThan: "14d", Action: "mark_read"},
+			"label:CI older_than:14d (from:a OR from:b) is:unread"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.BuildQuery(); got != tt.want {
+				t.Errorf("BuildQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetroState records how far a retro run has progressed so that it can be resumed.
+//
+// The state points at the filter being processed and the page of messages that was
+// being worked on. Processed holds the IDs already modified on that page, so a resumed
+// run re-lists the page and skips them.
+type RetroState struct {
+	RunId       string    `json:"run_id"`
+	FilterIndex int       `json:"filter_index"`
+	FilterId    string    `json:"filter_id"`
+	PageToken   string    `json:"page_token"`
+	Processed   []string  `json:"processed"`
+	Applied     int       `json:"applied"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	processed map[string]bool
+}
+
+// NewRetroState creates an empty RetroState starting at the first filter under a new run ID.
+func NewRetroState() *RetroState {
+	return &RetroState{RunId: NewRunId(), processed: make(map[string]bool)}
+}
+
+// LoadRetroState loads a RetroState from a JSON state file.
+func LoadRetroState(statePath string) (*RetroState, error) {
+	state := NewRetroState()
+	if err := loadStateFile(statePath, state); err != nil {
+		return nil, err
+	}
+	for _, id := range state.Processed {
+		state.processed[id] = true
+	}
+	if state.RunId == "" {
+		state.RunId = NewRunId()
+	}
+
+	logrus.Infof("Loaded retro state from %s: filter %d, %d processed messages on current page",
+		statePath, state.FilterIndex, len(state.Processed))
+	return state, nil
+}
+
+// Save writes the RetroState to a JSON state file.
+func (r *RetroState) Save(statePath string) error {
+	r.UpdatedAt = time.Now()
+	return saveStateFile(statePath, r)
+}
+
+// IsProcessed reports whether a message on the current page has already been processed.
+func (r *RetroState) IsProcessed(messageId string) bool {
+	return r.processed[messageId]
+}
+
+// MarkProcessed records a message on the current page as processed.
+func (r *RetroState) MarkProcessed(messageId string) {
+	if r.processed[messageId] {
+		return
+	}
+	r.processed[messageId] = true
+	r.Processed = append(r.Processed, messageId)
+	r.Applied++
+}
+
+// NextPage moves the state to the next page of the current filter.
+func (r *RetroState) NextPage(pageToken string) {
+	r.PageToken = pageToken
+	r.Processed = nil
+	r.processed = make(map[string]bool)
+}
+
+// NextFilter moves the state to the first page of the next filter.
+func (r *RetroState) NextFilter() {
+	r.FilterIndex++
+	r.FilterId = ""
+	r.NextPage("")
+}
+
+// ClearRetroState removes the state file after a completed run.
+func ClearRetroState(statePath string) error {
+	err := os.Remove(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Failed to delete state file: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Rules are evaluated locally by the tool, for logic Gmail filters cannot express.
+type Rules []*Rule
+
+// Rule applies actions to messages matching its query and conditions.
+type Rule struct {
+	// Name identifies the rule in logs and errors.
+	Name string `yaml:"name"`
+	// Query is an optional Gmail search query, evaluated locally, that messages must match.
+	Query string `yaml:"query,omitempty"`
+	// Match is "all" (the default) when every condition must hold, or "any" when one is enough.
+	Match string `yaml:"match,omitempty"`
+	// Conditions are checked against the headers, body, attachments and age of a message.
+	Conditions []*RuleCondition `yaml:"conditions,omitempty"`
+	// Actions are applied to matching messages.
+	Actions RuleActions `yaml:"actions"`
+	// Stop prevents later rules from being evaluated for messages matching this rule.
+	Stop bool `yaml:"stop,omitempty"`
+
+	query QueryNode
+}
+
+// RuleCondition is a check on a message. Every field that is set must hold; regular expressions
+// use Go syntax, so (?i) makes them case-insensitive.
+type RuleCondition struct {
+	// Header is the name of a header that must be present, e.g. X-GitHub-Reason or List-Id.
+	Header string `yaml:"header,omitempty"`
+	// Matches is a regular expression one of the values of Header must match.
+	Matches string `yaml:"matches,omitempty"`
+	// Body is a regular expression the text of the message must match.
+	Body string `yaml:"body,omitempty"`
+	// Attachment is a regular expression the filename of an attachment must match.
+	Attachment string `yaml:"attachment,omitempty"`
+	// HasAttachment requires the message to have, or not to have, attachments.
+	HasAttachment *bool `yaml:"has_attachment,omitempty"`
+	// OlderThan and NewerThan compare the age of the message, e.g. 14d, 2m, 1y or 36h.
+	OlderThan string `yaml:"older_than,omitempty"`
+	NewerThan string `yaml:"newer_than,omitempty"`
+	// Not negates the condition.
+	Not bool `yaml:"not,omitempty"`
+
+	matches, body, attachment *regexp.Regexp
+	olderThan, newerThan      time.Duration
+}
+
+// RuleActions are the changes a rule makes to matching messages.
+type RuleActions struct {
+	// Labels are label names to add, created if missing.
+	Labels   []string `yaml:"labels,omitempty"`
+	Archive  bool     `yaml:"archive,omitempty"`
+	MarkRead bool     `yaml:"mark_read,omitempty"`
+	Star     bool     `yaml:"star,omitempty"`
+	Trash    bool     `yaml:"trash,omitempty"`
+	// ForwardTo creates a draft forwarding the message to this address, to be reviewed and sent by hand.
+	ForwardTo string `yaml:"forward_to,omitempty"`
+}
+
+// Compile validates the rules and prepares their queries and regular expressions.
+func (r Rules) Compile() error {
+	for i, rule := range r {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("invalid rule %s: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) compile() error {
+	switch r.Match {
+	case "", "all", "any":
+	default:
+		return fmt.Errorf("match must be all or any, not '%s'", r.Match)
+	}
+
+	if r.Query != "" {
+		node, err := ParseQuery(r.Query)
+		if err != nil {
+			return err
+		}
+		r.query = node
+	}
+
+	var err error
+	for _, c := range r.Conditions {
+		if c.Matches != "" && c.Header == "" {
+			return fmt.Errorf("matches needs a header")
+		}
+		if c.matches, err = compileRuleRegexp(c.Matches); err != nil {
+			return err
+		}
+		if c.body, err = compileRuleRegexp(c.Body); err != nil {
+			return err
+		}
+		if c.attachment, err = compileRuleRegexp(c.Attachment); err != nil {
+			return err
+		}
+		if c.olderThan, err = parseRuleAge(c.OlderThan); err != nil {
+			return err
+		}
+		if c.newerThan, err = parseRuleAge(c.NewerThan); err != nil {
+			return err
+		}
+	}
+
+	a := r.Actions
+	if len(a.Labels) == 0 && !a.Archive && !a.MarkRead && !a.Star && !a.Trash && a.ForwardTo == "" {
+		return fmt.Errorf("no actions")
+	}
+	return nil
+}
+
+// compileRuleRegexp compiles a regular expression of a condition, if one is set.
+func compileRuleRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// parseRuleAge parses an age in search query form (14d, 2m, 1y) or as a Go duration (36h).
+func parseRuleAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if age, ok := parseQueryAge(value); ok {
+		return age, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age '%s'", value)
+	}
+	return age, nil
+}
+
+// Matches reports whether a message matches the rule's query and conditions.
+func (r *Rule) Matches(m *LocalMessage) bool {
+	if r.query != nil && !MatchQuery(r.query, m) {
+		return false
+	}
+	if len(r.Conditions) == 0 {
+		return true
+	}
+
+	matchAny := r.Match == "any"
+	for _, c := range r.Conditions {
+		if c.matchesMessage(m) == matchAny {
+			return matchAny
+		}
+	}
+	return !matchAny
+}
+
+// matchesMessage reports whether a message satisfies the condition.
+func (c *RuleCondition) matchesMessage(m *LocalMessage) bool {
+	return c.check(m) != c.Not
+}
+
+func (c *RuleCondition) check(m *LocalMessage) bool {
+	if c.Header != "" {
+		values := m.Header[textproto.CanonicalMIMEHeaderKey(c.Header)]
+		if len(values) == 0 {
+			return false
+		}
+		if c.matches != nil && !anyMatch(c.matches, values, decodeHeader) {
+			return false
+		}
+	}
+	if c.body != nil && !c.body.MatchString(m.Body) {
+		return false
+	}
+	if c.attachment != nil && !anyMatch(c.attachment, m.Attachments, nil) {
+		return false
+	}
+	if c.HasAttachment != nil && m.HasAttachment != *c.HasAttachment {
+		return false
+	}
+	if c.olderThan > 0 && (m.Date.IsZero() || !m.Date.Before(time.Now().Add(-c.olderThan))) {
+		return false
+	}
+	if c.newerThan > 0 && (m.Date.IsZero() || m.Date.Before(time.Now().Add(-c.newerThan))) {
+		return false
+	}
+	return true
+}
+
+// anyMatch reports whether a regular expression matches one of the values, optionally decoded first.
+func anyMatch(re *regexp.Regexp, values []string, decode func(string) string) bool {
+	for _, v := range values {
+		if decode != nil {
+			v = decode(v)
+		}
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// EvaluateRules returns the rules a message matches, in order, up to the first matching rule with Stop set.
+func EvaluateRules(rules Rules, m *LocalMessage) Rules {
+	var matched Rules
+	for _, rule := range rules {
+		if rule.Matches(m) {
+			matched = append(matched, rule)
+			if rule.Stop {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// RuleRunner applies rules to messages through a Service. Its Process method is a MessageProcessor,
+// so rules can run on demand or on every message a Watcher picks up.
+type RuleRunner struct {
+	Service *Service
+	Rules   Rules
+	// DryRun logs the actions without applying them.
+	DryRun bool
+
+	labelIds map[string]string
+}
+
+// NewRuleRunner creates a RuleRunner for compiled rules.
+func NewRuleRunner(s *Service, rules Rules, dryRun bool) *RuleRunner {
+	return &RuleRunner{Service: s, Rules: rules, DryRun: dryRun, labelIds: make(map[string]string)}
+}
+
+// Process evaluates the rules against a message and applies the actions of the matching rules.
+// Label changes go through ApplyFilterActions and are journaled; trashing and drafts are not.
+func (r *RuleRunner) Process(ctx context.Context, s *Service, msg *gmail.Message, local *LocalMessage) error {
+	matched := EvaluateRules(r.Rules, local)
+	if len(matched) == 0 {
+		return nil
+	}
+
+	var names []string
+	var actions RuleActions
+	for _, rule := range matched {
+		names = append(names, rule.Name)
+		a := rule.Actions
+		actions.Labels = append(actions.Labels, a.Labels...)
+		actions.Archive = actions.Archive || a.Archive
+		actions.MarkRead = actions.MarkRead || a.MarkRead
+		actions.Star = actions.Star || a.Star
+		actions.Trash = actions.Trash || a.Trash
+		if a.ForwardTo != "" {
+			actions.ForwardTo = a.ForwardTo
+		}
+	}
+	log := logrus.WithFields(logrus.Fields{"message_id": msg.Id, "rules": strings.Join(names, ",")})
+	log.Infof("Message matches rules (subject: %s)", local.Subject)
+
+	if r.DryRun {
+		log.Infof("Dry run: would apply %+v", actions)
+		return nil
+	}
+
+	action := &gmail.FilterAction{}
+	for _, name := range actions.Labels {
+		id, err := r.labelId(ctx, name)
+		if err != nil {
+			return err
+		}
+		action.AddLabelIds = append(action.AddLabelIds, id)
+	}
+	if actions.Star {
+		action.AddLabelIds = append(action.AddLabelIds, "STARRED")
+	}
+	if actions.Archive {
+		action.RemoveLabelIds = append(action.RemoveLabelIds, "INBOX")
+	}
+	if actions.MarkRead {
+		action.RemoveLabelIds = append(action.RemoveLabelIds, "UNREAD")
+	}
+	if len(action.AddLabelIds) > 0 || len(action.RemoveLabelIds) > 0 {
+		if err := s.ApplyFilterActions(ctx, action, Messages{msg}); err != nil {
+			return err
+		}
+	}
+
+	if actions.ForwardTo != "" {
+		if err := s.ForwardAsDraft(ctx, msg.Id, actions.ForwardTo); err != nil {
+			return err
+		}
+	}
+	if actions.Trash {
+		if _, err := s.Client.TrashMessage(ctx, msg.Id); err != nil {
+			logrus.Errorf("Failed to trash message %s: %v", msg.Id, err)
+			return err
+		}
+		log.Info("Message moved to trash")
+	}
+	return nil
+}
+
+// labelId resolves a label name to its ID, creating the label on first use.
+func (r *RuleRunner) labelId(ctx context.Context, name string) (string, error) {
+	if id, ok := r.labelIds[name]; ok {
+		return id, nil
+	}
+	id, err := r.Service.EnsureLabel(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	r.labelIds[name] = id
+	return id, nil
+}
+
+// ForwardAsDraft creates a draft that forwards a message to an address, with the original message attached.
+func (s *Service) ForwardAsDraft(ctx context.Context, messageId, to string) error {
+	original, err := s.Client.GetMessage(ctx, messageId, "raw")
+	if err != nil {
+		logrus.Errorf("Failed to fetch message %s: %v", messageId, err)
+		return err
+	}
+	raw, err := decodeBase64URL(original.Raw)
+	if err != nil {
+		return fmt.Errorf("failed to decode raw message %s: %v", messageId, err)
+	}
+	local, err := ParseRawMessage(raw)
+	if err != nil {
+		return err
+	}
+
+	draft, err := buildForward(local, raw, to)
+	if err != nil {
+		return err
+	}
+	created, err := s.Client.CreateDraft(ctx, &gmail.Draft{
+		Message: &gmail.Message{Raw: base64.URLEncoding.EncodeToString(draft), ThreadId: original.ThreadId},
+	})
+	if err != nil {
+		logrus.Errorf("Failed to create forward draft for message %s: %v", messageId, err)
+		return err
+	}
+	logrus.Infof("Created draft %s forwarding message %s to %s", created.Id, messageId, to)
+	return nil
+}
+
+// buildForward builds a forward of a message: a short text part followed by the original as message/rfc822.
+func buildForward(m *LocalMessage, raw []byte, to string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	subject := m.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "fwd:") {
+		subject = "Fwd: " + subject
+	}
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "---------- Forwarded message ---------\r\nFrom: %s\r\nDate: %s\r\nSubject: %s\r\nTo: %s\r\n",
+		m.From, m.Header.Get("Date"), m.Subject, m.To)
+
+	attached, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/rfc822"},
+		"Content-Disposition": {"attachment; filename=\"forwarded.eml\""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := attached.Write(raw); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -6,25 +6,67 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
+	"net/http"
+	"strings"
 )
 
+// Service implements the tool's Gmail operations on top of a Client.
 type Service struct {
-	*gmail.Service
+	Client Client
+
+	// Journal records every label modification made through the service, if set.
+	Journal *Journal
 }
 
-func NewService(credentialsPath, tokenPath string, scopes []string) (*Service, error) {
-	// Authenticate and get an HTTP client
-	client, err := getGmailClient(credentialsPath, tokenPath, scopes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Gmail client: %v", err)
+// serviceOptions holds the settings changed by ServiceOption.
+type serviceOptions struct {
+	endpoint string
+}
+
+// ServiceOption configures NewService.
+type ServiceOption func(*serviceOptions)
+
+// WithEndpoint makes the service talk to a custom Gmail API endpoint, such as a local
+// gmailtest emulator, instead of Google. No OAuth credentials are used for custom endpoints.
+func WithEndpoint(endpoint string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.endpoint = strings.TrimSuffix(endpoint, "/") + "/"
+	}
+}
+
+func NewService(credentialsPath, tokenPath string, scopes []string, opts ...ServiceOption) (*Service, error) {
+	var o serviceOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var client *http.Client
+	clientOpts := []option.ClientOption{}
+	if o.endpoint != "" {
+		logrus.Infof("Using custom Gmail API endpoint: %s", o.endpoint)
+		client = &http.Client{}
+		clientOpts = append(clientOpts, option.WithEndpoint(o.endpoint))
+	} else {
+		// Authenticate and get an HTTP client
+		var err error
+		client, err = getGmailClient(credentialsPath, tokenPath, scopes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Gmail client: %v", err)
+		}
 	}
+	client.Transport = newRetryTransport(client.Transport)
 	logrus.Info("Gmail client initialized")
 	// Create Gmail service
-	svc, err := gmail.NewService(context.Background(), option.WithHTTPClient(client))
+	svc, err := gmail.NewService(context.Background(), append(clientOpts, option.WithHTTPClient(client))...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Gmail service: %v", err)
 	}
 
-	return &Service{svc}, nil
+	return NewServiceWithClient(NewGmailClient(svc)), nil
+
+}
 
+// NewServiceWithClient creates a Service on top of any Client, such as a gmailtest.FakeClient in tests.
+func NewServiceWithClient(client Client) *Service {
+	return &Service{Client: client}
 }
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotManifestFile is the name of the manifest in a backup directory.
+const snapshotManifestFile = "manifest.json"
+
+// snapshotTimeFormat names snapshot files after their creation time in UTC, so they sort chronologically.
+const snapshotTimeFormat = "20060102T150405Z"
+
+// SnapshotManifest lists the settings snapshots of a backup directory, oldest first.
+type SnapshotManifest struct {
+	Snapshots []*Snapshot `json:"snapshots"`
+}
+
+// Snapshot is a settings backup taken at a point in time.
+type Snapshot struct {
+	// File is the name of the snapshot file in the backup directory.
+	File         string    `json:"file"`
+	CreatedAt    time.Time `json:"created_at"`
+	EmailAddress string    `json:"email_address"`
+	Labels       int       `json:"labels"`
+	Filters      int       `json:"filters"`
+	// SHA256 is the checksum of the file as written, encrypted or not.
+	SHA256    string `json:"sha256"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// LoadSnapshotManifest loads the manifest of a backup directory. A missing manifest yields an empty one.
+func LoadSnapshotManifest(dir string) (*SnapshotManifest, error) {
+	manifest := &SnapshotManifest{}
+	manifestPath := filepath.Join(dir, snapshotManifestFile)
+	if !fileExists(manifestPath) {
+		return manifest, nil
+	}
+	if err := loadStateFile(manifestPath, manifest); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(manifest.Snapshots, func(i, j int) bool {
+		return manifest.Snapshots[i].CreatedAt.Before(manifest.Snapshots[j].CreatedAt)
+	})
+	return manifest, nil
+}
+
+// Save writes the manifest to the backup directory.
+func (m *SnapshotManifest) Save(dir string) error {
+	return saveStateFile(filepath.Join(dir, snapshotManifestFile), m)
+}
+
+// SaveSnapshot writes a configuration to a new timestamped file in a backup directory and adds it to the manifest.
+func (m *SnapshotManifest) SaveSnapshot(dir string, config *Config, emailAddress string, enc *Encryption) (*Snapshot, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Errorf("Failed to create backup directory: %v", err)
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	// The account is part of the name, so snapshots of several accounts taken at once do not collide
+	now := time.Now().UTC()
+	name := "backup-" + now.Format(snapshotTimeFormat)
+	if emailAddress != "" {
+		name += "-" + emailAddress
+	}
+	snapshot := &Snapshot{
+		File:         name + ".yaml",
+		CreatedAt:    now,
+		EmailAddress: emailAddress,
+		Labels:       len(config.Labels),
+		Filters:      len(config.Filters),
+		Encrypted:    enc.Encrypts(),
+	}
+	snapshotPath := filepath.Join(dir, snapshot.File)
+	if fileExists(snapshotPath) {
+		return nil, fmt.Errorf("snapshot %s already exists", snapshotPath)
+	}
+	if err := config.SaveToFile(snapshotPath, enc); err != nil {
+		return nil, err
+	}
+
+	sum, err := fileChecksum(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.SHA256 = sum
+	m.Snapshots = append(m.Snapshots, snapshot)
+	if err := m.Save(dir); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// At returns the latest snapshot of an account taken at or before t, or nil if there is none.
+// A backup directory may hold the snapshots of several accounts.
+func (m *SnapshotManifest) At(t time.Time, emailAddress string) *Snapshot {
+	var found *Snapshot
+	for _, s := range m.Snapshots {
+		if s.CreatedAt.After(t) {
+			break
+		}
+		if strings.EqualFold(s.EmailAddress, emailAddress) {
+			found = s
+		}
+	}
+	return found
+}
+
+// Rotate deletes the snapshots no retention rule keeps and returns them. Each account's snapshots
+// are rotated on their own: the latest snapshot of each of the keepDaily most recent days with
+// snapshots is kept, as is the latest of each of the keepWeekly most recent ISO weeks, and always
+// the account's latest snapshot. Days and weeks are in local time.
+func (m *SnapshotManifest) Rotate(dir string, keepDaily, keepWeekly int) ([]*Snapshot, error) {
+	accounts := make(map[string][]*Snapshot)
+	for _, s := range m.Snapshots {
+		account := strings.ToLower(s.EmailAddress)
+		accounts[account] = append(accounts[account], s)
+	}
+
+	keep := make(map[*Snapshot]bool)
+	for _, snapshots := range accounts {
+		keepLatest := func(limit int, period func(time.Time) string) {
+			seen := make(map[string]bool)
+			for i := len(snapshots) - 1; i >= 0 && len(seen) < limit; i-- {
+				key := period(snapshots[i].CreatedAt.Local())
+				if !seen[key] {
+					seen[key] = true
+					keep[snapshots[i]] = true
+				}
+			}
+		}
+		keepLatest(keepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+		keepLatest(keepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		})
+		keep[snapshots[len(snapshots)-1]] = true
+	}
+
+	var kept, removed []*Snapshot
+	for _, s := range m.Snapshots {
+		if keep[s] {
+			kept = append(kept, s)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, s.File)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove snapshot %s: %v", s.File, err)
+		}
+		logrus.Infof("Removed snapshot %s", s.File)
+		removed = append(removed, s)
+	}
+
+	m.Snapshots = kept
+	return removed, m.Save(dir)
+}
+
+// Verify checks the snapshot file in a backup directory against its recorded checksum.
+func (s *Snapshot) Verify(dir string) error {
+	sum, err := fileChecksum(filepath.Join(dir, s.File))
+	if err != nil {
+		return err
+	}
+	if sum != s.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", s.SHA256, sum)
+	}
+	return nil
+}
+
+// ParseSnapshotTime parses the time given to select a snapshot: RFC 3339, "2006-01-02 15:04",
+// a snapshot file timestamp, or a date, which selects the end of that day. Times without a zone are local.
+func ParseSnapshotTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(snapshotTimeFormat, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', use e.g. 2024-01-02, '2024-01-02 15:04' or RFC 3339", value)
+}
+
+// fileChecksum returns the hex-encoded SHA-256 checksum of a file.
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testManifest builds a manifest of empty snapshot files in dir, one per account and time.
+func testManifest(t *testing.T, dir string, snapshots ...*Snapshot) *SnapshotManifest {
+	t.Helper()
+	for _, s := range snapshots {
+		s.File = s.EmailAddress + "-" + s.CreatedAt.UTC().Format(snapshotTimeFormat) + ".yaml"
+		if err := os.WriteFile(filepath.Join(dir, s.File), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &SnapshotManifest{Snapshots: snapshots}
+}
+
+func TestSnapshotManifestAt(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	manifest := testManifest(t, t.TempDir(),
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: day(1)},
+		&Snapshot{EmailAddress: "b@example.com", CreatedAt: day(2)},
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: day(3)},
+		&Snapshot{EmailAddress: "b@example.com", CreatedAt: day(4)},
+	)
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		account string
+		want    time.Time
+	}{
+		{"latest of a", day(10), "a@example.com", day(3)},
+		{"latest of b", day(10), "b@example.com", day(4)},
+		{"account case", day(10), "B@Example.com", day(4)},
+		{"a before the latest of b", day(4), "a@example.com", day(3)},
+		{"b between its snapshots", day(3), "b@example.com", day(2)},
+		{"exact time", day(2), "b@example.com", day(2)},
+		{"before the first of b", day(1), "b@example.com", time.Time{}},
+		{"unknown account", day(10), "c@example.com", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := manifest.At(tt.at, tt.account)
+			if tt.want.IsZero() {
+				if got != nil {
+					t.Errorf("At() = %s, want none", got.File)
+				}
+				return
+			}
+			if got == nil || !got.CreatedAt.Equal(tt.want) {
+				t.Errorf("At() = %v, want the snapshot of %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotManifestRotate(t *testing.T) {
+	dir := t.TempDir()
+	at := func(d, h int) time.Time { return time.Date(2024, 1, d, h, 0, 0, 0, time.Local) }
+	manifest := testManifest(t, dir,
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: at(1, 9)},
+		&Snapshot{EmailAddress: "b@example.com", CreatedAt: at(1, 10)},
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: at(2, 9)},
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: at(2, 18)},
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: at(3, 9)},
+		&Snapshot{EmailAddress: "a@example.com", CreatedAt: at(3, 10)},
+	)
+
+	removed, err := manifest.Rotate(dir, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a keeps the latest of its two most recent days; b's only snapshot is its latest
+	var kept []string
+	for _, s := range manifest.Snapshots {
+		kept = append(kept, s.EmailAddress+" "+s.CreatedAt.Format("2 15"))
+	}
+	want := []string{"b@example.com 1 10", "a@example.com 2 18", "a@example.com 3 10"}
+	if !slices.Equal(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if len(removed) != 3 {
+		t.Errorf("removed %d snapshots, want 3", len(removed))
+	}
+	for _, s := range removed {
+		if _, err := os.Stat(filepath.Join(dir, s.File)); !os.IsNotExist(err) {
+			t.Errorf("removed snapshot %s is still on disk", s.File)
+		}
+	}
+
+	loaded, err := LoadSnapshotManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Snapshots) != len(want) {
+		t.Errorf("saved manifest has %d snapshots, want %d", len(loaded.Snapshots), len(want))
+	}
+}
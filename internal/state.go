@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loadStateFile decodes a JSON state file into v.
+func loadStateFile(statePath string, v interface{}) error {
+	if !fileExists(statePath) {
+		return fmt.Errorf("state file does not exist: %s", statePath)
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		logrus.Errorf("Failed to read state file: %v", err)
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		logrus.Errorf("Failed to decode state file: %v", err)
+		return fmt.Errorf("failed to decode state file: %v", err)
+	}
+	return nil
+}
+
+// saveStateFile writes v to a JSON state file.
+// The file is written to a temporary path first and renamed, so a crash never leaves a truncated state file.
+func saveStateFile(statePath string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		logrus.Errorf("Failed to write state file: %v", err)
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		logrus.Errorf("Failed to replace state file: %v", err)
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
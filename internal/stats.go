@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MailboxStats summarizes a set of messages.
+type MailboxStats struct {
+	Messages   int          `json:"messages"`
+	Unread     int          `json:"unread"`
+	Since      time.Time    `json:"since"`
+	Until      time.Time    `json:"until"`
+	TopSenders []StatCount  `json:"top_senders"`
+	TopDomains []StatCount  `json:"top_domains"`
+	Labels     []LabelStat  `json:"labels"`
+	Weeks      []StatCount  `json:"weeks"`
+	Threads    []ThreadStat `json:"largest_threads"`
+}
+
+// StatCount is the number of messages for a key, such as a sender or a week.
+type StatCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// LabelStat is the number of messages and unread messages under a label.
+type LabelStat struct {
+	Label    string `json:"label"`
+	Messages int    `json:"messages"`
+	Unread   int    `json:"unread"`
+}
+
+// ThreadStat describes a thread by its number of messages and total size.
+type ThreadStat struct {
+	ThreadId string `json:"thread_id"`
+	Subject  string `json:"subject"`
+	Messages int    `json:"messages"`
+	Size     int64  `json:"size"`
+}
+
+// ComputeStats summarizes messages fetched in "metadata" or "full" format.
+// labelNames maps label IDs to names; top limits the senders, domains and threads listed.
+func ComputeStats(messages Messages, labelNames map[string]string, top int) *MailboxStats {
+	stats := &MailboxStats{Messages: len(messages)}
+	senders := make(map[string]int)
+	domains := make(map[string]int)
+	weeks := make(map[string]int)
+	labels := make(map[string]*LabelStat)
+	threads := make(map[string]*ThreadStat)
+
+	for _, m := range messages {
+		unread := false
+		for _, id := range m.LabelIds {
+			if id == "UNREAD" {
+				unread = true
+			}
+		}
+		if unread {
+			stats.Unread++
+		}
+
+		headers := messageHeaders(m)
+		if sender := senderAddress(headers["From"]); sender != "" {
+			senders[sender]++
+			if _, domain, ok := strings.Cut(sender, "@"); ok {
+				domains[domain]++
+			}
+		}
+
+		if date := messageDate(m, headers["Date"]); !date.IsZero() {
+			year, week := date.ISOWeek()
+			weeks[fmt.Sprintf("%d-W%02d", year, week)]++
+			if stats.Since.IsZero() || date.Before(stats.Since) {
+				stats.Since = date
+			}
+			if date.After(stats.Until) {
+				stats.Until = date
+			}
+		}
+
+		for _, id := range m.LabelIds {
+			name := labelNames[id]
+			if name == "" {
+				name = id
+			}
+			l := labels[name]
+			if l == nil {
+				l = &LabelStat{Label: name}
+				labels[name] = l
+			}
+			l.Messages++
+			if unread {
+				l.Unread++
+			}
+		}
+
+		t := threads[m.ThreadId]
+		if t == nil {
+			t = &ThreadStat{ThreadId: m.ThreadId, Subject: decodeHeader(headers["Subject"])}
+			threads[m.ThreadId] = t
+		}
+		t.Messages++
+		t.Size += m.SizeEstimate
+	}
+
+	stats.TopSenders = topCounts(senders, top)
+	stats.TopDomains = topCounts(domains, top)
+
+	for _, l := range labels {
+		stats.Labels = append(stats.Labels, *l)
+	}
+	sort.Slice(stats.Labels, func(i, j int) bool {
+		if stats.Labels[i].Messages != stats.Labels[j].Messages {
+			return stats.Labels[i].Messages > stats.Labels[j].Messages
+		}
+		return stats.Labels[i].Label < stats.Labels[j].Label
+	})
+
+	for week, count := range weeks {
+		stats.Weeks = append(stats.Weeks, StatCount{Key: week, Count: count})
+	}
+	sort.Slice(stats.Weeks, func(i, j int) bool { return stats.Weeks[i].Key < stats.Weeks[j].Key })
+
+	for _, t := range threads {
+		stats.Threads = append(stats.Threads, *t)
+	}
+	sort.Slice(stats.Threads, func(i, j int) bool {
+		if stats.Threads[i].Messages != stats.Threads[j].Messages {
+			return stats.Threads[i].Messages > stats.Threads[j].Messages
+		}
+		return stats.Threads[i].Size > stats.Threads[j].Size
+	})
+	if len(stats.Threads) > top {
+		stats.Threads = stats.Threads[:top]
+	}
+
+	return stats
+}
+
+// messageHeaders returns the first value of each header of a message's payload.
+func messageHeaders(m *gmail.Message) map[string]string {
+	headers := make(map[string]string)
+	if m.Payload == nil {
+		return headers
+	}
+	for _, h := range m.Payload.Headers {
+		if _, ok := headers[h.Name]; !ok {
+			headers[h.Name] = h.Value
+		}
+	}
+	return headers
+}
+
+// senderAddress returns the lower-cased email address of a From header.
+func senderAddress(from string) string {
+	if from == "" {
+		return ""
+	}
+	if addr, err := mail.ParseAddress(decodeHeader(from)); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	return strings.ToLower(strings.TrimSpace(from))
+}
+
+// messageDate returns the date Gmail received a message, falling back to its Date header.
+func messageDate(m *gmail.Message, dateHeader string) time.Time {
+	if m.InternalDate > 0 {
+		return time.UnixMilli(m.InternalDate)
+	}
+	date, _ := mail.ParseDate(dateHeader)
+	return date
+}
+
+// topCounts returns the keys with the highest counts, ties broken alphabetically.
+func topCounts(counts map[string]int, top int) []StatCount {
+	var result []StatCount
+	for key, count := range counts {
+		result = append(result, StatCount{Key: key, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
+
+// WriteTable writes the statistics as aligned text tables.
+func (s *MailboxStats) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Messages:\t%d (%d unread)\n", s.Messages, s.Unread)
+	if !s.Since.IsZero() {
+		fmt.Fprintf(tw, "Period:\t%s to %s\n", s.Since.Format("2006-01-02"), s.Until.Format("2006-01-02"))
+	}
+
+	writeCounts := func(title string, counts []StatCount) {
+		fmt.Fprintf(tw, "\n%s\tMESSAGES\n", title)
+		for _, c := range counts {
+			fmt.Fprintf(tw, "%s\t%d\n", c.Key, c.Count)
+		}
+	}
+	writeCounts("SENDER", s.TopSenders)
+	writeCounts("DOMAIN", s.TopDomains)
+	writeCounts("WEEK", s.Weeks)
+
+	fmt.Fprintf(tw, "\nLABEL\tMESSAGES\tUNREAD\n")
+	for _, l := range s.Labels {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", l.Label, l.Messages, l.Unread)
+	}
+
+	fmt.Fprintf(tw, "\nTHREAD\tMESSAGES\tSIZE\tSUBJECT\n")
+	for _, t := range s.Threads {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", t.ThreadId, t.Messages, t.Size, t.Subject)
+	}
+
+	return tw.Flush()
+}
+
+// WriteCSV writes the statistics as CSV rows of section, key, messages, unread and size.
+func (s *MailboxStats) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{
+		{"section", "key", "messages", "unread", "size"},
+		{"total", "", strconv.Itoa(s.Messages), strconv.Itoa(s.Unread), ""},
+	}
+	for _, c := range s.TopSenders {
+		rows = append(rows, []string{"sender", c.Key, strconv.Itoa(c.Count), "", ""})
+	}
+	for _, c := range s.TopDomains {
+		rows = append(rows, []string{"domain", c.Key, strconv.Itoa(c.Count), "", ""})
+	}
+	for _, c := range s.Weeks {
+		rows = append(rows, []string{"week", c.Key, strconv.Itoa(c.Count), "", ""})
+	}
+	for _, l := range s.Labels {
+		rows = append(rows, []string{"label", l.Label, strconv.Itoa(l.Messages), strconv.Itoa(l.Unread), ""})
+	}
+	for _, t := range s.Threads {
+		rows = append(rows, []string{"thread", t.ThreadId + " " + t.Subject, strconv.Itoa(t.Messages), "", strconv.FormatInt(t.Size, 10)})
+	}
+
+	if err := cw.WriteAll(rows); err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	return nil
+}
+
+// WriteJSON writes the statistics as an indented JSON document.
+func (s *MailboxStats) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
@@ -0,0 +1,185 @@
+package internal_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestComputeStats(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+
+	finance, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Finance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage([]byte("From: Alice <alice@example.com>\r\nSubject: Invoice\r\nMessage-Id: <a1@example.com>\r\n"+
+		"Date: Mon, 15 Jan 2024 10:00:00 +0000\r\n\r\nHello\r\n"), "INBOX", "UNREAD", finance.Id)
+	fake.AddMessage([]byte("From: alice@example.com\r\nSubject: Re: Invoice\r\nIn-Reply-To: <a1@example.com>\r\n"+
+		"Date: Wed, 17 Jan 2024 10:00:00 +0000\r\n\r\nThanks\r\n"), "INBOX")
+	fake.AddMessage([]byte("From: =?UTF-8?Q?Bj=C3=B6rn?= <BJORN@Shop.example.com>\r\nSubject: Sale\r\n"+
+		"Date: Mon, 22 Jan 2024 10:00:00 +0000\r\n\r\n50% off\r\n"), "UNREAD", "CATEGORY_PROMOTIONS")
+	fake.AddMessage([]byte("From: bob@example.org\r\nSubject: Hi\r\n"+
+		"Date: Mon, 1 Jan 2024 10:00:00 +0000\r\n\r\nHappy new year\r\n"), "INBOX")
+
+	labelNames, err := svc.LabelNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := svc.MessagesWithFormat(ctx, 100, "", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := internal.ComputeStats(messages, labelNames, 2)
+
+	if stats.Messages != 4 || stats.Unread != 2 {
+		t.Errorf("messages = %d (%d unread), want 4 (2 unread)", stats.Messages, stats.Unread)
+	}
+	if !stats.Since.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) || !stats.Until.Equal(time.Date(2024, 1, 22, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("period = %s to %s, want 2024-01-01 to 2024-01-22", stats.Since, stats.Until)
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		// Senders are compared by lower-cased address; ties are broken alphabetically
+		{"top senders", stats.TopSenders, []internal.StatCount{{Key: "alice@example.com", Count: 2}, {Key: "bjorn@shop.example.com", Count: 1}}},
+		{"top domains", stats.TopDomains, []internal.StatCount{{Key: "example.com", Count: 2}, {Key: "example.org", Count: 1}}},
+		{"weeks", stats.Weeks, []internal.StatCount{{Key: "2024-W01", Count: 1}, {Key: "2024-W03", Count: 2}, {Key: "2024-W04", Count: 1}}},
+		{"labels", stats.Labels, []internal.LabelStat{
+			{Label: "INBOX", Messages: 3, Unread: 1},
+			{Label: "UNREAD", Messages: 2, Unread: 2},
+			{Label: "CATEGORY_PROMOTIONS", Messages: 1, Unread: 1},
+			{Label: "Finance", Messages: 1, Unread: 1},
+		}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s = %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if len(stats.Threads) != 2 || stats.Threads[0].Messages != 2 || stats.Threads[1].Messages != 1 {
+		t.Fatalf("threads = %+v, want the invoice thread first and one other", stats.Threads)
+	}
+	if thread := stats.Threads[0]; thread.Size != messages[2].SizeEstimate+messages[3].SizeEstimate {
+		t.Errorf("invoice thread size = %d, want the sum of its messages", thread.Size)
+	}
+}
+
+func TestComputeStatsEmpty(t *testing.T) {
+	stats := internal.ComputeStats(nil, nil, 10)
+	if stats.Messages != 0 || !stats.Since.IsZero() || len(stats.TopSenders) != 0 || len(stats.Threads) != 0 {
+		t.Errorf("stats of no messages = %+v", stats)
+	}
+}
+
+// testStats is a small report for testing the output formats.
+var testStats = &internal.MailboxStats{
+	Messages:   3,
+	Unread:     1,
+	Since:      time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC),
+	Until:      time.Date(2024, 1, 22, 10, 0, 0, 0, time.UTC),
+	TopSenders: []internal.StatCount{{Key: "alice@example.com", Count: 2}, {Key: "bob@example.org", Count: 1}},
+	TopDomains: []internal.StatCount{{Key: "example.com", Count: 2}, {Key: "example.org", Count: 1}},
+	Labels:     []internal.LabelStat{{Label: "INBOX", Messages: 3, Unread: 1}, {Label: "Finance/Invoices", Messages: 1}},
+	Weeks:      []internal.StatCount{{Key: "2024-W03", Count: 2}, {Key: "2024-W04", Count: 1}},
+	Threads:    []internal.ThreadStat{{ThreadId: "t1", Subject: "Invoice, January", Messages: 2, Size: 2048}},
+}
+
+func TestMailboxStatsWriters(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(s *internal.MailboxStats, buf *bytes.Buffer) error
+		want  string
+	}{
+		{
+			name:  "table",
+			write: func(s *internal.MailboxStats, buf *bytes.Buffer) error { return s.WriteTable(buf) },
+			want: "Messages:  3 (1 unread)\n" +
+				"Period:    2024-01-15 to 2024-01-22\n" +
+				"\n" +
+				"SENDER             MESSAGES\n" +
+				"alice@example.com  2\n" +
+				"bob@example.org    1\n" +
+				"\n" +
+				"DOMAIN       MESSAGES\n" +
+				"example.com  2\n" +
+				"example.org  1\n" +
+				"\n" +
+				"WEEK      MESSAGES\n" +
+				"2024-W03  2\n" +
+				"2024-W04  1\n" +
+				"\n" +
+				"LABEL             MESSAGES  UNREAD\n" +
+				"INBOX             3         1\n" +
+				"Finance/Invoices  1         0\n" +
+				"\n" +
+				"THREAD  MESSAGES  SIZE  SUBJECT\n" +
+				"t1      2         2048  Invoice, January\n",
+		},
+		{
+			name:  "csv",
+			write: func(s *internal.MailboxStats, buf *bytes.Buffer) error { return s.WriteCSV(buf) },
+			want: "section,key,messages,unread,size\n" +
+				"total,,3,1,\n" +
+				"sender,alice@example.com,2,,\n" +
+				"sender,bob@example.org,1,,\n" +
+				"domain,example.com,2,,\n" +
+				"domain,example.org,1,,\n" +
+				"week,2024-W03,2,,\n" +
+				"week,2024-W04,1,,\n" +
+				"label,INBOX,3,1,\n" +
+				"label,Finance/Invoices,1,0,\n" +
+				"thread,\"t1 Invoice, January\",2,,2048\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.write(testStats, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("output =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMailboxStatsWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testStats.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	for _, name := range []string{"messages", "unread", "since", "until", "top_senders", "top_domains", "labels", "weeks", "largest_threads"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("output has no %q field", name)
+		}
+	}
+
+	var decoded internal.MailboxStats
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, testStats) {
+		t.Errorf("decoded output = %+v, want %+v", decoded, *testStats)
+	}
+}
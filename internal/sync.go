@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// SyncState is the locally stored position in the mailbox history.
+type SyncState struct {
+	EmailAddress string    `json:"email_address"`
+	HistoryId    uint64    `json:"history_id"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// LoadSyncState loads a SyncState from a JSON state file.
+// A missing state file yields an empty state, which makes the next sync a full scan.
+func LoadSyncState(statePath string) (*SyncState, error) {
+	state := &SyncState{}
+	if !fileExists(statePath) {
+		logrus.Infof("No sync state at %s; the next sync will scan the whole mailbox.", statePath)
+		return state, nil
+	}
+	if err := loadStateFile(statePath, state); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Loaded sync state from %s: history ID %d", statePath, state.HistoryId)
+	return state, nil
+}
+
+// Save writes the SyncState to a JSON state file.
+func (s *SyncState) Save(statePath string) error {
+	s.UpdatedAt = time.Now()
+	return saveStateFile(statePath, s)
+}
+
+// CheckAccount compares the account a sync state was recorded for with the authenticated mailbox.
+// History IDs only mean something in the mailbox they come from, so a state of another account is
+// refused. A state without an account, such as a new one, is assigned the authenticated account.
+func (s *Service) CheckAccount(ctx context.Context, state *SyncState) error {
+	profile, err := s.Client.GetProfile(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to fetch mailbox profile: %v", err)
+		return err
+	}
+	if state.EmailAddress != "" && !strings.EqualFold(state.EmailAddress, profile.EmailAddress) {
+		return fmt.Errorf("the state was recorded for %s but the authenticated account is %s", state.EmailAddress, profile.EmailAddress)
+	}
+	state.EmailAddress = profile.EmailAddress
+	return nil
+}
+
+// SyncResult lists the messages that changed since the previous sync.
+type SyncResult struct {
+	// Added holds messages added to the mailbox.
+	Added []string
+	// Relabeled holds existing messages whose labels changed.
+	Relabeled []string
+	// Deleted holds messages permanently deleted from the mailbox.
+	Deleted []string
+	// HistoryId is the mailbox position the result is current up to.
+	HistoryId uint64
+	// FullScan is set when the history was unavailable and every message was listed as added.
+	FullScan bool
+}
+
+// Sync fetches the messages added, relabeled or deleted since the state's history ID and advances
+// the state to the current history ID. When the state is empty, or Gmail no longer has history that
+// old (404), it falls back to a full scan that lists every message matching query as added.
+func (s *Service) Sync(ctx context.Context, state *SyncState, query string) (*SyncResult, error) {
+	if state.HistoryId == 0 {
+		return s.fullSync(ctx, state, query)
+	}
+
+	logrus.Infof("Fetching mailbox history since history ID %d...", state.HistoryId)
+	result := &SyncResult{HistoryId: state.HistoryId}
+	changes := make(map[string]string)
+	var order []string
+	record := func(id, change string) {
+		previous, seen := changes[id]
+		if !seen {
+			order = append(order, id)
+		}
+		switch {
+		case change == "deleted", !seen, previous == "relabeled" && change == "added":
+			changes[id] = change
+		}
+	}
+
+	var pageToken string
+	for {
+		page, err := s.Client.ListHistory(ctx, state.HistoryId, pageToken)
+		if err != nil {
+			if isNotFound(err) {
+				logrus.Warnf("History ID %d is too old; falling back to a full scan.", state.HistoryId)
+				return s.fullSync(ctx, state, query)
+			}
+			logrus.Errorf("Failed to fetch mailbox history: %v", err)
+			return nil, err
+		}
+
+		for _, h := range page.History {
+			for _, m := range h.MessagesAdded {
+				record(m.Message.Id, "added")
+			}
+			for _, m := range h.LabelsAdded {
+				record(m.Message.Id, "relabeled")
+			}
+			for _, m := range h.LabelsRemoved {
+				record(m.Message.Id, "relabeled")
+			}
+			for _, m := range h.MessagesDeleted {
+				record(m.Message.Id, "deleted")
+			}
+		}
+		if page.HistoryId > result.HistoryId {
+			result.HistoryId = page.HistoryId
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+
+	for _, id := range order {
+		switch changes[id] {
+		case "added":
+			result.Added = append(result.Added, id)
+		case "relabeled":
+			result.Relabeled = append(result.Relabeled, id)
+		case "deleted":
+			result.Deleted = append(result.Deleted, id)
+		}
+	}
+
+	state.HistoryId = result.HistoryId
+	logrus.Infof("Synced to history ID %d: %d added, %d relabeled, %d deleted.",
+		result.HistoryId, len(result.Added), len(result.Relabeled), len(result.Deleted))
+	return result, nil
+}
+
+// fullSync lists every message matching query as added and moves the state to the current history ID.
+func (s *Service) fullSync(ctx context.Context, state *SyncState, query string) (*SyncResult, error) {
+	// Read the history ID before listing so changes made during the scan are picked up next time
+	profile, err := s.Client.GetProfile(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to fetch mailbox profile: %v", err)
+		return nil, err
+	}
+
+	logrus.Info("Scanning the whole mailbox...")
+	ids, err := s.MessageIds(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	state.EmailAddress = profile.EmailAddress
+	state.HistoryId = profile.HistoryId
+	logrus.Infof("Full scan found %d messages; synced to history ID %d.", len(ids), profile.HistoryId)
+	return &SyncResult{Added: ids, HistoryId: profile.HistoryId, FullScan: true}, nil
+}
+
+// isNotFound reports whether err is a Gmail API 404, e.g. for a deleted message or expired history.
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
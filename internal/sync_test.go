@@ -0,0 +1,73 @@
+package internal_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+)
+
+func TestCheckAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   string
+		wantErr bool
+	}{
+		{"new state", "", false},
+		{"same account", "me@example.com", false},
+		{"same account in another case", "Me@Example.com", false},
+		{"another account", "other@example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := internal.NewServiceWithClient(gmailtest.NewFakeClient())
+			state := &internal.SyncState{EmailAddress: tt.state, HistoryId: 1000}
+			err := svc.CheckAccount(context.Background(), state)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckAccount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && state.EmailAddress == "" {
+				t.Error("state was not assigned the account")
+			}
+			if err != nil && state.EmailAddress != tt.state {
+				t.Errorf("refused state was changed to %s", state.EmailAddress)
+			}
+		})
+	}
+}
+
+func TestSyncStateAccount(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "sync.state.json")
+
+	// A full sync records the account with the history ID
+	state, err := internal.LoadSyncState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Sync(ctx, state, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := internal.LoadSyncState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.EmailAddress != fake.EmailAddress || loaded.HistoryId == 0 {
+		t.Fatalf("loaded state = %+v, want the account and history ID", loaded)
+	}
+
+	// The state is refused once the authenticated account changes
+	fake.EmailAddress = "other@example.com"
+	if err := svc.CheckAccount(ctx, loaded); err == nil {
+		t.Error("CheckAccount() accepted the state of another account")
+	}
+}
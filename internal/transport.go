@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// Gmail allows 250 quota units per user per second, averaged over time, with short bursts allowed.
+const (
+	quotaUnitsPerSecond = 250
+	quotaBurst          = 250
+)
+
+// retryTransport wraps the HTTP transport of the Gmail client. It throttles requests to the
+// per-user quota and retries transient failures with jittered exponential backoff, so every
+// Service method gets the same behavior without handling it at the call site. Requests that
+// create something are only retried when they were rate limited, since a network error or
+// server error does not tell whether they were applied.
+type retryTransport struct {
+	base       http.RoundTripper
+	limiter    *quotaLimiter
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+// newRetryTransport creates a retryTransport around the given transport.
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{
+		base:       base,
+		limiter:    newQuotaLimiter(quotaUnitsPerSecond, quotaBurst),
+		maxRetries: 6,
+		baseDelay:  time.Second,
+		maxDelay:   64 * time.Second,
+	}
+}
+
+// RoundTrip sends the request, waiting for quota first and retrying transient failures.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	units := QuotaUnits(req.Method, req.URL.Path)
+
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req.Context(), units); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(req.Context())
+			if req.Body != nil && req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		retry, reason := shouldRetry(req, resp, err)
+		if !retry || attempt >= t.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if after, ok := retryAfter(resp); ok {
+			delay = min(after, t.maxDelay)
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		logrus.Warnf("Gmail API request %s %s failed (%s), retrying in %s (attempt %d/%d)...",
+			req.Method, req.URL.Path, reason, delay.Round(time.Millisecond), attempt+1, t.maxRetries)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay between zero and the exponential backoff cap for an attempt ("full jitter").
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := t.baseDelay << attempt
+	if ceiling <= 0 || ceiling > t.maxDelay {
+		ceiling = t.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + time.Millisecond
+}
+
+// shouldRetry classifies the outcome of a request and reports whether it is a transient failure.
+// Network errors are retried unless the request context was cancelled; API errors are classified
+// by IsRetryable. Requests that are not idempotent are only retried when they were rate limited.
+// The response body is buffered so it can still be read by the caller.
+func shouldRetry(req *http.Request, resp *http.Response, err error) (bool, string) {
+	idempotent := isIdempotent(req.Method, req.URL.Path)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || !idempotent {
+			return false, ""
+		}
+		return true, err.Error()
+	}
+	if resp.StatusCode < 400 {
+		return false, ""
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return false, ""
+	}
+
+	apiErr := googleapi.CheckResponse(&http.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	})
+	if IsRateLimited(apiErr) || (idempotent && IsRetryable(apiErr)) {
+		return true, apiErr.Error()
+	}
+	return false, ""
+}
+
+// isIdempotent reports whether sending a Gmail API request twice has the same effect as sending it
+// once. Reads, deletes and label changes are; creating filters, labels, drafts or messages is not.
+func isIdempotent(method, path string) bool {
+	if method != http.MethodPost {
+		return true
+	}
+	last := path[strings.LastIndex(path, "/")+1:]
+	switch last {
+	case "modify", "batchModify", "batchDelete", "trash", "untrash", "watch", "stop":
+		return true
+	}
+	return false
+}
+
+// IsRateLimited reports whether an error returned by the Gmail API rejected the request for
+// exceeding a rate limit (429, or 403 with a rate limit reason), in which case it was not applied.
+func IsRateLimited(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.Code {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		for _, item := range apiErr.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsRetryable reports whether an error returned by the Gmail API is transient: rate limiting (429, or
+// 403 with a rate limit reason) and server errors (500, 502, 503, 504).
+func IsRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		for _, item := range apiErr.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "backendError":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of a response, given in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// QuotaUnits returns the quota cost of a Gmail API request, based on its method and path.
+// Costs follow the Gmail API usage limits; unknown methods are charged 5 units.
+func QuotaUnits(method, path string) float64 {
+	// Paths look like /gmail/v1/users/me/messages/{id}/modify
+	_, rest, found := strings.Cut(path, "/users/")
+	if !found {
+		return 5
+	}
+	parts := strings.Split(rest, "/")[1:]
+	if len(parts) == 0 || parts[0] == "profile" {
+		return 1
+	}
+
+	last := parts[len(parts)-1]
+	switch parts[0] {
+	case "messages":
+		switch {
+		case last == "batchModify" || last == "batchDelete":
+			return 50
+		case last == "import" || (len(parts) == 1 && method == http.MethodPost):
+			return 25
+		case last == "send":
+			return 100
+		}
+		return 5
+	case "labels":
+		if method == http.MethodGet {
+			return 1
+		}
+		return 5
+	case "settings":
+		if method == http.MethodGet {
+			return 1
+		}
+		return 5
+	case "history":
+		return 2
+	case "threads", "drafts":
+		return 10
+	case "watch":
+		return 100
+	case "stop":
+		return 50
+	}
+	return 5
+}
+
+// quotaLimiter is a token bucket of quota units shared by all requests of a client.
+type quotaLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newQuotaLimiter creates a full token bucket refilled at rate units per second.
+func newQuotaLimiter(rate, burst float64) *quotaLimiter {
+	return &quotaLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until the given number of units is available or the context is done.
+func (l *quotaLimiter) wait(ctx context.Context, units float64) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= units {
+			l.tokens -= units
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((units - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
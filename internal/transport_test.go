@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const messagesURL = "https://gmail.googleapis.com/gmail/v1/users/me/messages"
+
+// stubResponse is a response or network error returned by stubTransport.
+type stubResponse struct {
+	status     int
+	reason     string
+	retryAfter string
+	err        error
+}
+
+// stubTransport returns a planned sequence of responses and records the requests it receives.
+type stubTransport struct {
+	responses []stubResponse
+	bodies    []string
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		s.bodies = append(s.bodies, string(body))
+	} else {
+		s.bodies = append(s.bodies, "")
+	}
+	next := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	if next.err != nil {
+		return nil, next.err
+	}
+	return apiResponse(next.status, next.reason, next.retryAfter), nil
+}
+
+// apiResponse builds a Gmail API response with the given status and error reason.
+func apiResponse(status int, reason, retryAfter string) *http.Response {
+	body := "{}"
+	if status >= 400 {
+		body = fmt.Sprintf(`{"error":{"code":%d,"message":"failed","errors":[{"reason":"%s"}]}}`, status, reason)
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		resp   stubResponse
+		want   bool
+	}{
+		{"get succeeded", "GET", "/messages/1", stubResponse{status: 200}, false},
+		{"get not found", "GET", "/messages/1", stubResponse{status: 404, reason: "notFound"}, false},
+		{"get rate limited", "GET", "/messages/1", stubResponse{status: 429, reason: "rateLimitExceeded"}, true},
+		{"get server error", "GET", "/messages/1", stubResponse{status: 500, reason: "backendError"}, true},
+		{"get unavailable", "GET", "/messages/1", stubResponse{status: 503}, true},
+		{"get forbidden rate limit", "GET", "/messages/1", stubResponse{status: 403, reason: "userRateLimitExceeded"}, true},
+		{"get forbidden backend error", "GET", "/messages/1", stubResponse{status: 403, reason: "backendError"}, true},
+		{"get forbidden", "GET", "/messages/1", stubResponse{status: 403, reason: "insufficientPermissions"}, false},
+		{"get network error", "GET", "/messages/1", stubResponse{err: errors.New("connection reset")}, true},
+		{"get cancelled", "GET", "/messages/1", stubResponse{err: context.Canceled}, false},
+		{"modify server error", "POST", "/messages/1/modify", stubResponse{status: 500}, true},
+		{"batch modify network error", "POST", "/messages/batchModify", stubResponse{err: errors.New("EOF")}, true},
+		{"delete server error", "DELETE", "/settings/filters/1", stubResponse{status: 502}, true},
+		{"create filter rate limited", "POST", "/settings/filters", stubResponse{status: 429}, true},
+		{"create filter forbidden rate limit", "POST", "/settings/filters", stubResponse{status: 403, reason: "rateLimitExceeded"}, true},
+		{"create filter server error", "POST", "/settings/filters", stubResponse{status: 500}, false},
+		{"create filter forbidden backend error", "POST", "/settings/filters", stubResponse{status: 403, reason: "backendError"}, false},
+		{"create filter network error", "POST", "/settings/filters", stubResponse{err: errors.New("connection reset")}, false},
+		{"create label server error", "POST", "/labels", stubResponse{status: 503}, false},
+		{"import message server error", "POST", "/messages/import", stubResponse{status: 500}, false},
+		{"create draft network error", "POST", "/drafts", stubResponse{err: errors.New("EOF")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "https://gmail.googleapis.com/gmail/v1/users/me"+tt.path, nil)
+			var resp *http.Response
+			if tt.resp.err == nil {
+				resp = apiResponse(tt.resp.status, tt.resp.reason, "")
+			}
+			got, _ := shouldRetry(req, resp, tt.resp.err)
+			if got != tt.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, tt.want)
+			}
+			if resp != nil {
+				// The body stays readable for the caller
+				if body, _ := io.ReadAll(resp.Body); len(body) == 0 {
+					t.Error("response body was consumed")
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaUnits(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   float64
+	}{
+		{"GET", "/gmail/v1/users/me/profile", 1},
+		{"GET", "/gmail/v1/users/me/labels", 1},
+		{"POST", "/gmail/v1/users/me/labels", 5},
+		{"GET", "/gmail/v1/users/me/settings/filters", 1},
+		{"POST", "/gmail/v1/users/me/settings/filters", 5},
+		{"DELETE", "/gmail/v1/users/me/settings/filters/abc", 5},
+		{"GET", "/gmail/v1/users/me/messages", 5},
+		{"GET", "/gmail/v1/users/me/messages/abc", 5},
+		{"POST", "/gmail/v1/users/me/messages/abc/modify", 5},
+		{"POST", "/gmail/v1/users/me/messages/batchModify", 50},
+		{"POST", "/gmail/v1/users/me/messages/batchDelete", 50},
+		{"POST", "/gmail/v1/users/me/messages/import", 25},
+		{"POST", "/gmail/v1/users/me/messages", 25},
+		{"POST", "/gmail/v1/users/me/messages/send", 100},
+		{"GET", "/gmail/v1/users/me/history", 2},
+		{"GET", "/gmail/v1/users/me/threads/abc", 10},
+		{"POST", "/gmail/v1/users/me/drafts", 10},
+		{"POST", "/gmail/v1/users/me/watch", 100},
+		{"POST", "/gmail/v1/users/me/stop", 50},
+		{"GET", "/other", 5},
+	}
+
+	for _, tt := range tests {
+		if got := QuotaUnits(tt.method, tt.path); got != tt.want {
+			t.Errorf("QuotaUnits(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	transport := &retryTransport{baseDelay: time.Second, maxDelay: 64 * time.Second}
+	for attempt := 0; attempt < 70; attempt++ {
+		ceiling := min(time.Second<<min(attempt, 7), 64*time.Second)
+		for i := 0; i < 100; i++ {
+			delay := transport.backoff(attempt)
+			if delay <= 0 || delay > ceiling+time.Millisecond {
+				t.Fatalf("backoff(%d) = %s, want between 0 and %s", attempt, delay, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		responses  []stubResponse
+		wantStatus int
+		wantErr    bool
+		wantCalls  int
+	}{
+		{"get retried until it succeeds", "GET", messagesURL, []stubResponse{{status: 503}, {status: 500}, {status: 200}}, 200, false, 3},
+		{"get gives up after max retries", "GET", messagesURL, []stubResponse{{status: 503}}, 503, false, 4},
+		{"get not found is not retried", "GET", messagesURL, []stubResponse{{status: 404}}, 404, false, 1},
+		{"get network error is retried", "GET", messagesURL, []stubResponse{{err: errors.New("connection reset")}, {status: 200}}, 200, false, 2},
+		{"import is retried when rate limited", "POST", messagesURL + "/import", []stubResponse{{status: 429}, {status: 200}}, 200, false, 2},
+		{"import is not retried on server errors", "POST", messagesURL + "/import", []stubResponse{{status: 500}, {status: 200}}, 500, false, 1},
+		{"import is not retried on network errors", "POST", messagesURL + "/import", []stubResponse{{err: errors.New("EOF")}, {status: 200}}, 0, true, 1},
+		{"retry after is capped", "GET", messagesURL, []stubResponse{{status: 429, retryAfter: "3600"}, {status: 200}}, 200, false, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubTransport{responses: tt.responses}
+			transport := &retryTransport{
+				base:       stub,
+				limiter:    newQuotaLimiter(1e6, 1e6),
+				maxRetries: 3,
+				baseDelay:  time.Millisecond,
+				maxDelay:   10 * time.Millisecond,
+			}
+
+			req, _ := http.NewRequest(tt.method, tt.url, strings.NewReader(`{"raw":"x"}`))
+			start := time.Now()
+			resp, err := transport.RoundTrip(req)
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("RoundTrip took %s", time.Since(start))
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RoundTrip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if resp != nil && resp.StatusCode != tt.wantStatus {
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if len(stub.bodies) != tt.wantCalls {
+				t.Errorf("RoundTrip() sent %d requests, want %d", len(stub.bodies), tt.wantCalls)
+			}
+			for i, body := range stub.bodies {
+				if body != `{"raw":"x"}` {
+					t.Errorf("request %d body = %q, want the original body", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaLimiter(t *testing.T) {
+	limiter := newQuotaLimiter(1000, 10)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.wait(context.Background(), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The burst covers the first request; the next two wait for 10 units each at 1000 units per second
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("three requests took %s, want at least 20ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(ctx, 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait() error = %v, want context.Canceled", err)
+	}
+}
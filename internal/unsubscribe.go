@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Subscription is a sender of list mail, with the unsubscribe methods advertised by its latest message.
+type Subscription struct {
+	Sender          string
+	Messages        int
+	LatestMessageId string
+	LatestSubject   string
+	// OneClickURL is an HTTPS URL accepting an RFC 8058 one-click unsubscribe POST.
+	OneClickURL string
+	// MailTo is a mailto: URL to send an unsubscribe request to.
+	MailTo string
+	// WebURL is an unsubscribe page that has to be visited in a browser.
+	WebURL string
+}
+
+// ParseListUnsubscribe parses the List-Unsubscribe and List-Unsubscribe-Post headers of a message (RFC 2369, RFC 8058).
+func ParseListUnsubscribe(header, post string) (oneClickURL, mailTo, webURL string) {
+	oneClick := strings.EqualFold(strings.TrimSpace(post), "List-Unsubscribe=One-Click")
+	for _, entry := range strings.Split(header, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.HasPrefix(entry, "<") || !strings.HasSuffix(entry, ">") {
+			continue
+		}
+		target := strings.TrimSpace(entry[1 : len(entry)-1])
+		u, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			if mailTo == "" {
+				mailTo = target
+			}
+		case "https":
+			if oneClick && oneClickURL == "" {
+				oneClickURL = target
+			} else if webURL == "" {
+				webURL = target
+			}
+		case "http":
+			if webURL == "" {
+				webURL = target
+			}
+		}
+	}
+	return oneClickURL, mailTo, webURL
+}
+
+// GroupSubscriptions groups messages fetched with metadata by sender, keeping those with a
+// List-Unsubscribe header. Messages are expected newest first, as Gmail lists them.
+func GroupSubscriptions(messages Messages) []*Subscription {
+	bySender := make(map[string]*Subscription)
+	var subscriptions []*Subscription
+	for _, m := range messages {
+		headers := messageHeaders(m)
+		if headers["List-Unsubscribe"] == "" {
+			continue
+		}
+		sender := senderAddress(headers["From"])
+		if sender == "" {
+			continue
+		}
+
+		sub := bySender[sender]
+		if sub == nil {
+			sub = &Subscription{Sender: sender, LatestMessageId: m.Id, LatestSubject: decodeHeader(headers["Subject"])}
+			sub.OneClickURL, sub.MailTo, sub.WebURL = ParseListUnsubscribe(headers["List-Unsubscribe"], headers["List-Unsubscribe-Post"])
+			bySender[sender] = sub
+			subscriptions = append(subscriptions, sub)
+		}
+		sub.Messages++
+	}
+
+	sort.SliceStable(subscriptions, func(i, j int) bool { return subscriptions[i].Messages > subscriptions[j].Messages })
+	return subscriptions
+}
+
+// UnsubscribeRecord records what was done to unsubscribe from a sender.
+type UnsubscribeRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Sender    string    `json:"sender"`
+	// Method is one-click, mailto-draft or none.
+	Method   string `json:"method"`
+	Target   string `json:"target,omitempty"`
+	DraftId  string `json:"draft_id,omitempty"`
+	FilterId string `json:"filter_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Unsubscribe unsubscribes from a sender with the best advertised method: an RFC 8058 one-click POST,
+// or else a draft of the mailto: request to be sent by hand. Senders offering only a web page are
+// reported as an error.
+func (s *Service) Unsubscribe(ctx context.Context, sub *Subscription, client *http.Client) (*UnsubscribeRecord, error) {
+	record := &UnsubscribeRecord{Timestamp: time.Now(), Sender: sub.Sender, Method: "none"}
+
+	switch {
+	case sub.OneClickURL != "":
+		record.Method, record.Target = "one-click", sub.OneClickURL
+		if err := postOneClick(ctx, client, sub.OneClickURL); err != nil {
+			return record, err
+		}
+		logrus.Infof("Unsubscribed from %s with a one-click request", sub.Sender)
+	case sub.MailTo != "":
+		record.Method, record.Target = "mailto-draft", sub.MailTo
+		draft, err := s.createMailToDraft(ctx, sub.MailTo)
+		if err != nil {
+			return record, err
+		}
+		record.DraftId = draft.Id
+		logrus.Infof("Created unsubscribe draft %s for %s; send it to finish unsubscribing", draft.Id, sub.Sender)
+	default:
+		record.Target = sub.WebURL
+		return record, fmt.Errorf("%s only offers an unsubscribe page: %s", sub.Sender, sub.WebURL)
+	}
+	return record, nil
+}
+
+// postOneClick sends an RFC 8058 one-click unsubscribe request.
+func postOneClick(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("one-click unsubscribe request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("one-click unsubscribe request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// createMailToDraft creates a draft of the message a mailto: URL describes (RFC 6068).
+func (s *Service) createMailToDraft(ctx context.Context, mailTo string) (*gmail.Draft, error) {
+	u, err := url.Parse(mailTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mailto URL %s: %v", mailTo, err)
+	}
+	// The URL comes from the sender, so line breaks that would add headers to the draft are refused
+	to, err := url.PathUnescape(u.Opaque)
+	if err != nil || to == "" || strings.ContainsAny(to, "\r\n") {
+		return nil, fmt.Errorf("invalid mailto URL %s", mailTo)
+	}
+	addresses, err := mail.ParseAddressList(to)
+	if err != nil || len(addresses) != 1 {
+		return nil, fmt.Errorf("mailto URL %s must name exactly one address", mailTo)
+	}
+	params := u.Query()
+	subject, body := params.Get("subject"), params.Get("body")
+	if strings.ContainsAny(subject+body, "\r\n") {
+		return nil, fmt.Errorf("mailto URL %s has line breaks in its subject or body", mailTo)
+	}
+	if subject == "" {
+		subject = "unsubscribe"
+	}
+
+	var raw strings.Builder
+	fmt.Fprintf(&raw, "To: %s\r\n", addresses[0].String())
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&raw, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&raw, "%s\r\n", body)
+
+	draft, err := s.Client.CreateDraft(ctx, &gmail.Draft{
+		Message: &gmail.Message{Raw: base64.URLEncoding.EncodeToString([]byte(raw.String()))},
+	})
+	if err != nil {
+		logrus.Errorf("Failed to create unsubscribe draft to %s: %v", to, err)
+		return nil, err
+	}
+	return draft, nil
+}
+
+// TrashFilter returns a filter that sends future mail from a sender to the trash.
+func TrashFilter(sender string) *gmail.Filter {
+	return &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{From: sender},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{"TRASH"}},
+	}
+}
+
+// AppendUnsubscribeRecord appends a record to a JSON Lines file.
+func AppendUnsubscribeRecord(recordPath string, record *UnsubscribeRecord) error {
+	file, err := os.OpenFile(recordPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Errorf("Failed to open record file: %v", err)
+		return fmt.Errorf("failed to open record file: %v", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(record); err != nil {
+		return fmt.Errorf("failed to write record: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package internal_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseListUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		post         string
+		wantOneClick string
+		wantMailTo   string
+		wantWeb      string
+	}{
+		{"empty", "", "", "", "", ""},
+		{"mailto", "<mailto:unsub@example.com?subject=stop>", "", "", "mailto:unsub@example.com?subject=stop", ""},
+		{"https without post header", "<https://example.com/u/1>", "", "", "", "https://example.com/u/1"},
+		{"one-click", "<https://example.com/u/1>", "List-Unsubscribe=One-Click", "https://example.com/u/1", "", ""},
+		{"one-click case and spaces", "<https://example.com/u/1>", "  list-unsubscribe=one-click ", "https://example.com/u/1", "", ""},
+		{"other post value", "<https://example.com/u/1>", "List-Unsubscribe=Later", "", "", "https://example.com/u/1"},
+		{"http is never one-click", "<http://example.com/u/1>", "List-Unsubscribe=One-Click", "", "", "http://example.com/u/1"},
+		{
+			"mailto and one-click", "<mailto:unsub@example.com>, <https://example.com/u/1>", "List-Unsubscribe=One-Click",
+			"https://example.com/u/1", "mailto:unsub@example.com", "",
+		},
+		{
+			"first of each kind", "<https://a.example.com/1>, <https://b.example.com/2>, <mailto:a@example.com>, <mailto:b@example.com>", "List-Unsubscribe=One-Click",
+			"https://a.example.com/1", "mailto:a@example.com", "https://b.example.com/2",
+		},
+		{"spaces inside brackets", "< https://example.com/u/1 >", "List-Unsubscribe=One-Click", "https://example.com/u/1", "", ""},
+		{"without brackets", "https://example.com/u/1, mailto:unsub@example.com", "List-Unsubscribe=One-Click", "", "", ""},
+		{"unknown scheme", "<ftp://example.com/u/1>", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oneClick, mailTo, web := internal.ParseListUnsubscribe(tt.header, tt.post)
+			if oneClick != tt.wantOneClick || mailTo != tt.wantMailTo || web != tt.wantWeb {
+				t.Errorf("ParseListUnsubscribe() = (%q, %q, %q), want (%q, %q, %q)",
+					oneClick, mailTo, web, tt.wantOneClick, tt.wantMailTo, tt.wantWeb)
+			}
+		})
+	}
+}
+
+// listMessage builds a message fetched in metadata format with the given headers.
+func listMessage(id string, headers ...string) *gmail.Message {
+	payload := &gmail.MessagePart{}
+	for i := 0; i+1 < len(headers); i += 2 {
+		payload.Headers = append(payload.Headers, &gmail.MessagePartHeader{Name: headers[i], Value: headers[i+1]})
+	}
+	return &gmail.Message{Id: id, Payload: payload}
+}
+
+func TestGroupSubscriptions(t *testing.T) {
+	messages := internal.Messages{
+		listMessage("3", "From", "News <news@example.com>", "Subject", "Latest", "List-Unsubscribe", "<https://example.com/u/new>", "List-Unsubscribe-Post", "List-Unsubscribe=One-Click"),
+		listMessage("2", "From", "Friend <friend@example.com>", "Subject", "Hi"),
+		listMessage("1", "From", "news@example.com", "Subject", "Older", "List-Unsubscribe", "<https://example.com/u/old>"),
+		listMessage("0", "From", "Shop <shop@example.com>", "Subject", "Sale", "List-Unsubscribe", "<mailto:unsub@example.com>"),
+	}
+
+	subscriptions := internal.GroupSubscriptions(messages)
+	if len(subscriptions) != 2 {
+		t.Fatalf("got %d subscriptions, want 2", len(subscriptions))
+	}
+	news := subscriptions[0]
+	if news.Sender != "news@example.com" || news.Messages != 2 || news.LatestMessageId != "3" || news.LatestSubject != "Latest" {
+		t.Errorf("news subscription = %+v", news)
+	}
+	if news.OneClickURL != "https://example.com/u/new" {
+		t.Errorf("news one-click URL = %q, want the latest message's", news.OneClickURL)
+	}
+	if shop := subscriptions[1]; shop.Sender != "shop@example.com" || shop.MailTo != "mailto:unsub@example.com" {
+		t.Errorf("shop subscription = %+v", shop)
+	}
+}
+
+func TestUnsubscribeMailTo(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+
+	sub := &internal.Subscription{Sender: "shop@example.com", MailTo: "mailto:unsub@example.com?subject=Remove%20me&body=stop"}
+	record, err := svc.Unsubscribe(context.Background(), sub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Method != "mailto-draft" || record.DraftId == "" {
+		t.Errorf("record = %+v, want a mailto draft", record)
+	}
+
+	drafts := fake.Drafts()
+	raw := string(drafts[record.DraftId])
+	for _, want := range []string{"To: <unsub@example.com>\r\n", "Subject: Remove me\r\n", "\r\n\r\nstop\r\n"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("draft %q does not contain %q", raw, want)
+		}
+	}
+}
+
+func TestUnsubscribeWebOnly(t *testing.T) {
+	svc := internal.NewServiceWithClient(gmailtest.NewFakeClient())
+
+	sub := &internal.Subscription{Sender: "shop@example.com", WebURL: "https://example.com/preferences"}
+	record, err := svc.Unsubscribe(context.Background(), sub, nil)
+	if err == nil {
+		t.Fatal("Unsubscribe() succeeded for a sender offering only a web page")
+	}
+	if record.Method != "none" || record.Target != sub.WebURL {
+		t.Errorf("record = %+v, want method none with the page as target", record)
+	}
+}
+
+func TestUnsubscribeMailToRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		mailTo string
+	}{
+		{"header injection in the address", "mailto:unsub@example.com%0D%0ABcc:victim@example.com"},
+		{"line feed in the address", "mailto:unsub@example.com%0ABcc:victim@example.com"},
+		{"several addresses", "mailto:unsub@example.com,other@example.com"},
+		{"not an address", "mailto:unsubscribe"},
+		{"line break in the subject", "mailto:unsub@example.com?subject=stop%0D%0ABcc:victim@example.com"},
+		{"line break in the body", "mailto:unsub@example.com?body=stop%0D%0A%0D%0Amore"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := gmailtest.NewFakeClient()
+			svc := internal.NewServiceWithClient(fake)
+
+			sub := &internal.Subscription{Sender: "shop@example.com", MailTo: tt.mailTo}
+			if _, err := svc.Unsubscribe(context.Background(), sub, nil); err == nil {
+				t.Error("Unsubscribe() succeeded")
+			}
+			if drafts := fake.Drafts(); len(drafts) != 0 {
+				t.Errorf("created drafts %q", drafts)
+			}
+		})
+	}
+}
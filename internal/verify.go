@@ -0,0 +1,545 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// BackupManifest records the checksums and counts of a settings backup or a message archive, so
+// the backup can be verified before it is needed. It is written next to the backup as <backup>.manifest.json.
+type BackupManifest struct {
+	// Kind is "settings" or "messages".
+	Kind string `json:"kind"`
+	// Format is "yaml", "mbox" or "maildir".
+	Format       string    `json:"format"`
+	CreatedAt    time.Time `json:"created_at"`
+	EmailAddress string    `json:"email_address,omitempty"`
+	// Query is the search query that selected the archived messages.
+	Query string `json:"query,omitempty"`
+	// Index is the path of the index of an incremental message archive, relative to the manifest.
+	// LoadBackupManifest resolves it.
+	Index     string `json:"index,omitempty"`
+	Labels    int    `json:"labels,omitempty"`
+	Filters   int    `json:"filters,omitempty"`
+	Messages  int    `json:"messages,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+	// Files lists every file of the backup; paths are relative to the Maildir of a Maildir archive.
+	Files []*ManifestFile `json:"files"`
+	// Warnings describes what was found wrong with the backup when it was taken, such as messages
+	// that cannot be parsed.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ManifestFile is the checksum of a file of a backup.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifestPath returns the path of the manifest of a backup file or Maildir.
+func BackupManifestPath(path string) string {
+	return strings.TrimSuffix(path, string(filepath.Separator)) + ".manifest.json"
+}
+
+// LoadBackupManifest loads the manifest of a backup; it returns nil if the backup has none.
+func LoadBackupManifest(path string) (*BackupManifest, error) {
+	manifestPath := BackupManifestPath(path)
+	if !fileExists(manifestPath) {
+		return nil, nil
+	}
+	manifest := &BackupManifest{}
+	if err := loadStateFile(manifestPath, manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Index != "" && !filepath.IsAbs(manifest.Index) {
+		manifest.Index = filepath.Join(filepath.Dir(manifestPath), manifest.Index)
+	}
+	return manifest, nil
+}
+
+// WriteSettingsManifest writes the manifest of a settings backup saved to path.
+func WriteSettingsManifest(path string, config *Config, emailAddress string, enc *Encryption) error {
+	manifest := &BackupManifest{
+		Kind:         "settings",
+		Format:       "yaml",
+		CreatedAt:    time.Now().UTC(),
+		EmailAddress: emailAddress,
+		Labels:       len(config.Labels),
+		Filters:      len(config.Filters),
+		Encrypted:    enc.Encrypts(),
+	}
+	return manifest.write(path)
+}
+
+// WriteArchiveManifest writes the manifest of a message archive. Messages are counted by reading
+// the archive back. An encrypted archive may not be readable with the keys it is written with, so
+// its count is the number of written messages, added to the count of the previous manifest when
+// the archive file it recorded is still there and the run only added segments.
+func WriteArchiveManifest(path, format, query, indexPath, emailAddress string, written int, enc *Encryption) error {
+	manifest := &BackupManifest{
+		Kind:         "messages",
+		Format:       format,
+		CreatedAt:    time.Now().UTC(),
+		EmailAddress: emailAddress,
+		Query:        query,
+		Messages:     written,
+		Encrypted:    enc.Encrypts(),
+	}
+	if indexPath != "" {
+		index, err := relativeToManifest(path, indexPath)
+		if err != nil {
+			return err
+		}
+		manifest.Index = index
+	}
+	if !manifest.Encrypted {
+		// A message that cannot be parsed is archived all the same, so it is only worth a warning
+		count, unparsable, err := countArchive(path, nil)
+		if err != nil {
+			return err
+		}
+		manifest.Messages, manifest.Warnings = count, unparsable
+		for _, warning := range unparsable {
+			logrus.Warnf("Archived %s", warning)
+		}
+	} else {
+		previous, err := LoadBackupManifest(path)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.Encrypted && len(previous.Files) > 0 {
+			sum, err := fileChecksum(path)
+			if err != nil {
+				return err
+			}
+			if sum == previous.Files[0].SHA256 {
+				manifest.Messages += previous.Messages
+			}
+		}
+	}
+	return manifest.write(path)
+}
+
+// relativeToManifest returns a path relative to the directory of the manifest of the backup at
+// path, so the manifest can be read from any working directory.
+func relativeToManifest(path, target string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(BackupManifestPath(path)))
+	if err != nil {
+		return "", err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(dir, target)
+}
+
+// write records the checksums of the files of the backup at path and saves the manifest next to it.
+func (m *BackupManifest) write(path string) error {
+	files, err := backupFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		sum, err := fileChecksum(filepath.Join(backupRoot(path), filepath.FromSlash(f.Path)))
+		if err != nil {
+			return err
+		}
+		f.SHA256 = sum
+	}
+	m.Files = files
+	return saveStateFile(BackupManifestPath(path), m)
+}
+
+// backupRoot returns the directory the file paths of a backup's manifest are relative to.
+func backupRoot(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// backupFiles lists the files of a backup with their sizes: the file itself with the encrypted
+// segments of an mbox archive, or the messages of a Maildir. Maildir tmp directories hold partly written messages and are left out.
+func backupFiles(path string) ([]*ManifestFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+	if !info.IsDir() {
+		var files []*ManifestFile
+		for _, segment := range MboxSegments(path) {
+			info, err := os.Stat(segment)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open backup: %v", err)
+			}
+			files = append(files, &ManifestFile{Path: filepath.Base(segment), Size: info.Size()})
+		}
+		return files, nil
+	}
+
+	var files []*ManifestFile
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, &ManifestFile{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", path, err)
+	}
+	return files, nil
+}
+
+// countArchive reads every message of an archive and returns the number of messages, with a
+// description of every message that cannot be parsed. It fails if the archive cannot be read.
+func countArchive(path string, enc *Encryption) (count int, unparsable []string, err error) {
+	r, err := NewMessageReader(path, enc)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			return count, unparsable, nil
+		}
+		if err != nil {
+			return count, unparsable, err
+		}
+		count++
+		if _, err := ParseRawMessage(msg.Raw); err != nil {
+			unparsable = append(unparsable, fmt.Sprintf("message at %s cannot be parsed: %v", msg.Location, err))
+		}
+	}
+}
+
+// VerifyReport is the result of verifying a backup.
+type VerifyReport struct {
+	// Kind is "settings", "snapshots" or "messages".
+	Kind     string
+	Files    int
+	Labels   int
+	Filters  int
+	Messages int
+	// Problems describes every check that failed. A backup without problems can be restored.
+	Problems []string
+	// Warnings describes what could not be checked.
+	Warnings []string
+	// Config is the settings backup, or the latest snapshot of a backup directory.
+	Config *Config
+	// Manifest is the manifest of a settings backup or message archive, if it has one.
+	Manifest *BackupManifest
+}
+
+func (r *VerifyReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyBackup checks that a backup is intact and can be restored: a settings backup file, a
+// snapshot directory written by 'backup --dir', or an mbox or Maildir message archive. The files
+// are checked against the checksums of the backup's manifest, every settings file is parsed like
+// push and restore parse it, and every archived message is read and parsed.
+func VerifyBackup(path string, enc *Encryption) (*VerifyReport, error) {
+	// The manifest of a backup stands for the backup
+	path = strings.TrimSuffix(path, ".manifest.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, snapshotManifestFile)); err == nil {
+			return verifySnapshots(path, enc)
+		}
+	}
+
+	manifest, err := LoadBackupManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Kind: "messages", Manifest: manifest}
+	if ext := strings.ToLower(filepath.Ext(path)); !info.IsDir() && (ext == ".yaml" || ext == ".yml") {
+		report.Kind = "settings"
+	}
+
+	// Step 1: Check the files against the manifest
+	if manifest == nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("no manifest at %s; checksums and counts were not verified", BackupManifestPath(path)))
+	} else {
+		report.Kind = manifest.Kind
+		if err := verifyFiles(path, manifest, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 2: Parse the contents
+	if report.Kind == "settings" {
+		config, err := NewConfigFromYAML(path, enc)
+		if err != nil {
+			report.problem("%s cannot be parsed: %v", path, err)
+			return report, nil
+		}
+		report.Config = config
+		report.Labels, report.Filters = len(config.Labels), len(config.Filters)
+		if manifest != nil && (manifest.Labels != report.Labels || manifest.Filters != report.Filters) {
+			report.problem("%s holds %d labels and %d filters, the manifest records %d and %d",
+				path, report.Labels, report.Filters, manifest.Labels, manifest.Filters)
+		}
+		return report, nil
+	}
+
+	var unparsable []string
+	report.Messages, unparsable, err = countArchive(path, enc)
+	if err != nil {
+		report.problem("%s cannot be read after %d messages: %v", path, report.Messages, err)
+		return report, nil
+	}
+	// Restores import such messages as they are, so they do not keep the archive from being restored
+	report.Warnings = append(report.Warnings, unparsable...)
+	if manifest != nil && manifest.Messages != report.Messages {
+		report.problem("%s holds %d messages, the manifest records %d", path, report.Messages, manifest.Messages)
+	}
+	if manifest == nil && report.Messages == 0 {
+		report.problem("%s holds no messages; it is not an mbox file or Maildir", path)
+	}
+	return report, nil
+}
+
+// verifyFiles compares the files of a backup with its manifest.
+func verifyFiles(path string, manifest *BackupManifest, report *VerifyReport) error {
+	files, err := backupFiles(path)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]*ManifestFile)
+	for _, f := range files {
+		found[f.Path] = f
+	}
+
+	root := backupRoot(path)
+	for _, expected := range manifest.Files {
+		actual := found[expected.Path]
+		delete(found, expected.Path)
+		if actual == nil {
+			report.problem("%s is missing", expected.Path)
+			continue
+		}
+		report.Files++
+		if actual.Size != expected.Size {
+			report.problem("%s has changed: %d bytes, the manifest records %d", expected.Path, actual.Size, expected.Size)
+			continue
+		}
+		sum, err := fileChecksum(filepath.Join(root, filepath.FromSlash(expected.Path)))
+		if err != nil {
+			return err
+		}
+		if sum != expected.SHA256 {
+			report.problem("%s has changed: checksum mismatch", expected.Path)
+		}
+	}
+
+	var extra []string
+	for p := range found {
+		extra = append(extra, p)
+	}
+	sort.Strings(extra)
+	for _, p := range extra {
+		report.problem("%s is not in the manifest", p)
+	}
+	return nil
+}
+
+// verifySnapshots verifies every snapshot of a backup directory.
+func verifySnapshots(dir string, enc *Encryption) (*VerifyReport, error) {
+	manifest, err := LoadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Kind: "snapshots"}
+	if len(manifest.Snapshots) == 0 {
+		report.problem("the manifest of %s lists no snapshots", dir)
+		return report, nil
+	}
+
+	for _, s := range manifest.Snapshots {
+		if err := s.Verify(dir); err != nil {
+			report.problem("snapshot %s: %v", s.File, err)
+			continue
+		}
+		report.Files++
+		config, err := NewConfigFromYAML(filepath.Join(dir, s.File), enc)
+		if err != nil {
+			report.problem("snapshot %s cannot be parsed: %v", s.File, err)
+			continue
+		}
+		if len(config.Labels) != s.Labels || len(config.Filters) != s.Filters {
+			report.problem("snapshot %s holds %d labels and %d filters, the manifest records %d and %d",
+				s.File, len(config.Labels), len(config.Filters), s.Labels, s.Filters)
+		}
+		report.Config = config
+		report.Labels, report.Filters = len(config.Labels), len(config.Filters)
+	}
+	return report, nil
+}
+
+// CompareSettings describes how the labels and filters of the account differ from a settings backup.
+// Filters are compared by criteria and actions, with label IDs resolved to names on both sides.
+func (s *Service) CompareSettings(ctx context.Context, config *Config) ([]string, error) {
+	labels, err := s.Labels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := s.Filters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	backupNames := make(map[string]string)
+	backupLabels := make(map[string]bool)
+	for _, l := range config.Labels {
+		backupNames[l.Id] = l.Name
+		if !isSystemLabelId(l.Id) && l.Type != "system" {
+			backupLabels[l.Name] = true
+		}
+	}
+	liveNames := make(map[string]string)
+	liveLabels := make(map[string]bool)
+	for _, l := range labels {
+		liveNames[l.Id] = l.Name
+		if !isSystemLabelId(l.Id) && l.Type != "system" {
+			liveLabels[l.Name] = true
+		}
+	}
+	for _, name := range sortedKeys(liveLabels) {
+		if !backupLabels[name] {
+			changes = append(changes, fmt.Sprintf("label %s was created", name))
+		}
+	}
+	for _, name := range sortedKeys(backupLabels) {
+		if !liveLabels[name] {
+			changes = append(changes, fmt.Sprintf("label %s was deleted", name))
+		}
+	}
+
+	backupFilters := make(map[string]bool)
+	for _, f := range config.Filters {
+		backupFilters[filterSignature(f, backupNames)] = true
+	}
+	liveFilters := make(map[string]bool)
+	for _, f := range filters {
+		key := filterSignature(f, liveNames)
+		liveFilters[key] = true
+		if !backupFilters[key] {
+			changes = append(changes, fmt.Sprintf("filter '%s' was created", DescribeFilter(f.Criteria)))
+		}
+	}
+	for _, f := range config.Filters {
+		if !liveFilters[filterSignature(f, backupNames)] {
+			changes = append(changes, fmt.Sprintf("filter '%s' was deleted", DescribeFilter(f.Criteria)))
+		}
+	}
+	return changes, nil
+}
+
+// filterSignature identifies a filter by its criteria and actions, with label IDs replaced by names.
+func filterSignature(f *gmail.Filter, labelNames map[string]string) string {
+	named := &gmail.Filter{Criteria: f.Criteria}
+	if f.Action != nil {
+		action := *f.Action
+		rename := func(ids []string) []string {
+			var names []string
+			for _, id := range ids {
+				if name := labelNames[id]; name != "" {
+					id = name
+				}
+				names = append(names, id)
+			}
+			return names
+		}
+		action.AddLabelIds = rename(f.Action.AddLabelIds)
+		action.RemoveLabelIds = rename(f.Action.RemoveLabelIds)
+		named.Action = &action
+	}
+	return filterKey(named)
+}
+
+// CompareArchive describes how the messages of the account differ from a message archive holding
+// archived messages. With the index of an incremental archive, new and deleted messages are
+// counted exactly; otherwise only the number of messages matching the archive's query is compared.
+func (s *Service) CompareArchive(ctx context.Context, manifest *BackupManifest, archived int) ([]string, error) {
+	query := ""
+	if manifest != nil {
+		query = manifest.Query
+	}
+	ids, err := s.MessageIds(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil || manifest.Index == "" || !fileExists(manifest.Index) {
+		if len(ids) == archived {
+			return nil, nil
+		}
+		if query == "" {
+			return []string{fmt.Sprintf("the account has %d messages, the archive holds %d", len(ids), archived)}, nil
+		}
+		return []string{fmt.Sprintf("the account has %d messages matching '%s', the archive holds %d", len(ids), query, archived)}, nil
+	}
+
+	index, err := LoadBackupIndex(manifest.Index, manifest.Format, manifest.Query)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	added := 0
+	for _, id := range ids {
+		live[id] = true
+		if entry := index.Messages[id]; entry == nil || entry.Deleted {
+			added++
+		}
+	}
+	deleted := 0
+	for id, entry := range index.Messages {
+		if !entry.Deleted && !live[id] {
+			deleted++
+		}
+	}
+
+	var changes []string
+	if added > 0 {
+		changes = append(changes, fmt.Sprintf("%d messages were received since the backup", added))
+	}
+	if deleted > 0 {
+		changes = append(changes, fmt.Sprintf("%d archived messages were deleted from the account", deleted))
+	}
+	logrus.Debugf("Compared %d messages of the account with index %s", len(ids), manifest.Index)
+	return changes, nil
+}
@@ -0,0 +1,437 @@
+package internal_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+// settingsConfig returns settings with a label and a filter adding it.
+func settingsConfig() *internal.Config {
+	return internal.NewConfig(
+		internal.Filters{{Criteria: &gmail.FilterCriteria{From: "shop@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}}},
+		internal.Labels{{Id: "Label_1", Name: "Receipts", Type: "user"}},
+	)
+}
+
+// writeSettingsBackup saves a settings backup with its manifest and returns its path.
+func writeSettingsBackup(t *testing.T, dir string, enc *internal.Encryption) string {
+	t.Helper()
+	path := filepath.Join(dir, "backup.yaml")
+	config := settingsConfig()
+	if err := config.SaveToFile(path, enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.WriteSettingsManifest(path, config, "me@example.com", enc); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeMaildirArchive archives messages to a Maildir with its manifest and returns its path.
+func writeMaildirArchive(t *testing.T, dir string, raws ...string) string {
+	t.Helper()
+	path := filepath.Join(dir, "Maildir")
+	writer, err := internal.NewMaildirWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, raw := range raws {
+		msg := &internal.ExportedMessage{Id: fmt.Sprintf("m%d", i), Labels: []string{"INBOX"}, Date: time.Unix(int64(i), 0), Raw: []byte(raw)}
+		if _, err := writer.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := internal.WriteArchiveManifest(path, "maildir", "", "", "me@example.com", len(raws), nil); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// editManifest changes a field of the manifest of a backup.
+func editManifest(t *testing.T, path, field string, value any) {
+	t.Helper()
+	manifestPath := internal.BackupManifestPath(path)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields[field] = value
+	if data, err = json.Marshal(fields); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// maildirMessage returns the path of the only copy of a message in the inbox of a Maildir.
+func maildirMessage(t *testing.T, root, id string) string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(root, "cur", "*."+id+".gmail:2,*"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("message %s is in %v", id, paths)
+	}
+	return paths[0]
+}
+
+func TestVerifyBackup(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &internal.Encryption{Recipients: []age.Recipient{identity.Recipient()}, Identities: []age.Identity{identity}}
+	const message = "From: shop@example.com\r\nSubject: Order\r\n\r\nHello\r\n"
+
+	tests := []struct {
+		name string
+		// setup writes a backup to dir, possibly damaging it, and returns its path.
+		setup        func(t *testing.T, dir string) string
+		enc          *internal.Encryption
+		wantProblems []string
+		wantWarnings []string
+		wantKind     string
+	}{
+		{
+			name:     "settings",
+			setup:    func(t *testing.T, dir string) string { return writeSettingsBackup(t, dir, nil) },
+			wantKind: "settings",
+		},
+		{
+			name:     "encrypted settings",
+			setup:    func(t *testing.T, dir string) string { return writeSettingsBackup(t, dir, enc) },
+			enc:      enc,
+			wantKind: "settings",
+		},
+		{
+			name:         "encrypted settings without keys",
+			setup:        func(t *testing.T, dir string) string { return writeSettingsBackup(t, dir, enc) },
+			wantProblems: []string{"cannot be parsed"},
+			wantKind:     "settings",
+		},
+		{
+			name: "tampered settings",
+			setup: func(t *testing.T, dir string) string {
+				path := writeSettingsBackup(t, dir, nil)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Same size, other content
+				tampered := strings.Replace(string(data), "shop@example.com", "spam@example.com", 1)
+				if err := os.WriteFile(path, []byte(tampered), 0600); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantProblems: []string{"backup.yaml has changed: checksum mismatch"},
+			wantKind:     "settings",
+		},
+		{
+			name: "settings count mismatch",
+			setup: func(t *testing.T, dir string) string {
+				path := writeSettingsBackup(t, dir, nil)
+				editManifest(t, path, "filters", 2)
+				return path
+			},
+			wantProblems: []string{"holds 1 labels and 1 filters, the manifest records 1 and 2"},
+			wantKind:     "settings",
+		},
+		{
+			name: "settings without manifest",
+			setup: func(t *testing.T, dir string) string {
+				path := writeSettingsBackup(t, dir, nil)
+				if err := os.Remove(internal.BackupManifestPath(path)); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantWarnings: []string{"no manifest"},
+			wantKind:     "settings",
+		},
+		{
+			name:     "maildir",
+			setup:    func(t *testing.T, dir string) string { return writeMaildirArchive(t, dir, message, message) },
+			wantKind: "messages",
+		},
+		{
+			name: "missing message file",
+			setup: func(t *testing.T, dir string) string {
+				path := writeMaildirArchive(t, dir, message, message)
+				if err := os.Remove(maildirMessage(t, path, "m1")); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantProblems: []string{"is missing", "holds 1 messages, the manifest records 2"},
+			wantKind:     "messages",
+		},
+		{
+			name: "extra message file",
+			setup: func(t *testing.T, dir string) string {
+				path := writeMaildirArchive(t, dir, message)
+				extra := filepath.Join(path, "cur", "1.extra.gmail:2,S")
+				if err := os.WriteFile(extra, []byte(message), 0600); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantProblems: []string{"cur/1.extra.gmail:2,S is not in the manifest", "holds 2 messages, the manifest records 1"},
+			wantKind:     "messages",
+		},
+		{
+			name: "resized message file",
+			setup: func(t *testing.T, dir string) string {
+				path := writeMaildirArchive(t, dir, message)
+				if err := os.WriteFile(maildirMessage(t, path, "m0"), []byte(message+"More\r\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantProblems: []string{"has changed"},
+			wantKind:     "messages",
+		},
+		{
+			name: "unparsable message",
+			setup: func(t *testing.T, dir string) string {
+				return writeMaildirArchive(t, dir, message, "Subject: Broken\r\nnot a header\r\n\r\nHello\r\n")
+			},
+			wantWarnings: []string{"cannot be parsed"},
+			wantKind:     "messages",
+		},
+		{
+			name: "snapshots",
+			setup: func(t *testing.T, dir string) string {
+				if _, err := (&internal.SnapshotManifest{}).SaveSnapshot(dir, settingsConfig(), "me@example.com", enc); err != nil {
+					t.Fatal(err)
+				}
+				return dir
+			},
+			enc:      enc,
+			wantKind: "snapshots",
+		},
+		{
+			name: "tampered snapshot",
+			setup: func(t *testing.T, dir string) string {
+				snapshot, err := (&internal.SnapshotManifest{}).SaveSnapshot(dir, settingsConfig(), "me@example.com", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, snapshot.File), []byte("labels: []\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				return dir
+			},
+			wantProblems: []string{"checksum mismatch"},
+			wantKind:     "snapshots",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.setup(t, t.TempDir())
+			report, err := internal.VerifyBackup(path, tt.enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Kind != tt.wantKind {
+				t.Errorf("Kind = %s, want %s", report.Kind, tt.wantKind)
+			}
+			checkMessages(t, "problems", report.Problems, tt.wantProblems)
+			checkMessages(t, "warnings", report.Warnings, tt.wantWarnings)
+		})
+	}
+}
+
+// checkMessages checks that every message contains the wanted text in order.
+func checkMessages(t *testing.T, kind string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %q, want %d matching %q", kind, got, len(want), want)
+		return
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("%s = %q, want %q", kind, got, want)
+			return
+		}
+	}
+}
+
+func TestWriteArchiveManifestIndexPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Maildir")
+	if _, err := internal.NewMaildirWriter(path); err != nil {
+		t.Fatal(err)
+	}
+	indexPath := path + ".index.json"
+	if err := os.WriteFile(indexPath, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index is given relative to the working directory and recorded relative to the manifest
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.WriteArchiveManifest(path, "maildir", "", relative, "me@example.com", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(internal.BackupManifestPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"index": "Maildir.index.json"`) {
+		t.Errorf("manifest %s does not record the index next to it", data)
+	}
+
+	manifest, err := internal.LoadBackupManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Index != indexPath {
+		t.Errorf("loaded index path = %s, want %s", manifest.Index, indexPath)
+	}
+}
+
+func TestCompareSettings(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+
+	receipts, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.CreateFilter(ctx, &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{From: "shop@example.com"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{receipts.Id}, RemoveLabelIds: []string{"INBOX"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup was taken from another mailbox, where the label has another ID
+	backup := settingsConfig()
+	backup.Filters[0].Action.RemoveLabelIds = []string{"INBOX"}
+	changes, err := svc.CompareSettings(ctx, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("CompareSettings() = %q for an unchanged account", changes)
+	}
+
+	work, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.CreateFilter(ctx, &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{From: "boss@example.com"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{work.Id}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	backup.Labels = append(backup.Labels, &gmail.Label{Id: "Label_2", Name: "Old", Type: "user"})
+	backup.Filters[0].Action.RemoveLabelIds = nil
+
+	changes, err = svc.CompareSettings(ctx, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"label Work was created",
+		"label Old was deleted",
+		"filter '(from:shop@example.com)' was created",
+		"filter '(from:boss@example.com)' was created",
+		"filter '(from:shop@example.com)' was deleted",
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("CompareSettings() = %q, want %q", changes, want)
+	}
+}
+
+func TestCompareArchive(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "messages.mbox")
+	indexPath := path + ".index.json"
+
+	first := fake.AddMessage([]byte("Subject: One\r\n\r\nHello\r\n"), "INBOX")
+	fake.AddMessage([]byte("Subject: Two\r\n\r\nHello\r\n"), "INBOX")
+	index, err := internal.LoadBackupIndex(indexPath, "mbox", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := internal.NewMboxWriter(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.IncrementalBackup(ctx, index, nil, writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Save(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := internal.WriteArchiveManifest(path, "mbox", "", indexPath, "me@example.com", 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := internal.LoadBackupManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := svc.CompareArchive(ctx, manifest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("CompareArchive() = %q for an unchanged account", changes)
+	}
+
+	// One message received and one trashed since the backup
+	fake.AddMessage([]byte("Subject: Three\r\n\r\nHello\r\n"), "INBOX")
+	fake.AddMessage([]byte("Subject: Four\r\n\r\nHello\r\n"), "INBOX")
+	if _, err := fake.TrashMessage(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = svc.CompareArchive(ctx, manifest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2 messages were received since the backup", "1 archived messages were deleted from the account"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("CompareArchive() = %q, want %q", changes, want)
+	}
+
+	// Without an index only the counts are compared
+	changes, err = svc.CompareArchive(ctx, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"the account has 3 messages, the archive holds 2"}; !slices.Equal(changes, want) {
+		t.Errorf("CompareArchive() without an index = %q, want %q", changes, want)
+	}
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// watchUnhealthyFailures is the number of consecutive failed polls after which the watcher reports itself unhealthy.
+const watchUnhealthyFailures = 3
+
+// MessageProcessor handles a message that arrived since the previous poll.
+// The message is fetched in "full" format and parsed, so processors can inspect headers and body.
+// Errors are logged and do not stop the other processors.
+type MessageProcessor func(ctx context.Context, s *Service, msg *gmail.Message, local *LocalMessage) error
+
+// WatchStatus is a snapshot of the watcher's health, served by its health endpoint.
+type WatchStatus struct {
+	Healthy             bool      `json:"healthy"`
+	HistoryId           uint64    `json:"history_id"`
+	LastPoll            time.Time `json:"last_poll"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Processed           int       `json:"processed"`
+}
+
+// Watcher polls the mailbox history and runs its processors on every new message.
+// Processing is at-least-once: the state is saved after each poll, so a message may be
+// processed again when the watcher stops between processing it and saving the state.
+type Watcher struct {
+	Service    *Service
+	State      *SyncState
+	StatePath  string
+	Query      QueryNode
+	Interval   time.Duration
+	MaxBackoff time.Duration
+	Processors []MessageProcessor
+
+	labelNames map[string]string
+	trigger    chan struct{}
+	mu         sync.Mutex
+	status     WatchStatus
+}
+
+// NewWatcher creates a Watcher that polls every interval and backs off up to maxBackoff on errors.
+func NewWatcher(s *Service, state *SyncState, statePath string, interval, maxBackoff time.Duration) *Watcher {
+	return &Watcher{
+		Service:    s,
+		State:      state,
+		StatePath:  statePath,
+		Interval:   interval,
+		MaxBackoff: max(maxBackoff, interval),
+		trigger:    make(chan struct{}, 1),
+		status:     WatchStatus{Healthy: true, HistoryId: state.HistoryId},
+	}
+}
+
+// Trigger requests a poll as soon as possible, without waiting for the interval to elapse.
+func (w *Watcher) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls until the context is done. Failed polls are retried with exponential backoff.
+func (w *Watcher) Run(ctx context.Context) error {
+	logrus.WithField("interval", w.Interval.String()).Info("Watching mailbox for new messages...")
+
+	for {
+		delay := w.Interval
+		if err := w.Poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures := w.Status().ConsecutiveFailures
+			delay = w.backoff(failures)
+			logrus.WithFields(logrus.Fields{
+				"failures": failures,
+				"retry_in": delay.String(),
+			}).Errorf("Poll failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.trigger:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns the delay before the next poll after the given number of consecutive failures.
+func (w *Watcher) backoff(failures int) time.Duration {
+	delay := w.Interval << min(failures, 16)
+	if delay <= 0 || delay > w.MaxBackoff {
+		return w.MaxBackoff
+	}
+	return delay
+}
+
+// Poll syncs the mailbox once, runs the processors on new messages and saves the state.
+func (w *Watcher) Poll(ctx context.Context) error {
+	w.mu.Lock()
+	w.status.LastPoll = time.Now()
+	w.mu.Unlock()
+
+	processed, err := w.poll(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.Processed += processed
+	w.status.HistoryId = w.State.HistoryId
+	if err != nil {
+		w.status.ConsecutiveFailures++
+		w.status.LastError = err.Error()
+	} else {
+		w.status.ConsecutiveFailures = 0
+		w.status.LastError = ""
+		w.status.LastSuccess = time.Now()
+	}
+	w.status.Healthy = w.status.ConsecutiveFailures < watchUnhealthyFailures
+	return err
+}
+
+func (w *Watcher) poll(ctx context.Context) (int, error) {
+	previous := *w.State
+	result, err := w.Service.Sync(ctx, w.State, "")
+	if err != nil {
+		return 0, err
+	}
+
+	// A full scan lists the whole mailbox; processing all of it would flood the processors
+	var processed int
+	if result.FullScan {
+		if previous.HistoryId != 0 {
+			logrus.Warnf("History was unavailable; messages that arrived since history ID %d were not processed.", previous.HistoryId)
+		}
+		logrus.WithField("history_id", result.HistoryId).Info("Established the starting point; watching for new messages from here.")
+	} else {
+		for _, id := range result.Added {
+			if err := w.process(ctx, id); err != nil {
+				// Keep the previous position so the remaining messages are picked up by the next poll
+				*w.State = previous
+				return processed, err
+			}
+			processed++
+		}
+	}
+
+	if err := w.State.Save(w.StatePath); err != nil {
+		return processed, err
+	}
+	return processed, nil
+}
+
+// process fetches a new message and runs the processors on it.
+func (w *Watcher) process(ctx context.Context, id string) error {
+	msg, err := w.Service.Client.GetMessage(ctx, id, "full")
+	if err != nil {
+		if isNotFound(err) {
+			logrus.WithField("message_id", id).Debug("Message was deleted before it could be processed")
+			return nil
+		}
+		logrus.Errorf("Failed to fetch message %s: %v", id, err)
+		return err
+	}
+
+	labelNames, err := w.labelNamesFor(ctx, msg.LabelIds)
+	if err != nil {
+		return err
+	}
+	local, err := ParseGmailMessage(msg, labelNames)
+	if err != nil {
+		logrus.WithField("message_id", id).Warnf("Skipping message that cannot be parsed: %v", err)
+		return nil
+	}
+	if w.Query != nil && !MatchQuery(w.Query, local) {
+		logrus.WithField("message_id", id).Debug("Message does not match the watch query")
+		return nil
+	}
+
+	// A processor failing on one message must not block the messages after it
+	for _, processor := range w.Processors {
+		if err := processor(ctx, w.Service, msg, local); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logrus.WithField("message_id", id).Errorf("Failed to process message: %v", err)
+		}
+	}
+	return nil
+}
+
+// labelNamesFor returns the names of the account's labels by ID, fetching them again when one of
+// the given label IDs is unknown, such as a label created after the watcher started.
+func (w *Watcher) labelNamesFor(ctx context.Context, labelIds []string) (map[string]string, error) {
+	for _, id := range labelIds {
+		if _, ok := w.labelNames[id]; !ok {
+			labelNames, err := w.Service.LabelNames(ctx)
+			if err != nil {
+				logrus.Errorf("Failed to fetch label names: %v", err)
+				return nil, err
+			}
+			w.labelNames = labelNames
+			break
+		}
+	}
+	return w.labelNames, nil
+}
+
+// Status returns a snapshot of the watcher's health.
+func (w *Watcher) Status() WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// ServeHTTP serves the watcher's status as JSON, with status 503 when it is unhealthy.
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	status := w.Status()
+	rw.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(rw).Encode(status)
+}
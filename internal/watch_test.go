@@ -0,0 +1,109 @@
+package internal_test
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ryanparsa/gmail/internal"
+	"github.com/ryanparsa/gmail/internal/gmailtest"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestWatcherLabelQuery(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+
+	receipts, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &internal.SyncState{}
+	if _, err := svc.Sync(ctx, state, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := internal.ParseQuery("label:Receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := internal.NewWatcher(svc, state, filepath.Join(t.TempDir(), "watch.state.json"), time.Second, time.Minute)
+	watcher.Query = query
+	var processed []string
+	watcher.Processors = append(watcher.Processors, func(ctx context.Context, s *internal.Service, msg *gmail.Message, local *internal.LocalMessage) error {
+		processed = append(processed, local.Subject)
+		return nil
+	})
+
+	fake.AddMessage([]byte("Subject: Order\r\n\r\nHello\r\n"), "INBOX", receipts.Id)
+	fake.AddMessage([]byte("Subject: Hi\r\n\r\nHello\r\n"), "INBOX")
+	if err := watcher.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(processed, []string{"Order"}) {
+		t.Errorf("processed %v, want [Order]", processed)
+	}
+
+	// A label created after the watcher loaded the label names is looked up by name too
+	renamed, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Receipts/2024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher.Query, err = internal.ParseQuery("label:receipts-2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.AddMessage([]byte("Subject: Invoice\r\n\r\nHello\r\n"), "INBOX", renamed.Id)
+	if err := watcher.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(processed, []string{"Order", "Invoice"}) {
+		t.Errorf("processed %v, want [Order Invoice]", processed)
+	}
+}
+
+func TestRuleRunnerLabelQuery(t *testing.T) {
+	fake := gmailtest.NewFakeClient()
+	svc := internal.NewServiceWithClient(fake)
+	ctx := context.Background()
+
+	receipts, err := fake.CreateLabel(ctx, &gmail.Label{Name: "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := internal.Rules{{Name: "archive receipts", Query: "label:Receipts is:unread", Actions: internal.RuleActions{Archive: true, MarkRead: true}}}
+	if err := rules.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	runner := internal.NewRuleRunner(svc, rules, false)
+
+	receipt := fake.AddMessage([]byte("Subject: Order\r\n\r\nHello\r\n"), "INBOX", "UNREAD", receipts.Id)
+	other := fake.AddMessage([]byte("Subject: Hi\r\n\r\nHello\r\n"), "INBOX", "UNREAD")
+	labelNames, err := svc.LabelNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{receipt, other} {
+		msg, err := fake.GetMessage(ctx, id, "full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := internal.ParseGmailMessage(msg, labelNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runner.Process(ctx, svc, msg, local); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fake.MessageLabels(receipt); !slices.Equal(got, []string{receipts.Id}) {
+		t.Errorf("receipt labels = %v, want [%s]", got, receipts.Id)
+	}
+	if got := fake.MessageLabels(other); !slices.Equal(got, []string{"INBOX", "UNREAD"}) {
+		t.Errorf("other labels = %v, want [INBOX UNREAD]", got)
+	}
+}